@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+	"http-from-tcp/internal/server"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+func main() {
+	hosts := flag.String("hosts", "localhost,127.0.0.1,::1", "comma separated hostnames and IPs")
+	certFile := flag.String("cert", "cert.pem", "certificate output file")
+	keyFile := flag.String("key", "key.pem", "private key output file")
+	validFor := flag.Duration("valid-for", 365*24*time.Hour, "certificate lifetime")
+	flag.Parse()
+
+	certPEM, keyPEM, err := server.GenerateSelfSignedCert(strings.Split(*hosts, ","), *validFor)
+	if err != nil {
+		log.Fatalf("Error generating certificate: %v", err)
+	}
+	if err := os.WriteFile(*certFile, certPEM, 0644); err != nil {
+		log.Fatalf("Error writing certificate: %v", err)
+	}
+	if err := os.WriteFile(*keyFile, keyPEM, 0600); err != nil {
+		log.Fatalf("Error writing key: %v", err)
+	}
+	log.Printf("Wrote %s and %s for %s", *certFile, *keyFile, *hosts)
+}
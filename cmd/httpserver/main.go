@@ -1,25 +1,30 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"context"
+	"flag"
 	"fmt"
-	"http-from-tcp/internal/headers"
+	"http-from-tcp/internal/accesslog"
+	"http-from-tcp/internal/cache"
+	"http-from-tcp/internal/proxy"
 	"http-from-tcp/internal/request"
 	"http-from-tcp/internal/response"
 	"http-from-tcp/internal/server"
-	"io"
+	"http-from-tcp/internal/sse"
+	"http-from-tcp/internal/websocket"
 	"log"
-	"log/slog"
-	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 )
 
-const port = 42069
+const (
+	defaultPort    = 42069
+	upgradeTimeout = 10 * time.Second
+	drainTimeout   = 30 * time.Second
+)
 
 var resp400 = []byte(`<html>
   <head>
@@ -51,61 +56,23 @@ var resp200 = []byte(`<html>
   </body>
 </html>`)
 
-func handleHttpBin(w response.Writer, req *request.Request) {
-	reqUrl := url.URL{
-		Scheme: "https",
-		Host:   "httpbin.org",
-		Path:   strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin"),
-	}
-	resp, err := http.Get(reqUrl.String())
-	if err != nil {
-		he := server.HandlerError{
-			StatusCode: response.StatusInternalServerError,
-			Message:    fmt.Sprintf("error making request to httpbin, %v", err),
-		}
-		slog.Info("reached")
-		he.Write(w)
-		return
-	}
-	// TODO: add a check for the response code
-	w.WriteStatusLine(response.StatusOK)
+// httpbin is the cached proxy to the -httpbin upstream
+var httpbin server.Handler
 
-	h := response.GetDefaultHeaders(0)
-	h.Delete("content-length")
-	h.Set("transfer-encoding", "chunked")
-	h.Set("Trailer", "X-Content-SHA256")
-	h.Set("Trailer", "X-Content-Length")
-	h.Delete("content-length")
-	w.WriteHeaders(h)
+// backends is nil unless -upstreams is set
+var backends *proxy.ReverseProxy
 
-	respBody := make([]byte, 1024)
-	fullBody := make([]byte, 1024)
-	for {
-		n, err := resp.Body.Read(respBody)
-		slog.Info("read data from httpbin", "data", n)
-		if err != nil && err != io.EOF {
-			he := server.HandlerError{
-				StatusCode: response.StatusInternalServerError,
-				Message:    fmt.Sprintf("error reading body from httpbin, %v", err),
-			}
-			he.Write(w)
-			return
-		}
-		if n == 0 || err == io.EOF {
-			w.WriteChunkedBodyDone()
-			break
-		}
-		fullBody = append(fullBody, respBody[:n]...)
-		w.WriteChunkedBody(respBody[:n])
-	}
-	sum := sha256.Sum256(fullBody)
-	hexSum := hex.EncodeToString(sum[:])
-	trailer := headers.NewHeaders()
-	trailer.Set("X-Content-SHA256", hexSum)
-	trailer.Set("X-Content-Length", fmt.Sprintf("%d", len(fullBody)))
-	w.WriteTrailers(trailer)
-	w.Write([]byte("\r\n"))
-	return
+// forward is nil unless -forward-proxy is set
+var forward *proxy.ForwardProxy
+
+// streamBody leaves the bodies of proxied requests on the connection so they
+// are sent upstream as they arrive.
+func streamBody(req *request.Request) bool {
+	if forward != nil && req.RequestLine.Form != request.OriginForm {
+		return true
+	}
+	target := req.RequestLine.RequestTarget
+	return strings.HasPrefix(target, "/httpbin/") || (backends != nil && strings.HasPrefix(target, "/upstream/"))
 }
 
 func handler(w response.Writer, req *request.Request) {
@@ -113,8 +80,26 @@ func handler(w response.Writer, req *request.Request) {
 	var sc response.StatusCode
 	var contentType = "text/html"
 
+	if forward != nil && req.RequestLine.Form != request.OriginForm {
+		forward.Handle(w, req)
+		return
+	}
 	if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin/") {
-		handleHttpBin(w, req)
+		httpbin(w, req)
+		return
+	}
+	if backends != nil && strings.HasPrefix(req.RequestLine.RequestTarget, "/upstream/") {
+		backends.Handle(w, req)
+		return
+	}
+
+	if req.RequestLine.RequestTarget == "/ws" && websocket.IsUpgrade(req) {
+		handleEcho(w, req)
+		return
+	}
+
+	if req.RequestLine.RequestTarget == "/events" {
+		handleEvents(w, req)
 		return
 	}
 
@@ -152,17 +137,240 @@ func handler(w response.Writer, req *request.Request) {
 	w.WriteBody(body)
 }
 
+var upgrader = &websocket.Upgrader{}
+
+// handleEcho sends every WebSocket message back to the client
+func handleEcho(w response.Writer, req *request.Request) {
+	conn, err := upgrader.Upgrade(w, req)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := conn.WriteMessage(messageType, data); err != nil {
+			return
+		}
+	}
+}
+
+// events fans the clock ticks out to /events subscribers
+var events *sse.Hub
+
+func handleEvents(w response.Writer, req *request.Request) {
+	stream, err := sse.NewStream(w, req, sse.Config{Heartbeat: 15 * time.Second, Retry: 2 * time.Second})
+	if err != nil {
+		return
+	}
+	defer stream.Close()
+	if err := events.Stream(stream, "clock"); err != nil {
+		log.Printf("Event stream ended: %v", err)
+	}
+}
+
+func publishClock(hub *sse.Hub) {
+	for now := range time.Tick(time.Second) {
+		if _, err := hub.Publish("clock", sse.Event{Event: "tick", Data: now.Format(time.RFC3339)}); err != nil {
+			return
+		}
+	}
+}
+
+type listenFlags []server.ListenAddr
+
+func (l *listenFlags) String() string {
+	return fmt.Sprint(*l)
+}
+
+func (l *listenFlags) Set(value string) error {
+	addr, err := server.ParseListenAddr(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, addr)
+	return nil
+}
+
 func main() {
-	server, err := server.Serve(port, handler)
+	var listen listenFlags
+	flag.Var(&listen, "listen", fmt.Sprintf("address to listen on, repeatable (default :%d)", defaultPort))
+	reusePort := flag.Int("reuseport", 0, "sockets to open per address with SO_REUSEPORT")
+	prefork := flag.Int("prefork", 0, "worker processes to supervise, each listening with SO_REUSEPORT")
+	httpbinURL := flag.String("httpbin", "https://httpbin.org", "upstream proxied under /httpbin/")
+	cacheDir := flag.String("cache-dir", "", "directory for the proxy cache, in memory if empty")
+	cacheBytes := flag.Int64("cache-bytes", cache.DefaultMaxBytes, "bytes the proxy cache may hold")
+	upstreams := flag.String("upstreams", "", "comma separated upstreams balanced under /upstream/")
+	healthPath := flag.String("health-path", "", "path probed on each of -upstreams")
+	forwardProxy := flag.Bool("forward-proxy", false, "act as a forward proxy for absolute-form and CONNECT requests")
+	forwardAllow := flag.String("forward-allow", "", "comma separated destinations the forward proxy may reach, all public ones if empty")
+	forwardAuth := flag.String("forward-auth", "", "user:password required in Proxy-Authorization")
+	ipRules := flag.String("ip-rules", "", "file with allow/deny CIDR rules, reloaded on SIGHUP")
+	h2c := flag.Bool("h2c", false, "serve HTTP/2 over cleartext, by prior knowledge or Upgrade: h2c")
+	flag.Parse()
+
+	if _, isWorker := server.PreforkWorker(); *prefork > 0 && !isWorker {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		if err := (server.Prefork{Workers: *prefork}).Run(ctx); err != nil {
+			log.Fatalf("Error running workers: %v", err)
+		}
+		return
+	}
+	if *prefork > 0 {
+		*reusePort = max(*reusePort, 1)
+	}
+	if len(listen) == 0 {
+		listen = append(listen, server.ListenAddr{Network: "tcp", Address: fmt.Sprintf(":%d", defaultPort)})
+	}
+
+	metrics := server.NewMetrics()
+	proxyMetrics := proxy.NewMetrics(metrics.Registry)
+	breaker := proxy.BreakerConfig{Metrics: proxyMetrics}
+	retry := proxy.RetryPolicy{Attempts: 3}
+
+	httpbinProxy, err := proxy.NewReverseProxy(*httpbinURL)
+	if err != nil {
+		log.Fatalf("Error configuring httpbin proxy: %v", err)
+	}
+	httpbinProxy.StripPrefix = "/httpbin"
+	httpbinProxy.Breaker = proxy.NewBreaker(httpbinProxy.Target.Host, breaker)
+	httpbinProxy.Retry = retry
+	httpbinProxy.TryTimeout = 10 * time.Second
+	httpbinProxy.Timeout = 30 * time.Second
+	httpbinProxy.Metrics = proxyMetrics
+	httpbinProxy.ContentDigest = true
+
+	events = sse.NewHub(sse.HubConfig{Overflow: sse.Coalesce, Metrics: sse.NewMetrics(metrics.Registry)})
+	defer events.Close()
+	go publishClock(events)
+
+	var store cache.Store = cache.NewLRU(*cacheBytes)
+	if *cacheDir != "" {
+		if store, err = cache.NewDiskStore(*cacheDir, *cacheBytes); err != nil {
+			log.Fatalf("Error opening cache directory: %v", err)
+		}
+	}
+	proxyCache := cache.New(cache.Config{Store: store, Shared: true})
+	httpbin = server.Chain(httpbinProxy.Handle, proxyCache.Middleware())
+
+	if *forwardProxy {
+		forward = proxy.NewForwardProxy()
+		if *forwardAllow != "" {
+			forward.Allow = strings.Split(*forwardAllow, ",")
+		}
+		if user, password, ok := strings.Cut(*forwardAuth, ":"); ok {
+			forward.Authenticate = proxy.BasicAuth(map[string]string{user: password})
+		}
+	}
+
+	if *upstreams != "" {
+		pool, err := proxy.NewPool(proxy.PoolConfig{
+			Targets:     strings.Split(*upstreams, ","),
+			Balancer:    &proxy.LeastConn{},
+			HealthCheck: proxy.HealthCheck{Path: *healthPath},
+			MaxFails:    3,
+			SlowStart:   30 * time.Second,
+			Breaker:     &breaker,
+		})
+		if err != nil {
+			log.Fatalf("Error configuring upstreams: %v", err)
+		}
+		pool.Start()
+		defer pool.Close()
+		backends = proxy.NewPoolProxy(pool)
+		backends.StripPrefix = "/upstream"
+		backends.Retry = retry
+		backends.TryTimeout = 10 * time.Second
+		backends.Timeout = 30 * time.Second
+		backends.Metrics = proxyMetrics
+	}
+
+	accessLog, err := accesslog.New(accesslog.Config{
+		Format: accesslog.FormatCombined,
+		Fields: []accesslog.Field{accesslog.FieldDuration},
+	})
 	if err != nil {
+		log.Fatalf("Error opening access log: %v", err)
+	}
+	defer accessLog.Close()
+
+	var ipFilter *server.IPFilter
+	if *ipRules != "" {
+		ipFilter = &server.IPFilter{}
+		if err := ipFilter.LoadFile(*ipRules); err != nil {
+			log.Fatalf("Error loading ip rules: %v", err)
+		}
+		go reloadOnHangup(func() error { return ipFilter.LoadFile(*ipRules) })
+	}
+
+	srv, err := server.New(server.ServerConfig{
+		Listen:      listen,
+		Handler:     server.Chain(handler, accessLog.Middleware()),
+		Metrics:     metrics,
+		MetricsPath: "/metrics",
+		ReusePort:   *reusePort,
+		IPFilter:    ipFilter,
+		H2C:         *h2c,
+		StreamBody:  streamBody,
+	})
+	if err != nil {
+		log.Fatalf("Error configuring server: %v", err)
+	}
+	if err := srv.Listen(); err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer server.Close()
-	log.Println("Server started on port", port)
+	log.Println("Server started on", srv.Addrs())
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve()
+	}()
 
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
-	log.Println("Server gracefully stopped")
+	signal.Notify(sigChan, stopSignals...)
+	for {
+		select {
+		case sig := <-sigChan:
+			if sig == upgradeSignal {
+				proc, err := srv.Upgrade(upgradeTimeout)
+				if err != nil {
+					log.Printf("Upgrade failed, still serving: %v", err)
+					continue
+				}
+				log.Println("Upgraded to pid", proc.Pid)
+			}
+			shutdown(srv)
+			return
+		case err := <-serveErr:
+			log.Fatalf("Server stopped: %v", err)
+		}
+	}
+}
 
+func reloadOnHangup(reload func() error) {
+	if hangupSignal == nil {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, hangupSignal)
+	for range hup {
+		if err := reload(); err != nil {
+			log.Printf("Error reloading ip rules: %v", err)
+			continue
+		}
+		log.Println("Reloaded ip rules")
+	}
+}
+
+func shutdown(srv *server.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Server stopped before draining: %v", err)
+		return
+	}
+	log.Println("Server gracefully stopped")
 }
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignal is nil where listeners cannot be handed to a new process
+var upgradeSignal os.Signal
+
+// hangupSignal is nil where there is no SIGHUP, the ip rules are then only
+// loaded at startup
+var hangupSignal os.Signal
+
+var stopSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
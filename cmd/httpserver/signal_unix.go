@@ -0,0 +1,16 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignal hands the listeners to a new process, see Server.Upgrade
+var upgradeSignal os.Signal = syscall.SIGUSR2
+
+// hangupSignal reloads the ip rules
+var hangupSignal os.Signal = syscall.SIGHUP
+
+var stopSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, upgradeSignal}
@@ -0,0 +1,243 @@
+package accesslog
+
+import (
+	"context"
+	"fmt"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"http-from-tcp/internal/server"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Format int
+
+const (
+	FormatCommon Format = iota
+	FormatCombined
+	FormatJSON
+)
+
+type Field int
+
+const (
+	FieldRemoteAddr Field = iota
+	FieldUserAgent
+	FieldRequestID
+	FieldDuration
+	FieldBytesIn
+	FieldBytesOut
+)
+
+const commonTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+var DefaultFields = []Field{FieldRemoteAddr, FieldUserAgent, FieldDuration, FieldBytesIn, FieldBytesOut}
+
+type Config struct {
+	Format Format
+	// Fields are added as attributes in the JSON format and appended after
+	// the standard line in the Common and Combined formats. Nil means
+	// DefaultFields, an empty slice adds none.
+	Fields []Field
+	// Output is "stdout", "stderr" or a file path, empty means stdout.
+	Output     string
+	MaxSize    int64
+	MaxBackups int
+}
+
+type Entry struct {
+	Time       time.Time
+	RemoteAddr string
+	Method     string
+	Target     string
+	Version    string
+	Status     response.StatusCode
+	BytesIn    int
+	BytesOut   int
+	Duration   time.Duration
+	Referer    string
+	UserAgent  string
+	RequestID  string
+}
+
+type Logger struct {
+	format Format
+	fields []Field
+	out    io.Writer
+	closer io.Closer
+	json   *slog.Logger
+	mu     sync.Mutex
+}
+
+func New(cfg Config) (*Logger, error) {
+	var out io.Writer
+	var closer io.Closer
+	switch cfg.Output {
+	case "", "stdout":
+		out = os.Stdout
+	case "stderr":
+		out = os.Stderr
+	default:
+		rf, err := OpenRotatingFile(cfg.Output, cfg.MaxSize, cfg.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		out = rf
+		closer = rf
+	}
+
+	l := NewWithWriter(out, cfg.Format, cfg.Fields)
+	l.closer = closer
+	return l, nil
+}
+
+// NewWithWriter logs to w, nil fields mean DefaultFields as in Config.
+func NewWithWriter(w io.Writer, format Format, fields []Field) *Logger {
+	if fields == nil {
+		fields = DefaultFields
+	}
+	l := &Logger{
+		format: format,
+		fields: fields,
+		out:    w,
+	}
+	if l.format == FormatJSON {
+		l.json = slog.New(slog.NewJSONHandler(l.out, nil))
+	}
+	return l
+}
+
+func (l *Logger) Close() error {
+	if l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+func (l *Logger) Middleware() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w response.Writer, req *request.Request) {
+			start := time.Now()
+			rec := server.Record(next, w, req)
+			l.Log(Entry{
+				Time:       start,
+				RemoteAddr: req.RemoteAddr,
+				Method:     req.RequestLine.Method,
+				Target:     req.RequestLine.RequestTarget,
+				Version:    req.RequestLine.HttpVersion,
+				Status:     rec.StatusCode,
+				BytesIn:    req.ContentLength(),
+				BytesOut:   rec.BodyWritten,
+				Duration:   rec.Duration,
+				Referer:    req.Headers.Get("Referer"),
+				UserAgent:  req.Headers.Get("User-Agent"),
+				RequestID:  req.Headers.Get("X-Request-Id"),
+			})
+		}
+	}
+}
+
+func (l *Logger) Log(e Entry) {
+	if l.format == FormatJSON {
+		l.json.LogAttrs(context.Background(), slog.LevelInfo, "request", l.jsonAttrs(e)...)
+		return
+	}
+
+	line := l.formatLine(e)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := io.WriteString(l.out, line)
+	if err != nil {
+		slog.Error("error writing access log", "error", err)
+	}
+}
+
+func (l *Logger) jsonAttrs(e Entry) []slog.Attr {
+	attrs := []slog.Attr{
+		slog.String("method", e.Method),
+		slog.String("target", e.Target),
+		slog.String("version", e.Version),
+		slog.Int("status", int(e.Status)),
+	}
+	for _, f := range l.fields {
+		switch f {
+		case FieldRemoteAddr:
+			attrs = append(attrs, slog.String("remote_addr", e.RemoteAddr))
+		case FieldUserAgent:
+			attrs = append(attrs, slog.String("user_agent", e.UserAgent))
+		case FieldRequestID:
+			attrs = append(attrs, slog.String("request_id", e.RequestID))
+		case FieldDuration:
+			attrs = append(attrs, slog.Duration("duration", e.Duration))
+		case FieldBytesIn:
+			attrs = append(attrs, slog.Int("bytes_in", e.BytesIn))
+		case FieldBytesOut:
+			attrs = append(attrs, slog.Int("bytes_out", e.BytesOut))
+		}
+	}
+	return attrs
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// quote escapes quotes, backslashes and control characters as Go does, so
+// a client cannot end a field or forge a line.
+func quote(s string) string {
+	return strconv.Quote(orDash(s))
+}
+
+func host(addr string) string {
+	h, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return h
+}
+
+func (l *Logger) formatLine(e Entry) string {
+	var sb strings.Builder
+
+	bytesOut := "-"
+	if e.BytesOut > 0 {
+		bytesOut = fmt.Sprintf("%d", e.BytesOut)
+	}
+	requestLine := fmt.Sprintf("%s %s HTTP/%s", e.Method, e.Target, e.Version)
+	fmt.Fprintf(&sb, "%s - - [%s] %s %d %s",
+		orDash(host(e.RemoteAddr)), e.Time.Format(commonTimeFormat), quote(requestLine), e.Status, bytesOut)
+
+	if l.format == FormatCombined {
+		fmt.Fprintf(&sb, " %s %s", quote(e.Referer), quote(e.UserAgent))
+	}
+
+	for _, f := range l.fields {
+		switch f {
+		case FieldRemoteAddr:
+			// already the first column
+		case FieldUserAgent:
+			if l.format != FormatCombined {
+				fmt.Fprintf(&sb, " %s", quote(e.UserAgent))
+			}
+		case FieldRequestID:
+			fmt.Fprintf(&sb, " %s", orDash(e.RequestID))
+		case FieldDuration:
+			fmt.Fprintf(&sb, " %dus", e.Duration.Microseconds())
+		case FieldBytesIn:
+			fmt.Fprintf(&sb, " %d", e.BytesIn)
+		case FieldBytesOut:
+			fmt.Fprintf(&sb, " %d", e.BytesOut)
+		}
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
@@ -0,0 +1,130 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var entry = Entry{
+	Time:       time.Date(2000, time.October, 10, 13, 55, 36, 0, time.FixedZone("", -7*60*60)),
+	RemoteAddr: "127.0.0.1:5555",
+	Method:     "GET",
+	Target:     "/apache_pb.gif",
+	Version:    "1.1",
+	Status:     200,
+	BytesOut:   2326,
+	Duration:   1500 * time.Microsecond,
+	Referer:    "http://www.example.com/start.html",
+	UserAgent:  "curl/7.81.0",
+	RequestID:  "abc",
+}
+
+func TestFormatLine(t *testing.T) {
+	tests := []struct {
+		name   string
+		format Format
+		fields []Field
+		want   string
+	}{
+		{
+			name:   "Common",
+			format: FormatCommon,
+			fields: []Field{},
+			want:   "127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] \"GET /apache_pb.gif HTTP/1.1\" 200 2326\n",
+		},
+		{
+			name:   "Combined",
+			format: FormatCombined,
+			fields: []Field{},
+			want:   "127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] \"GET /apache_pb.gif HTTP/1.1\" 200 2326 \"http://www.example.com/start.html\" \"curl/7.81.0\"\n",
+		},
+		{
+			name:   "Common with extra fields",
+			format: FormatCommon,
+			fields: []Field{FieldRequestID, FieldDuration},
+			want:   "127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] \"GET /apache_pb.gif HTTP/1.1\" 200 2326 abc 1500us\n",
+		},
+		{
+			name:   "Default fields",
+			format: FormatCommon,
+			want:   "127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] \"GET /apache_pb.gif HTTP/1.1\" 200 2326 \"curl/7.81.0\" 1500us 0 2326\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			l := NewWithWriter(buf, tt.format, tt.fields)
+			l.Log(entry)
+			assert.Equal(t, tt.want, buf.String())
+		})
+	}
+}
+
+func TestFormatLineEscapes(t *testing.T) {
+	e := entry
+	e.Target = "/a\"b\\c"
+	e.UserAgent = "evil\n127.0.0.1 - - [forged]\x1b[31m"
+	buf := &bytes.Buffer{}
+	NewWithWriter(buf, FormatCombined, []Field{}).Log(e)
+
+	line := buf.String()
+	assert.Equal(t, 1, strings.Count(line, "\n"), "one line per entry")
+	assert.Contains(t, line, `"GET /a\"b\\c HTTP/1.1"`)
+	assert.Contains(t, line, `"evil\n127.0.0.1 - - [forged]\x1b[31m"`)
+}
+
+func TestJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewWithWriter(buf, FormatJSON, []Field{FieldRemoteAddr, FieldBytesOut})
+	l.Log(entry)
+
+	got := map[string]any{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	assert.Equal(t, "GET", got["method"])
+	assert.Equal(t, float64(200), got["status"])
+	assert.Equal(t, "127.0.0.1:5555", got["remote_addr"])
+	assert.Equal(t, float64(2326), got["bytes_out"])
+	assert.NotContains(t, got, "user_agent")
+}
+
+func TestNewDefaultFields(t *testing.T) {
+	dir := t.TempDir()
+	l, err := New(Config{Output: filepath.Join(dir, "default.log")})
+	require.NoError(t, err)
+	defer l.Close()
+	assert.Equal(t, DefaultFields, l.fields)
+
+	l, err = New(Config{Output: filepath.Join(dir, "none.log"), Fields: []Field{}})
+	require.NoError(t, err)
+	defer l.Close()
+	assert.Empty(t, l.fields)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	rf, err := OpenRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+	defer rf.Close()
+
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		_, err := rf.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	current, _ := os.ReadFile(path)
+	first, _ := os.ReadFile(path + ".1")
+	second, _ := os.ReadFile(path + ".2")
+	assert.Equal(t, "dddddddd\n", string(current))
+	assert.Equal(t, "cccccccc\n", string(first))
+	assert.Equal(t, "bbbbbbbb\n", string(second))
+	assert.NoFileExists(t, path+".3")
+}
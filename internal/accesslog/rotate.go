@@ -0,0 +1,93 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile is a file that is renamed to path.1 (shifting older backups
+// up) once it grows past MaxSize bytes.
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{
+		Path:       path,
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.file = f
+	rf.size = info.Size()
+	return nil
+}
+
+func (rf *RotatingFile) backupName(n int) string {
+	return fmt.Sprintf("%s.%d", rf.Path, n)
+}
+
+func (rf *RotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+
+	if rf.MaxBackups <= 0 {
+		if err := os.Remove(rf.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return rf.open()
+	}
+
+	os.Remove(rf.backupName(rf.MaxBackups))
+	for i := rf.MaxBackups - 1; i >= 1; i-- {
+		os.Rename(rf.backupName(i), rf.backupName(i+1))
+	}
+	if err := os.Rename(rf.Path, rf.backupName(1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return rf.open()
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.MaxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.MaxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.file.Close()
+}
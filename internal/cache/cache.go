@@ -0,0 +1,390 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"http-from-tcp/internal/headers"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"http-from-tcp/internal/server"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxEntryBytes = 8 << 20
+	cacheName            = "http-from-tcp"
+)
+
+var ErrorNoResponse = fmt.Errorf("handler did not write a complete response")
+
+// Headers that describe the connection or the framing of the stored
+// response rather than the response itself.
+var unstoredHeaders = []string{"Connection", "Keep-Alive", "Transfer-Encoding", "Trailer", "Cache-Status"}
+
+// Request headers that would let the handler answer 304 to a fetch meant to
+// fill the cache.
+var conditionalHeaders = []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"}
+
+type Config struct {
+	// Store defaults to an LRU of DefaultMaxBytes
+	Store Store
+	// Shared caches honor s-maxage and never store private responses or
+	// answers to authorized requests.
+	Shared bool
+	// MaxEntryBytes bounds the body of a stored response, larger ones are
+	// served but not stored.
+	MaxEntryBytes int
+	Logger        *slog.Logger
+}
+
+type result struct {
+	entry  *Entry
+	stored bool
+	// revalidated is set when the handler answered a conditional request
+	// with 304 and the stale entry was refreshed.
+	revalidated bool
+}
+
+type call struct {
+	done chan struct{}
+	res  result
+	err  error
+}
+
+// Cache is an RFC 9111 cache in front of a handler. Only GET responses are
+// stored, HEAD requests are answered from them.
+type Cache struct {
+	cfg Config
+	now func() time.Time
+
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+func New(cfg Config) *Cache {
+	if cfg.Store == nil {
+		cfg.Store = NewLRU(DefaultMaxBytes)
+	}
+	if cfg.MaxEntryBytes <= 0 {
+		cfg.MaxEntryBytes = defaultMaxEntryBytes
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	return &Cache{
+		cfg:   cfg,
+		now:   time.Now,
+		calls: map[string]*call{},
+	}
+}
+
+func (c *Cache) Middleware() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w response.Writer, req *request.Request) {
+			c.serve(next, w, req)
+		}
+	}
+}
+
+func cacheKey(req *request.Request) string {
+	return req.Headers.Get("Host") + req.RequestLine.RequestTarget
+}
+
+func (c *Cache) serve(next server.Handler, w response.Writer, req *request.Request) {
+	key := cacheKey(req)
+	method := req.RequestLine.Method
+	if method != "GET" && method != "HEAD" {
+		// A successful unsafe request invalidates what is stored for the
+		// target, RFC 9111 section 4.4.
+		rec := server.Record(next, w, req)
+		if rec.StatusCode >= 200 && rec.StatusCode < 400 {
+			c.cfg.Store.Delete(key)
+		}
+		return
+	}
+
+	reqCC := parseCacheControl(req.Headers.Get("Cache-Control"))
+	if reqCC.has("no-store") {
+		next(w, req)
+		return
+	}
+
+	entry, ok := c.cfg.Store.Get(key)
+	if !ok || !entry.matches(req.Headers) {
+		switch {
+		case reqCC.has("only-if-cached"):
+			c.writeError(w, response.StatusGatewayTimeout, "not cached")
+		case method == "HEAD":
+			next(w, req)
+		default:
+			c.fetchAndServe(next, w, req, key, nil)
+		}
+		return
+	}
+
+	now := c.now()
+	age := entry.age(now)
+	lifetime := entry.lifetime(c.cfg.Shared)
+	cc := entry.control()
+	fresh := age < lifetime && !cc.has("no-cache") && !reqCC.has("no-cache")
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		fresh = false
+	}
+	if fresh {
+		c.write(w, req, entry, fmt.Sprintf("hit; ttl=%d", int((lifetime-age).Seconds())))
+		return
+	}
+	if reqCC.has("only-if-cached") {
+		c.writeError(w, response.StatusGatewayTimeout, "cached response is stale")
+		return
+	}
+
+	mustRevalidate := cc.has("must-revalidate") || cc.has("no-cache") || (c.cfg.Shared && cc.has("proxy-revalidate"))
+	if swr, ok := cc.seconds("stale-while-revalidate"); ok && age < lifetime+swr && !mustRevalidate && !reqCC.has("no-cache") {
+		go c.revalidate(next, req, key, entry)
+		c.write(w, req, entry, fmt.Sprintf("hit; ttl=%d", int((lifetime-age).Seconds())))
+		return
+	}
+	c.fetchAndServe(next, w, req, key, entry)
+}
+
+// revalidate refreshes a stale entry in the background after it was served
+func (c *Cache) revalidate(next server.Handler, req *request.Request, key string, stale *Entry) {
+	bg := req.WithContext(context.WithoutCancel(req.Context()))
+	if _, _, err := c.do(key, func() (result, error) {
+		// Another request may have refreshed the entry since it was served
+		if cur, ok := c.cfg.Store.Get(key); ok && cur.ResponseTime.After(stale.ResponseTime) {
+			return result{entry: cur, stored: true}, nil
+		}
+		return c.fetchAndStore(next, bg, key, stale, nil)
+	}); err != nil {
+		c.cfg.Logger.Error("error revalidating cache entry", "key", key, "error", err)
+	}
+}
+
+// fetchAndServe streams a miss to the client as the handler writes it, a
+// revalidation is buffered since a 304 has to be turned into the stored
+// response.
+func (c *Cache) fetchAndServe(next server.Handler, w response.Writer, req *request.Request, key string, stale *Entry) {
+	streamed := false
+	fetch := func() (result, error) {
+		if stale != nil {
+			return c.fetchAndStore(next, req, key, stale, nil)
+		}
+		streamed = true
+		return c.fetchAndStore(next, req, key, nil, &teeWriter{w: w, req: req.Headers, status: "fwd=miss"})
+	}
+	res, collapsed, err := c.do(key, fetch)
+	// Only responses fit for storing are fit for sharing
+	if err == nil && collapsed && (!res.stored || !res.entry.matches(req.Headers)) {
+		res, err = fetch()
+		collapsed = false
+	}
+	if err != nil {
+		// The tee fails before anything reaches the client
+		c.cfg.Logger.Error("error filling cache", "key", key, "error", err)
+		c.writeError(w, response.StatusInternalServerError, err.Error())
+		return
+	}
+	if streamed {
+		return
+	}
+
+	status := "fwd=miss"
+	if stale != nil {
+		status = "fwd=stale"
+	}
+	if res.revalidated {
+		status += "; fwd-status=304"
+	}
+	if res.stored {
+		status += "; stored"
+	}
+	if collapsed {
+		status += "; collapsed"
+	}
+	c.write(w, req, res.entry, status)
+}
+
+// do runs fn once for concurrent callers with the same key, collapsed is set
+// for callers that got the result of another caller's fn.
+func (c *Cache) do(key string, fn func() (result, error)) (res result, collapsed bool, err error) {
+	c.mu.Lock()
+	if cl, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		<-cl.done
+		return cl.res, true, cl.err
+	}
+	cl := &call{done: make(chan struct{})}
+	c.calls[key] = cl
+	c.mu.Unlock()
+
+	cl.res, cl.err = fn()
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+	close(cl.done)
+	return cl.res, false, cl.err
+}
+
+// fetchAndStore runs the handler, conditionally when a stale entry with
+// validators is given, and stores the outcome if it may be stored. With a
+// tee the response goes to the client as it is written and res.entry is nil
+// unless a copy was kept.
+func (c *Cache) fetchAndStore(next server.Handler, req *request.Request, key string, stale *Entry, tee *teeWriter) (result, error) {
+	out := req.WithContext(req.Context())
+	out.Headers = maps.Clone(req.Headers)
+	for _, name := range conditionalHeaders {
+		out.Headers.Delete(name)
+	}
+	if stale != nil {
+		if etag := stale.Header.Get("ETag"); etag != "" {
+			out.Headers.Override("If-None-Match", etag)
+		}
+		if lastModified := stale.Header.Get("Last-Modified"); lastModified != "" {
+			out.Headers.Override("If-Modified-Since", lastModified)
+		}
+	}
+
+	requestTime := c.now()
+	var e *Entry
+	if tee != nil {
+		tee.limit = c.cfg.MaxEntryBytes
+		tee.storable = func(e *Entry) bool {
+			e.RequestTime, e.ResponseTime = requestTime, c.now()
+			return storable(req.Headers, e, c.cfg.Shared)
+		}
+		next(response.NewWrite(tee), out)
+		if !tee.headDone {
+			return result{}, ErrorNoResponse
+		}
+		if e = tee.entry(); e == nil {
+			return result{}, nil
+		}
+	} else {
+		var buf bytes.Buffer
+		next(response.NewWrite(&buf), out)
+		var err error
+		if e, err = readEntry(&buf); err != nil {
+			return result{}, err
+		}
+	}
+	e.RequestTime = requestTime
+	e.ResponseTime = c.now()
+
+	res := result{entry: e}
+	if stale != nil && e.StatusCode == int(response.StatusNotModified) {
+		res.entry = stale.refresh(e)
+		res.revalidated = true
+	}
+	if storable(req.Headers, res.entry, c.cfg.Shared) && len(res.entry.Body) <= c.cfg.MaxEntryBytes {
+		res.entry.Vary = map[string]string{}
+		for _, name := range varyNames(res.entry.Header) {
+			res.entry.Vary[name] = req.Headers.Get(name)
+		}
+		if err := c.cfg.Store.Set(key, res.entry); err != nil {
+			c.cfg.Logger.Error("error storing cache entry", "key", key, "error", err)
+		} else {
+			res.stored = true
+		}
+	}
+	return res, nil
+}
+
+// readEntry parses a response written by a handler
+func readEntry(r io.Reader) (*Entry, error) {
+	resp, err := http.ReadResponse(bufio.NewReader(r), nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrorNoResponse, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrorNoResponse, err)
+	}
+
+	h := headers.NewHeaders()
+	for name, values := range resp.Header {
+		for _, value := range values {
+			h.Set(name, value)
+		}
+	}
+	for _, name := range unstoredHeaders {
+		h.Delete(name)
+	}
+	return &Entry{
+		StatusCode: resp.StatusCode,
+		Header:     h,
+		Body:       body,
+	}, nil
+}
+
+// refresh applies the headers of a 304 to a copy of the stale entry, RFC
+// 9111 section 4.3.4.
+func (e *Entry) refresh(notModified *Entry) *Entry {
+	fresh := *e
+	fresh.Header = maps.Clone(e.Header)
+	for name, value := range notModified.Header {
+		if name == "content-length" {
+			continue
+		}
+		fresh.Header.Override(name, value)
+	}
+	fresh.RequestTime = notModified.RequestTime
+	fresh.ResponseTime = notModified.ResponseTime
+	return &fresh
+}
+
+func notModified(req headers.Headers, e *Entry) bool {
+	if e.StatusCode != int(response.StatusOK) {
+		return false
+	}
+	if inm := req.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, e.Header.Get("ETag"))
+	}
+	ims, ok := parseDate(req, "If-Modified-Since")
+	if !ok {
+		return false
+	}
+	lastModified, ok := parseDate(e.Header, "Last-Modified")
+	return ok && !lastModified.After(ims)
+}
+
+func (c *Cache) write(w response.Writer, req *request.Request, e *Entry, status string) {
+	h := maps.Clone(e.Header)
+	h.Override("Age", strconv.Itoa(int(e.age(c.now()).Seconds())))
+	h.Override("Cache-Status", cacheName+"; "+status)
+
+	sc := response.StatusCode(e.StatusCode)
+	if notModified(req.Headers, e) {
+		sc = response.StatusNotModified
+	}
+	noBody := req.RequestLine.Method == "HEAD" || sc == response.StatusNotModified || sc == response.StatusNoContent
+	if sc == response.StatusNoContent {
+		h.Delete("Content-Length")
+	} else if sc != response.StatusNotModified {
+		h.Override("Content-Length", strconv.Itoa(len(e.Body)))
+	}
+
+	w.WriteStatusLine(sc)
+	w.WriteHeaders(h)
+	if !noBody {
+		w.WriteBody(e.Body)
+	}
+}
+
+func (c *Cache) writeError(w response.Writer, sc response.StatusCode, message string) {
+	he := &server.HandlerError{
+		StatusCode: sc,
+		Message:    message,
+	}
+	he.Write(w)
+}
@@ -0,0 +1,443 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"http-from-tcp/internal/headers"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"http-from-tcp/internal/server"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type origin struct {
+	calls   atomic.Int64
+	mu      sync.Mutex
+	headers map[string]string
+	body    string
+	// lastRequest holds the headers the origin saw last
+	lastRequest headers.Headers
+}
+
+func (o *origin) set(body string, hdrs ...string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.body = body
+	o.headers = map[string]string{}
+	for i := 0; i+1 < len(hdrs); i += 2 {
+		o.headers[hdrs[i]] = hdrs[i+1]
+	}
+}
+
+func (o *origin) handle(w response.Writer, req *request.Request) {
+	o.calls.Add(1)
+	o.mu.Lock()
+	body, hdrs := o.body, o.headers
+	o.lastRequest = req.Headers
+	o.mu.Unlock()
+
+	status := response.StatusOK
+	if etag := hdrs["ETag"]; etag != "" && req.Headers.Get("If-None-Match") == etag {
+		status = response.StatusNotModified
+		body = ""
+	}
+	h := response.GetDefaultHeaders(len(body))
+	for name, value := range hdrs {
+		h.Override(name, value)
+	}
+	w.WriteStatusLine(status)
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(body))
+}
+
+type testCache struct {
+	*Cache
+	origin  *origin
+	handler server.Handler
+	now     time.Time
+}
+
+func newTestCache(shared bool) *testCache {
+	tc := &testCache{origin: &origin{}, now: time.Unix(1_700_000_000, 0)}
+	tc.Cache = New(Config{Shared: shared})
+	tc.Cache.now = func() time.Time { return tc.now }
+	tc.handler = server.Chain(tc.origin.handle, tc.Middleware())
+	return tc
+}
+
+func (tc *testCache) do(t *testing.T, method, target string, hdrs ...string) (*http.Response, string) {
+	t.Helper()
+	req := request.NewRequest()
+	req.RequestLine = request.RequestLine{Method: method, RequestTarget: target, HttpVersion: "1.1"}
+	req.Headers.Set("Host", "example.com")
+	for i := 0; i+1 < len(hdrs); i += 2 {
+		req.Headers.Set(hdrs[i], hdrs[i+1])
+	}
+
+	buf := &bytes.Buffer{}
+	tc.handler(response.NewWrite(buf), req)
+	resp, err := http.ReadResponse(bufio.NewReader(buf), &http.Request{Method: method})
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestCacheFreshness(t *testing.T) {
+	tests := []struct {
+		name    string
+		shared  bool
+		headers []string
+		// fresh is how long the response is served from the cache
+		fresh time.Duration
+	}{
+		{name: "max-age", headers: []string{"Cache-Control", "max-age=60"}, fresh: 60 * time.Second},
+		{name: "s-maxage in shared cache", shared: true, headers: []string{"Cache-Control", "max-age=60, s-maxage=10"}, fresh: 10 * time.Second},
+		{name: "s-maxage in private cache", headers: []string{"Cache-Control", "max-age=60, s-maxage=10"}, fresh: 60 * time.Second},
+		{name: "expires", headers: []string{"Date", "Tue, 14 Nov 2023 22:13:20 GMT", "Expires", "Tue, 14 Nov 2023 22:13:50 GMT"}, fresh: 30 * time.Second},
+		{name: "age", headers: []string{"Cache-Control", "max-age=60", "Age", "45"}, fresh: 15 * time.Second},
+		{name: "heuristic", headers: []string{"Date", "Tue, 14 Nov 2023 22:13:20 GMT", "Last-Modified", "Tue, 14 Nov 2023 22:03:20 GMT"}, fresh: 60 * time.Second},
+		{name: "no-store", headers: []string{"Cache-Control", "no-store, max-age=60"}},
+		{name: "private in shared cache", shared: true, headers: []string{"Cache-Control", "private, max-age=60"}},
+		{name: "private in private cache", headers: []string{"Cache-Control", "private, max-age=60"}, fresh: 60 * time.Second},
+		{name: "vary star", headers: []string{"Cache-Control", "max-age=60", "Vary", "*"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := newTestCache(tt.shared)
+			tc.origin.set("hello", tt.headers...)
+
+			resp, body := tc.do(t, "GET", "/")
+			assert.Equal(t, "hello", body)
+			assert.Contains(t, resp.Header.Get("Cache-Status"), "fwd=miss")
+
+			if tt.fresh > 0 {
+				tc.now = tc.now.Add(tt.fresh - time.Second)
+				resp, body = tc.do(t, "GET", "/")
+				assert.Equal(t, "hello", body)
+				assert.Contains(t, resp.Header.Get("Cache-Status"), "; hit")
+				assert.Equal(t, int64(1), tc.origin.calls.Load())
+			}
+
+			tc.now = tc.now.Add(time.Second)
+			resp, _ = tc.do(t, "GET", "/")
+			assert.NotContains(t, resp.Header.Get("Cache-Status"), "; hit")
+			assert.Equal(t, int64(2), tc.origin.calls.Load())
+		})
+	}
+}
+
+func TestReadEntrySetCookie(t *testing.T) {
+	e, err := readEntry(strings.NewReader("HTTP/1.1 200 OK\r\n" +
+		"Set-Cookie: a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT\r\n" +
+		"Set-Cookie: b=2\r\n" +
+		"Content-Length: 0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT", "b=2"}, e.Header.Values("Set-Cookie"))
+}
+
+func TestCacheAgeHeader(t *testing.T) {
+	tc := newTestCache(true)
+	tc.origin.set("hello", "Cache-Control", "max-age=60")
+
+	tc.do(t, "GET", "/")
+	tc.now = tc.now.Add(20 * time.Second)
+	resp, _ := tc.do(t, "GET", "/")
+	assert.Equal(t, "20", resp.Header.Get("Age"))
+	assert.Equal(t, "http-from-tcp; hit; ttl=40", resp.Header.Get("Cache-Status"))
+	assert.Empty(t, resp.Header.Get("Connection"))
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	tc := newTestCache(true)
+	tc.origin.set("hello", "Cache-Control", "max-age=10", "ETag", `"v1"`, "X-Version", "1")
+
+	tc.do(t, "GET", "/")
+	tc.now = tc.now.Add(20 * time.Second)
+
+	// The origin answers 304 and the stored body is served with the new headers
+	tc.origin.set("", "Cache-Control", "max-age=10", "ETag", `"v1"`, "X-Version", "2")
+	resp, body := tc.do(t, "GET", "/")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello", body)
+	assert.Equal(t, "2", resp.Header.Get("X-Version"))
+	assert.Equal(t, "http-from-tcp; fwd=stale; fwd-status=304; stored", resp.Header.Get("Cache-Status"))
+	assert.Equal(t, `"v1"`, tc.origin.lastRequest.Get("If-None-Match"))
+
+	// Refreshed, so fresh again
+	resp, _ = tc.do(t, "GET", "/")
+	assert.Contains(t, resp.Header.Get("Cache-Status"), "; hit")
+	assert.Equal(t, int64(2), tc.origin.calls.Load())
+
+	// A changed resource replaces the entry
+	tc.now = tc.now.Add(20 * time.Second)
+	tc.origin.set("changed", "Cache-Control", "max-age=10", "ETag", `"v2"`)
+	_, body = tc.do(t, "GET", "/")
+	assert.Equal(t, "changed", body)
+
+	// Request no-cache forces revalidation of a fresh entry
+	tc.do(t, "GET", "/", "Cache-Control", "no-cache")
+	assert.Equal(t, int64(4), tc.origin.calls.Load())
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	tc := newTestCache(true)
+	tc.origin.set("old", "Cache-Control", "max-age=10, stale-while-revalidate=30")
+
+	tc.do(t, "GET", "/")
+	tc.now = tc.now.Add(20 * time.Second)
+	tc.origin.set("new", "Cache-Control", "max-age=10, stale-while-revalidate=30")
+
+	resp, body := tc.do(t, "GET", "/")
+	assert.Equal(t, "old", body)
+	assert.Equal(t, "http-from-tcp; hit; ttl=-10", resp.Header.Get("Cache-Status"))
+	assert.Eventually(t, func() bool {
+		_, body := tc.do(t, "GET", "/")
+		return body == "new"
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int64(2), tc.origin.calls.Load())
+
+	// Past the stale window the client waits for the origin
+	tc.now = tc.now.Add(time.Minute)
+	tc.origin.set("newest", "Cache-Control", "max-age=10, stale-while-revalidate=30")
+	_, body = tc.do(t, "GET", "/")
+	assert.Equal(t, "newest", body)
+}
+
+func TestCacheMustRevalidate(t *testing.T) {
+	tc := newTestCache(true)
+	tc.origin.set("old", "Cache-Control", "max-age=10, stale-while-revalidate=30, must-revalidate")
+
+	tc.do(t, "GET", "/")
+	tc.now = tc.now.Add(20 * time.Second)
+	tc.origin.set("new", "Cache-Control", "max-age=10")
+	_, body := tc.do(t, "GET", "/")
+	assert.Equal(t, "new", body)
+}
+
+func TestCacheVary(t *testing.T) {
+	tc := newTestCache(true)
+	tc.origin.set("hello", "Cache-Control", "max-age=60", "Vary", "Accept-Language")
+
+	tc.do(t, "GET", "/", "Accept-Language", "en")
+	resp, _ := tc.do(t, "GET", "/", "Accept-Language", "en")
+	assert.Contains(t, resp.Header.Get("Cache-Status"), "; hit")
+
+	resp, _ = tc.do(t, "GET", "/", "Accept-Language", "de")
+	assert.Contains(t, resp.Header.Get("Cache-Status"), "fwd=miss")
+	assert.Equal(t, int64(2), tc.origin.calls.Load())
+}
+
+func TestCacheConditionalClient(t *testing.T) {
+	tc := newTestCache(true)
+	tc.origin.set("hello", "Cache-Control", "max-age=60", "ETag", `"v1"`)
+
+	// The client's validators never reach the origin on a miss
+	resp, body := tc.do(t, "GET", "/", "If-None-Match", `"v1"`)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	assert.Empty(t, tc.origin.lastRequest.Get("If-None-Match"))
+
+	resp, body = tc.do(t, "GET", "/", "If-None-Match", `W/"v1"`)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	assert.Empty(t, body)
+
+	resp, body = tc.do(t, "GET", "/", "If-None-Match", `"v0"`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello", body)
+	assert.Equal(t, int64(1), tc.origin.calls.Load())
+}
+
+func TestCacheHeadAndInvalidation(t *testing.T) {
+	tc := newTestCache(true)
+	tc.origin.set("hello", "Cache-Control", "max-age=60")
+
+	// HEAD is not stored but answered from a stored GET
+	tc.do(t, "HEAD", "/")
+	tc.do(t, "GET", "/")
+	resp, body := tc.do(t, "HEAD", "/")
+	assert.Contains(t, resp.Header.Get("Cache-Status"), "; hit")
+	assert.Equal(t, int64(5), resp.ContentLength)
+	assert.Empty(t, body)
+	assert.Equal(t, int64(2), tc.origin.calls.Load())
+
+	tc.do(t, "POST", "/")
+	resp, _ = tc.do(t, "GET", "/")
+	assert.Contains(t, resp.Header.Get("Cache-Status"), "fwd=miss")
+	assert.Equal(t, int64(4), tc.origin.calls.Load())
+}
+
+func TestCacheOnlyIfCached(t *testing.T) {
+	tc := newTestCache(true)
+	tc.origin.set("hello", "Cache-Control", "max-age=60")
+
+	resp, _ := tc.do(t, "GET", "/", "Cache-Control", "only-if-cached")
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	assert.Zero(t, tc.origin.calls.Load())
+}
+
+func TestCacheCollapsing(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int64
+	slow := func(w response.Writer, req *request.Request) {
+		calls.Add(1)
+		<-release
+		body := "hello"
+		h := response.GetDefaultHeaders(len(body))
+		h.Override("Cache-Control", "max-age=60")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	}
+	handler := server.Chain(slow, New(Config{Shared: true}).Middleware())
+
+	const clients = 10
+	statuses := make(chan string, clients)
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := request.NewRequest()
+			req.RequestLine = request.RequestLine{Method: "GET", RequestTarget: "/", HttpVersion: "1.1"}
+			req.RemoteAddr = fmt.Sprintf("192.0.2.%d:1", i)
+			buf := &bytes.Buffer{}
+			handler(response.NewWrite(buf), req)
+			resp, err := http.ReadResponse(bufio.NewReader(buf), nil)
+			if assert.NoError(t, err) {
+				statuses <- resp.Header.Get("Cache-Status")
+			}
+		}()
+	}
+
+	// Let the waiters pile up behind the first fetch
+	assert.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(statuses)
+
+	assert.Equal(t, int64(1), calls.Load())
+	collapsed := 0
+	for status := range statuses {
+		if strings.Contains(status, "collapsed") {
+			collapsed++
+		}
+	}
+	assert.Equal(t, clients-1, collapsed)
+}
+
+func TestCacheStreamsMiss(t *testing.T) {
+	release := make(chan struct{})
+	slow := func(w response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(10)
+		h.Override("Cache-Control", "max-age=60")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte("first"))
+		<-release
+		w.WriteBody([]byte("second"[:5]))
+	}
+	c := New(Config{Shared: true})
+	handler := server.Chain(slow, c.Middleware())
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := request.NewRequest()
+		req.RequestLine = request.RequestLine{Method: "GET", RequestTarget: "/", HttpVersion: "1.1"}
+		req.Headers.Set("Host", "example.com")
+		handler(response.NewWrite(pw), req)
+		pw.Close()
+	}()
+
+	// The head and the first part arrive while the handler is still running
+	resp, err := http.ReadResponse(bufio.NewReader(pr), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "http-from-tcp; fwd=miss", resp.Header.Get("Cache-Status"))
+	first := make([]byte, 5)
+	_, err = io.ReadFull(resp.Body, first)
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(first))
+
+	close(release)
+	rest, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "secon", string(rest))
+
+	<-done
+	e, ok := c.cfg.Store.Get("example.com/")
+	require.True(t, ok)
+	assert.Equal(t, "firstsecon", string(e.Body))
+}
+
+func TestCacheStreamedMissStorage(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []string
+		body    string
+		chunked bool
+		stored  bool
+	}{
+		{name: "storable", headers: []string{"Cache-Control", "max-age=60"}, body: "hello", stored: true},
+		{name: "not storable", headers: []string{"Cache-Control", "no-store"}, body: "hello"},
+		{name: "length over the limit", headers: []string{"Cache-Control", "max-age=60"}, body: "hello world, hello world"},
+		{name: "chunked over the limit", headers: []string{"Cache-Control", "max-age=60"}, body: "hello world, hello world", chunked: true},
+		{name: "chunked within the limit", headers: []string{"Cache-Control", "max-age=60"}, body: "hello", chunked: true, stored: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			origin := func(w response.Writer, req *request.Request) {
+				h := response.GetDefaultHeaders(len(tt.body))
+				for i := 0; i+1 < len(tt.headers); i += 2 {
+					h.Override(tt.headers[i], tt.headers[i+1])
+				}
+				if tt.chunked {
+					h.Delete("Content-Length")
+					h.Override("Transfer-Encoding", "chunked")
+				}
+				w.WriteStatusLine(response.StatusOK)
+				w.WriteHeaders(h)
+				if !tt.chunked {
+					w.WriteBody([]byte(tt.body))
+					return
+				}
+				w.WriteChunkedBody([]byte(tt.body)[:len(tt.body)/2])
+				w.WriteChunkedBody([]byte(tt.body)[len(tt.body)/2:])
+				w.WriteChunkedBodyDone()
+				w.WriteTrailers(nil)
+			}
+			c := New(Config{Shared: true, MaxEntryBytes: 20})
+			handler := server.Chain(origin, c.Middleware())
+
+			req := request.NewRequest()
+			req.RequestLine = request.RequestLine{Method: "GET", RequestTarget: "/", HttpVersion: "1.1"}
+			req.Headers.Set("Host", "example.com")
+			buf := &bytes.Buffer{}
+			handler(response.NewWrite(buf), req)
+			resp, err := http.ReadResponse(bufio.NewReader(buf), nil)
+			require.NoError(t, err)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.body, string(body))
+
+			e, ok := c.cfg.Store.Get("example.com/")
+			assert.Equal(t, tt.stored, ok)
+			if ok {
+				assert.Equal(t, tt.body, string(e.Body))
+			}
+		})
+	}
+}
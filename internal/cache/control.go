@@ -0,0 +1,181 @@
+package cache
+
+import (
+	"http-from-tcp/internal/headers"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	heuristicFraction = 10
+	maxHeuristic      = 24 * time.Hour
+)
+
+// heuristicStatuses may be cached without explicit freshness, RFC 9110
+// section 15.1.
+var heuristicStatuses = []int{200, 203, 204, 206, 300, 301, 308, 404, 405, 410, 414, 501}
+
+type directives map[string]string
+
+func parseCacheControl(value string) directives {
+	d := directives{}
+	for _, part := range strings.Split(value, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name == "" {
+			continue
+		}
+		d[strings.ToLower(name)] = strings.Trim(arg, `"`)
+	}
+	return d
+}
+
+func (d directives) has(name string) bool {
+	_, ok := d[name]
+	return ok
+}
+
+func (d directives) seconds(name string) (time.Duration, bool) {
+	arg, ok := d[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+func parseDate(h headers.Headers, name string) (time.Time, bool) {
+	t, err := http.ParseTime(h.Get(name))
+	return t, err == nil
+}
+
+func varyNames(h headers.Headers) []string {
+	var names []string
+	for _, name := range strings.Split(h.Get("Vary"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, strings.ToLower(name))
+		}
+	}
+	return names
+}
+
+func (e *Entry) control() directives {
+	return parseCacheControl(e.Header.Get("Cache-Control"))
+}
+
+func (e *Entry) date() time.Time {
+	if date, ok := parseDate(e.Header, "Date"); ok {
+		return date
+	}
+	return e.ResponseTime
+}
+
+// lifetime is the freshness lifetime of RFC 9111 section 4.2.1
+func (e *Entry) lifetime(shared bool) time.Duration {
+	cc := e.control()
+	if shared {
+		if d, ok := cc.seconds("s-maxage"); ok {
+			return d
+		}
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	if e.Header.Get("Expires") != "" {
+		expires, ok := parseDate(e.Header, "Expires")
+		if !ok {
+			// Invalid dates such as "0" mean already expired
+			return 0
+		}
+		return max(0, expires.Sub(e.date()))
+	}
+	if lastModified, ok := parseDate(e.Header, "Last-Modified"); ok && slices.Contains(heuristicStatuses, e.StatusCode) {
+		return min(maxHeuristic, max(0, e.date().Sub(lastModified)/heuristicFraction))
+	}
+	return 0
+}
+
+// age is the current age of RFC 9111 section 4.2.3
+func (e *Entry) age(now time.Time) time.Duration {
+	apparentAge := max(0, e.ResponseTime.Sub(e.date()))
+	ageValue := time.Duration(0)
+	if n, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && n > 0 {
+		ageValue = time.Duration(n) * time.Second
+	}
+	responseDelay := e.ResponseTime.Sub(e.RequestTime)
+	correctedInitialAge := max(apparentAge, ageValue+responseDelay)
+	return correctedInitialAge + now.Sub(e.ResponseTime)
+}
+
+// expires is when e is stale past its stale-while-revalidate window and can
+// no longer be served. Entries with a validator never expire, they can still
+// be revalidated.
+func (e *Entry) expires() time.Time {
+	if e.hasValidator() {
+		return time.Time{}
+	}
+	swr, _ := e.control().seconds("stale-while-revalidate")
+	window := max(e.lifetime(true), e.lifetime(false)) + swr
+	return e.ResponseTime.Add(window - e.age(e.ResponseTime))
+}
+
+func (e *Entry) hasValidator() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// matches reports whether the entry was stored for a request with the same
+// values of the headers named in Vary.
+func (e *Entry) matches(h headers.Headers) bool {
+	for name, value := range e.Vary {
+		if h.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// storable follows RFC 9111 section 3
+func storable(req headers.Headers, e *Entry, shared bool) bool {
+	reqCC := parseCacheControl(req.Get("Cache-Control"))
+	cc := e.control()
+	switch {
+	case reqCC.has("no-store"), cc.has("no-store"):
+		return false
+	case shared && cc.has("private"):
+		return false
+	case shared && req.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate"):
+		return false
+	case slices.Contains(varyNames(e.Header), "*"):
+		return false
+	case e.Header.Get("Set-Cookie") != "" && shared:
+		return false
+	}
+
+	explicit := cc.has("max-age") || cc.has("public") || e.Header.Get("Expires") != "" ||
+		(shared && cc.has("s-maxage")) || (!shared && cc.has("private"))
+	if !explicit && !slices.Contains(heuristicStatuses, e.StatusCode) {
+		return false
+	}
+	// Without freshness or validators the entry could never be used
+	return e.lifetime(shared) > 0 || e.hasValidator()
+}
+
+// etagMatches is the weak comparison of RFC 9110 section 13.1.2
+func etagMatches(ifNoneMatch, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,236 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const diskTempPrefix = ".tmp-"
+
+type diskRecord struct {
+	Key   string
+	Entry *Entry
+}
+
+type diskFile struct {
+	name string
+	size int64
+	// expires is zero for entries that can always be revalidated
+	expires time.Time
+}
+
+// DiskStore keeps one gob encoded file per entry in a directory, entries
+// survive restarts. The least recently used files are removed once they take
+// more than maxBytes, entries that can neither be served nor revalidated any
+// more are removed when they are found.
+type DiskStore struct {
+	dir      string
+	maxBytes int64
+	now      func() time.Time
+
+	mu    sync.Mutex
+	size  int64
+	order *list.List
+	files map[string]*list.Element
+}
+
+// NewDiskStore opens dir, creating it if needed, and indexes the entries
+// already in it. maxBytes of zero means DefaultMaxBytes.
+func NewDiskStore(dir string, maxBytes int64) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+	d := &DiskStore{
+		dir:      dir,
+		maxBytes: maxBytes,
+		now:      time.Now,
+		order:    list.New(),
+		files:    map[string]*list.Element{},
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// load indexes the files left by a previous run, oldest first so the
+// recently written ones are evicted last.
+func (d *DiskStore) load() error {
+	dirEntries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	type found struct {
+		file    *diskFile
+		modTime time.Time
+	}
+	files := []found{}
+	for _, de := range dirEntries {
+		if de.IsDir() {
+			continue
+		}
+		path := filepath.Join(d.dir, de.Name())
+		if strings.HasPrefix(de.Name(), diskTempPrefix) {
+			os.Remove(path)
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		rec, err := readDiskRecord(path)
+		if err != nil {
+			os.Remove(path)
+			continue
+		}
+		files = append(files, found{
+			file:    &diskFile{name: de.Name(), size: info.Size(), expires: rec.Entry.expires()},
+			modTime: info.ModTime(),
+		})
+	}
+	slices.SortFunc(files, func(a, b found) int {
+		return a.modTime.Compare(b.modTime)
+	})
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, f := range files {
+		d.files[f.file.name] = d.order.PushFront(f.file)
+		d.size += f.file.size
+	}
+	d.expire()
+	d.evict()
+	return nil
+}
+
+func (d *DiskStore) name(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func readDiskRecord(path string) (*diskRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rec diskRecord
+	if err := gob.NewDecoder(f).Decode(&rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (d *DiskStore) Get(key string) (*Entry, bool) {
+	name := d.name(key)
+	rec, err := readDiskRecord(filepath.Join(d.dir, name))
+	if err != nil || rec.Key != key {
+		if os.IsNotExist(err) {
+			d.mu.Lock()
+			d.forget(name)
+			d.mu.Unlock()
+		}
+		return nil, false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if exp := rec.Entry.expires(); !exp.IsZero() && d.now().After(exp) {
+		d.remove(name)
+		return nil, false
+	}
+	if el, ok := d.files[name]; ok {
+		d.order.MoveToFront(el)
+	}
+	return rec.Entry, true
+}
+
+// Set writes to a temporary file first so readers never see a partial entry
+func (d *DiskStore) Set(key string, e *Entry) error {
+	f, err := os.CreateTemp(d.dir, diskTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := gob.NewEncoder(f).Encode(diskRecord{Key: key, Entry: e}); err != nil {
+		f.Close()
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	name := d.name(key)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.remove(name)
+	if info.Size() > d.maxBytes {
+		return nil
+	}
+	if err := os.Rename(f.Name(), filepath.Join(d.dir, name)); err != nil {
+		return err
+	}
+	d.files[name] = d.order.PushFront(&diskFile{name: name, size: info.Size(), expires: e.expires()})
+	d.size += info.Size()
+	d.expire()
+	d.evict()
+	return nil
+}
+
+func (d *DiskStore) Delete(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.remove(d.name(key))
+}
+
+func (d *DiskStore) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.order.Len()
+}
+
+// expire removes the entries past their expiry time
+func (d *DiskStore) expire() {
+	now := d.now()
+	for name, el := range d.files {
+		if exp := el.Value.(*diskFile).expires; !exp.IsZero() && now.After(exp) {
+			d.remove(name)
+		}
+	}
+}
+
+func (d *DiskStore) evict() {
+	for d.size > d.maxBytes {
+		d.remove(d.order.Back().Value.(*diskFile).name)
+	}
+}
+
+func (d *DiskStore) remove(name string) {
+	os.Remove(filepath.Join(d.dir, name))
+	d.forget(name)
+}
+
+func (d *DiskStore) forget(name string) {
+	if el, ok := d.files[name]; ok {
+		d.size -= d.order.Remove(el).(*diskFile).size
+		delete(d.files, name)
+	}
+}
@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"container/list"
+	"http-from-tcp/internal/headers"
+	"sync"
+	"time"
+)
+
+const DefaultMaxBytes = 64 << 20
+
+type Entry struct {
+	StatusCode int
+	Header     headers.Headers
+	Body       []byte
+	// RequestTime and ResponseTime bracket the fetch that produced the
+	// entry, they feed the age calculation.
+	RequestTime  time.Time
+	ResponseTime time.Time
+	// Vary holds the request headers named by the Vary response header as
+	// they were when the entry was stored.
+	Vary map[string]string
+}
+
+func (e *Entry) size() int64 {
+	n := int64(len(e.Body))
+	for k, v := range e.Header {
+		n += int64(len(k) + len(v))
+	}
+	return n
+}
+
+// Store keeps cache entries by key. Implementations must be safe for
+// concurrent use.
+type Store interface {
+	Get(key string) (*Entry, bool)
+	Set(key string, e *Entry) error
+	Delete(key string)
+}
+
+type lruItem struct {
+	key   string
+	entry *Entry
+	size  int64
+}
+
+// LRU is an in-memory Store evicting the least recently used entries once
+// MaxBytes is exceeded.
+type LRU struct {
+	maxBytes int64
+
+	mu    sync.Mutex
+	size  int64
+	order *list.List
+	items map[string]*list.Element
+}
+
+func NewLRU(maxBytes int64) *LRU {
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+	return &LRU{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		items:    map[string]*list.Element{},
+	}
+}
+
+func (l *LRU) Get(key string) (*Entry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(el)
+	return el.Value.(*lruItem).entry, true
+}
+
+func (l *LRU) Set(key string, e *Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if el, ok := l.items[key]; ok {
+		l.remove(el)
+	}
+	item := &lruItem{key: key, entry: e, size: e.size()}
+	if item.size > l.maxBytes {
+		return nil
+	}
+	l.items[key] = l.order.PushFront(item)
+	l.size += item.size
+	for l.size > l.maxBytes {
+		l.remove(l.order.Back())
+	}
+	return nil
+}
+
+func (l *LRU) Delete(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if el, ok := l.items[key]; ok {
+		l.remove(el)
+	}
+}
+
+func (l *LRU) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.order.Len()
+}
+
+func (l *LRU) remove(el *list.Element) {
+	item := l.order.Remove(el).(*lruItem)
+	delete(l.items, item.key)
+	l.size -= item.size
+}
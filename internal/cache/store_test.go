@@ -0,0 +1,152 @@
+package cache
+
+import (
+	"http-from-tcp/internal/headers"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testEntry(body string) *Entry {
+	h := headers.NewHeaders()
+	h.Set("Cache-Control", "max-age=60")
+	return &Entry{
+		StatusCode:   200,
+		Header:       h,
+		Body:         []byte(body),
+		RequestTime:  time.Unix(100, 0).UTC(),
+		ResponseTime: time.Unix(101, 0).UTC(),
+		Vary:         map[string]string{"accept": "text/plain"},
+	}
+}
+
+func TestLRU(t *testing.T) {
+	size := testEntry("aaaa").size()
+	l := NewLRU(3 * size)
+
+	for _, key := range []string{"a", "b", "c"} {
+		require.NoError(t, l.Set(key, testEntry("aaaa")))
+	}
+	// Touching a keeps it, b is the least recently used now
+	_, ok := l.Get("a")
+	assert.True(t, ok)
+	require.NoError(t, l.Set("d", testEntry("aaaa")))
+
+	_, ok = l.Get("b")
+	assert.False(t, ok)
+	for _, key := range []string{"a", "c", "d"} {
+		_, ok := l.Get(key)
+		assert.True(t, ok, key)
+	}
+	assert.Equal(t, 3, l.Len())
+
+	l.Delete("a")
+	assert.Equal(t, 2, l.Len())
+
+	require.NoError(t, l.Set("huge", testEntry(string(make([]byte, 4*size)))))
+	_, ok = l.Get("huge")
+	assert.False(t, ok)
+	assert.Equal(t, 2, l.Len())
+}
+
+func TestDiskStore(t *testing.T) {
+	d, err := NewDiskStore(t.TempDir(), 0)
+	require.NoError(t, err)
+
+	_, ok := d.Get("example.com/")
+	assert.False(t, ok)
+
+	want := testEntry("hello")
+	want.ResponseTime = time.Now().Truncate(time.Second).UTC()
+	want.RequestTime = want.ResponseTime
+	require.NoError(t, d.Set("example.com/", want))
+	got, ok := d.Get("example.com/")
+	require.True(t, ok)
+	assert.Equal(t, want, got)
+
+	// A second store on the same directory sees the entry
+	d2, err := NewDiskStore(d.dir, 0)
+	require.NoError(t, err)
+	_, ok = d2.Get("example.com/")
+	assert.True(t, ok)
+
+	d.Delete("example.com/")
+	_, ok = d2.Get("example.com/")
+	assert.False(t, ok)
+}
+
+func TestDiskStoreEviction(t *testing.T) {
+	// A validator keeps the entries from expiring
+	entry := func(body string) *Entry {
+		e := testEntry(body)
+		e.Header.Set("ETag", `"v1"`)
+		return e
+	}
+	probe, err := NewDiskStore(t.TempDir(), 0)
+	require.NoError(t, err)
+	require.NoError(t, probe.Set("a", entry("aaaa")))
+	size := probe.size
+
+	d, err := NewDiskStore(t.TempDir(), 3*size)
+	require.NoError(t, err)
+	for _, key := range []string{"a", "b", "c"} {
+		require.NoError(t, d.Set(key, entry("aaaa")))
+	}
+	// Touching a keeps it, b is the least recently used now
+	_, ok := d.Get("a")
+	assert.True(t, ok)
+	require.NoError(t, d.Set("d", entry("aaaa")))
+
+	_, ok = d.Get("b")
+	assert.False(t, ok)
+	for _, key := range []string{"a", "c", "d"} {
+		_, ok := d.Get(key)
+		assert.True(t, ok, key)
+	}
+	assert.Equal(t, 3, d.Len())
+
+	require.NoError(t, d.Set("huge", entry(string(make([]byte, 4*size)))))
+	_, ok = d.Get("huge")
+	assert.False(t, ok)
+	assert.Equal(t, 3, d.Len())
+
+	// Reopening keeps the size in check
+	d2, err := NewDiskStore(d.dir, size)
+	require.NoError(t, err)
+	assert.Equal(t, 1, d2.Len())
+}
+
+func TestDiskStoreExpiry(t *testing.T) {
+	now := time.Unix(101, 0)
+	d, err := NewDiskStore(t.TempDir(), 0)
+	require.NoError(t, err)
+	d.now = func() time.Time { return now }
+
+	swr := testEntry("hello")
+	swr.Header.Override("Cache-Control", "max-age=60, stale-while-revalidate=30")
+	withValidator := testEntry("hello")
+	withValidator.Header.Set("ETag", `"v1"`)
+	require.NoError(t, d.Set("swr", swr))
+	require.NoError(t, d.Set("plain", testEntry("hello")))
+	require.NoError(t, d.Set("etag", withValidator))
+
+	// Stale but still within stale-while-revalidate
+	now = time.Unix(185, 0)
+	_, ok := d.Get("swr")
+	assert.True(t, ok)
+	_, ok = d.Get("plain")
+	assert.False(t, ok)
+
+	// Storing sweeps out whatever expired meanwhile
+	now = time.Unix(200, 0)
+	require.NoError(t, d.Set("other", withValidator))
+	assert.Equal(t, 2, d.Len())
+	_, ok = d.Get("etag")
+	assert.True(t, ok)
+	entries, err := os.ReadDir(d.dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
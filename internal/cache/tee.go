@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"http-from-tcp/internal/headers"
+	"http-from-tcp/internal/response"
+	"strconv"
+	"strings"
+)
+
+var headEnd = []byte("\r\n\r\n")
+
+// teeWriter passes the response a handler writes on to the client while
+// keeping a copy to store. The copy is dropped as soon as the head shows the
+// response cannot be stored or the body grows past limit.
+type teeWriter struct {
+	w response.Writer
+	// req is the client request, a 200 matching its validators is sent on
+	// as a 304
+	req headers.Headers
+	// status is sent as Cache-Status
+	status string
+	limit  int
+	// storable decides from the status and headers whether to keep a copy
+	storable func(*Entry) bool
+
+	head      []byte
+	headDone  bool
+	kept      bytes.Buffer
+	headLen   int
+	recording bool
+	// discard drops the body for the client
+	discard bool
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	if t.headDone {
+		return t.writeBody(p)
+	}
+
+	t.head = append(t.head, p...)
+	i := bytes.Index(t.head, headEnd)
+	if i < 0 {
+		return len(p), nil
+	}
+	head, body := t.head[:i+len(headEnd)], t.head[i+len(headEnd):]
+	if err := t.writeHead(head); err != nil {
+		return 0, err
+	}
+	t.headDone = true
+	t.head = nil
+	if len(body) > 0 {
+		if _, err := t.writeBody(body); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (t *teeWriter) writeHead(head []byte) error {
+	statusLine, fields, _ := bytes.Cut(head, []byte("\r\n"))
+	parts := strings.SplitN(string(statusLine), " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "HTTP/") {
+		return fmt.Errorf("%w: malformed status line %q", ErrorNoResponse, statusLine)
+	}
+	code, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return fmt.Errorf("%w: malformed status line %q", ErrorNoResponse, statusLine)
+	}
+	h := headers.NewHeaders()
+	if _, _, err := h.Parse(fields); err != nil {
+		return fmt.Errorf("%w: %v", ErrorNoResponse, err)
+	}
+
+	e := &Entry{StatusCode: code, Header: h}
+	length, err := strconv.Atoi(h.Get("Content-Length"))
+	t.recording = t.storable(e) && (err != nil || length <= t.limit)
+	if t.recording {
+		t.kept.Write(head)
+		t.headLen = len(head)
+	}
+
+	sc := response.StatusCode(code)
+	if notModified(t.req, e) {
+		sc = response.StatusNotModified
+		t.discard = true
+	}
+	h.Override("Cache-Status", cacheName+"; "+t.status)
+	if err := t.w.WriteStatusLine(sc); err != nil {
+		return err
+	}
+	return t.w.WriteHeaders(h)
+}
+
+func (t *teeWriter) writeBody(p []byte) (int, error) {
+	if t.recording {
+		if t.kept.Len()-t.headLen+len(p) > t.limit {
+			t.recording = false
+			t.kept = bytes.Buffer{}
+		} else {
+			t.kept.Write(p)
+		}
+	}
+	if t.discard {
+		return len(p), nil
+	}
+	return t.w.WriteBody(p)
+}
+
+// entry parses the copy, nil when none was kept or the handler did not
+// finish the response.
+func (t *teeWriter) entry() *Entry {
+	if !t.recording {
+		return nil
+	}
+	e, err := readEntry(&t.kept)
+	if err != nil {
+		return nil
+	}
+	return e
+}
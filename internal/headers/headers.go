@@ -21,16 +21,45 @@ func (h Headers) Get(key string) string {
 	return h[strings.ToLower(key)]
 }
 
+// Set-Cookie values may contain commas, so repeated ones are kept on
+// separate lines and written back as separate fields.
+const cookieSeparator = "\n"
+
+func separator(key string) string {
+	if key == "set-cookie" {
+		return cookieSeparator
+	}
+	return ", "
+}
+
 func (h Headers) Set(key, value string) {
 	key = strings.ToLower(key)
 
 	if val, ok := h[key]; ok {
-		value = fmt.Sprintf("%s, %s", val, value)
+		value = val + separator(key) + value
 	}
 
 	h[key] = value
 }
 
+// SetValues is Set for every value but joins them only once.
+func (h Headers) SetValues(key string, values []string) {
+	key = strings.ToLower(key)
+	if val, ok := h[key]; ok {
+		values = append([]string{val}, values...)
+	}
+	h[key] = strings.Join(values, separator(key))
+}
+
+// Values returns the field values to write for key, one per field line.
+func (h Headers) Values(key string) []string {
+	val, ok := h[strings.ToLower(key)]
+	if !ok {
+		return nil
+	}
+	return strings.Split(val, cookieSeparator)
+}
+
 func (h Headers) Override(key, value string) {
 	key = strings.ToLower(key)
 	h[key] = value
@@ -41,7 +70,9 @@ func (h Headers) Delete(key string) {
 	delete(h, key)
 }
 
-func (h Headers) isToken(str string) bool {
+// IsToken reports whether str only holds token characters, RFC 9110
+// section 5.6.2
+func IsToken(str string) bool {
 	for _, ch := range str {
 		found := false
 
@@ -101,7 +132,7 @@ func (h Headers) Parse(data []byte) (int, bool, error) {
 		}
 		read += idx + len(CRLF)
 
-		if !h.isToken(name) {
+		if !IsToken(name) {
 			return 0, false, ErrorMalformedHeaderName
 		}
 
@@ -37,9 +37,27 @@ func TestHeaders_Parse(t *testing.T) {
 	require.NotNil(t, headers)
 	assert.Equal(t, "localhost:42069", headers.Get("Host"))
 	assert.Equal(t, "Same, Same", headers.Get("Same"))
+	assert.Equal(t, []string{"Same, Same"}, headers.Values("Same"))
 	assert.Equal(t, 52, n)
 	assert.True(t, done)
 
+	// Test: repeated Set-Cookie stays separate
+	headers = NewHeaders()
+	data = []byte("Set-Cookie: a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT\r\nSet-Cookie: b=2\r\n\r\n")
+	_, done, err = headers.Parse(data)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT", "b=2"}, headers.Values("Set-Cookie"))
+	assert.Nil(t, headers.Values("Missing"))
+	assert.True(t, done)
+
+	// Test: SetValues joins like repeated Set calls
+	headers = NewHeaders()
+	headers.Set("Accept", "text/html")
+	headers.SetValues("Accept", []string{"text/plain", "*/*"})
+	headers.SetValues("Set-Cookie", []string{"a=1", "b=2"})
+	assert.Equal(t, "text/html, text/plain, */*", headers.Get("Accept"))
+	assert.Equal(t, []string{"a=1", "b=2"}, headers.Values("Set-Cookie"))
+
 	// Test: Invalid header
 	headers = NewHeaders()
 	data = []byte("H©st: localhost:42069\r\n\r\n")
@@ -0,0 +1,79 @@
+package http2
+
+import (
+	"io"
+	"sync"
+)
+
+// bodyPipe hands a streamed request body to the handler. The client only
+// gets its window back as the handler reads, so at most a window's worth
+// of body is ever buffered.
+type bodyPipe struct {
+	c  *Conn
+	st *stream
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  []byte
+	err  error
+}
+
+func newBodyPipe(c *Conn, st *stream) *bodyPipe {
+	p := &bodyPipe{c: c, st: st}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// write reports false when the body is no longer read
+func (p *bodyPipe) write(data []byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return false
+	}
+	p.buf = append(p.buf, data...)
+	p.cond.Broadcast()
+	return true
+}
+
+// closeWithError makes Read return err once the buffered data is read
+func (p *bodyPipe) closeWithError(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+		p.cond.Broadcast()
+	}
+}
+
+// abort drops the unread data and returns its length, which the caller
+// owes the connection window.
+func (p *bodyPipe) abort(err error) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil || p.err == io.EOF {
+		p.err = err
+	}
+	n := len(p.buf)
+	p.buf = nil
+	p.cond.Broadcast()
+	return n
+}
+
+func (p *bodyPipe) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	for len(p.buf) == 0 && p.err == nil {
+		p.cond.Wait()
+	}
+	if len(p.buf) == 0 {
+		err := p.err
+		p.mu.Unlock()
+		return 0, err
+	}
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	p.mu.Unlock()
+
+	p.c.credit(p.st, n)
+	return n, nil
+}
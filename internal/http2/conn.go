@@ -0,0 +1,939 @@
+package http2
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"http-from-tcp/internal/http2/hpack"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxConcurrentStreams = 100
+	defaultWriteTimeout         = 10 * time.Second
+)
+
+var ErrorStreamClosed = fmt.Errorf("http2 stream closed")
+
+type Config struct {
+	Handler func(w response.Writer, req *request.Request)
+	// NewContext returns the context of a stream's request, it is also
+	// cancelled when the client resets the stream or the connection closes.
+	NewContext func() (context.Context, context.CancelFunc)
+	// MaxConcurrentStreams defaults to 100
+	MaxConcurrentStreams uint32
+	// MaxHeaderBytes bounds a header block, encoded and decoded, and
+	// MaxBodyBytes a request body, zero means no limit.
+	MaxHeaderBytes int
+	MaxBodyBytes   int
+	// IdleTimeout closes the connection after that long without streams,
+	// zero means no limit.
+	IdleTimeout time.Duration
+	// WriteTimeout bounds writing a single frame, defaults to 10 seconds.
+	WriteTimeout time.Duration
+	// StreamBody picks the requests whose handler reads the body from
+	// BodyReader as it arrives, the others are buffered into Body. Only
+	// bodies with a Content-Length are streamed.
+	StreamBody func(*request.Request) bool
+	Logger     *slog.Logger
+}
+
+type stream struct {
+	id     uint32
+	req    *request.Request
+	body   []byte
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// The fields below are guarded by Conn.mu
+
+	// remoteClosed is set once the client sent END_STREAM
+	remoteClosed bool
+	// dispatched is set once a handler runs for the stream
+	dispatched bool
+	// discard drops the rest of a body that was already answered
+	discard    bool
+	reset      bool
+	sendWindow int64
+	recvWindow int64
+	// pipe is set for streamed bodies, received counts what went into it
+	pipe     *bodyPipe
+	received int
+}
+
+// Conn serves HTTP/2 streams on a connection, each of them with its own
+// call to the handler.
+type Conn struct {
+	conn net.Conn
+	r    io.Reader
+	cfg  Config
+
+	// Frames are written whole under writeMu, the encoder depends on the
+	// order header blocks are sent in.
+	writeMu sync.Mutex
+	wbuf    []byte
+	encoder *hpack.Encoder
+	decoder *hpack.Decoder
+
+	mu            sync.Mutex
+	cond          *sync.Cond
+	streams       map[uint32]*stream
+	lastStreamID  uint32
+	sendWindow    int64
+	recvWindow    int64
+	initialWindow int64
+	maxFrameSize  uint32
+	// goingAway is set once either side sent GOAWAY, no new streams are
+	// accepted and the connection closes when the last one ends.
+	goingAway    bool
+	goAwaySent   bool
+	shutdown     bool
+	closed       bool
+	handlers     sync.WaitGroup
+	continuation *frame
+}
+
+// NewConn wraps conn, buffered holds bytes already read from it.
+func NewConn(conn net.Conn, buffered []byte, cfg Config) *Conn {
+	if cfg.MaxConcurrentStreams == 0 {
+		cfg.MaxConcurrentStreams = defaultMaxConcurrentStreams
+	}
+	if cfg.NewContext == nil {
+		cfg.NewContext = func() (context.Context, context.CancelFunc) {
+			return context.WithCancel(context.Background())
+		}
+	}
+	if cfg.WriteTimeout <= 0 {
+		cfg.WriteTimeout = defaultWriteTimeout
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+
+	var r io.Reader = conn
+	if len(buffered) > 0 {
+		r = io.MultiReader(bytes.NewReader(buffered), conn)
+	}
+	decoder := hpack.NewDecoder(hpack.DefaultTableSize)
+	decoder.MaxStringLength = cfg.MaxHeaderBytes
+	decoder.MaxHeaderListSize = cfg.MaxHeaderBytes
+	c := &Conn{
+		conn:          conn,
+		r:             r,
+		cfg:           cfg,
+		encoder:       hpack.NewEncoder(),
+		decoder:       decoder,
+		streams:       map[uint32]*stream{},
+		sendWindow:    defaultWindowSize,
+		recvWindow:    defaultWindowSize,
+		initialWindow: defaultWindowSize,
+		maxFrameSize:  defaultMaxFrameSize,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// IsUpgrade reports whether req asks to switch to h2c, RFC 7540 section 3.2.
+func IsUpgrade(req *request.Request) bool {
+	connection := strings.ToLower(req.Headers.Get("Connection"))
+	settings, ok := req.Headers["http2-settings"]
+	return ok && !strings.Contains(settings, ",") &&
+		strings.EqualFold(strings.TrimSpace(req.Headers.Get("Upgrade")), "h2c") &&
+		strings.Contains(connection, "upgrade") &&
+		strings.Contains(connection, "http2-settings")
+}
+
+// Serve runs the connection until it closes. For an h2c upgrade req is the
+// HTTP/1.1 request that asked for it, the 101 response must already be sent;
+// it is answered on stream 1.
+func (c *Conn) Serve(upgrade *request.Request) error {
+	defer c.close()
+
+	settings := []setting{{settingMaxConcurrentStreams, c.cfg.MaxConcurrentStreams}}
+	if c.cfg.MaxHeaderBytes > 0 {
+		settings = append(settings, setting{settingMaxHeaderListSize, uint32(c.cfg.MaxHeaderBytes)})
+	}
+	if err := c.writeFrame(frameSettings, 0, 0, appendSettings(nil, settings...)); err != nil {
+		return err
+	}
+
+	if upgrade != nil {
+		payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(upgrade.Headers.Get("HTTP2-Settings"), "="))
+		if err != nil {
+			return c.goAway(ConnError{ErrCodeProtocol, "invalid HTTP2-Settings header"})
+		}
+		if err := c.applySettings(payload); err != nil {
+			return c.goAway(err)
+		}
+		c.startUpgradeStream(upgrade)
+	}
+
+	preface := make([]byte, len(ClientPreface))
+	c.setIdleDeadline()
+	if _, err := io.ReadFull(c.r, preface); err != nil {
+		return err
+	}
+	if string(preface) != ClientPreface {
+		return c.goAway(ConnError{ErrCodeProtocol, "invalid client preface"})
+	}
+
+	var buf []byte
+	first := true
+	for {
+		f, b, err := readFrame(c.r, buf, defaultMaxFrameSize)
+		buf = b
+		if err != nil {
+			var ce ConnError
+			if errors.As(err, &ce) {
+				return c.goAway(ce)
+			}
+			c.mu.Lock()
+			closed := c.closed || (c.goingAway && len(c.streams) == 0)
+			c.mu.Unlock()
+			if closed || err == io.EOF {
+				return nil
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				c.Shutdown()
+				return nil
+			}
+			return err
+		}
+		if first && (f.typ != frameSettings || f.has(flagAck)) {
+			return c.goAway(ConnError{ErrCodeProtocol, "first frame is not SETTINGS"})
+		}
+		first = false
+
+		err = c.processFrame(f)
+		var se StreamError
+		if errors.As(err, &se) {
+			c.resetStream(se.StreamID, se.Code)
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return c.goAway(err)
+		}
+	}
+}
+
+func (c *Conn) processFrame(f frame) error {
+	if c.continuation != nil && f.typ != frameContinuation {
+		return ConnError{ErrCodeProtocol, fmt.Sprintf("%d frame in the middle of a header block", f.typ)}
+	}
+
+	switch f.typ {
+	case frameData:
+		return c.onData(f)
+	case frameHeaders:
+		return c.onHeaders(f)
+	case frameContinuation:
+		return c.onContinuation(f)
+	case framePriority:
+		if f.streamID == 0 {
+			return ConnError{ErrCodeProtocol, "PRIORITY on stream 0"}
+		}
+		if len(f.payload) != 5 {
+			return StreamError{f.streamID, ErrCodeFrameSize, "PRIORITY payload is not 5 bytes"}
+		}
+		// Prioritization is deprecated by RFC 9113 and ignored here
+		return nil
+	case frameRSTStream:
+		return c.onRSTStream(f)
+	case frameSettings:
+		return c.onSettings(f)
+	case framePushPromise:
+		return ConnError{ErrCodeProtocol, "clients cannot push"}
+	case framePing:
+		if f.streamID != 0 {
+			return ConnError{ErrCodeProtocol, "PING on a stream"}
+		}
+		if len(f.payload) != 8 {
+			return ConnError{ErrCodeFrameSize, "PING payload is not 8 bytes"}
+		}
+		if f.has(flagAck) {
+			return nil
+		}
+		return c.writeFrame(framePing, flagAck, 0, f.payload)
+	case frameGoAway:
+		if f.streamID != 0 {
+			return ConnError{ErrCodeProtocol, "GOAWAY on a stream"}
+		}
+		c.mu.Lock()
+		c.goingAway = true
+		idle := len(c.streams) == 0
+		c.mu.Unlock()
+		if idle {
+			return io.EOF
+		}
+		return nil
+	case frameWindowUpdate:
+		return c.onWindowUpdate(f)
+	}
+	// Unknown frame types are ignored, RFC 9113 section 4.1
+	return nil
+}
+
+// stream returns the open stream id, or an error for DATA and trailers on
+// streams that are not open.
+func (c *Conn) stream(id uint32) (*stream, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.streams[id]
+	switch {
+	case st != nil && !st.remoteClosed:
+		return st, nil
+	case st == nil && id > c.lastStreamID:
+		return nil, ConnError{ErrCodeProtocol, fmt.Sprintf("frame on idle stream %d", id)}
+	}
+	return nil, StreamError{id, ErrCodeStreamClosed, "stream is closed"}
+}
+
+func (c *Conn) onData(f frame) error {
+	if f.streamID == 0 {
+		return ConnError{ErrCodeProtocol, "DATA on stream 0"}
+	}
+	n := len(f.payload)
+	c.mu.Lock()
+	if int64(n) > c.recvWindow {
+		c.mu.Unlock()
+		return ConnError{ErrCodeFlowControl, "DATA over the connection window"}
+	}
+	c.recvWindow -= int64(n)
+	c.mu.Unlock()
+
+	data, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+	st, err := c.stream(f.streamID)
+	if err != nil {
+		// Nobody reads the data of a closed stream
+		c.credit(nil, n)
+		return err
+	}
+	c.mu.Lock()
+	if int64(n) > st.recvWindow {
+		c.mu.Unlock()
+		c.credit(nil, n)
+		return StreamError{st.id, ErrCodeFlowControl, "DATA over the stream window"}
+	}
+	st.recvWindow -= int64(n)
+	discard, pipe := st.discard, st.pipe
+	c.mu.Unlock()
+	end := f.has(flagEndStream)
+
+	if pipe != nil {
+		// The window comes back as the handler reads, padding is never read
+		st.received += len(data)
+		if st.received > st.req.ContentLength() {
+			pipe.closeWithError(request.ErrorBodyLengthExceeded)
+			c.credit(nil, n)
+			return StreamError{st.id, ErrCodeProtocol, "body longer than content-length"}
+		}
+		unread := n - len(data)
+		if !pipe.write(data) {
+			unread = n
+		}
+		if err := c.credit(st, unread); err != nil {
+			return err
+		}
+		if end {
+			return c.endRequest(st)
+		}
+		return nil
+	}
+
+	// Buffered bodies are bounded by MaxBodyBytes, so what was received is
+	// handed back to the client right away.
+	creditStream := st
+	if end {
+		creditStream = nil
+	}
+	if err := c.credit(creditStream, n); err != nil {
+		return err
+	}
+	if !discard {
+		st.body = append(st.body, data...)
+		if c.cfg.MaxBodyBytes > 0 && len(st.body) > c.cfg.MaxBodyBytes {
+			st.body = nil
+			c.mu.Lock()
+			st.discard = true
+			c.mu.Unlock()
+			c.dispatch(st, errorHandler(response.StatusContentTooLarge, request.ErrorBodyTooLarge.Error()))
+		}
+	}
+	if end {
+		return c.endRequest(st)
+	}
+	return nil
+}
+
+func (c *Conn) onHeaders(f frame) error {
+	if f.streamID == 0 {
+		return ConnError{ErrCodeProtocol, "HEADERS on stream 0"}
+	}
+	block, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+	if f.has(flagPriority) {
+		if len(block) < 5 {
+			return ConnError{ErrCodeFrameSize, "HEADERS too short for its priority"}
+		}
+		block = block[5:]
+	}
+	if !f.has(flagEndHeaders) {
+		c.continuation = &frame{typ: frameHeaders, flags: f.flags, streamID: f.streamID, payload: slices.Clone(block)}
+		return c.checkHeaderBlockSize()
+	}
+	return c.onHeaderBlock(f.streamID, f.has(flagEndStream), block)
+}
+
+func (c *Conn) onContinuation(f frame) error {
+	if c.continuation == nil || c.continuation.streamID != f.streamID {
+		return ConnError{ErrCodeProtocol, "unexpected CONTINUATION"}
+	}
+	c.continuation.payload = append(c.continuation.payload, f.payload...)
+	if err := c.checkHeaderBlockSize(); err != nil {
+		return err
+	}
+	if !f.has(flagEndHeaders) {
+		return nil
+	}
+	h := c.continuation
+	c.continuation = nil
+	return c.onHeaderBlock(h.streamID, h.has(flagEndStream), h.payload)
+}
+
+// checkHeaderBlockSize stops clients from sending endless CONTINUATION
+// frames, the block cannot be skipped without breaking HPACK.
+func (c *Conn) checkHeaderBlockSize() error {
+	if c.cfg.MaxHeaderBytes > 0 && len(c.continuation.payload) > c.cfg.MaxHeaderBytes {
+		return ConnError{ErrCodeEnhanceYourCalm, "header block larger than allowed"}
+	}
+	return nil
+}
+
+func (c *Conn) onHeaderBlock(id uint32, end bool, block []byte) error {
+	if c.cfg.MaxHeaderBytes > 0 && len(block) > c.cfg.MaxHeaderBytes {
+		return ConnError{ErrCodeEnhanceYourCalm, "header block larger than allowed"}
+	}
+	// Every block is decoded, even for refused streams, to keep the HPACK
+	// tables in sync.
+	fields, err := c.decoder.Decode(block)
+	if errors.Is(err, hpack.ErrorHeaderListTooLarge) {
+		return ConnError{ErrCodeEnhanceYourCalm, err.Error()}
+	}
+	if err != nil {
+		return ConnError{ErrCodeCompression, err.Error()}
+	}
+
+	c.mu.Lock()
+	if st := c.streams[id]; st != nil {
+		c.mu.Unlock()
+		return c.onTrailers(id, end, fields)
+	}
+	if id%2 == 0 || id <= c.lastStreamID {
+		c.mu.Unlock()
+		return ConnError{ErrCodeProtocol, fmt.Sprintf("invalid new stream id %d", id)}
+	}
+	c.lastStreamID = id
+	refused := c.goingAway || uint32(len(c.streams)) >= c.cfg.MaxConcurrentStreams
+	c.mu.Unlock()
+	if refused {
+		return StreamError{id, ErrCodeRefusedStream, "too many streams"}
+	}
+
+	req, err := newRequest(id, fields)
+	if err != nil {
+		return err
+	}
+	st := c.newStream(id, req)
+	if end {
+		return c.endRequest(st)
+	}
+	c.streamBody(st)
+	return nil
+}
+
+// streamBody starts the handler before the body arrived if the
+// configuration asks for it.
+func (c *Conn) streamBody(st *stream) {
+	if c.cfg.StreamBody == nil {
+		return
+	}
+	length, err := strconv.Atoi(st.req.Headers.Get("content-length"))
+	if err != nil || length < 0 || (c.cfg.MaxBodyBytes > 0 && length > c.cfg.MaxBodyBytes) || !c.cfg.StreamBody(st.req) {
+		return
+	}
+	pipe := newBodyPipe(c, st)
+	st.req.SetBodyReader(pipe, length)
+	c.mu.Lock()
+	st.pipe = pipe
+	c.mu.Unlock()
+	c.dispatch(st, c.handler(st.req))
+}
+
+func (c *Conn) handler(req *request.Request) func(response.Writer, *request.Request) {
+	if !request.ValidMethod(req.RequestLine.Method) {
+		return errorHandler(response.StatusBadRequest, request.ErrorInvalidRequestLine.Error())
+	}
+	return c.cfg.Handler
+}
+
+func (c *Conn) onTrailers(id uint32, end bool, fields []hpack.HeaderField) error {
+	st, err := c.stream(id)
+	if err != nil {
+		return err
+	}
+	if !end {
+		return StreamError{id, ErrCodeProtocol, "trailers without END_STREAM"}
+	}
+	if err := addTrailers(st.req, fields); err != nil {
+		return StreamError{id, ErrCodeProtocol, err.Error()}
+	}
+	return c.endRequest(st)
+}
+
+func (c *Conn) newStream(id uint32, req *request.Request) *stream {
+	ctx, cancel := c.cfg.NewContext()
+	st := &stream{id: id, req: req, ctx: ctx, cancel: cancel, body: []byte{}, recvWindow: defaultWindowSize}
+	c.mu.Lock()
+	st.sendWindow = c.initialWindow
+	c.streams[id] = st
+	c.mu.Unlock()
+	c.setIdleDeadline()
+	return st
+}
+
+// endRequest runs once the client sent END_STREAM
+func (c *Conn) endRequest(st *stream) error {
+	c.mu.Lock()
+	st.remoteClosed = true
+	dispatched, pipe := st.dispatched, st.pipe
+	c.mu.Unlock()
+	if pipe != nil {
+		if st.received != st.req.ContentLength() {
+			pipe.closeWithError(request.ErrorReadingBody)
+			return StreamError{st.id, ErrCodeProtocol, "body length does not match content-length"}
+		}
+		pipe.closeWithError(io.EOF)
+		return nil
+	}
+	if dispatched {
+		return nil
+	}
+	if !validContentLength(st.req, len(st.body)) {
+		return StreamError{st.id, ErrCodeProtocol, "body length does not match content-length"}
+	}
+	st.req.Body = st.body
+	c.dispatch(st, c.handler(st.req))
+	return nil
+}
+
+func (c *Conn) startUpgradeStream(req *request.Request) {
+	c.mu.Lock()
+	c.lastStreamID = 1
+	c.mu.Unlock()
+	st := c.newStream(1, upgradeRequest(req))
+	st.body = req.Body
+	c.endRequest(st)
+}
+
+func (c *Conn) dispatch(st *stream, handler func(response.Writer, *request.Request)) {
+	c.mu.Lock()
+	st.dispatched = true
+	c.mu.Unlock()
+
+	c.handlers.Add(1)
+	go func() {
+		defer c.handlers.Done()
+		w := &responseWriter{c: c, st: st}
+		handler(response.NewWrite(w), st.req.WithContext(st.ctx))
+		w.finish()
+		st.cancel()
+		c.streamDone(st)
+	}()
+}
+
+// streamDone forgets a stream whose handler returned. A client still
+// sending its body is told to stop with RST_STREAM NO_ERROR.
+func (c *Conn) streamDone(st *stream) {
+	c.mu.Lock()
+	stop := !st.remoteClosed && !st.reset
+	delete(c.streams, st.id)
+	closing := c.goingAway && len(c.streams) == 0
+	c.mu.Unlock()
+
+	if st.pipe != nil {
+		c.credit(nil, st.pipe.abort(ErrorStreamClosed))
+	}
+	if stop {
+		c.resetStream(st.id, ErrCodeNo)
+	}
+	if closing {
+		c.conn.Close()
+		return
+	}
+	c.setIdleDeadline()
+}
+
+// resetStream sends RST_STREAM and cancels the stream's request
+func (c *Conn) resetStream(id uint32, code ErrCode) {
+	payload := binary.BigEndian.AppendUint32(nil, uint32(code))
+	c.writeFrame(frameRSTStream, 0, id, payload)
+	c.closeStream(id)
+}
+
+func (c *Conn) closeStream(id uint32) {
+	c.mu.Lock()
+	st := c.streams[id]
+	if st == nil {
+		c.mu.Unlock()
+		return
+	}
+	st.reset = true
+	st.remoteClosed = true
+	st.cancel()
+	if !st.dispatched {
+		delete(c.streams, id)
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	if st.pipe != nil {
+		c.credit(nil, st.pipe.abort(ErrorStreamClosed))
+	}
+}
+
+func (c *Conn) onRSTStream(f frame) error {
+	if f.streamID == 0 {
+		return ConnError{ErrCodeProtocol, "RST_STREAM on stream 0"}
+	}
+	if len(f.payload) != 4 {
+		return ConnError{ErrCodeFrameSize, "RST_STREAM payload is not 4 bytes"}
+	}
+	c.mu.Lock()
+	idle := f.streamID > c.lastStreamID
+	c.mu.Unlock()
+	if idle {
+		return ConnError{ErrCodeProtocol, fmt.Sprintf("RST_STREAM on idle stream %d", f.streamID)}
+	}
+	c.closeStream(f.streamID)
+	return nil
+}
+
+func (c *Conn) onSettings(f frame) error {
+	if f.streamID != 0 {
+		return ConnError{ErrCodeProtocol, "SETTINGS on a stream"}
+	}
+	if f.has(flagAck) {
+		if len(f.payload) != 0 {
+			return ConnError{ErrCodeFrameSize, "SETTINGS ack with a payload"}
+		}
+		return nil
+	}
+	if err := c.applySettings(f.payload); err != nil {
+		return err
+	}
+	return c.writeFrame(frameSettings, flagAck, 0, nil)
+}
+
+func (c *Conn) applySettings(payload []byte) error {
+	settings, err := parseSettings(payload)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range settings {
+		switch s.id {
+		case settingHeaderTableSize:
+			c.writeMu.Lock()
+			c.encoder.SetMaxTableSize(s.value)
+			c.writeMu.Unlock()
+		case settingEnablePush:
+			if s.value > 1 {
+				return ConnError{ErrCodeProtocol, "SETTINGS_ENABLE_PUSH must be 0 or 1"}
+			}
+		case settingInitialWindowSize:
+			if s.value > maxWindowSize {
+				return ConnError{ErrCodeFlowControl, "SETTINGS_INITIAL_WINDOW_SIZE over the maximum"}
+			}
+			delta := int64(s.value) - c.initialWindow
+			for _, st := range c.streams {
+				st.sendWindow += delta
+				if st.sendWindow > maxWindowSize {
+					return ConnError{ErrCodeFlowControl, "stream window over the maximum"}
+				}
+			}
+			c.initialWindow = int64(s.value)
+			c.cond.Broadcast()
+		case settingMaxFrameSize:
+			if s.value < defaultMaxFrameSize || s.value > maxFrameSizeLimit {
+				return ConnError{ErrCodeProtocol, "SETTINGS_MAX_FRAME_SIZE out of range"}
+			}
+			c.maxFrameSize = s.value
+		}
+	}
+	return nil
+}
+
+func (c *Conn) onWindowUpdate(f frame) error {
+	if len(f.payload) != 4 {
+		return ConnError{ErrCodeFrameSize, "WINDOW_UPDATE payload is not 4 bytes"}
+	}
+	increment := int64(binary.BigEndian.Uint32(f.payload) & (1<<31 - 1))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f.streamID == 0 {
+		if increment == 0 {
+			return ConnError{ErrCodeProtocol, "WINDOW_UPDATE of 0"}
+		}
+		c.sendWindow += increment
+		if c.sendWindow > maxWindowSize {
+			return ConnError{ErrCodeFlowControl, "connection window over the maximum"}
+		}
+		c.cond.Broadcast()
+		return nil
+	}
+
+	st := c.streams[f.streamID]
+	if st == nil {
+		if f.streamID > c.lastStreamID {
+			return ConnError{ErrCodeProtocol, fmt.Sprintf("WINDOW_UPDATE on idle stream %d", f.streamID)}
+		}
+		return nil
+	}
+	if increment == 0 {
+		return StreamError{f.streamID, ErrCodeProtocol, "WINDOW_UPDATE of 0"}
+	}
+	st.sendWindow += increment
+	if st.sendWindow > maxWindowSize {
+		return StreamError{f.streamID, ErrCodeFlowControl, "stream window over the maximum"}
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) writeFrame(typ frameType, flags uint8, streamID uint32, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.wbuf = appendFrame(c.wbuf[:0], typ, flags, streamID, payload)
+	return c.write(c.wbuf)
+}
+
+// write is called with writeMu held. A client that stops reading would
+// otherwise hold every writer, and a frame cut short leaves nothing to
+// continue with, so the connection is closed when the write fails.
+func (c *Conn) write(buf []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteTimeout))
+	_, err := c.conn.Write(buf)
+	if err != nil {
+		c.conn.Close()
+	}
+	return err
+}
+
+func (c *Conn) writeWindowUpdate(streamID uint32, n int) error {
+	return c.writeFrame(frameWindowUpdate, 0, streamID, binary.BigEndian.AppendUint32(nil, uint32(n)))
+}
+
+// credit gives n bytes of receive window back to the client, for st too
+// while it can still send.
+func (c *Conn) credit(st *stream, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	c.recvWindow += int64(n)
+	open := st != nil && !st.remoteClosed
+	if open {
+		st.recvWindow += int64(n)
+	}
+	c.mu.Unlock()
+
+	if err := c.writeWindowUpdate(0, n); err != nil {
+		return err
+	}
+	if open {
+		return c.writeWindowUpdate(st.id, n)
+	}
+	return nil
+}
+
+// writeHeaders sends a header block, split into CONTINUATION frames when it
+// is larger than the client's maximum frame size.
+func (c *Conn) writeHeaders(st *stream, fields []hpack.HeaderField, end bool) error {
+	c.mu.Lock()
+	closed, maxFrameSize := c.closed || st.reset, int(c.maxFrameSize)
+	c.mu.Unlock()
+	if closed {
+		return ErrorStreamClosed
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	block := c.encoder.Encode(nil, fields)
+	typ, flags := frameHeaders, uint8(0)
+	if end {
+		flags = flagEndStream
+	}
+	buf := c.wbuf[:0]
+	for {
+		n := min(len(block), maxFrameSize)
+		if n == len(block) {
+			flags |= flagEndHeaders
+		}
+		buf = appendFrame(buf, typ, flags, st.id, block[:n])
+		block = block[n:]
+		if len(block) == 0 {
+			break
+		}
+		typ, flags = frameContinuation, 0
+	}
+	c.wbuf = buf
+	return c.write(buf)
+}
+
+// writeData sends p within the flow control windows, waiting for
+// WINDOW_UPDATE when they are used up.
+func (c *Conn) writeData(st *stream, p []byte, end bool) error {
+	for {
+		c.mu.Lock()
+		for !c.closed && !st.reset && len(p) > 0 && (c.sendWindow <= 0 || st.sendWindow <= 0) {
+			c.cond.Wait()
+		}
+		if c.closed || st.reset {
+			c.mu.Unlock()
+			return ErrorStreamClosed
+		}
+		n := min(int64(len(p)), c.sendWindow, st.sendWindow, int64(c.maxFrameSize))
+		c.sendWindow -= n
+		st.sendWindow -= n
+		c.mu.Unlock()
+
+		var flags uint8
+		last := int(n) == len(p)
+		if end && last {
+			flags = flagEndStream
+		}
+		if err := c.writeFrame(frameData, flags, st.id, p[:n]); err != nil {
+			return err
+		}
+		p = p[n:]
+		if last {
+			return nil
+		}
+	}
+}
+
+// goAway sends GOAWAY for a connection error and returns it
+func (c *Conn) goAway(err error) error {
+	code, reason := ErrCodeInternal, err.Error()
+	var ce ConnError
+	if errors.As(err, &ce) {
+		code, reason = ce.Code, ce.Reason
+	}
+	c.writeGoAway(code, reason)
+	c.cfg.Logger.Debug("http2 connection error", "remote_addr", c.conn.RemoteAddr(), "error", err)
+	return err
+}
+
+func (c *Conn) writeGoAway(code ErrCode, reason string) {
+	c.mu.Lock()
+	if c.goAwaySent {
+		c.mu.Unlock()
+		return
+	}
+	c.goAwaySent = true
+	c.goingAway = true
+	payload := binary.BigEndian.AppendUint32(nil, c.lastStreamID)
+	c.mu.Unlock()
+
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	payload = append(payload, reason...)
+	c.writeFrame(frameGoAway, 0, 0, payload)
+}
+
+// Shutdown sends GOAWAY and closes the connection once the streams already
+// started have ended. It can be called any number of times and does not
+// wait, GOAWAY may be queued behind a frame the client is slow to read.
+func (c *Conn) Shutdown() {
+	c.mu.Lock()
+	started := c.shutdown
+	c.shutdown = true
+	c.goingAway = true
+	c.mu.Unlock()
+	if started {
+		return
+	}
+
+	go func() {
+		c.writeGoAway(ErrCodeNo, "")
+		c.mu.Lock()
+		idle := len(c.streams) == 0
+		c.mu.Unlock()
+		if idle {
+			c.conn.Close()
+		}
+	}()
+}
+
+// setIdleDeadline makes the pending read fail after IdleTimeout while there
+// are no streams.
+func (c *Conn) setIdleDeadline() {
+	if c.cfg.IdleTimeout <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.streams) == 0 && !c.closed {
+		c.conn.SetReadDeadline(time.Now().Add(c.cfg.IdleTimeout))
+	} else {
+		c.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// close cancels every stream and waits for their handlers
+func (c *Conn) close() {
+	c.mu.Lock()
+	c.closed = true
+	for _, st := range c.streams {
+		st.cancel()
+		if st.pipe != nil {
+			st.pipe.abort(ErrorStreamClosed)
+		}
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	c.conn.Close()
+	c.handlers.Wait()
+}
+
+func errorHandler(status response.StatusCode, message string) func(response.Writer, *request.Request) {
+	return func(w response.Writer, req *request.Request) {
+		w.WriteStatusLine(status)
+		w.WriteHeaders(response.GetDefaultHeaders(len(message)))
+		w.WriteBody([]byte(message))
+	}
+}
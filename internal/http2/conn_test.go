@@ -0,0 +1,528 @@
+package http2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"http-from-tcp/internal/http2/hpack"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testConn struct {
+	t       *testing.T
+	conn    net.Conn
+	encoder *hpack.Encoder
+	decoder *hpack.Decoder
+	done    chan error
+}
+
+func echoHandler(w response.Writer, req *request.Request) {
+	body := req.RequestLine.Method + " " + req.RequestLine.RequestTarget + " " + string(req.Body)
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody([]byte(body))
+}
+
+// connPair returns both ends of a loopback TCP connection, unlike net.Pipe
+// writes don't wait for the other side to read.
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	server, err := l.Accept()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return server, client
+}
+
+// startConn serves one end of a connection and does the client half of the
+// connection preface on the other.
+func startConn(t *testing.T, cfg Config) (*testConn, *Conn) {
+	server, client := connPair(t)
+	if cfg.Handler == nil {
+		cfg.Handler = echoHandler
+	}
+	h2 := NewConn(server, nil, cfg)
+	tc := &testConn{
+		t:       t,
+		conn:    client,
+		encoder: hpack.NewEncoder(),
+		decoder: hpack.NewDecoder(hpack.DefaultTableSize),
+		done:    make(chan error, 1),
+	}
+	go func() {
+		tc.done <- h2.Serve(nil)
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	f := tc.read()
+	require.Equal(t, frameSettings, f.typ)
+	tc.writeRaw(appendFrame([]byte(ClientPreface), frameSettings, 0, 0, nil))
+	// Wait for the ack of our SETTINGS
+	for !f.has(flagAck) {
+		f = tc.expect(frameSettings)
+	}
+	return tc, h2
+}
+
+func (tc *testConn) write(typ frameType, flags uint8, streamID uint32, payload []byte) {
+	_, err := tc.conn.Write(appendFrame(nil, typ, flags, streamID, payload))
+	require.NoError(tc.t, err)
+}
+
+func (tc *testConn) writeRaw(b []byte) {
+	_, err := tc.conn.Write(b)
+	require.NoError(tc.t, err)
+}
+
+func (tc *testConn) read() frame {
+	f, _, err := readFrame(tc.conn, nil, maxFrameSizeLimit)
+	require.NoError(tc.t, err)
+	return f
+}
+
+func (tc *testConn) headers(fields ...string) []byte {
+	hf := []hpack.HeaderField{}
+	for i := 0; i+1 < len(fields); i += 2 {
+		hf = append(hf, hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	return tc.encoder.Encode(nil, hf)
+}
+
+func (tc *testConn) get(path string) []byte {
+	return tc.headers(":method", "GET", ":scheme", "http", ":authority", "example.com", ":path", path)
+}
+
+// expect skips frames until one of typ and returns it, a GOAWAY or
+// RST_STREAM of another kind fails the test.
+func (tc *testConn) expect(typ frameType) frame {
+	for {
+		f := tc.read()
+		if f.typ == typ {
+			return f
+		}
+		if f.typ == frameGoAway || f.typ == frameRSTStream {
+			tc.t.Fatalf("got frame type %d while waiting for %d", f.typ, typ)
+		}
+	}
+}
+
+func (tc *testConn) expectGoAway(code ErrCode) {
+	f := tc.expect(frameGoAway)
+	require.GreaterOrEqual(tc.t, len(f.payload), 8)
+	assert.Equal(tc.t, code, ErrCode(binary.BigEndian.Uint32(f.payload[4:])))
+}
+
+func (tc *testConn) expectReset(streamID uint32, code ErrCode) {
+	f := tc.expect(frameRSTStream)
+	assert.Equal(tc.t, streamID, f.streamID)
+	require.Len(tc.t, f.payload, 4)
+	assert.Equal(tc.t, code, ErrCode(binary.BigEndian.Uint32(f.payload)))
+}
+
+// response reads the response of a stream, decoding its header blocks
+func (tc *testConn) response(streamID uint32) (map[string]string, string) {
+	h := map[string]string{}
+	body := []byte{}
+	for {
+		f := tc.read()
+		switch {
+		case f.typ == frameRSTStream || f.typ == frameGoAway:
+			tc.t.Fatalf("stream %d ended by frame type %d", streamID, f.typ)
+		case f.streamID != streamID:
+			continue
+		case f.typ == frameHeaders:
+			fields, err := tc.decoder.Decode(f.payload)
+			require.NoError(tc.t, err)
+			for _, field := range fields {
+				h[field.Name] = field.Value
+			}
+		case f.typ == frameData:
+			body = append(body, f.payload...)
+		}
+		if f.has(flagEndStream) {
+			return h, string(body)
+		}
+	}
+}
+
+func TestConnStreams(t *testing.T) {
+	tc, _ := startConn(t, Config{})
+
+	tc.write(frameHeaders, flagEndHeaders|flagEndStream, 1, tc.get("/one"))
+	h, body := tc.response(1)
+	assert.Equal(t, "200", h[":status"])
+	assert.Equal(t, "GET /one ", body)
+
+	// A POST split over HEADERS, CONTINUATION and two padded DATA frames
+	block := tc.headers(":method", "POST", ":scheme", "http", ":authority", "example.com", ":path", "/two", "content-length", "6")
+	tc.write(frameHeaders, 0, 3, block[:3])
+	tc.write(frameContinuation, flagEndHeaders, 3, block[3:])
+	tc.write(frameData, flagPadded, 3, []byte("\x02abc\x00\x00"))
+	tc.write(frameData, flagEndStream, 3, []byte("def"))
+	h, body = tc.response(3)
+	assert.Equal(t, "200", h[":status"])
+	assert.Equal(t, "POST /two abcdef", body)
+
+	tc.write(framePing, 0, 0, []byte("12345678"))
+	f := tc.expect(framePing)
+	assert.True(t, f.has(flagAck))
+	assert.Equal(t, "12345678", string(f.payload))
+}
+
+func TestConnFlowControl(t *testing.T) {
+	large := make([]byte, 100000)
+	tc, _ := startConn(t, Config{Handler: func(w response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(large)))
+		w.WriteBody(large)
+	}})
+
+	tc.write(frameHeaders, flagEndHeaders|flagEndStream, 1, tc.get("/"))
+	tc.expect(frameHeaders)
+	received := 0
+	for received < defaultWindowSize {
+		f := tc.expect(frameData)
+		received += len(f.payload)
+	}
+	assert.Equal(t, defaultWindowSize, received)
+
+	// Nothing more is sent until the window opens on both levels
+	increment := binary.BigEndian.AppendUint32(nil, uint32(len(large)))
+	tc.write(frameWindowUpdate, 0, 0, increment)
+	tc.write(frameWindowUpdate, 0, 1, increment)
+	for {
+		f := tc.expect(frameData)
+		received += len(f.payload)
+		if f.has(flagEndStream) {
+			break
+		}
+	}
+	assert.Equal(t, len(large), received)
+}
+
+func TestConnErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		send func(tc *testConn)
+		// Either a connection error or a reset of stream 1
+		goAway ErrCode
+		reset  ErrCode
+	}{
+		{
+			name:   "PING on a stream",
+			send:   func(tc *testConn) { tc.write(framePing, 0, 1, []byte("12345678")) },
+			goAway: ErrCodeProtocol,
+		},
+		{
+			name:   "PING of the wrong length",
+			send:   func(tc *testConn) { tc.write(framePing, 0, 0, []byte("1234")) },
+			goAway: ErrCodeFrameSize,
+		},
+		{
+			name:   "SETTINGS with a partial entry",
+			send:   func(tc *testConn) { tc.write(frameSettings, 0, 0, []byte{0, 4, 0}) },
+			goAway: ErrCodeFrameSize,
+		},
+		{
+			name: "SETTINGS with an oversized window",
+			send: func(tc *testConn) {
+				tc.write(frameSettings, 0, 0, appendSettings(nil, setting{settingInitialWindowSize, 1 << 31}))
+			},
+			goAway: ErrCodeFlowControl,
+		},
+		{
+			name: "SETTINGS ack with a payload",
+			send: func(tc *testConn) {
+				tc.write(frameSettings, flagAck, 0, appendSettings(nil, setting{settingEnablePush, 0}))
+			},
+			goAway: ErrCodeFrameSize,
+		},
+		{
+			name:   "WINDOW_UPDATE of zero on the connection",
+			send:   func(tc *testConn) { tc.write(frameWindowUpdate, 0, 0, []byte{0, 0, 0, 0}) },
+			goAway: ErrCodeProtocol,
+		},
+		{
+			name: "WINDOW_UPDATE overflowing the connection window",
+			send: func(tc *testConn) {
+				tc.write(frameWindowUpdate, 0, 0, binary.BigEndian.AppendUint32(nil, maxWindowSize))
+			},
+			goAway: ErrCodeFlowControl,
+		},
+		{
+			name:   "DATA on stream 0",
+			send:   func(tc *testConn) { tc.write(frameData, 0, 0, []byte("x")) },
+			goAway: ErrCodeProtocol,
+		},
+		{
+			name:   "DATA on an idle stream",
+			send:   func(tc *testConn) { tc.write(frameData, 0, 5, []byte("x")) },
+			goAway: ErrCodeProtocol,
+		},
+		{
+			name:   "HEADERS on an even stream",
+			send:   func(tc *testConn) { tc.write(frameHeaders, flagEndHeaders|flagEndStream, 2, tc.get("/")) },
+			goAway: ErrCodeProtocol,
+		},
+		{
+			name: "HEADERS on a lower stream",
+			send: func(tc *testConn) {
+				tc.write(frameHeaders, flagEndHeaders|flagEndStream, 5, tc.get("/"))
+				tc.write(frameHeaders, flagEndHeaders|flagEndStream, 3, tc.get("/"))
+			},
+			goAway: ErrCodeProtocol,
+		},
+		{
+			name: "another frame between HEADERS and CONTINUATION",
+			send: func(tc *testConn) {
+				tc.write(frameHeaders, 0, 1, tc.get("/"))
+				tc.write(framePing, 0, 0, []byte("12345678"))
+			},
+			goAway: ErrCodeProtocol,
+		},
+		{
+			name:   "CONTINUATION without HEADERS",
+			send:   func(tc *testConn) { tc.write(frameContinuation, flagEndHeaders, 1, tc.get("/")) },
+			goAway: ErrCodeProtocol,
+		},
+		{
+			name:   "invalid HPACK",
+			send:   func(tc *testConn) { tc.write(frameHeaders, flagEndHeaders, 1, []byte{0xff, 0xff, 0xff, 0xff}) },
+			goAway: ErrCodeCompression,
+		},
+		{
+			name:   "PUSH_PROMISE from the client",
+			send:   func(tc *testConn) { tc.write(framePushPromise, flagEndHeaders, 1, []byte{0, 0, 0, 2}) },
+			goAway: ErrCodeProtocol,
+		},
+		{
+			name:   "RST_STREAM on an idle stream",
+			send:   func(tc *testConn) { tc.write(frameRSTStream, 0, 1, []byte{0, 0, 0, 8}) },
+			goAway: ErrCodeProtocol,
+		},
+		{
+			name:   "frame over the maximum size",
+			send:   func(tc *testConn) { tc.write(frameData, 0, 1, make([]byte, defaultMaxFrameSize+1)) },
+			goAway: ErrCodeFrameSize,
+		},
+		{
+			name: "uppercase header name",
+			send: func(tc *testConn) {
+				tc.write(frameHeaders, flagEndHeaders|flagEndStream, 1, tc.headers(":method", "GET", ":scheme", "http", ":path", "/", "X-Upper", "1"))
+			},
+			reset: ErrCodeProtocol,
+		},
+		{
+			name: "missing :path",
+			send: func(tc *testConn) {
+				tc.write(frameHeaders, flagEndHeaders|flagEndStream, 1, tc.headers(":method", "GET", ":scheme", "http"))
+			},
+			reset: ErrCodeProtocol,
+		},
+		{
+			name: "connection specific header",
+			send: func(tc *testConn) {
+				tc.write(frameHeaders, flagEndHeaders|flagEndStream, 1, tc.headers(":method", "GET", ":scheme", "http", ":path", "/", "connection", "close"))
+			},
+			reset: ErrCodeProtocol,
+		},
+		{
+			name: "body shorter than content-length",
+			send: func(tc *testConn) {
+				tc.write(frameHeaders, flagEndHeaders, 1, tc.headers(":method", "POST", ":scheme", "http", ":path", "/", "content-length", "10"))
+				tc.write(frameData, flagEndStream, 1, []byte("abc"))
+			},
+			reset: ErrCodeProtocol,
+		},
+		{
+			name: "WINDOW_UPDATE of zero on a stream",
+			send: func(tc *testConn) {
+				tc.write(frameHeaders, flagEndHeaders, 1, tc.headers(":method", "POST", ":scheme", "http", ":path", "/"))
+				tc.write(frameWindowUpdate, 0, 1, []byte{0, 0, 0, 0})
+			},
+			reset: ErrCodeProtocol,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, _ := startConn(t, Config{})
+			tt.send(tc)
+			if tt.goAway != ErrCodeNo {
+				tc.expectGoAway(tt.goAway)
+				return
+			}
+			tc.expectReset(1, tt.reset)
+
+			// The connection survives a stream error
+			tc.write(frameHeaders, flagEndHeaders|flagEndStream, 7, tc.get("/after"))
+			h, _ := tc.response(7)
+			assert.Equal(t, "200", h[":status"])
+		})
+	}
+}
+
+func TestConnHeaderListSize(t *testing.T) {
+	tc, _ := startConn(t, Config{MaxHeaderBytes: 1024})
+	// Small on the wire, 20 copies of an indexed field once decoded
+	block := tc.get("/")
+	block = append(append(block, 0x40, 5), "x-big"...)
+	block = append(append(block, 100), strings.Repeat("v", 100)...)
+	block = append(block, bytes.Repeat([]byte{0xbe}, 20)...)
+	require.Less(t, len(block), 1024)
+
+	tc.write(frameHeaders, flagEndHeaders|flagEndStream, 1, block)
+	tc.expectGoAway(ErrCodeEnhanceYourCalm)
+}
+
+func TestConnIgnoresUnknownFrames(t *testing.T) {
+	tc, _ := startConn(t, Config{})
+	tc.write(0x42, 0xff, 0, []byte("ignored"))
+	tc.write(framePriority, 0, 3, []byte{0, 0, 0, 0, 16})
+	tc.write(frameHeaders, flagEndHeaders|flagEndStream, 1, tc.get("/"))
+	h, _ := tc.response(1)
+	assert.Equal(t, "200", h[":status"])
+}
+
+func TestConnPreface(t *testing.T) {
+	server, client := connPair(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	done := make(chan error, 1)
+	go func() {
+		done <- NewConn(server, nil, Config{Handler: echoHandler}).Serve(nil)
+	}()
+
+	tc := &testConn{t: t, conn: client}
+	tc.expect(frameSettings)
+	tc.writeRaw([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+	tc.expectGoAway(ErrCodeProtocol)
+	<-done
+}
+
+func TestConnShutdown(t *testing.T) {
+	release := make(chan struct{})
+	tc, h2 := startConn(t, Config{Handler: func(w response.Writer, req *request.Request) {
+		<-release
+		echoHandler(w, req)
+	}})
+
+	tc.write(frameHeaders, flagEndHeaders|flagEndStream, 1, tc.get("/slow"))
+	time.Sleep(50 * time.Millisecond)
+	go h2.Shutdown()
+
+	f := tc.expect(frameGoAway)
+	assert.Equal(t, uint32(1), binary.BigEndian.Uint32(f.payload)&(1<<31-1))
+	assert.Equal(t, ErrCodeNo, ErrCode(binary.BigEndian.Uint32(f.payload[4:])))
+
+	// The stream in flight still completes, then the connection closes
+	close(release)
+	_, body := tc.response(1)
+	assert.Equal(t, "GET /slow ", body)
+	assert.NoError(t, <-tc.done)
+}
+
+func TestConnWriteTimeout(t *testing.T) {
+	// Writes to a pipe wait for a reader, which never comes
+	server, client := net.Pipe()
+	defer client.Close()
+	h2 := NewConn(server, nil, Config{Handler: echoHandler, WriteTimeout: 50 * time.Millisecond})
+	done := make(chan error, 1)
+	go func() {
+		done <- h2.Serve(nil)
+	}()
+
+	start := time.Now()
+	h2.Shutdown()
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+	select {
+	case err := <-done:
+		// Either write may be the one that times out and closes the pipe
+		assert.Error(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve did not return")
+	}
+}
+
+// readBodyLength answers with the length of the streamed body once release
+// is closed.
+func readBodyLength(release chan struct{}) func(response.Writer, *request.Request) {
+	return func(w response.Writer, req *request.Request) {
+		<-release
+		body, _ := io.ReadAll(req.BodyReader())
+		msg := strconv.Itoa(len(body))
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(msg)))
+		w.WriteBody([]byte(msg))
+	}
+}
+
+// sendData sends n bytes on a stream in frames of the default maximum size
+func (tc *testConn) sendData(streamID uint32, n int, end bool) {
+	for n > 0 {
+		size := min(n, defaultMaxFrameSize)
+		n -= size
+		var flags uint8
+		if end && n == 0 {
+			flags = flagEndStream
+		}
+		tc.write(frameData, flags, streamID, make([]byte, size))
+	}
+}
+
+func TestConnStreamBody(t *testing.T) {
+	release := make(chan struct{})
+	tc, _ := startConn(t, Config{
+		StreamBody: func(*request.Request) bool { return true },
+		Handler:    readBodyLength(release),
+	})
+
+	const size = 100000
+	tc.write(frameHeaders, flagEndHeaders, 1, tc.headers(":method", "POST", ":scheme", "http", ":path", "/", "content-length", strconv.Itoa(size)))
+	tc.sendData(1, defaultWindowSize, false)
+
+	// Nothing is handed back before the handler reads
+	tc.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err := readFrame(tc.conn, nil, maxFrameSizeLimit)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	tc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	close(release)
+	credited := 0
+	for credited < size-defaultWindowSize {
+		if f := tc.expect(frameWindowUpdate); f.streamID == 1 {
+			credited += int(binary.BigEndian.Uint32(f.payload))
+		}
+	}
+	tc.sendData(1, size-defaultWindowSize, true)
+	_, body := tc.response(1)
+	assert.Equal(t, strconv.Itoa(size), body)
+}
+
+func TestConnStreamBodyOverWindow(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	tc, _ := startConn(t, Config{
+		StreamBody: func(*request.Request) bool { return true },
+		Handler:    readBodyLength(release),
+	})
+
+	tc.write(frameHeaders, flagEndHeaders, 1, tc.headers(":method", "POST", ":scheme", "http", ":path", "/", "content-length", "100000"))
+	tc.sendData(1, defaultWindowSize+1, false)
+	tc.expectGoAway(ErrCodeFlowControl)
+}
@@ -0,0 +1,215 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ClientPreface starts every HTTP/2 connection, RFC 9113 section 3.4.
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	frameHeaderLen      = 9
+	defaultMaxFrameSize = 1 << 14
+	maxFrameSizeLimit   = 1<<24 - 1
+	defaultWindowSize   = 65535
+	maxWindowSize       = 1<<31 - 1
+)
+
+type frameType uint8
+
+const (
+	frameData         frameType = 0x0
+	frameHeaders      frameType = 0x1
+	framePriority     frameType = 0x2
+	frameRSTStream    frameType = 0x3
+	frameSettings     frameType = 0x4
+	framePushPromise  frameType = 0x5
+	framePing         frameType = 0x6
+	frameGoAway       frameType = 0x7
+	frameWindowUpdate frameType = 0x8
+	frameContinuation frameType = 0x9
+)
+
+const (
+	flagEndStream  = 0x1
+	flagAck        = 0x1
+	flagEndHeaders = 0x4
+	flagPadded     = 0x8
+	flagPriority   = 0x20
+)
+
+type settingID uint16
+
+const (
+	settingHeaderTableSize      settingID = 0x1
+	settingEnablePush           settingID = 0x2
+	settingMaxConcurrentStreams settingID = 0x3
+	settingInitialWindowSize    settingID = 0x4
+	settingMaxFrameSize         settingID = 0x5
+	settingMaxHeaderListSize    settingID = 0x6
+)
+
+type setting struct {
+	id    settingID
+	value uint32
+}
+
+type ErrCode uint32
+
+const (
+	ErrCodeNo                 ErrCode = 0x0
+	ErrCodeProtocol           ErrCode = 0x1
+	ErrCodeInternal           ErrCode = 0x2
+	ErrCodeFlowControl        ErrCode = 0x3
+	ErrCodeSettingsTimeout    ErrCode = 0x4
+	ErrCodeStreamClosed       ErrCode = 0x5
+	ErrCodeFrameSize          ErrCode = 0x6
+	ErrCodeRefusedStream      ErrCode = 0x7
+	ErrCodeCancel             ErrCode = 0x8
+	ErrCodeCompression        ErrCode = 0x9
+	ErrCodeConnect            ErrCode = 0xa
+	ErrCodeEnhanceYourCalm    ErrCode = 0xb
+	ErrCodeInadequateSecurity ErrCode = 0xc
+	ErrCodeHTTP11Required     ErrCode = 0xd
+)
+
+func (e ErrCode) String() string {
+	switch e {
+	case ErrCodeNo:
+		return "NO_ERROR"
+	case ErrCodeProtocol:
+		return "PROTOCOL_ERROR"
+	case ErrCodeInternal:
+		return "INTERNAL_ERROR"
+	case ErrCodeFlowControl:
+		return "FLOW_CONTROL_ERROR"
+	case ErrCodeSettingsTimeout:
+		return "SETTINGS_TIMEOUT"
+	case ErrCodeStreamClosed:
+		return "STREAM_CLOSED"
+	case ErrCodeFrameSize:
+		return "FRAME_SIZE_ERROR"
+	case ErrCodeRefusedStream:
+		return "REFUSED_STREAM"
+	case ErrCodeCancel:
+		return "CANCEL"
+	case ErrCodeCompression:
+		return "COMPRESSION_ERROR"
+	case ErrCodeConnect:
+		return "CONNECT_ERROR"
+	case ErrCodeEnhanceYourCalm:
+		return "ENHANCE_YOUR_CALM"
+	case ErrCodeInadequateSecurity:
+		return "INADEQUATE_SECURITY"
+	case ErrCodeHTTP11Required:
+		return "HTTP_1_1_REQUIRED"
+	default:
+		return fmt.Sprintf("unknown error code 0x%x", uint32(e))
+	}
+}
+
+// ConnError ends the whole connection with a GOAWAY
+type ConnError struct {
+	Code   ErrCode
+	Reason string
+}
+
+func (e ConnError) Error() string {
+	return fmt.Sprintf("http2 connection error %s: %s", e.Code, e.Reason)
+}
+
+// StreamError resets a single stream with RST_STREAM
+type StreamError struct {
+	StreamID uint32
+	Code     ErrCode
+	Reason   string
+}
+
+func (e StreamError) Error() string {
+	return fmt.Sprintf("http2 stream %d error %s: %s", e.StreamID, e.Code, e.Reason)
+}
+
+type frame struct {
+	typ      frameType
+	flags    uint8
+	streamID uint32
+	payload  []byte
+}
+
+func (f frame) has(flag uint8) bool {
+	return f.flags&flag != 0
+}
+
+// readFrame reads the next frame, rejecting payloads over maxSize. The
+// payload is only valid until the next call.
+func readFrame(r io.Reader, buf []byte, maxSize uint32) (frame, []byte, error) {
+	var h [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return frame{}, buf, err
+	}
+	length := uint32(h[0])<<16 | uint32(h[1])<<8 | uint32(h[2])
+	f := frame{
+		typ:   frameType(h[3]),
+		flags: h[4],
+		// The reserved bit is ignored on receipt
+		streamID: binary.BigEndian.Uint32(h[5:]) & (1<<31 - 1),
+	}
+	if length > maxSize {
+		return f, buf, ConnError{ErrCodeFrameSize, fmt.Sprintf("frame of %d bytes is over the limit of %d", length, maxSize)}
+	}
+	if uint32(cap(buf)) < length {
+		buf = make([]byte, length)
+	}
+	f.payload = buf[:length]
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return f, buf, err
+	}
+	return f, buf, nil
+}
+
+func appendFrame(dst []byte, typ frameType, flags uint8, streamID uint32, payload []byte) []byte {
+	n := len(payload)
+	dst = append(dst, byte(n>>16), byte(n>>8), byte(n), byte(typ), flags)
+	dst = binary.BigEndian.AppendUint32(dst, streamID)
+	return append(dst, payload...)
+}
+
+// stripPadding removes the pad length byte and the padding of padded DATA
+// and HEADERS frames.
+func stripPadding(f frame) ([]byte, error) {
+	if !f.has(flagPadded) {
+		return f.payload, nil
+	}
+	if len(f.payload) == 0 {
+		return nil, ConnError{ErrCodeFrameSize, "padded frame without pad length"}
+	}
+	pad := int(f.payload[0])
+	if pad >= len(f.payload) {
+		return nil, ConnError{ErrCodeProtocol, "padding longer than the frame"}
+	}
+	return f.payload[1 : len(f.payload)-pad], nil
+}
+
+func parseSettings(payload []byte) ([]setting, error) {
+	if len(payload)%6 != 0 {
+		return nil, ConnError{ErrCodeFrameSize, "settings payload is not a multiple of 6 bytes"}
+	}
+	settings := make([]setting, 0, len(payload)/6)
+	for b := payload; len(b) > 0; b = b[6:] {
+		settings = append(settings, setting{
+			id:    settingID(binary.BigEndian.Uint16(b)),
+			value: binary.BigEndian.Uint32(b[2:]),
+		})
+	}
+	return settings, nil
+}
+
+func appendSettings(dst []byte, settings ...setting) []byte {
+	for _, s := range settings {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(s.id))
+		dst = binary.BigEndian.AppendUint32(dst, s.value)
+	}
+	return dst
+}
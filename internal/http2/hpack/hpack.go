@@ -0,0 +1,266 @@
+// Package hpack implements the HTTP/2 header compression of RFC 7541.
+package hpack
+
+import (
+	"fmt"
+)
+
+// DefaultTableSize is the initial SETTINGS_HEADER_TABLE_SIZE
+const DefaultTableSize = 4096
+
+var ErrorInvalidEncoding = fmt.Errorf("invalid hpack encoding")
+var ErrorInvalidIndex = fmt.Errorf("invalid hpack table index")
+var ErrorInvalidHuffman = fmt.Errorf("invalid hpack huffman string")
+var ErrorInvalidTableSize = fmt.Errorf("invalid hpack dynamic table size update")
+var ErrorStringTooLong = fmt.Errorf("hpack string longer than allowed")
+var ErrorHeaderListTooLarge = fmt.Errorf("hpack header list larger than allowed")
+
+type HeaderField struct {
+	Name  string
+	Value string
+	// Sensitive fields are never added to a table, by us or intermediaries
+	Sensitive bool
+}
+
+// appendInt encodes v with an n bit prefix, first holds the bits of the
+// first byte above the prefix. RFC 7541 section 5.1.
+func appendInt(dst []byte, first byte, n uint, v uint64) []byte {
+	limit := uint64(1)<<n - 1
+	if v < limit {
+		return append(dst, first|byte(v))
+	}
+	dst = append(dst, first|byte(limit))
+	v -= limit
+	for v >= 0x80 {
+		dst = append(dst, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
+
+// readInt decodes an integer with an n bit prefix, values past 32 bits are
+// rejected since nothing in HPACK needs them.
+func readInt(b []byte, n uint) (uint64, []byte, error) {
+	if len(b) == 0 {
+		return 0, b, ErrorInvalidEncoding
+	}
+	limit := uint64(1)<<n - 1
+	v := uint64(b[0]) & limit
+	b = b[1:]
+	if v < limit {
+		return v, b, nil
+	}
+	for shift := uint(0); ; shift += 7 {
+		if len(b) == 0 || shift > 28 {
+			return 0, b, ErrorInvalidEncoding
+		}
+		c := b[0]
+		b = b[1:]
+		v += uint64(c&0x7f) << shift
+		if c&0x80 == 0 {
+			break
+		}
+	}
+	if v > 1<<32-1 {
+		return 0, b, ErrorInvalidEncoding
+	}
+	return v, b, nil
+}
+
+func appendString(dst []byte, s string) []byte {
+	if n := huffmanEncodedLen(s); n < len(s) {
+		dst = appendInt(dst, 0x80, 7, uint64(n))
+		return appendHuffman(dst, s)
+	}
+	dst = appendInt(dst, 0, 7, uint64(len(s)))
+	return append(dst, s...)
+}
+
+type Decoder struct {
+	table dynamicTable
+	// allowedSize is the largest size update the peer may send, our
+	// SETTINGS_HEADER_TABLE_SIZE
+	allowedSize uint32
+	// MaxStringLength bounds every name and value, zero means no limit
+	MaxStringLength int
+	// MaxHeaderListSize bounds the decoded block as counted for
+	// SETTINGS_MAX_HEADER_LIST_SIZE, zero means no limit
+	MaxHeaderListSize int
+}
+
+func NewDecoder(maxTableSize uint32) *Decoder {
+	return &Decoder{
+		table:       dynamicTable{maxSize: maxTableSize},
+		allowedSize: maxTableSize,
+	}
+}
+
+func (d *Decoder) readString(b []byte) (string, []byte, error) {
+	if len(b) == 0 {
+		return "", b, ErrorInvalidEncoding
+	}
+	huffman := b[0]&0x80 != 0
+	n, b, err := readInt(b, 7)
+	if err != nil {
+		return "", b, err
+	}
+	if n > uint64(len(b)) {
+		return "", b, ErrorInvalidEncoding
+	}
+	raw, b := b[:n], b[n:]
+	if !huffman {
+		if d.MaxStringLength > 0 && len(raw) > d.MaxStringLength {
+			return "", b, ErrorStringTooLong
+		}
+		return string(raw), b, nil
+	}
+	// Huffman codes are at least 5 bits long
+	if d.MaxStringLength > 0 && len(raw)*8/5 > d.MaxStringLength {
+		return "", b, ErrorStringTooLong
+	}
+	s, err := decodeHuffman(make([]byte, 0, len(raw)*8/5), raw)
+	return string(s), b, err
+}
+
+// Decode returns the fields of a complete header block. Once it fails the
+// tables of both ends no longer agree and the connection must be closed.
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	fields := []HeaderField{}
+	listSize, counted := 0, 0
+	b := block
+	for len(b) > 0 {
+		var err error
+		switch c := b[0]; {
+		case c&0x80 != 0:
+			// Indexed header field, section 6.1
+			var i uint64
+			i, b, err = readInt(b, 7)
+			if err != nil {
+				return nil, err
+			}
+			f, ok := d.table.at(i)
+			if !ok {
+				return nil, ErrorInvalidIndex
+			}
+			fields = append(fields, f)
+		case c&0xe0 == 0x20:
+			// Dynamic table size update, section 6.3, only allowed before
+			// the first field of a block
+			if len(fields) > 0 {
+				return nil, ErrorInvalidTableSize
+			}
+			var size uint64
+			size, b, err = readInt(b, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > uint64(d.allowedSize) {
+				return nil, ErrorInvalidTableSize
+			}
+			d.table.setMaxSize(uint32(size))
+		default:
+			// Literal header field, section 6.2
+			prefix, indexing, sensitive := uint(4), false, c&0xf0 == 0x10
+			if c&0xc0 == 0x40 {
+				prefix, indexing = 6, true
+			}
+			var i uint64
+			i, b, err = readInt(b, prefix)
+			if err != nil {
+				return nil, err
+			}
+			var f HeaderField
+			if i == 0 {
+				f.Name, b, err = d.readString(b)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				named, ok := d.table.at(i)
+				if !ok {
+					return nil, ErrorInvalidIndex
+				}
+				f.Name = named.Name
+			}
+			f.Value, b, err = d.readString(b)
+			if err != nil {
+				return nil, err
+			}
+			f.Sensitive = sensitive
+			if indexing {
+				d.table.add(f)
+			}
+			fields = append(fields, f)
+		}
+
+		// Indexed fields are cheap to send but not to keep, so the limit
+		// is checked as the block is decoded. RFC 9113 section 6.5.2 counts
+		// name and value plus 32 per field.
+		if n := len(fields); d.MaxHeaderListSize > 0 && counted < n {
+			counted = n
+			listSize += len(fields[n-1].Name) + len(fields[n-1].Value) + 32
+			if listSize > d.MaxHeaderListSize {
+				return nil, ErrorHeaderListTooLarge
+			}
+		}
+	}
+	return fields, nil
+}
+
+type Encoder struct {
+	table dynamicTable
+	// Size updates to announce at the start of the next block, the
+	// smallest one and the current one, RFC 7541 section 4.2.
+	pendingUpdate bool
+	minSize       uint32
+}
+
+func NewEncoder() *Encoder {
+	return &Encoder{
+		table: dynamicTable{maxSize: DefaultTableSize},
+	}
+}
+
+// SetMaxTableSize applies the peer's SETTINGS_HEADER_TABLE_SIZE, the table
+// never grows past DefaultTableSize.
+func (e *Encoder) SetMaxTableSize(n uint32) {
+	n = min(n, DefaultTableSize)
+	if n == e.table.maxSize {
+		return
+	}
+	if !e.pendingUpdate || n < e.minSize {
+		e.minSize = min(n, e.table.maxSize)
+	}
+	e.pendingUpdate = true
+	e.table.setMaxSize(n)
+}
+
+// Encode appends the header block for fields to dst
+func (e *Encoder) Encode(dst []byte, fields []HeaderField) []byte {
+	if e.pendingUpdate {
+		if e.minSize < e.table.maxSize {
+			dst = appendInt(dst, 0x20, 5, uint64(e.minSize))
+		}
+		dst = appendInt(dst, 0x20, 5, uint64(e.table.maxSize))
+		e.pendingUpdate = false
+	}
+
+	for _, f := range fields {
+		index, nameOnly := e.table.search(f)
+		switch {
+		case index != 0 && !nameOnly && !f.Sensitive:
+			dst = appendInt(dst, 0x80, 7, uint64(index))
+			continue
+		case f.Sensitive:
+			dst = appendInt(dst, 0x10, 4, uint64(index))
+		default:
+			dst = appendInt(dst, 0x40, 6, uint64(index))
+			e.table.add(f)
+		}
+		if index == 0 {
+			dst = appendString(dst, f.Name)
+		}
+		dst = appendString(dst, f.Value)
+	}
+	return dst
+}
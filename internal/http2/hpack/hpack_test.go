@@ -0,0 +1,180 @@
+package hpack
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The request examples of RFC 7541 Appendix C.3 and C.4, each case runs on
+// the tables left by the previous one.
+var requestExamples = []struct {
+	name      string
+	plain     string
+	huffman   string
+	fields    []HeaderField
+	tableSize uint32
+}{
+	{
+		name:    "first request",
+		plain:   "828684410f7777772e6578616d706c652e636f6d",
+		huffman: "828684418cf1e3c2e5f23a6ba0ab90f4ff",
+		fields: []HeaderField{
+			{Name: ":method", Value: "GET"},
+			{Name: ":scheme", Value: "http"},
+			{Name: ":path", Value: "/"},
+			{Name: ":authority", Value: "www.example.com"},
+		},
+		tableSize: 57,
+	},
+	{
+		name:    "second request",
+		plain:   "828684be58086e6f2d6361636865",
+		huffman: "828684be5886a8eb10649cbf",
+		fields: []HeaderField{
+			{Name: ":method", Value: "GET"},
+			{Name: ":scheme", Value: "http"},
+			{Name: ":path", Value: "/"},
+			{Name: ":authority", Value: "www.example.com"},
+			{Name: "cache-control", Value: "no-cache"},
+		},
+		tableSize: 110,
+	},
+	{
+		name:    "third request",
+		plain:   "828785bf400a637573746f6d2d6b65790c637573746f6d2d76616c7565",
+		huffman: "828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf",
+		fields: []HeaderField{
+			{Name: ":method", Value: "GET"},
+			{Name: ":scheme", Value: "https"},
+			{Name: ":path", Value: "/index.html"},
+			{Name: ":authority", Value: "www.example.com"},
+			{Name: "custom-key", Value: "custom-value"},
+		},
+		tableSize: 164,
+	},
+}
+
+func TestDecodeExamples(t *testing.T) {
+	plain := NewDecoder(DefaultTableSize)
+	huffman := NewDecoder(DefaultTableSize)
+	for _, tt := range requestExamples {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, c := range []struct {
+				d       *Decoder
+				encoded string
+			}{{plain, tt.plain}, {huffman, tt.huffman}} {
+				block, err := hex.DecodeString(c.encoded)
+				require.NoError(t, err)
+				fields, err := c.d.Decode(block)
+				require.NoError(t, err)
+				assert.Equal(t, tt.fields, fields)
+				assert.Equal(t, tt.tableSize, c.d.table.size)
+			}
+		})
+	}
+}
+
+func TestEncodeExamples(t *testing.T) {
+	e := NewEncoder()
+	for _, tt := range requestExamples {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.huffman, hex.EncodeToString(e.Encode(nil, tt.fields)))
+			assert.Equal(t, tt.tableSize, e.table.size)
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	e := NewEncoder()
+	d := NewDecoder(DefaultTableSize)
+	blocks := [][]HeaderField{
+		{{Name: ":status", Value: "200"}, {Name: "content-type", Value: "text/html"}, {Name: "x-binary", Value: "\x00\xff\x7f"}},
+		{{Name: ":status", Value: "200"}, {Name: "content-type", Value: "text/html"}, {Name: "authorization", Value: "secret", Sensitive: true}},
+		{{Name: "x-large", Value: strings.Repeat("v", 5000)}, {Name: "content-type", Value: "text/plain"}},
+	}
+	for i, fields := range blocks {
+		if i == 2 {
+			e.SetMaxTableSize(100)
+			e.SetMaxTableSize(4096)
+		}
+		block := e.Encode(nil, fields)
+		got, err := d.Decode(block)
+		require.NoError(t, err)
+		assert.Equal(t, fields, got)
+		assert.Equal(t, e.table.entries, d.table.entries)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+		wantErr error
+	}{
+		{name: "index zero", encoded: "80", wantErr: ErrorInvalidIndex},
+		{name: "index past the tables", encoded: "be", wantErr: ErrorInvalidIndex},
+		{name: "literal name index past the tables", encoded: "7f0a0161", wantErr: ErrorInvalidIndex},
+		{name: "truncated integer", encoded: "ff", wantErr: ErrorInvalidEncoding},
+		{name: "integer overflow", encoded: "ffffffffffffff7f", wantErr: ErrorInvalidEncoding},
+		{name: "truncated string", encoded: "4005616263", wantErr: ErrorInvalidEncoding},
+		{name: "table size over the limit", encoded: "3fe21f", wantErr: ErrorInvalidTableSize},
+		{name: "table size after a field", encoded: "8220", wantErr: ErrorInvalidTableSize},
+		// 'a' is 00011, padded with zeros instead of ones
+		{name: "huffman padding not ones", encoded: "408118018161", wantErr: ErrorInvalidHuffman},
+		{name: "huffman padding too long", encoded: "40821fff018161", wantErr: ErrorInvalidHuffman},
+		{name: "huffman eos", encoded: "4084ffffffff018161", wantErr: ErrorInvalidHuffman},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			block, err := hex.DecodeString(tt.encoded)
+			require.NoError(t, err)
+			_, err = NewDecoder(DefaultTableSize).Decode(block)
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestDecodeStringLimit(t *testing.T) {
+	d := NewDecoder(DefaultTableSize)
+	d.MaxStringLength = 4
+	_, err := d.Decode(NewEncoder().Encode(nil, []HeaderField{{Name: "x-long", Value: "value"}}))
+	assert.ErrorIs(t, err, ErrorStringTooLong)
+}
+
+func TestDecodeHeaderListLimit(t *testing.T) {
+	// A field added to the dynamic table and then referenced by index is
+	// one byte per copy on the wire
+	block := append([]byte{0x40, 5}, "x-big"...)
+	block = append(append(block, 100), strings.Repeat("v", 100)...)
+	block = append(block, bytes.Repeat([]byte{0xbe}, 20)...)
+
+	tests := []struct {
+		name    string
+		limit   int
+		wantErr error
+	}{
+		{name: "no limit", limit: 0},
+		{name: "within limit", limit: 21 * 137},
+		{name: "over limit", limit: 20 * 137, wantErr: ErrorHeaderListTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDecoder(DefaultTableSize)
+			d.MaxHeaderListSize = tt.limit
+			fields, err := d.Decode(block)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, fields, 21)
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package hpack
+
+const eos = 256
+
+// huffmanNode is a node of the decoding tree, leaves have no children and
+// hold the symbol.
+type huffmanNode struct {
+	children [2]*huffmanNode
+	symbol   int
+}
+
+var huffmanRoot = func() *huffmanNode {
+	root := &huffmanNode{}
+	for symbol, c := range huffmanCodes {
+		n := root
+		for bit := int(c.bits) - 1; bit >= 0; bit-- {
+			b := (c.code >> bit) & 1
+			if n.children[b] == nil {
+				n.children[b] = &huffmanNode{}
+			}
+			n = n.children[b]
+		}
+		n.symbol = symbol
+	}
+	return root
+}()
+
+func huffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodes[s[i]].bits)
+	}
+	return (bits + 7) / 8
+}
+
+func appendHuffman(dst []byte, s string) []byte {
+	var acc uint64
+	n := 0
+	for i := 0; i < len(s); i++ {
+		c := huffmanCodes[s[i]]
+		acc = acc<<c.bits | uint64(c.code)
+		n += int(c.bits)
+		for n >= 8 {
+			n -= 8
+			dst = append(dst, byte(acc>>n))
+		}
+	}
+	if n > 0 {
+		// Padding is the most significant bits of EOS, all ones
+		dst = append(dst, byte(acc<<(8-n))|byte(0xff>>n))
+	}
+	return dst
+}
+
+// decodeHuffman rejects EOS in the data and padding that is longer than 7
+// bits or not all ones, RFC 7541 section 5.2.
+func decodeHuffman(dst []byte, b []byte) ([]byte, error) {
+	n := huffmanRoot
+	// Bits read since the last symbol and whether they were all ones
+	pending, ones := 0, true
+	for _, c := range b {
+		for bit := 7; bit >= 0; bit-- {
+			v := (c >> bit) & 1
+			n = n.children[v]
+			if n == nil {
+				return dst, ErrorInvalidHuffman
+			}
+			pending++
+			ones = ones && v == 1
+			if n.children[0] != nil || n.children[1] != nil {
+				continue
+			}
+			if n.symbol == eos {
+				return dst, ErrorInvalidHuffman
+			}
+			dst = append(dst, byte(n.symbol))
+			n, pending, ones = huffmanRoot, 0, true
+		}
+	}
+	if pending > 7 || !ones {
+		return dst, ErrorInvalidHuffman
+	}
+	return dst, nil
+}
@@ -0,0 +1,162 @@
+package hpack
+
+// staticTable is RFC 7541 Appendix A, index 1 is the first entry
+var staticTable = []HeaderField{
+	{Name: ":authority"},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-charset"},
+	{Name: "accept-encoding", Value: "gzip, deflate"},
+	{Name: "accept-language"},
+	{Name: "accept-ranges"},
+	{Name: "accept"},
+	{Name: "access-control-allow-origin"},
+	{Name: "age"},
+	{Name: "allow"},
+	{Name: "authorization"},
+	{Name: "cache-control"},
+	{Name: "content-disposition"},
+	{Name: "content-encoding"},
+	{Name: "content-language"},
+	{Name: "content-length"},
+	{Name: "content-location"},
+	{Name: "content-range"},
+	{Name: "content-type"},
+	{Name: "cookie"},
+	{Name: "date"},
+	{Name: "etag"},
+	{Name: "expect"},
+	{Name: "expires"},
+	{Name: "from"},
+	{Name: "host"},
+	{Name: "if-match"},
+	{Name: "if-modified-since"},
+	{Name: "if-none-match"},
+	{Name: "if-range"},
+	{Name: "if-unmodified-since"},
+	{Name: "last-modified"},
+	{Name: "link"},
+	{Name: "location"},
+	{Name: "max-forwards"},
+	{Name: "proxy-authenticate"},
+	{Name: "proxy-authorization"},
+	{Name: "range"},
+	{Name: "referer"},
+	{Name: "refresh"},
+	{Name: "retry-after"},
+	{Name: "server"},
+	{Name: "set-cookie"},
+	{Name: "strict-transport-security"},
+	{Name: "transfer-encoding"},
+	{Name: "user-agent"},
+	{Name: "vary"},
+	{Name: "via"},
+	{Name: "www-authenticate"},
+}
+
+// staticByName and staticByField map to the lowest matching index
+var staticByName, staticByField = func() (map[string]int, map[HeaderField]int) {
+	byName := map[string]int{}
+	byField := map[HeaderField]int{}
+	for i, f := range staticTable {
+		if _, ok := byName[f.Name]; !ok {
+			byName[f.Name] = i + 1
+		}
+		byField[f] = i + 1
+	}
+	return byName, byField
+}()
+
+// entryOverhead is added to the length of name and value to get the size of
+// an entry, RFC 7541 section 4.1.
+const entryOverhead = 32
+
+func entrySize(f HeaderField) uint32 {
+	return uint32(len(f.Name) + len(f.Value) + entryOverhead)
+}
+
+// dynamicTable keeps the newest entry last, HPACK numbers it first.
+type dynamicTable struct {
+	entries []HeaderField
+	size    uint32
+	maxSize uint32
+}
+
+func (t *dynamicTable) evict(room uint32) {
+	n := 0
+	for n < len(t.entries) && t.size+room > t.maxSize {
+		t.size -= entrySize(t.entries[n])
+		n++
+	}
+	t.entries = append(t.entries[:0], t.entries[n:]...)
+}
+
+// add evicts old entries to make room, an entry larger than the table
+// empties it and is not added.
+func (t *dynamicTable) add(f HeaderField) {
+	size := entrySize(f)
+	if size > t.maxSize {
+		t.entries = t.entries[:0]
+		t.size = 0
+		return
+	}
+	t.evict(size)
+	f.Sensitive = false
+	t.entries = append(t.entries, f)
+	t.size += size
+}
+
+func (t *dynamicTable) setMaxSize(n uint32) {
+	t.maxSize = n
+	t.evict(0)
+}
+
+// at returns the entry at HPACK index i, counting the static table.
+func (t *dynamicTable) at(i uint64) (HeaderField, bool) {
+	if i == 0 {
+		return HeaderField{}, false
+	}
+	if i <= uint64(len(staticTable)) {
+		return staticTable[i-1], true
+	}
+	i -= uint64(len(staticTable))
+	if i > uint64(len(t.entries)) {
+		return HeaderField{}, false
+	}
+	return t.entries[len(t.entries)-int(i)], true
+}
+
+// search returns the index of an entry matching f, or of one with the same
+// name when there is none, preferring the static table.
+func (t *dynamicTable) search(f HeaderField) (index int, nameOnly bool) {
+	key := HeaderField{Name: f.Name, Value: f.Value}
+	if i, ok := staticByField[key]; ok {
+		return i, false
+	}
+	nameIndex := staticByName[f.Name]
+	for i := len(t.entries) - 1; i >= 0; i-- {
+		e := t.entries[i]
+		if e.Name != f.Name {
+			continue
+		}
+		index := len(staticTable) + len(t.entries) - i
+		if e.Value == f.Value {
+			return index, false
+		}
+		if nameIndex == 0 {
+			nameIndex = index
+		}
+	}
+	return nameIndex, nameIndex != 0
+}
@@ -0,0 +1,154 @@
+package http2
+
+import (
+	"fmt"
+	"http-from-tcp/internal/headers"
+	"http-from-tcp/internal/http2/hpack"
+	"http-from-tcp/internal/request"
+	"strconv"
+	"strings"
+)
+
+// connectionHeaders are meaningless in HTTP/2 and make a message malformed,
+// RFC 9113 section 8.2.2.
+var connectionHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+// newRequest validates the decoded header block of a request and turns it
+// into the request handlers know from HTTP/1.1.
+func newRequest(streamID uint32, fields []hpack.HeaderField) (*request.Request, error) {
+	malformed := func(format string, args ...any) error {
+		return StreamError{streamID, ErrCodeProtocol, fmt.Sprintf(format, args...)}
+	}
+
+	req := request.NewRequest()
+	pseudo := map[string]string{}
+	cookies := []string{}
+	// Repeated fields are joined once at the end instead of one Set each
+	values := map[string][]string{}
+	regular := false
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") {
+			switch f.Name {
+			case ":method", ":scheme", ":authority", ":path":
+			default:
+				return nil, malformed("unknown pseudo header %s", f.Name)
+			}
+			if regular {
+				return nil, malformed("pseudo header %s after regular headers", f.Name)
+			}
+			if _, ok := pseudo[f.Name]; ok {
+				return nil, malformed("duplicate pseudo header %s", f.Name)
+			}
+			pseudo[f.Name] = f.Value
+			continue
+		}
+		regular = true
+		if !validHeaderName(f.Name) {
+			return nil, malformed("invalid header name %q", f.Name)
+		}
+		if connectionHeaders[f.Name] || (f.Name == "te" && f.Value != "trailers") {
+			return nil, malformed("connection specific header %s", f.Name)
+		}
+		if strings.ContainsAny(f.Value, "\r\n\x00") {
+			return nil, malformed("invalid value for header %s", f.Name)
+		}
+		if f.Name == "cookie" {
+			cookies = append(cookies, f.Value)
+			continue
+		}
+		values[f.Name] = append(values[f.Name], f.Value)
+	}
+	for name, vs := range values {
+		req.Headers.SetValues(name, vs)
+	}
+	if len(cookies) > 0 {
+		req.Headers.Set("cookie", strings.Join(cookies, "; "))
+	}
+
+	method, authority := pseudo[":method"], pseudo[":authority"]
+	line := request.RequestLine{HttpVersion: "2.0", Method: method}
+	switch {
+	case method == "":
+		return nil, malformed("missing :method")
+	case method == "CONNECT":
+		if authority == "" || pseudo[":scheme"] != "" || pseudo[":path"] != "" {
+			return nil, malformed("CONNECT needs :authority and no :scheme or :path")
+		}
+		line.RequestTarget, line.Form = authority, request.AuthorityForm
+	default:
+		path := pseudo[":path"]
+		if pseudo[":scheme"] == "" || path == "" {
+			return nil, malformed("missing :scheme or :path")
+		}
+		switch {
+		case path == "*" && method == "OPTIONS":
+			line.Form = request.AsteriskForm
+		case strings.HasPrefix(path, "/"):
+			line.Form = request.OriginForm
+		default:
+			return nil, malformed("invalid :path %q", path)
+		}
+		line.RequestTarget = path
+	}
+	if authority != "" && req.Headers.Get("host") == "" {
+		req.Headers.Set("host", authority)
+	}
+	req.RequestLine = line
+	return req, nil
+}
+
+// validHeaderName accepts lowercase tokens, RFC 9110 section 5.6.2
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= ' ' || c >= 0x7f || ('A' <= c && c <= 'Z') || strings.IndexByte("\"(),/:;<=>?@[\\]{}", c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// validContentLength reports whether the body matches the content-length
+// the client announced, if any.
+func validContentLength(req *request.Request, bodyLen int) bool {
+	value := req.Headers.Get("content-length")
+	if value == "" {
+		return true
+	}
+	n, err := strconv.Atoi(value)
+	return err == nil && n == bodyLen
+}
+
+func addTrailers(req *request.Request, fields []hpack.HeaderField) error {
+	for _, f := range fields {
+		if !validHeaderName(f.Name) || connectionHeaders[f.Name] {
+			return fmt.Errorf("invalid trailer %s", f.Name)
+		}
+		req.Headers.Set(f.Name, f.Value)
+	}
+	return nil
+}
+
+// upgradeRequest prepares the HTTP/1.1 request of an h2c upgrade to be
+// answered on stream 1.
+func upgradeRequest(req *request.Request) *request.Request {
+	h := headers.NewHeaders()
+	for name, value := range req.Headers {
+		if connectionHeaders[name] || name == "http2-settings" {
+			continue
+		}
+		h.Set(name, value)
+	}
+	upgraded := *req
+	upgraded.Headers = h
+	return &upgraded
+}
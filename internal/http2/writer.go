@@ -0,0 +1,193 @@
+package http2
+
+import (
+	"bytes"
+	"fmt"
+	"http-from-tcp/internal/http2/hpack"
+	"strconv"
+	"strings"
+)
+
+const maxResponseHeadBytes = 1 << 20
+
+type chunkState int
+
+const (
+	chunkSize chunkState = iota
+	chunkData
+	chunkDataEnd
+	chunkTrailers
+	chunkDone
+)
+
+// responseWriter turns the HTTP/1.1 response a handler writes into HEADERS
+// and DATA frames, so handlers written against response.Writer work
+// unchanged. Chunked bodies are decoded and their trailers sent as a
+// trailing HEADERS frame.
+type responseWriter struct {
+	c  *Conn
+	st *stream
+
+	head       []byte
+	headerDone bool
+	chunked    bool
+
+	state     chunkState
+	line      []byte
+	remaining int64
+	trailers  []hpack.HeaderField
+
+	ended bool
+}
+
+var errorResponseWritten = fmt.Errorf("http2 response already ended")
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.ended {
+		return 0, errorResponseWritten
+	}
+	n := len(p)
+	if !w.headerDone {
+		w.head = append(w.head, p...)
+		i := bytes.Index(w.head, []byte("\r\n\r\n"))
+		if i < 0 {
+			if len(w.head) > maxResponseHeadBytes {
+				return 0, fmt.Errorf("response head larger than %d bytes", maxResponseHeadBytes)
+			}
+			return n, nil
+		}
+		p = bytes.Clone(w.head[i+4:])
+		if err := w.writeHead(w.head[:i]); err != nil {
+			return 0, err
+		}
+		w.head = nil
+	}
+	if len(p) == 0 {
+		return n, nil
+	}
+	if !w.chunked {
+		return n, w.c.writeData(w.st, p, false)
+	}
+	return n, w.writeChunked(p)
+}
+
+func (w *responseWriter) writeHead(head []byte) error {
+	lines := strings.Split(string(head), "\r\n")
+	parts := strings.SplitN(lines[0], " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "HTTP/") {
+		return fmt.Errorf("malformed status line %q", lines[0])
+	}
+	status, err := strconv.Atoi(parts[1])
+	if err != nil || status < 100 || status > 999 {
+		return fmt.Errorf("malformed status line %q", lines[0])
+	}
+
+	fields := []hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(status)}}
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return fmt.Errorf("malformed header line %q", line)
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+		if name == "transfer-encoding" && strings.Contains(strings.ToLower(value), "chunked") {
+			w.chunked = true
+		}
+		if connectionHeaders[name] {
+			continue
+		}
+		fields = append(fields, hpack.HeaderField{Name: name, Value: value})
+	}
+	w.headerDone = true
+	return w.c.writeHeaders(w.st, fields, false)
+}
+
+// writeChunked decodes the chunked encoding, RFC 9112 section 7.1
+func (w *responseWriter) writeChunked(p []byte) error {
+	for len(p) > 0 {
+		switch w.state {
+		case chunkSize, chunkDataEnd, chunkTrailers:
+			i := bytes.IndexByte(p, '\n')
+			if i < 0 {
+				w.line = append(w.line, p...)
+				return nil
+			}
+			w.line = append(w.line, p[:i+1]...)
+			p = p[i+1:]
+			line := strings.TrimRight(string(w.line), "\r\n")
+			w.line = w.line[:0]
+			if err := w.chunkLine(line); err != nil {
+				return err
+			}
+		case chunkData:
+			n := min(int64(len(p)), w.remaining)
+			if err := w.c.writeData(w.st, p[:n], false); err != nil {
+				return err
+			}
+			p = p[n:]
+			w.remaining -= n
+			if w.remaining == 0 {
+				w.state = chunkDataEnd
+			}
+		case chunkDone:
+			return errorResponseWritten
+		}
+	}
+	return nil
+}
+
+func (w *responseWriter) chunkLine(line string) error {
+	switch w.state {
+	case chunkSize:
+		size, _, _ := strings.Cut(line, ";")
+		n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("malformed chunk size %q", line)
+		}
+		w.remaining = n
+		w.state = chunkData
+		if n == 0 {
+			w.state = chunkTrailers
+		}
+	case chunkDataEnd:
+		if line != "" {
+			return fmt.Errorf("chunk data longer than its size")
+		}
+		w.state = chunkSize
+	case chunkTrailers:
+		if line == "" {
+			w.state = chunkDone
+			return w.end()
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return fmt.Errorf("malformed trailer %q", line)
+		}
+		w.trailers = append(w.trailers, hpack.HeaderField{
+			Name:  strings.ToLower(strings.TrimSpace(name)),
+			Value: strings.TrimSpace(value),
+		})
+	}
+	return nil
+}
+
+// end closes our side of the stream, with the trailers when there are any
+func (w *responseWriter) end() error {
+	w.ended = true
+	if len(w.trailers) > 0 {
+		return w.c.writeHeaders(w.st, w.trailers, true)
+	}
+	return w.c.writeData(w.st, nil, true)
+}
+
+// finish runs after the handler returned, a handler that wrote nothing gets
+// its stream reset like an HTTP/1.1 connection would be closed.
+func (w *responseWriter) finish() {
+	switch {
+	case w.ended:
+	case !w.headerDone:
+		w.c.resetStream(w.st.id, ErrCodeInternal)
+	default:
+		w.end()
+	}
+}
@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/server"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultReplicas = 100
+
+// Balancer picks one of upstreams for req. weights holds the current weight
+// of each upstream and is zero for upstreams that must not be picked, at
+// least one weight is positive.
+type Balancer interface {
+	Pick(req *request.Request, upstreams []*Upstream, weights []float64) *Upstream
+}
+
+// RoundRobin is a smooth weighted round-robin, upstreams ramping up after
+// slow start are picked proportionally less often.
+type RoundRobin struct {
+	mu      sync.Mutex
+	current map[*Upstream]float64
+}
+
+func (b *RoundRobin) Pick(req *request.Request, upstreams []*Upstream, weights []float64) *Upstream {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.current == nil {
+		b.current = map[*Upstream]float64{}
+	}
+
+	var best *Upstream
+	total := 0.0
+	for i, u := range upstreams {
+		if weights[i] <= 0 {
+			continue
+		}
+		b.current[u] += weights[i]
+		total += weights[i]
+		if best == nil || b.current[u] > b.current[best] {
+			best = u
+		}
+	}
+	b.current[best] -= total
+	return best
+}
+
+// LeastConn picks the upstream with the fewest in-flight requests relative
+// to its weight, rotating between ties.
+type LeastConn struct {
+	next atomic.Uint64
+}
+
+func (b *LeastConn) Pick(req *request.Request, upstreams []*Upstream, weights []float64) *Upstream {
+	start := int(b.next.Add(1) % uint64(len(upstreams)))
+
+	var best *Upstream
+	bestScore := 0.0
+	for n := range upstreams {
+		i := (start + n) % len(upstreams)
+		if weights[i] <= 0 {
+			continue
+		}
+		score := float64(upstreams[i].Active()+1) / weights[i]
+		if best == nil || score < bestScore {
+			best, bestScore = upstreams[i], score
+		}
+	}
+	return best
+}
+
+type ringEntry struct {
+	hash  uint64
+	index int
+}
+
+// ConsistentHash maps each key to the same upstream for as long as it is
+// available, only keys of an unavailable upstream move elsewhere.
+type ConsistentHash struct {
+	// Key defaults to server.KeyByRemoteIP, server.KeyByHeader hashes by a
+	// header instead.
+	Key server.KeyFunc
+	// Replicas is the number of points per upstream on the ring
+	Replicas int
+
+	mu        sync.Mutex
+	ring      []ringEntry
+	upstreams []*Upstream
+}
+
+func NewConsistentHash(key server.KeyFunc) *ConsistentHash {
+	return &ConsistentHash{Key: key}
+}
+
+// hashKey is FNV-1a followed by the splitmix64 finalizer, FNV alone leaves
+// short keys that differ in the last byte close together on the ring.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (b *ConsistentHash) buildRing(upstreams []*Upstream) []ringEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if slices.Equal(b.upstreams, upstreams) {
+		return b.ring
+	}
+
+	replicas := b.Replicas
+	if replicas <= 0 {
+		replicas = defaultReplicas
+	}
+	ring := make([]ringEntry, 0, len(upstreams)*replicas)
+	// Keyed on the whole URL, upstreams may share a host and differ in path
+	for i, u := range upstreams {
+		for r := range replicas {
+			ring = append(ring, ringEntry{hash: hashKey(u.URL.String() + "#" + strconv.Itoa(r)), index: i})
+		}
+	}
+	slices.SortFunc(ring, func(a, b ringEntry) int {
+		switch {
+		case a.hash < b.hash:
+			return -1
+		case a.hash > b.hash:
+			return 1
+		}
+		return 0
+	})
+
+	b.ring = ring
+	b.upstreams = slices.Clone(upstreams)
+	return ring
+}
+
+func (b *ConsistentHash) Pick(req *request.Request, upstreams []*Upstream, weights []float64) *Upstream {
+	key := b.Key
+	if key == nil {
+		key = server.KeyByRemoteIP
+	}
+	ring := b.buildRing(upstreams)
+	h := hashKey(key(req))
+
+	start, _ := slices.BinarySearchFunc(ring, h, func(e ringEntry, h uint64) int {
+		switch {
+		case e.hash < h:
+			return -1
+		case e.hash > h:
+			return 1
+		}
+		return 0
+	})
+	for n := range ring {
+		e := ring[(start+n)%len(ring)]
+		if weights[e.index] > 0 {
+			return upstreams[e.index]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFailureThreshold = 5
+	defaultOpenTimeout      = 30 * time.Second
+	defaultHalfOpenRequests = 1
+)
+
+var ErrorCircuitOpen = fmt.Errorf("circuit open")
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitOpenError is returned instead of calling an upstream whose breaker
+// is open.
+type CircuitOpenError struct {
+	Upstream   string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit open for %s", e.Upstream)
+}
+
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrorCircuitOpen
+}
+
+type BreakerConfig struct {
+	// FailureThreshold consecutive failures open the breaker
+	FailureThreshold int
+	// OpenTimeout is how long the breaker rejects calls before it lets
+	// HalfOpenRequests probes through, the breaker closes once they all
+	// succeed and opens again on the first failure.
+	OpenTimeout      time.Duration
+	HalfOpenRequests int
+	Logger           *slog.Logger
+	Metrics          *Metrics
+}
+
+type Breaker struct {
+	name string
+	cfg  BreakerConfig
+	now  func() time.Time
+
+	mu    sync.Mutex
+	state BreakerState
+	// generation counts state changes, outcomes of calls allowed under an
+	// earlier one say nothing about the current state
+	generation uint64
+	failures   int
+	openedAt   time.Time
+	probes     int
+	successes  int
+}
+
+func NewBreaker(name string, cfg BreakerConfig) *Breaker {
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = defaultFailureThreshold
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = defaultOpenTimeout
+	}
+	if cfg.HalfOpenRequests <= 0 {
+		cfg.HalfOpenRequests = defaultHalfOpenRequests
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	b := &Breaker{
+		name: name,
+		cfg:  cfg,
+		now:  time.Now,
+	}
+	cfg.Metrics.breakerState(name, BreakerClosed)
+	return b
+}
+
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// ready reports whether Allow would let a call through without reserving a
+// probe.
+func (b *Breaker) ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		return b.now().Sub(b.openedAt) >= b.cfg.OpenTimeout
+	case BreakerHalfOpen:
+		return b.probes < b.cfg.HalfOpenRequests
+	}
+	return true
+}
+
+// Allow must be followed by Record with the returned generation when it
+// returns nil
+func (b *Breaker) Allow() (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen {
+		wait := b.cfg.OpenTimeout - b.now().Sub(b.openedAt)
+		if wait > 0 {
+			return 0, &CircuitOpenError{Upstream: b.name, RetryAfter: wait}
+		}
+		b.setState(BreakerHalfOpen)
+	}
+	if b.state == BreakerHalfOpen {
+		if b.probes >= b.cfg.HalfOpenRequests {
+			return 0, &CircuitOpenError{Upstream: b.name, RetryAfter: time.Second}
+		}
+		b.probes++
+	}
+	return b.generation, nil
+}
+
+// Record counts the outcome of a call Allow let through. Calls allowed
+// before the breaker last changed state are ignored, so a slow request that
+// started before it opened cannot pass for a half-open probe.
+func (b *Breaker) Record(generation uint64, success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+	switch b.state {
+	case BreakerClosed:
+		if success {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.cfg.FailureThreshold {
+			b.setState(BreakerOpen)
+		}
+	case BreakerHalfOpen:
+		b.probes--
+		if !success {
+			b.setState(BreakerOpen)
+			return
+		}
+		b.successes++
+		if b.successes >= b.cfg.HalfOpenRequests {
+			b.setState(BreakerClosed)
+		}
+	}
+}
+
+func (b *Breaker) setState(state BreakerState) {
+	from := b.state
+	b.state = state
+	b.generation++
+	b.failures = 0
+	b.probes = 0
+	b.successes = 0
+	if state == BreakerOpen {
+		b.openedAt = b.now()
+	}
+
+	b.cfg.Logger.Warn("circuit breaker state changed", "upstream", b.name, "from", from.String(), "to", state.String())
+	b.cfg.Metrics.breakerState(b.name, state)
+	b.cfg.Metrics.breakerTransition(b.name, state)
+}
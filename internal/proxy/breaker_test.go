@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"http-from-tcp/internal/server"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	metrics := NewMetrics(server.NewRegistry())
+	b := NewBreaker("a", BreakerConfig{
+		FailureThreshold: 3,
+		OpenTimeout:      10 * time.Second,
+		HalfOpenRequests: 2,
+		Metrics:          metrics,
+	})
+	b.now = func() time.Time { return now }
+
+	allow := func() uint64 {
+		t.Helper()
+		generation, err := b.Allow()
+		require.NoError(t, err)
+		return generation
+	}
+	fail := func(n int) {
+		for range n {
+			b.Record(allow(), false)
+		}
+	}
+
+	fail(2)
+	b.Record(allow(), true)
+	fail(2)
+	assert.Equal(t, BreakerClosed, b.State())
+	fail(1)
+	assert.Equal(t, BreakerOpen, b.State())
+	assert.Equal(t, 1.0, metrics.BreakerState.Value("a"))
+
+	_, err := b.Allow()
+	assert.ErrorIs(t, err, ErrorCircuitOpen)
+	assert.Equal(t, 10*time.Second, err.(*CircuitOpenError).RetryAfter)
+
+	// Half-open lets two probes through and fails back to open
+	now = now.Add(10 * time.Second)
+	first, second := allow(), allow()
+	_, err = b.Allow()
+	assert.ErrorIs(t, err, ErrorCircuitOpen)
+	assert.Equal(t, BreakerHalfOpen, b.State())
+	b.Record(first, true)
+	b.Record(second, false)
+	assert.Equal(t, BreakerOpen, b.State())
+
+	now = now.Add(10 * time.Second)
+	b.Record(allow(), true)
+	b.Record(allow(), true)
+	assert.Equal(t, BreakerClosed, b.State())
+
+	assert.Equal(t, 0.0, metrics.BreakerState.Value("a"))
+	assert.Equal(t, 2.0, metrics.BreakerTransitions.Value("a", "open"))
+	assert.Equal(t, 2.0, metrics.BreakerTransitions.Value("a", "half-open"))
+	assert.Equal(t, 1.0, metrics.BreakerTransitions.Value("a", "closed"))
+}
+
+// A call that started before the breaker opened must not count as a probe
+// when it finishes during half-open.
+func TestBreakerIgnoresEarlierGenerations(t *testing.T) {
+	now := time.Now()
+	b := NewBreaker("a", BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Second})
+	b.now = func() time.Time { return now }
+
+	slow, err := b.Allow()
+	require.NoError(t, err)
+	failing, err := b.Allow()
+	require.NoError(t, err)
+	b.Record(failing, false)
+	assert.Equal(t, BreakerOpen, b.State())
+
+	now = now.Add(time.Second)
+	probe, err := b.Allow()
+	require.NoError(t, err)
+	assert.Equal(t, BreakerHalfOpen, b.State())
+
+	b.Record(slow, true)
+	assert.Equal(t, BreakerHalfOpen, b.State(), "slow call was not a probe")
+	_, err = b.Allow()
+	assert.ErrorIs(t, err, ErrorCircuitOpen, "the probe is still in flight")
+
+	b.Record(probe, true)
+	assert.Equal(t, BreakerClosed, b.State())
+}
+
+func TestRetryPolicy(t *testing.T) {
+	tests := []struct {
+		method string
+		want   int
+	}{
+		{method: "GET", want: 3},
+		{method: "PUT", want: 3},
+		{method: "DELETE", want: 3},
+		{method: "POST", want: 1},
+		{method: "PATCH", want: 1},
+	}
+
+	policy := RetryPolicy{Attempts: 3, BaseDelay: 10 * time.Millisecond, MaxDelay: 30 * time.Millisecond}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			assert.Equal(t, tt.want, policy.tries(tt.method))
+		})
+	}
+	assert.Equal(t, 1, RetryPolicy{}.tries("GET"))
+
+	for retry := 1; retry < 10; retry++ {
+		d := policy.backoff(retry)
+		assert.Positive(t, d)
+		assert.LessOrEqual(t, d, min(30*time.Millisecond, 10*time.Millisecond<<(retry-1)))
+	}
+}
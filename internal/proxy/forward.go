@@ -0,0 +1,347 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"http-from-tcp/internal/headers"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultRealm = "proxy"
+
+var ErrorDestinationNotAllowed = fmt.Errorf("destination not allowed")
+
+// Allowlist holds the destinations a forward proxy may reach. Entries are a
+// host name, "*.example.com" for any subdomain, an IP or CIDR prefix, each
+// optionally followed by ":port". An empty list allows everything, though
+// ForwardProxy still refuses internal addresses.
+type Allowlist []string
+
+// internalRanges are reachable from the proxy but not meant for its
+// clients, on top of what netip classifies as loopback, private or link-local.
+var internalRanges = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("64:ff9b::/96"),  // NAT64, can embed any IPv4 address
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	// Cloud metadata endpoints, already covered by the link-local and
+	// private ranges but named since they are what an attacker goes for
+	netip.MustParsePrefix("169.254.169.254/32"),
+	netip.MustParsePrefix("fd00:ec2::254/128"),
+}
+
+// internalAddr covers the addresses a proxy reachable from outside must not
+// open up: loopback, private, link-local, shared and metadata ones.
+func internalAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() || addr.IsUnspecified() {
+		return true
+	}
+	for _, prefix := range internalRanges {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitEntry separates the optional port from an allowlist entry
+func splitEntry(entry string) (pattern, port string) {
+	if h, p, err := net.SplitHostPort(entry); err == nil {
+		return strings.ToLower(h), p
+	}
+	return strings.ToLower(entry), ""
+}
+
+// entryPrefix returns the addresses an IP or CIDR pattern covers
+func entryPrefix(pattern string) (netip.Prefix, bool) {
+	if prefix, err := netip.ParsePrefix(pattern); err == nil {
+		return prefix, true
+	}
+	if addr, err := netip.ParseAddr(pattern); err == nil {
+		addr = addr.Unmap().WithZone("")
+		return netip.PrefixFrom(addr, addr.BitLen()), true
+	}
+	return netip.Prefix{}, false
+}
+
+func (a Allowlist) Allowed(host, port string) bool {
+	if len(a) == 0 {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	addr, addrErr := netip.ParseAddr(host)
+	for _, entry := range a {
+		pattern, patternPort := splitEntry(entry)
+		if patternPort != "" && patternPort != port {
+			continue
+		}
+
+		if prefix, ok := entryPrefix(pattern); ok {
+			if addrErr == nil && prefix.Contains(addr.Unmap()) {
+				return true
+			}
+			continue
+		}
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+			continue
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// containsAddr reports whether an IP or CIDR entry covers addr. Host name
+// entries do not count, the name may resolve anywhere.
+func (a Allowlist) containsAddr(addr netip.Addr, port string) bool {
+	for _, entry := range a {
+		pattern, patternPort := splitEntry(entry)
+		if patternPort != "" && patternPort != port {
+			continue
+		}
+		if prefix, ok := entryPrefix(pattern); ok && prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// BasicAuth checks Proxy-Authorization credentials against a fixed set of
+// users and passwords.
+func BasicAuth(users map[string]string) func(user, password string) bool {
+	return func(user, password string) bool {
+		want, ok := users[user]
+		return ok && subtle.ConstantTimeCompare([]byte(want), []byte(password)) == 1
+	}
+}
+
+// ForwardProxy serves clients configured to use it as their proxy. Plain
+// HTTP requests arrive in absolute form and are forwarded, CONNECT opens a
+// tunnel to the requested host and port. Destinations resolving to internal
+// addresses are refused unless an IP or CIDR entry in Allow covers them.
+type ForwardProxy struct {
+	Allow Allowlist
+	// Authenticate checks the Proxy-Authorization Basic credentials, nil
+	// lets everyone through.
+	Authenticate func(user, password string) bool
+	Realm        string
+	// Client has to dial through DialContext for internal addresses to be
+	// refused.
+	Client      *http.Client
+	DialTimeout time.Duration
+	Logger      *slog.Logger
+}
+
+func NewForwardProxy() *ForwardProxy {
+	p := &ForwardProxy{
+		DialTimeout: defaultDialTimeout,
+		Logger:      slog.Default(),
+	}
+	p.Client = NewClient()
+	p.Client.Transport.(*http.Transport).DialContext = p.DialContext
+	return p
+}
+
+// DialContext connects to addr, failing with ErrorDestinationNotAllowed when
+// it resolves to an internal address that no IP or CIDR entry in Allow
+// covers.
+func (p *ForwardProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout: p.DialTimeout,
+		// Checked on the address actually dialed, after name resolution
+		Control: func(network, address string, c syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if internalAddr(ap.Addr()) && !p.Allow.containsAddr(ap.Addr(), strconv.Itoa(int(ap.Port()))) {
+				return ErrorDestinationNotAllowed
+			}
+			return nil
+		},
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+func (p *ForwardProxy) logger() *slog.Logger {
+	if p.Logger == nil {
+		return slog.Default()
+	}
+	return p.Logger
+}
+
+func (p *ForwardProxy) authorized(req *request.Request) bool {
+	if p.Authenticate == nil {
+		return true
+	}
+	scheme, credentials, ok := strings.Cut(req.Headers.Get("Proxy-Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return false
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	return ok && p.Authenticate(user, password)
+}
+
+func (p *ForwardProxy) writeAuthRequired(w response.Writer) {
+	realm := p.Realm
+	if realm == "" {
+		realm = defaultRealm
+	}
+	message := "proxy authentication required"
+	h := response.GetDefaultHeaders(len(message))
+	h.Override("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+	w.WriteStatusLine(response.StatusProxyAuthRequired)
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(message))
+}
+
+func (p *ForwardProxy) Handle(w response.Writer, req *request.Request) {
+	if !p.authorized(req) {
+		p.writeAuthRequired(w)
+		return
+	}
+	switch req.RequestLine.Form {
+	case request.AuthorityForm:
+		p.tunnel(w, req)
+	case request.AbsoluteForm:
+		p.forward(w, req)
+	default:
+		writeError(w, response.StatusBadRequest, "proxy requests need an absolute-form target")
+	}
+}
+
+func (p *ForwardProxy) forward(w response.Writer, req *request.Request) {
+	target, err := url.Parse(req.RequestLine.RequestTarget)
+	if err != nil || target.Scheme != "http" {
+		writeError(w, response.StatusBadRequest, "only http targets can be forwarded, use CONNECT for https")
+		return
+	}
+	port := target.Port()
+	if port == "" {
+		port = "80"
+	}
+	if !p.Allow.Allowed(target.Hostname(), port) {
+		writeError(w, response.StatusForbidden, "destination not allowed")
+		return
+	}
+
+	out, err := OutboundRequest(req.Context(), req, target)
+	if err != nil {
+		writeError(w, response.StatusBadRequest, err.Error())
+		return
+	}
+	resp, err := p.Client.Do(out)
+	if err != nil {
+		if req.Context().Err() == context.Canceled {
+			return
+		}
+		if errors.Is(err, ErrorDestinationNotAllowed) {
+			writeError(w, response.StatusForbidden, err.Error())
+			return
+		}
+		p.logger().Error("error forwarding request", "target", target.Host, "error", err)
+		writeError(w, ErrorStatus(err), "upstream request failed")
+		return
+	}
+	defer resp.Body.Close()
+
+	if err := CopyResponse(w, req, resp); err != nil {
+		p.logger().Error("error copying forwarded response", "target", target.Host, "error", err)
+	}
+}
+
+func (p *ForwardProxy) tunnel(w response.Writer, req *request.Request) {
+	// Over HTTP/2 CONNECT would need the stream itself to carry the tunnel
+	if !w.Hijackable() {
+		writeError(w, response.StatusNotImplemented, "CONNECT is not supported on this connection")
+		return
+	}
+	target := req.RequestLine.RequestTarget
+	host, port, _ := net.SplitHostPort(target)
+	if !p.Allow.Allowed(host, port) {
+		writeError(w, response.StatusForbidden, "destination not allowed")
+		return
+	}
+
+	upstream, err := p.DialContext(req.Context(), "tcp", target)
+	if errors.Is(err, ErrorDestinationNotAllowed) {
+		writeError(w, response.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		p.logger().Error("error dialing tunnel target", "target", target, "error", err)
+		writeError(w, ErrorStatus(err), "could not connect to destination")
+		return
+	}
+	defer upstream.Close()
+
+	if err := w.WriteStatusLine(response.StatusOK); err != nil {
+		return
+	}
+	if err := w.WriteHeaders(headers.NewHeaders()); err != nil {
+		return
+	}
+	conn, buffered, err := w.Hijack()
+	if err != nil {
+		p.logger().Error("error hijacking connection", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	if len(buffered) > 0 {
+		if _, err := upstream.Write(buffered); err != nil {
+			return
+		}
+	}
+	splice(conn, upstream)
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// splice copies both ways until both sides are done, half closing each
+// direction as its source reaches EOF.
+func splice(a, b net.Conn) {
+	var wg sync.WaitGroup
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, err := io.Copy(dst, src)
+		if cw, ok := dst.(closeWriter); ok && err == nil {
+			cw.CloseWrite()
+			return
+		}
+		// Without a half close the other direction cannot finish either
+		dst.Close()
+		src.Close()
+	}
+	wg.Add(2)
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+}
@@ -0,0 +1,292 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"http-from-tcp/internal/server"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowlist(t *testing.T) {
+	allow := Allowlist{"example.com", "*.internal.test", "10.0.0.0/8", "api.test:443", "[2001:db8::1]:8443"}
+
+	tests := []struct {
+		host string
+		port string
+		want bool
+	}{
+		{host: "example.com", port: "80", want: true},
+		{host: "EXAMPLE.com.", port: "443", want: true},
+		{host: "www.example.com", port: "80", want: false},
+		{host: "build.internal.test", port: "443", want: true},
+		{host: "internal.test", port: "443", want: false},
+		{host: "10.1.2.3", port: "22", want: true},
+		{host: "11.1.2.3", port: "22", want: false},
+		{host: "api.test", port: "443", want: true},
+		{host: "api.test", port: "80", want: false},
+		{host: "2001:db8::1", port: "8443", want: true},
+		{host: "2001:db8::1", port: "443", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host+":"+tt.port, func(t *testing.T) {
+			assert.Equal(t, tt.want, allow.Allowed(tt.host, tt.port))
+		})
+	}
+	assert.True(t, Allowlist{}.Allowed("anything", "1"))
+}
+
+func TestInternalAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{addr: "127.0.0.1", want: true},
+		{addr: "10.1.2.3", want: true},
+		{addr: "0.1.2.3", want: true},
+		{addr: "100.64.0.1", want: true},
+		{addr: "100.127.255.254", want: true},
+		{addr: "169.254.169.254", want: true},
+		{addr: "::ffff:169.254.169.254", want: true},
+		{addr: "fd00:ec2::254", want: true},
+		{addr: "64:ff9b::a9fe:a9fe", want: true},
+		{addr: "::1", want: true},
+		{addr: "100.128.0.1", want: false},
+		{addr: "93.184.215.14", want: false},
+		{addr: "2606:2800:21f:cb07::1", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			assert.Equal(t, tt.want, internalAddr(netip.MustParseAddr(tt.addr)))
+		})
+	}
+}
+
+func startForwardProxy(t *testing.T, p *ForwardProxy) *url.URL {
+	t.Helper()
+	s, err := server.Serve(0, p.Handle)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return &url.URL{Scheme: "http", Host: s.Addr().String()}
+}
+
+func proxyClient(proxyURL *url.URL, tlsConfig *tls.Config) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: tlsConfig,
+	}}
+}
+
+func TestForwardProxy(t *testing.T) {
+	var seen *http.Request
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r
+		w.Write([]byte("hello from " + r.URL.Path))
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	p := NewForwardProxy()
+	p.Allow = Allowlist{"127.0.0.1"}
+	p.Authenticate = BasicAuth(map[string]string{"agent": "secret"})
+	proxyURL := startForwardProxy(t, p)
+
+	t.Run("absolute form", func(t *testing.T) {
+		authed := *proxyURL
+		authed.User = url.UserPassword("agent", "secret")
+		resp, err := proxyClient(&authed, nil).Get(plain.URL + "/plain")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "hello from /plain", string(body))
+		assert.Empty(t, seen.Header.Get("Proxy-Authorization"))
+		assert.Equal(t, "1.1 http-from-tcp", seen.Header.Get("Via"))
+	})
+
+	t.Run("connect tunnel", func(t *testing.T) {
+		authed := *proxyURL
+		authed.User = url.UserPassword("agent", "secret")
+		tlsConfig := secure.Client().Transport.(*http.Transport).TLSClientConfig
+		resp, err := proxyClient(&authed, tlsConfig).Get(secure.URL + "/secure")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "hello from /secure", string(body))
+	})
+
+	t.Run("authentication required", func(t *testing.T) {
+		resp, err := proxyClient(proxyURL, nil).Get(plain.URL + "/plain")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+		assert.Equal(t, `Basic realm="proxy"`, resp.Header.Get("Proxy-Authenticate"))
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		authed := *proxyURL
+		authed.User = url.UserPassword("agent", "guess")
+		resp, err := proxyClient(&authed, nil).Get(plain.URL + "/plain")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	})
+}
+
+func TestForwardProxyAllowlist(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+
+	p := NewForwardProxy()
+	p.Allow = Allowlist{"allowed.test"}
+	proxyURL := startForwardProxy(t, p)
+
+	resp, err := proxyClient(proxyURL, nil).Get(upstream.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("CONNECT " + target.Host + " HTTP/1.1\r\nHost: " + target.Host + "\r\n\r\n"))
+	resp, err = http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestForwardProxyInternalDestinations(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+
+	tests := []struct {
+		name  string
+		allow Allowlist
+		host  string
+		want  int
+	}{
+		{name: "loopback ip", host: "127.0.0.1", want: http.StatusForbidden},
+		{name: "name resolving to loopback", host: "localhost", want: http.StatusForbidden},
+		{name: "allowed by name only", allow: Allowlist{"localhost"}, host: "localhost", want: http.StatusForbidden},
+		{name: "allowed by name and prefix", allow: Allowlist{"localhost", "127.0.0.1"}, host: "localhost", want: http.StatusOK},
+		{name: "allowed by prefix", allow: Allowlist{"127.0.0.0/8"}, host: "127.0.0.1", want: http.StatusOK},
+		{name: "prefix for another port", allow: Allowlist{"127.0.0.1:1"}, host: "127.0.0.1", want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewForwardProxy()
+			p.Allow = tt.allow
+			proxyURL := startForwardProxy(t, p)
+			addr := net.JoinHostPort(tt.host, target.Port())
+
+			resp, err := proxyClient(proxyURL, nil).Get("http://" + addr + "/")
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tt.want, resp.StatusCode)
+
+			conn, err := net.Dial("tcp", proxyURL.Host)
+			require.NoError(t, err)
+			defer conn.Close()
+			conn.Write([]byte("CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n\r\n"))
+			resp, err = http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, resp.StatusCode)
+		})
+	}
+}
+
+// Without a connection to take over, as over HTTP/2, CONNECT is refused
+// before the target is dialed.
+func TestForwardProxyTunnelNotHijackable(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+
+	p := NewForwardProxy()
+	p.Allow = Allowlist{"127.0.0.1"}
+	req := request.NewRequest()
+	req.RequestLine = request.RequestLine{
+		HttpVersion:   "1.1",
+		Method:        "CONNECT",
+		RequestTarget: target.Addr().String(),
+		Form:          request.AuthorityForm,
+	}
+	buf := &bytes.Buffer{}
+	p.Handle(response.NewWrite(buf), req)
+	assert.Contains(t, buf.String(), "501 Not Implemented")
+
+	target.(*net.TCPListener).SetDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = target.Accept()
+	assert.Error(t, err, "target should not have been dialed")
+}
+
+// Bytes the client sends right behind the CONNECT request must reach the
+// target even though the server read them along with the request.
+func TestForwardProxyPipelinedTunnel(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	p := NewForwardProxy()
+	p.Allow = Allowlist{"127.0.0.1"}
+	proxyURL := startForwardProxy(t, p)
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("CONNECT " + echo.Addr().String() + " HTTP/1.1\r\n\r\nping"))
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(reader, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	conn.Write([]byte("pong"))
+	_, err = io.ReadFull(reader, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "pong", string(buf))
+
+	// Closing our side ends the tunnel in both directions
+	conn.(*net.TCPConn).CloseWrite()
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Empty(t, strings.TrimSpace(string(rest)))
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"http-from-tcp/internal/headers"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const viaName = "http-from-tcp"
+
+// hopByHopHeaders only apply to a single connection and are never forwarded.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHop deletes the standard hop-by-hop headers and any header
+// named in Connection.
+func removeHopByHop(h headers.Headers) {
+	for _, name := range strings.Split(h.Get("Connection"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			h.Delete(name)
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Delete(name)
+	}
+}
+
+func removeHopByHopHTTP(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+func appendValue(h http.Header, name, value string) {
+	if prior := h.Get(name); prior != "" {
+		value = prior + ", " + value
+	}
+	h.Set(name, value)
+}
+
+// fromHTTPHeader folds repeated headers the way headers.Headers stores them,
+// Set-Cookie values stay separate fields.
+func fromHTTPHeader(h http.Header) headers.Headers {
+	out := headers.NewHeaders()
+	for name, values := range h {
+		for _, value := range values {
+			out.Set(name, value)
+		}
+	}
+	return out
+}
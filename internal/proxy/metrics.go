@@ -0,0 +1,39 @@
+package proxy
+
+import "http-from-tcp/internal/server"
+
+type Metrics struct {
+	// BreakerState is 0 while closed, 1 while open and 2 while half-open
+	BreakerState       *server.Gauge
+	BreakerTransitions *server.Counter
+	Retries            *server.Counter
+}
+
+func NewMetrics(r *server.Registry) *Metrics {
+	return &Metrics{
+		BreakerState:       r.NewGauge("proxy_circuit_breaker_state", "Circuit breaker state per upstream, 0 closed, 1 open, 2 half-open.", "upstream"),
+		BreakerTransitions: r.NewCounter("proxy_circuit_breaker_transitions_total", "Total number of circuit breaker state changes.", "upstream", "state"),
+		Retries:            r.NewCounter("proxy_retries_total", "Total number of retried upstream requests.", "upstream"),
+	}
+}
+
+func (m *Metrics) breakerState(upstream string, state BreakerState) {
+	if m == nil {
+		return
+	}
+	m.BreakerState.Set(float64(state), upstream)
+}
+
+func (m *Metrics) breakerTransition(upstream string, state BreakerState) {
+	if m == nil {
+		return
+	}
+	m.BreakerTransitions.Inc(upstream, state.String())
+}
+
+func (m *Metrics) retry(upstream string) {
+	if m == nil {
+		return
+	}
+	m.Retries.Inc(upstream)
+}
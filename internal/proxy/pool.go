@@ -0,0 +1,286 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"http-from-tcp/internal/request"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultHealthInterval     = 10 * time.Second
+	defaultHealthTimeout      = 2 * time.Second
+	defaultHealthyThreshold   = 2
+	defaultUnhealthyThreshold = 2
+	defaultFailTimeout        = 10 * time.Second
+	// minSlowStartFactor keeps an upstream that just came back from being
+	// starved completely.
+	minSlowStartFactor = 0.1
+)
+
+var ErrorNoHealthyUpstream = fmt.Errorf("no healthy upstream")
+
+type Upstream struct {
+	URL    *url.URL
+	Weight float64
+	// Breaker is nil unless the pool was configured with one
+	Breaker *Breaker
+
+	active atomic.Int64
+
+	mu sync.Mutex
+	// healthy is the result of the active health checks
+	healthy      bool
+	checkPasses  int
+	checkFails   int
+	fails        int
+	ejectedUntil time.Time
+	// availableSince starts the slow start ramp
+	availableSince time.Time
+}
+
+// Active returns the number of in-flight requests to the upstream
+func (u *Upstream) Active() int64 {
+	return u.active.Load()
+}
+
+func (u *Upstream) Healthy() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.healthy
+}
+
+// weight returns zero while the upstream is unhealthy or ejected and ramps
+// up linearly over slowStart once it is available again.
+func (u *Upstream) weight(now time.Time, slowStart time.Duration) float64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.healthy || now.Before(u.ejectedUntil) || (u.Breaker != nil && !u.Breaker.ready()) {
+		return 0
+	}
+	if slowStart <= 0 || u.availableSince.IsZero() {
+		return u.Weight
+	}
+	factor := float64(now.Sub(u.availableSince)) / float64(slowStart)
+	return u.Weight * min(1, max(minSlowStartFactor, factor))
+}
+
+type HealthCheck struct {
+	// Path is requested on every upstream each Interval, an empty path
+	// disables active checks. Any 2xx or 3xx answer within Timeout passes.
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+	// HealthyThreshold consecutive passes bring an unhealthy upstream back
+	// and UnhealthyThreshold consecutive fails take a healthy one out.
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+type PoolConfig struct {
+	Targets []string
+	// Balancer defaults to RoundRobin, each pool needs its own.
+	Balancer    Balancer
+	HealthCheck HealthCheck
+	// MaxFails consecutive failed requests eject an upstream for
+	// FailTimeout, zero disables passive ejection.
+	MaxFails    int
+	FailTimeout time.Duration
+	// SlowStart ramps the weight of a recovered upstream from a tenth to its
+	// full weight over the duration.
+	SlowStart time.Duration
+	// Breaker gives every upstream its own circuit breaker, upstreams with
+	// an open circuit are skipped.
+	Breaker *BreakerConfig
+	// Client is used for health checks
+	Client *http.Client
+	Logger *slog.Logger
+}
+
+type Pool struct {
+	cfg       PoolConfig
+	upstreams []*Upstream
+	now       func() time.Time
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewPool(cfg PoolConfig) (*Pool, error) {
+	if len(cfg.Targets) == 0 {
+		return nil, fmt.Errorf("pool has no targets")
+	}
+	if cfg.Balancer == nil {
+		cfg.Balancer = &RoundRobin{}
+	}
+	if cfg.HealthCheck.Interval == 0 {
+		cfg.HealthCheck.Interval = defaultHealthInterval
+	}
+	if cfg.HealthCheck.Timeout == 0 {
+		cfg.HealthCheck.Timeout = defaultHealthTimeout
+	}
+	if cfg.HealthCheck.HealthyThreshold == 0 {
+		cfg.HealthCheck.HealthyThreshold = defaultHealthyThreshold
+	}
+	if cfg.HealthCheck.UnhealthyThreshold == 0 {
+		cfg.HealthCheck.UnhealthyThreshold = defaultUnhealthyThreshold
+	}
+	if cfg.FailTimeout == 0 {
+		cfg.FailTimeout = defaultFailTimeout
+	}
+	if cfg.Client == nil {
+		cfg.Client = NewClient()
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+
+	p := &Pool{
+		cfg: cfg,
+		now: time.Now,
+	}
+	for _, target := range cfg.Targets {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("unsupported upstream scheme %q", u.Scheme)
+		}
+		up := &Upstream{URL: u, Weight: 1, healthy: true}
+		if cfg.Breaker != nil {
+			up.Breaker = NewBreaker(u.Host, *cfg.Breaker)
+		}
+		p.upstreams = append(p.upstreams, up)
+	}
+	return p, nil
+}
+
+func (p *Pool) Upstreams() []*Upstream {
+	return p.upstreams
+}
+
+// Pick chooses an upstream for req, the caller must hand it back with Done.
+func (p *Pool) Pick(req *request.Request) (*Upstream, error) {
+	now := p.now()
+	weights := make([]float64, len(p.upstreams))
+	available := false
+	for i, u := range p.upstreams {
+		weights[i] = u.weight(now, p.cfg.SlowStart)
+		available = available || weights[i] > 0
+	}
+	if !available {
+		return nil, ErrorNoHealthyUpstream
+	}
+
+	u := p.cfg.Balancer.Pick(req, p.upstreams, weights)
+	u.active.Add(1)
+	return u, nil
+}
+
+// Done releases an upstream returned by Pick, failed requests count towards
+// passive ejection.
+func (p *Pool) Done(u *Upstream, failed bool) {
+	u.active.Add(-1)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !failed {
+		u.fails = 0
+		return
+	}
+	u.fails++
+	if p.cfg.MaxFails > 0 && u.fails >= p.cfg.MaxFails {
+		u.fails = 0
+		u.ejectedUntil = p.now().Add(p.cfg.FailTimeout)
+		u.availableSince = u.ejectedUntil
+		p.cfg.Logger.Warn("ejecting upstream", "upstream", u.URL.Host, "until", u.ejectedUntil)
+	}
+}
+
+// Start runs the active health checks until Close, it does nothing without
+// a health check path.
+func (p *Pool) Start() {
+	if p.cfg.HealthCheck.Path == "" || p.stop != nil {
+		return
+	}
+	p.stop = make(chan struct{})
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(p.cfg.HealthCheck.Interval)
+		defer ticker.Stop()
+		for {
+			p.CheckHealth()
+			select {
+			case <-ticker.C:
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (p *Pool) Close() {
+	if p.stop == nil {
+		return
+	}
+	close(p.stop)
+	p.wg.Wait()
+}
+
+// CheckHealth probes every upstream once and waits for the results
+func (p *Pool) CheckHealth() {
+	var wg sync.WaitGroup
+	for _, u := range p.upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.record(u, p.probe(u))
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *Pool) probe(u *Upstream) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), p.cfg.HealthCheck.Timeout)
+	defer cancel()
+
+	target := u.URL.JoinPath(p.cfg.HealthCheck.Path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := p.cfg.Client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
+
+func (p *Pool) record(u *Upstream, ok bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if ok {
+		u.checkFails = 0
+		u.checkPasses++
+		if !u.healthy && u.checkPasses >= p.cfg.HealthCheck.HealthyThreshold {
+			u.healthy = true
+			u.availableSince = p.now()
+			p.cfg.Logger.Info("upstream healthy", "upstream", u.URL.Host)
+		}
+		return
+	}
+	u.checkPasses = 0
+	u.checkFails++
+	if u.healthy && u.checkFails >= p.cfg.HealthCheck.UnhealthyThreshold {
+		u.healthy = false
+		p.cfg.Logger.Warn("upstream unhealthy", "upstream", u.URL.Host)
+	}
+}
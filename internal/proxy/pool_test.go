@@ -0,0 +1,312 @@
+package proxy
+
+import (
+	"fmt"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/server"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type backend struct {
+	*httptest.Server
+	name    string
+	healthy atomic.Bool
+	hits    atomic.Int64
+}
+
+func startBackends(t *testing.T, n int) []*backend {
+	t.Helper()
+	backends := make([]*backend, n)
+	for i := range backends {
+		b := &backend{name: fmt.Sprintf("backend-%d", i)}
+		b.healthy.Store(true)
+		b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/healthz" {
+				if !b.healthy.Load() {
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+				return
+			}
+			b.hits.Add(1)
+			w.Write([]byte(b.name))
+		}))
+		t.Cleanup(b.Close)
+		backends[i] = b
+	}
+	return backends
+}
+
+func targets(backends []*backend) []string {
+	urls := make([]string, len(backends))
+	for i, b := range backends {
+		urls[i] = b.URL
+	}
+	return urls
+}
+
+func clientRequest(remoteAddr string, hdrs ...string) *request.Request {
+	req := request.NewRequest()
+	req.RequestLine = request.RequestLine{Method: "GET", RequestTarget: "/", HttpVersion: "1.1"}
+	req.RemoteAddr = remoteAddr
+	for i := 0; i+1 < len(hdrs); i += 2 {
+		req.Headers.Set(hdrs[i], hdrs[i+1])
+	}
+	return req
+}
+
+func pick(t *testing.T, p *Pool, req *request.Request) *Upstream {
+	t.Helper()
+	u, err := p.Pick(req)
+	require.NoError(t, err)
+	p.Done(u, false)
+	return u
+}
+
+func TestRoundRobin(t *testing.T) {
+	p, err := NewPool(PoolConfig{Targets: []string{"http://a", "http://b", "http://c"}})
+	require.NoError(t, err)
+	p.Upstreams()[2].Weight = 2
+
+	counts := map[string]int{}
+	for range 40 {
+		counts[pick(t, p, clientRequest("192.0.2.1:1")).URL.Host]++
+	}
+	assert.Equal(t, map[string]int{"a": 10, "b": 10, "c": 20}, counts)
+}
+
+func TestLeastConn(t *testing.T) {
+	p, err := NewPool(PoolConfig{
+		Targets:  []string{"http://a", "http://b", "http://c"},
+		Balancer: &LeastConn{},
+	})
+	require.NoError(t, err)
+
+	busy, err := p.Pick(clientRequest("192.0.2.1:1"))
+	require.NoError(t, err)
+	for range 10 {
+		assert.NotEqual(t, busy, pick(t, p, clientRequest("192.0.2.1:1")))
+	}
+	p.Done(busy, false)
+	assert.Zero(t, busy.Active())
+}
+
+func TestConsistentHash(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     server.KeyFunc
+		targets []string
+		req     func(i int) *request.Request
+	}{
+		{
+			name: "client ip",
+			req: func(i int) *request.Request {
+				return clientRequest(fmt.Sprintf("192.0.2.%d:1234", i))
+			},
+		},
+		{
+			name: "header",
+			key:  server.KeyByHeader("X-Api-Key"),
+			req: func(i int) *request.Request {
+				return clientRequest("192.0.2.1:1234", "X-Api-Key", fmt.Sprintf("key-%d", i))
+			},
+		},
+		{
+			name:    "same host",
+			targets: []string{"http://a/one", "http://a/two", "http://a/three"},
+			req: func(i int) *request.Request {
+				return clientRequest(fmt.Sprintf("192.0.2.%d:1234", i))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets := tt.targets
+			if targets == nil {
+				targets = []string{"http://a", "http://b", "http://c"}
+			}
+			p, err := NewPool(PoolConfig{
+				Targets:     targets,
+				Balancer:    NewConsistentHash(tt.key),
+				MaxFails:    1,
+				FailTimeout: time.Hour,
+			})
+			require.NoError(t, err)
+
+			before := map[int]*Upstream{}
+			used := map[*Upstream]bool{}
+			for i := range 50 {
+				before[i] = pick(t, p, tt.req(i))
+				used[before[i]] = true
+				assert.Equal(t, before[i], pick(t, p, tt.req(i)))
+			}
+			assert.Len(t, used, 3)
+
+			ejected := p.Upstreams()[0]
+			ejected.active.Add(1)
+			p.Done(ejected, true)
+			for i := range 50 {
+				got := pick(t, p, tt.req(i))
+				assert.NotEqual(t, ejected, got)
+				if before[i] != ejected {
+					assert.Equal(t, before[i], got)
+				}
+			}
+		})
+	}
+}
+
+func TestConsistentHashRingSameHost(t *testing.T) {
+	p, err := NewPool(PoolConfig{Targets: []string{"http://a/one", "http://a/two", "http://a/three"}})
+	require.NoError(t, err)
+
+	ring := NewConsistentHash(nil).buildRing(p.Upstreams())
+	hashes := map[uint64]bool{}
+	for _, e := range ring {
+		hashes[e.hash] = true
+	}
+	assert.Len(t, hashes, len(ring))
+}
+
+func TestPassiveEjectionAndSlowStart(t *testing.T) {
+	now := time.Now()
+	p, err := NewPool(PoolConfig{
+		Targets:     []string{"http://a", "http://b"},
+		MaxFails:    2,
+		FailTimeout: 10 * time.Second,
+		SlowStart:   10 * time.Second,
+	})
+	require.NoError(t, err)
+	p.now = func() time.Time { return now }
+	a := p.Upstreams()[0]
+
+	a.active.Add(2)
+	p.Done(a, true)
+	assert.NotZero(t, a.weight(now, p.cfg.SlowStart))
+	p.Done(a, true)
+	assert.Zero(t, a.weight(now, p.cfg.SlowStart))
+	for range 10 {
+		assert.NotEqual(t, a, pick(t, p, clientRequest("192.0.2.1:1")))
+	}
+
+	now = now.Add(15 * time.Second)
+	assert.InDelta(t, 0.5, a.weight(now, p.cfg.SlowStart), 0.01)
+	counts := map[*Upstream]int{}
+	for range 30 {
+		counts[pick(t, p, clientRequest("192.0.2.1:1"))]++
+	}
+	assert.Equal(t, 10, counts[a])
+
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, 1.0, a.weight(now, p.cfg.SlowStart))
+}
+
+func TestActiveHealthCheck(t *testing.T) {
+	backends := startBackends(t, 2)
+	p, err := NewPool(PoolConfig{
+		Targets: targets(backends),
+		HealthCheck: HealthCheck{
+			Path:               "/healthz",
+			HealthyThreshold:   2,
+			UnhealthyThreshold: 1,
+		},
+	})
+	require.NoError(t, err)
+	down := p.Upstreams()[1]
+
+	backends[1].healthy.Store(false)
+	p.CheckHealth()
+	assert.False(t, down.Healthy())
+	for range 4 {
+		assert.NotEqual(t, down, pick(t, p, clientRequest("192.0.2.1:1")))
+	}
+
+	backends[1].healthy.Store(true)
+	p.CheckHealth()
+	assert.False(t, down.Healthy())
+	p.CheckHealth()
+	assert.True(t, down.Healthy())
+
+	backends[0].healthy.Store(false)
+	backends[1].healthy.Store(false)
+	p.CheckHealth()
+	_, err = p.Pick(clientRequest("192.0.2.1:1"))
+	assert.Equal(t, ErrorNoHealthyUpstream, err)
+}
+
+func TestActiveHealthCheckLoop(t *testing.T) {
+	backends := startBackends(t, 1)
+	p, err := NewPool(PoolConfig{
+		Targets: targets(backends),
+		HealthCheck: HealthCheck{
+			Path:               "/healthz",
+			Interval:           10 * time.Millisecond,
+			UnhealthyThreshold: 1,
+		},
+	})
+	require.NoError(t, err)
+	p.Start()
+	defer p.Close()
+
+	backends[0].healthy.Store(false)
+	assert.Eventually(t, func() bool { return !p.Upstreams()[0].Healthy() }, time.Second, 10*time.Millisecond)
+}
+
+func TestPoolProxy(t *testing.T) {
+	backends := startBackends(t, 3)
+	backends[2].Close()
+
+	p, err := NewPool(PoolConfig{
+		Targets:     targets(backends),
+		MaxFails:    1,
+		FailTimeout: time.Hour,
+	})
+	require.NoError(t, err)
+	rp := NewPoolProxy(p)
+
+	statuses := map[int]int{}
+	for range 9 {
+		resp := proxyRequest(t, rp, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		io.Copy(io.Discard, resp.Body)
+		statuses[resp.StatusCode]++
+	}
+	// The closed backend fails once and is ejected
+	assert.Equal(t, map[int]int{http.StatusOK: 8, http.StatusBadGateway: 1}, statuses)
+	assert.Equal(t, int64(4), backends[0].hits.Load())
+	assert.Equal(t, int64(4), backends[1].hits.Load())
+	for _, u := range p.Upstreams() {
+		assert.Zero(t, u.Active())
+	}
+}
+
+func TestPoolProxySkipsOpenCircuit(t *testing.T) {
+	backends := startBackends(t, 2)
+	p, err := NewPool(PoolConfig{
+		Targets: targets(backends),
+		Breaker: &BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Hour},
+	})
+	require.NoError(t, err)
+	rp := NewPoolProxy(p)
+	rp.Retry = RetryPolicy{Attempts: 2, BaseDelay: time.Millisecond}
+
+	broken := p.Upstreams()[0].Breaker
+	generation, err := broken.Allow()
+	require.NoError(t, err)
+	broken.Record(generation, false)
+	require.Equal(t, BreakerOpen, broken.State())
+
+	for range 4 {
+		resp := proxyRequest(t, rp, "POST / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	assert.Zero(t, backends[0].hits.Load())
+	assert.Equal(t, int64(4), backends[1].hits.Load())
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"context"
+	"math/rand/v2"
+	"slices"
+	"time"
+)
+
+const (
+	defaultRetryBaseDelay = 50 * time.Millisecond
+	defaultRetryMaxDelay  = time.Second
+)
+
+var idempotentMethods = []string{"GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE"}
+
+type RetryPolicy struct {
+	// Attempts is the total number of tries for idempotent requests, zero
+	// or one disables retries.
+	Attempts int
+	// BaseDelay doubles with every retry up to MaxDelay, the actual wait is
+	// picked at random below it.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+func (r RetryPolicy) tries(method string) int {
+	if r.Attempts <= 1 || !slices.Contains(idempotentMethods, method) {
+		return 1
+	}
+	return r.Attempts
+}
+
+func (r RetryPolicy) backoff(retry int) time.Duration {
+	base := r.BaseDelay
+	if base <= 0 {
+		base = defaultRetryBaseDelay
+	}
+	maxDelay := r.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = defaultRetryMaxDelay
+	}
+	delay := min(maxDelay, base<<min(retry-1, 30))
+	return rand.N(delay) + 1
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
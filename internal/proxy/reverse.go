@@ -0,0 +1,380 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"http-from-tcp/internal/headers"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"http-from-tcp/internal/server"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDialTimeout           = 10 * time.Second
+	defaultResponseHeaderTimeout = 30 * time.Second
+	copyBufferSize               = 32 * 1024
+)
+
+// ReverseProxy forwards requests to an upstream and streams its response
+// back.
+type ReverseProxy struct {
+	Target *url.URL
+	// Pool, when set, picks the upstream for each request instead of Target
+	Pool *Pool
+	// Breaker guards Target, pooled upstreams have their own
+	Breaker *Breaker
+	Retry   RetryPolicy
+	// TryTimeout bounds every attempt and Timeout the whole request
+	// including retries, zero means no limit.
+	TryTimeout time.Duration
+	Timeout    time.Duration
+	Metrics    *Metrics
+	// StripPrefix is removed from the request path before it is appended to
+	// the target path.
+	StripPrefix string
+	// ContentDigest chunks every body and ends it with X-Content-SHA256 and
+	// X-Content-Length trailers.
+	ContentDigest bool
+	Client        *http.Client
+	Logger        *slog.Logger
+}
+
+func NewClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 nil,
+			DialContext:           (&net.Dialer{Timeout: defaultDialTimeout}).DialContext,
+			ResponseHeaderTimeout: defaultResponseHeaderTimeout,
+			MaxIdleConnsPerHost:   32,
+			IdleConnTimeout:       90 * time.Second,
+			// Bodies are passed through untouched
+			DisableCompression: true,
+		},
+		// Redirects are for the client to follow
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func NewReverseProxy(target string) (*ReverseProxy, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported upstream scheme %q", u.Scheme)
+	}
+	return &ReverseProxy{
+		Target: u,
+		Client: NewClient(),
+		Logger: slog.Default(),
+	}, nil
+}
+
+func (p *ReverseProxy) logger() *slog.Logger {
+	if p.Logger == nil {
+		return slog.Default()
+	}
+	return p.Logger
+}
+
+// NewPoolProxy balances requests across the upstreams of pool
+func NewPoolProxy(pool *Pool) *ReverseProxy {
+	return &ReverseProxy{
+		Pool:   pool,
+		Client: NewClient(),
+		Logger: slog.Default(),
+	}
+}
+
+func (p *ReverseProxy) upstreamURL(base *url.URL, req *request.Request) (*url.URL, error) {
+	in, err := url.ParseRequestURI(req.RequestLine.RequestTarget)
+	if err != nil {
+		return nil, err
+	}
+	path := strings.TrimPrefix(in.Path, p.StripPrefix)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	out := *base
+	out.Path = strings.TrimSuffix(base.Path, "/") + path
+	out.RawPath = ""
+	out.RawQuery = in.RawQuery
+	return &out, nil
+}
+
+// OutboundRequest builds the request sent upstream: hop-by-hop headers are
+// dropped and X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host and Via
+// are added.
+func OutboundRequest(ctx context.Context, req *request.Request, target *url.URL) (*http.Request, error) {
+	out, err := http.NewRequestWithContext(ctx, req.RequestLine.Method, target.String(), req.BodyReader())
+	if err != nil {
+		return nil, err
+	}
+
+	h := maps.Clone(req.Headers)
+	removeHopByHop(h)
+	for name := range h {
+		for _, value := range h.Values(name) {
+			out.Header.Add(name, value)
+		}
+	}
+	out.Header.Del("Host")
+	out.Header.Del("Content-Length")
+	out.ContentLength = int64(req.ContentLength())
+	out.Host = target.Host
+
+	if ip := clientIP(req.RemoteAddr); ip != "" {
+		appendValue(out.Header, "X-Forwarded-For", ip)
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	out.Header.Set("X-Forwarded-Proto", proto)
+	if host := req.Headers.Get("Host"); host != "" {
+		out.Header.Set("X-Forwarded-Host", host)
+	}
+	appendValue(out.Header, "Via", "1.1 "+viaName)
+	return out, nil
+}
+
+// ErrorStatus maps a failed upstream call to 504 for timeouts and 502 for
+// everything else.
+func ErrorStatus(err error) response.StatusCode {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return response.StatusGatewayTimeout
+	}
+	return response.StatusBadGateway
+}
+
+func writeError(w response.Writer, status response.StatusCode, message string) {
+	he := &server.HandlerError{
+		StatusCode: status,
+		Message:    message,
+	}
+	he.Write(w)
+}
+
+// isUpstreamFailure reports answers that count towards passive ejection
+func isUpstreamFailure(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+func (p *ReverseProxy) Handle(w response.Writer, req *request.Request) {
+	ctx := req.Context()
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	tries := p.Retry.tries(req.RequestLine.Method)
+	if req.BodyStreamed() && req.ContentLength() > 0 {
+		// The body is gone after the first attempt
+		tries = 1
+	}
+	var err error
+	for try := range tries {
+		if try > 0 {
+			// Nothing was sent when the circuit was open, so there is no
+			// reason to wait before picking another upstream.
+			if !errors.Is(err, ErrorCircuitOpen) {
+				if serr := sleepContext(ctx, p.Retry.backoff(try)); serr != nil {
+					err = serr
+					break
+				}
+			}
+		}
+		var done bool
+		done, err = p.try(ctx, w, req, try == tries-1)
+		if done {
+			return
+		}
+	}
+	p.writeFailure(w, req, err)
+}
+
+// try makes one attempt and reports whether a response was written. Gateway
+// errors from the upstream are only passed on by the last attempt.
+func (p *ReverseProxy) try(ctx context.Context, w response.Writer, req *request.Request, last bool) (bool, error) {
+	base, breaker := p.Target, p.Breaker
+	var up *Upstream
+	if p.Pool != nil {
+		var err error
+		up, err = p.Pool.Pick(req)
+		if err != nil {
+			return false, err
+		}
+		base, breaker = up.URL, up.Breaker
+	}
+
+	failed := false
+	if breaker != nil {
+		generation, err := breaker.Allow()
+		if err != nil {
+			if up != nil {
+				p.Pool.Done(up, false)
+			}
+			return false, err
+		}
+		defer func() { breaker.Record(generation, !failed) }()
+	}
+	if up != nil {
+		defer func() { p.Pool.Done(up, failed) }()
+	}
+
+	target, err := p.upstreamURL(base, req)
+	if err != nil {
+		writeError(w, response.StatusBadRequest, "invalid request target")
+		return true, nil
+	}
+	if p.TryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.TryTimeout)
+		defer cancel()
+	}
+	out, err := OutboundRequest(ctx, req, target)
+	if err != nil {
+		writeError(w, response.StatusBadRequest, err.Error())
+		return true, nil
+	}
+
+	resp, err := p.Client.Do(out)
+	if err != nil {
+		// A client that went away says nothing about the upstream
+		failed = req.Context().Err() == nil
+		if failed {
+			p.logger().Error("error calling upstream", "upstream", target.Host, "error", err)
+			if !last {
+				p.Metrics.retry(target.Host)
+			}
+		}
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	failed = isUpstreamFailure(resp.StatusCode)
+	if failed && !last {
+		p.Metrics.retry(target.Host)
+		return false, fmt.Errorf("upstream answered %s", resp.Status)
+	}
+	if err := copyResponse(w, req, resp, p.ContentDigest); err != nil {
+		p.logger().Error("error copying upstream response", "upstream", target.Host, "error", err)
+	}
+	return true, nil
+}
+
+func (p *ReverseProxy) writeFailure(w response.Writer, req *request.Request, err error) {
+	if req.Context().Err() == context.Canceled {
+		// The client is gone, nobody to answer
+		return
+	}
+
+	var open *CircuitOpenError
+	switch {
+	case errors.As(err, &open):
+		message := fmt.Sprintf("circuit open for upstream %s", open.Upstream)
+		w.WriteStatusLine(response.StatusServiceUnavailable)
+		h := response.GetDefaultHeaders(len(message))
+		h.Override("Retry-After", strconv.Itoa(int(max(time.Second, open.RetryAfter.Round(time.Second)).Seconds())))
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(message))
+	case errors.Is(err, ErrorNoHealthyUpstream):
+		writeError(w, response.StatusServiceUnavailable, err.Error())
+	default:
+		writeError(w, ErrorStatus(err), "upstream request failed")
+	}
+}
+
+// CopyResponse writes the upstream status and headers and streams the body,
+// using chunked encoding when the upstream length is unknown.
+func CopyResponse(w response.Writer, req *request.Request, resp *http.Response) error {
+	return copyResponse(w, req, resp, false)
+}
+
+func copyResponse(w response.Writer, req *request.Request, resp *http.Response, digest bool) error {
+	removeHopByHopHTTP(resp.Header)
+	h := fromHTTPHeader(resp.Header)
+	h.Set("Via", "1.1 "+viaName)
+
+	noBody := req.RequestLine.Method == "HEAD" || resp.StatusCode == 204 || resp.StatusCode == 304
+	digest = digest && !noBody
+	chunked := !noBody && (resp.ContentLength < 0 || digest)
+	if chunked {
+		h.Delete("Content-Length")
+		h.Override("Transfer-Encoding", "chunked")
+		if digest {
+			h.Override("Trailer", "X-Content-SHA256, X-Content-Length")
+		}
+	} else if !noBody {
+		h.Override("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+
+	if err := w.WriteStatusLine(response.StatusCode(resp.StatusCode)); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return err
+	}
+	if noBody {
+		return nil
+	}
+
+	sum := sha256.New()
+	length := 0
+	buf := make([]byte, copyBufferSize)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if digest {
+				sum.Write(buf[:n])
+				length += n
+			}
+			var werr error
+			if chunked {
+				_, werr = w.WriteChunkedBody(buf[:n])
+			} else {
+				_, werr = w.WriteBody(buf[:n])
+			}
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if chunked {
+		if _, err := w.WriteChunkedBodyDone(); err != nil {
+			return err
+		}
+		var trailers headers.Headers
+		if digest {
+			trailers = headers.NewHeaders()
+			trailers.Set("X-Content-SHA256", hex.EncodeToString(sum.Sum(nil)))
+			trailers.Set("X-Content-Length", strconv.Itoa(length))
+		}
+		return w.WriteTrailers(trailers)
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"http-from-tcp/internal/server"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func proxyRequest(t *testing.T, p *ReverseProxy, raw string) *http.Response {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	req.RemoteAddr = "192.0.2.10:5555"
+
+	buf := &bytes.Buffer{}
+	p.Handle(response.NewWrite(buf), req)
+
+	resp, err := http.ReadResponse(bufio.NewReader(buf), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestReverseProxy(t *testing.T) {
+	var got *http.Request
+	var gotBody []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		gotBody, _ = io.ReadAll(r.Body)
+		w.Header().Set("X-Upstream", "yes")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		switch r.URL.Path {
+		case "/base/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/base/cookies":
+			w.Header().Add("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT")
+			w.Header().Add("Set-Cookie", "b=2")
+		case "/base/stream":
+			w.Write([]byte("first "))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("second"))
+		default:
+			w.Write([]byte("echo " + string(gotBody)))
+		}
+	}))
+	defer upstream.Close()
+
+	p, err := NewReverseProxy(upstream.URL + "/base")
+	require.NoError(t, err)
+	p.StripPrefix = "/api"
+
+	t.Run("forwards method, body and headers", func(t *testing.T) {
+		resp := proxyRequest(t, p, "PUT /api/items?id=7 HTTP/1.1\r\n"+
+			"Host: example.com\r\n"+
+			"Content-Length: 5\r\n"+
+			"Connection: X-Secret\r\n"+
+			"X-Secret: drop me\r\n"+
+			"X-Forwarded-For: 198.51.100.1\r\n"+
+			"X-Custom: keep me\r\n"+
+			"\r\n"+
+			"hello")
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "echo hello", string(body))
+		assert.Equal(t, "yes", resp.Header.Get("X-Upstream"))
+		assert.Empty(t, resp.Header.Get("Keep-Alive"))
+		assert.Equal(t, "1.1 http-from-tcp", resp.Header.Get("Via"))
+
+		assert.Equal(t, "PUT", got.Method)
+		assert.Equal(t, "/base/items", got.URL.Path)
+		assert.Equal(t, "id=7", got.URL.RawQuery)
+		assert.Equal(t, "hello", string(gotBody))
+		assert.Equal(t, "keep me", got.Header.Get("X-Custom"))
+		assert.Empty(t, got.Header.Get("X-Secret"))
+		assert.Equal(t, "198.51.100.1, 192.0.2.10", got.Header.Get("X-Forwarded-For"))
+		assert.Equal(t, "http", got.Header.Get("X-Forwarded-Proto"))
+		assert.Equal(t, "example.com", got.Header.Get("X-Forwarded-Host"))
+		assert.Equal(t, "1.1 http-from-tcp", got.Header.Get("Via"))
+	})
+
+	t.Run("propagates upstream status", func(t *testing.T) {
+		resp := proxyRequest(t, p, "GET /api/missing HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("keeps set-cookie fields separate", func(t *testing.T) {
+		resp := proxyRequest(t, p, "GET /api/cookies HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT", "b=2"}, resp.Header.Values("Set-Cookie"))
+	})
+
+	t.Run("forwards a streamed body", func(t *testing.T) {
+		reader := request.NewReader(strings.NewReader("POST /api/items HTTP/1.1\r\nHost: example.com\r\nContent-Length: 8\r\n\r\nstreamed"))
+		req, err := reader.ReadRequestHeader()
+		require.NoError(t, err)
+		require.NoError(t, reader.StreamBody(req))
+
+		buf := &bytes.Buffer{}
+		p.Handle(response.NewWrite(buf), req)
+		resp, err := http.ReadResponse(bufio.NewReader(buf), nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "echo streamed", string(body))
+		assert.Equal(t, int64(8), got.ContentLength)
+	})
+
+	t.Run("sends content digest trailers", func(t *testing.T) {
+		digest := *p
+		digest.ContentDigest = true
+		resp := proxyRequest(t, &digest, "GET /api/items HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "echo ", string(body))
+		sum := sha256.Sum256(body)
+		assert.Equal(t, hex.EncodeToString(sum[:]), resp.Trailer.Get("X-Content-SHA256"))
+		assert.Equal(t, "5", resp.Trailer.Get("X-Content-Length"))
+	})
+
+	t.Run("forwards HEAD without a body", func(t *testing.T) {
+		req, err := request.RequestFromReader(strings.NewReader("HEAD /api/items HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		require.NoError(t, err)
+		buf := &bytes.Buffer{}
+		p.Handle(response.NewWrite(buf), req)
+
+		assert.Equal(t, "HEAD", got.Method)
+		head, body, ok := strings.Cut(buf.String(), "\r\n\r\n")
+		require.True(t, ok)
+		assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 "), head)
+		assert.Contains(t, strings.ToLower(head), "content-length: 5")
+		assert.Empty(t, body)
+	})
+
+	t.Run("streams unknown length as chunked", func(t *testing.T) {
+		resp := proxyRequest(t, p, "GET /api/stream HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "first second", string(body))
+	})
+}
+
+func TestReverseProxyErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream func(t *testing.T) string
+		want     int
+	}{
+		{
+			name: "closed upstream",
+			upstream: func(t *testing.T) string {
+				s := httptest.NewServer(http.NotFoundHandler())
+				s.Close()
+				return s.URL
+			},
+			want: http.StatusBadGateway,
+		},
+		{
+			name: "slow upstream",
+			upstream: func(t *testing.T) string {
+				release := make(chan struct{})
+				s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					<-release
+				}))
+				t.Cleanup(s.Close)
+				t.Cleanup(func() { close(release) })
+				return s.URL
+			},
+			want: http.StatusGatewayTimeout,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewReverseProxy(tt.upstream(t))
+			require.NoError(t, err)
+			p.Client.Timeout = 100 * time.Millisecond
+
+			resp := proxyRequest(t, p, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+			assert.Equal(t, tt.want, resp.StatusCode)
+		})
+	}
+}
+
+func TestReverseProxyRetries(t *testing.T) {
+	var calls atomic.Int64
+	failFirst := int64(2)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failFirst {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name      string
+		method    string
+		attempts  int
+		want      int
+		wantCalls int64
+	}{
+		{name: "idempotent retried", method: "GET", attempts: 3, want: http.StatusOK, wantCalls: 3},
+		{name: "retries exhausted", method: "GET", attempts: 2, want: http.StatusServiceUnavailable, wantCalls: 2},
+		{name: "post not retried", method: "POST", attempts: 3, want: http.StatusServiceUnavailable, wantCalls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls.Store(0)
+			p, err := NewReverseProxy(upstream.URL)
+			require.NoError(t, err)
+			p.Retry = RetryPolicy{Attempts: tt.attempts, BaseDelay: time.Millisecond}
+			p.Metrics = NewMetrics(server.NewRegistry())
+
+			resp := proxyRequest(t, p, tt.method+" / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+			assert.Equal(t, tt.want, resp.StatusCode)
+			assert.Equal(t, tt.wantCalls, calls.Load())
+			assert.Equal(t, float64(tt.wantCalls-1), p.Metrics.Retries.Value(strings.TrimPrefix(upstream.URL, "http://")))
+		})
+	}
+}
+
+func TestReverseProxyTimeouts(t *testing.T) {
+	var calls atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 || r.URL.Path == "/slow" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	p, err := NewReverseProxy(upstream.URL)
+	require.NoError(t, err)
+	p.Retry = RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond}
+	p.TryTimeout = 50 * time.Millisecond
+	p.Timeout = 200 * time.Millisecond
+
+	// The first attempt times out and the retry succeeds
+	resp := proxyRequest(t, p, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(2), calls.Load())
+
+	p.TryTimeout = 0
+	start := time.Now()
+	resp = proxyRequest(t, p, "GET /slow HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestReverseProxyCircuitBreaker(t *testing.T) {
+	var calls atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer upstream.Close()
+
+	p, err := NewReverseProxy(upstream.URL)
+	require.NoError(t, err)
+	p.Breaker = NewBreaker("upstream", BreakerConfig{FailureThreshold: 2, OpenTimeout: time.Minute})
+
+	for range 2 {
+		resp := proxyRequest(t, p, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	}
+	resp := proxyRequest(t, p, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "60", resp.Header.Get("Retry-After"))
+	body, _ := io.ReadAll(resp.Body)
+	assert.Contains(t, string(body), "circuit open")
+	assert.Equal(t, int64(2), calls.Load())
+}
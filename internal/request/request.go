@@ -1,12 +1,18 @@
 package request
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"http-from-tcp/internal/headers"
 	"io"
-	"slices"
+	"net"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type parserState int
@@ -20,19 +26,39 @@ const (
 
 const SEPARATOR = "\r\n"
 
-var ValidMethods = []string{"GET", "POST", "PUT", "DELETE", "PATCH"}
-
 var ErrorMalformedStartLine = fmt.Errorf("bad request line")
 var ErrorInvalidData = fmt.Errorf("invalid data")
 var ErrorInvalidRequestLine = fmt.Errorf("invalid request line")
 var ErrorParsingRequestLine = fmt.Errorf("unable to parse request line even after parsing the complete data sent")
 var ErrorBodyLengthExceeded = fmt.Errorf("body length is more than the content-length header")
 var ErrorReadingBody = fmt.Errorf("error reading the body")
+var ErrorHeaderTooLarge = fmt.Errorf("request line and headers are larger than allowed")
+var ErrorBodyTooLarge = fmt.Errorf("body is larger than allowed")
+var ErrorInvalidRequestTarget = fmt.Errorf("invalid request target")
+var ErrorInvalidContentLength = fmt.Errorf("invalid content-length")
+var ErrorTransferEncoding = fmt.Errorf("transfer-encoding is not supported")
+
+// TargetForm is the form of the request target, RFC 9112 section 3.2.
+type TargetForm int
+
+const (
+	// OriginForm is a path with an optional query, "/index.html?q=1"
+	OriginForm TargetForm = iota
+	// AbsoluteForm is a full URI and is sent to proxies,
+	// "http://example.com/index.html"
+	AbsoluteForm
+	// AuthorityForm is host and port and only used by CONNECT,
+	// "example.com:443"
+	AuthorityForm
+	// AsteriskForm is "*" and only used by OPTIONS
+	AsteriskForm
+)
 
 type RequestLine struct {
 	HttpVersion   string
 	Method        string
 	RequestTarget string
+	Form          TargetForm
 }
 
 func (r *RequestLine) ValidateRequestLine() bool {
@@ -40,23 +66,56 @@ func (r *RequestLine) ValidateRequestLine() bool {
 		return false
 	}
 
-	if !slices.Contains(ValidMethods, r.Method) {
+	if !ValidMethod(r.Method) {
 		return false
 	}
 
 	return true
 }
 
-func getInt(val string, defValue int) (int, error) {
-	if val == "" {
-		return defValue, nil
+// ValidMethod accepts any method token, RFC 9110 section 9.1, handlers
+// answer the ones they do not implement.
+func ValidMethod(method string) bool {
+	return method != "" && headers.IsToken(method)
+}
+
+func parseTargetForm(method, target string) (TargetForm, bool) {
+	switch {
+	case method == "CONNECT":
+		host, port, err := net.SplitHostPort(target)
+		return AuthorityForm, err == nil && host != "" && port != "" && !strings.Contains(target, "/")
+	case target == "*":
+		return AsteriskForm, method == "OPTIONS"
+	case strings.HasPrefix(target, "/"):
+		return OriginForm, true
 	}
+	u, err := url.Parse(target)
+	return AbsoluteForm, err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
 
-	intVal, err := strconv.Atoi(val)
+// contentLength returns the body length of a request. The body can only be
+// delimited by a single Content-Length of plain digits, anything else would
+// let a proxy in front of the server disagree about where the request ends.
+func contentLength(h headers.Headers) (int, error) {
+	value, hasLength := h["content-length"]
+	if _, ok := h["transfer-encoding"]; ok {
+		if hasLength {
+			return 0, ErrorInvalidContentLength
+		}
+		return 0, ErrorTransferEncoding
+	}
+	if !hasLength {
+		return 0, nil
+	}
+	// Repeated fields were joined with a comma
+	if value == "" || strings.Trim(value, "0123456789") != "" {
+		return 0, ErrorInvalidContentLength
+	}
+	n, err := strconv.Atoi(value)
 	if err != nil {
-		return 0, err
+		return 0, ErrorInvalidContentLength
 	}
-	return intVal, nil
+	return n, nil
 }
 
 type Request struct {
@@ -64,6 +123,81 @@ type Request struct {
 	Headers     headers.Headers
 	Body        []byte
 	State       parserState
+	RemoteAddr  string
+	LocalAddr   string
+	// ConnID identifies the connection the request arrived on and ConnSeq
+	// counts requests on it starting at 1.
+	ConnID     uint64
+	ConnSeq    int
+	AcceptedAt time.Time
+	// TLS is nil for requests received over plain TCP
+	TLS *tls.ConnectionState
+
+	ctx context.Context
+	// stream is the body when it is read as it arrives, streamLength its
+	// announced length
+	stream       io.Reader
+	streamLength int
+}
+
+// Context is cancelled when the client disconnects, the request deadline
+// passes or the server stops. A graceful shutdown only cancels it once the
+// drain deadline passes, long-lived handlers also watch
+// server.ShuttingDown.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// WithContext returns a shallow copy of r using ctx, middleware uses it to
+// pass values down to the next handler.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
+	}
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+// BodyReader returns the body, read from the connection as it arrives when
+// the server streams it instead of filling Body.
+func (r *Request) BodyReader() io.Reader {
+	if r.stream != nil {
+		return r.stream
+	}
+	return bytes.NewReader(r.Body)
+}
+
+// BodyStreamed reports whether the body is read from BodyReader, Body is
+// empty then.
+func (r *Request) BodyStreamed() bool {
+	return r.stream != nil
+}
+
+// ContentLength is the length of the body, including the part of a streamed
+// body that was not read yet.
+func (r *Request) ContentLength() int {
+	if r.stream != nil {
+		return r.streamLength
+	}
+	return len(r.Body)
+}
+
+// SetBodyReader has the handler read the body from body instead of Body,
+// length is the Content-Length the client announced.
+func (r *Request) SetBodyReader(body io.Reader, length int) {
+	r.stream = body
+	r.streamLength = length
+}
+
+func (r *Request) PeerCertificates() []*x509.Certificate {
+	if r.TLS == nil {
+		return nil
+	}
+	return r.TLS.PeerCertificates
 }
 
 func NewRequest() *Request {
@@ -74,10 +208,11 @@ func NewRequest() *Request {
 	}
 }
 
-func (r *Request) parse(data []byte) (int, error) {
+// parse consumes data until the request reaches the stop state
+func (r *Request) parse(data []byte, stop parserState) (int, error) {
 	read := 0
 outer:
-	for {
+	for r.State < stop {
 		currentData := data[read:]
 
 		switch r.State {
@@ -111,7 +246,7 @@ outer:
 			}
 
 		case RequestStateParsingBody:
-			contentLength, err := getInt(r.Headers.Get("Content-Length"), 0)
+			contentLength, err := contentLength(r.Headers)
 			if err != nil {
 				return 0, err
 			}
@@ -122,22 +257,17 @@ outer:
 			}
 
 			if len(currentData) == 0 {
-				if len(r.Body) != contentLength {
-					return 0, ErrorReadingBody
-				}
-				r.State = RequestStateParsed
 				break outer
 			}
 
-			if len(r.Body)+len(currentData) > contentLength {
-				return 0, ErrorBodyLengthExceeded
-			}
+			// Anything past the content length belongs to the next request
+			remaining := contentLength - len(r.Body)
+			chunk := currentData[:min(remaining, len(currentData))]
 
-			r.Body = append(r.Body, currentData...)
-			read += len(currentData)
+			r.Body = append(r.Body, chunk...)
+			read += len(chunk)
 			if len(r.Body) == contentLength {
 				r.State = RequestStateParsed
-				break outer
 			}
 			break outer
 
@@ -173,39 +303,188 @@ func parseRequestLine(data string) (*RequestLine, int, error) {
 	if !rl.ValidateRequestLine() {
 		return nil, -1, ErrorInvalidRequestLine
 	}
+	form, ok := parseTargetForm(rl.Method, rl.RequestTarget)
+	if !ok {
+		return nil, -1, ErrorInvalidRequestTarget
+	}
+	rl.Form = form
 
 	return rl, len(before) + len(SEPARATOR), nil
 }
 
-func RequestFromReader(reader io.Reader) (*Request, error) {
+// Reader reads consecutive requests from a connection, keeping whatever was
+// read past the end of one request for the next.
+type Reader struct {
+	// MaxHeaderBytes and MaxBodyBytes limit the size of a single request,
+	// zero means no limit.
+	MaxHeaderBytes int
+	MaxBodyBytes   int
+
+	reader io.Reader
+	buf    []byte
+	bufIdx int
+	// body is the last streamed body
+	body *bodyReader
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{
+		reader: reader,
+		buf:    make([]byte, 1024),
+	}
+}
+
+// Buffered returns the bytes read from the underlying reader that were not
+// consumed by a request yet.
+func (rr *Reader) Buffered() []byte {
+	return rr.buf[:rr.bufIdx]
+}
+
+// ReadRequest returns io.EOF when the reader ends cleanly between requests.
+func (rr *Reader) ReadRequest() (*Request, error) {
+	request, err := rr.ReadRequestHeader()
+	if err != nil {
+		return nil, err
+	}
+	if err := rr.ReadBody(request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// ReadRequestHeader reads the request line and headers, the body has to be
+// read with ReadBody or StreamBody before the next request.
+func (rr *Reader) ReadRequestHeader() (*Request, error) {
 	request := NewRequest()
-	buf := make([]byte, 1024)
-	bufIdx := 0
-	for request.State != RequestStateParsed {
-		if bufIdx == len(buf) {
-			newBuf := make([]byte, len(buf)*2)
-			copy(newBuf, buf)
-			buf = newBuf
-		}
+	if err := rr.read(request, RequestStateParsingBody); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
 
-		n, err := reader.Read(buf[bufIdx:])
-		if err != nil && err != io.EOF {
-			return nil, err
-		}
+// ReadBody reads the body of a request returned by ReadRequestHeader into
+// Body.
+func (rr *Reader) ReadBody(request *Request) error {
+	return rr.read(request, RequestStateParsed)
+}
 
-		bufIdx += n
-		readN, err := request.parse(buf[:bufIdx])
+// StreamBody lets the handler read the body from BodyReader as it arrives
+// instead of buffering it into Body.
+func (rr *Reader) StreamBody(request *Request) error {
+	contentLength, err := contentLength(request.Headers)
+	if err != nil {
+		return err
+	}
+	rr.body = &bodyReader{rr: rr, remaining: contentLength}
+	request.SetBodyReader(rr.body, contentLength)
+	request.State = RequestStateParsed
+	return nil
+}
+
+// BodyPending reports whether the handler left part of a streamed body
+// unread, the connection cannot be used for another request then.
+func (rr *Reader) BodyPending() bool {
+	return rr.body != nil && rr.body.remaining > 0
+}
+
+func (rr *Reader) read(request *Request, stop parserState) error {
+	headerBytes := 0
+	for {
+		readN, err := request.parse(rr.buf[:rr.bufIdx], stop)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		// Removing the parsed data from the buffer
-		copy(buf, buf[readN:bufIdx])
-		bufIdx -= readN
+		copy(rr.buf, rr.buf[readN:rr.bufIdx])
+		rr.bufIdx -= readN
+
+		if request.State < RequestStateParsingBody {
+			headerBytes += readN
+			if rr.MaxHeaderBytes > 0 && headerBytes+rr.bufIdx > rr.MaxHeaderBytes {
+				return ErrorHeaderTooLarge
+			}
+		} else {
+			contentLength, err := contentLength(request.Headers)
+			if err != nil {
+				return err
+			}
+			if rr.MaxBodyBytes > 0 && contentLength > rr.MaxBodyBytes {
+				return ErrorBodyTooLarge
+			}
+		}
+
+		if request.State >= stop {
+			return nil
+		}
 
-		if err == io.EOF && request.State != RequestStateParsed {
-			return nil, ErrorParsingRequestLine
+		if rr.bufIdx == len(rr.buf) {
+			newBuf := make([]byte, len(rr.buf)*2)
+			copy(newBuf, rr.buf)
+			rr.buf = newBuf
+		}
+
+		n, err := rr.reader.Read(rr.buf[rr.bufIdx:])
+		rr.bufIdx += n
+		if err != nil && err != io.EOF {
+			return err
 		}
+		if err == io.EOF && n == 0 {
+			switch {
+			case request.State == RequestStateInit && rr.bufIdx == 0:
+				return io.EOF
+			case request.State == RequestStateParsingBody:
+				return ErrorReadingBody
+			default:
+				return ErrorParsingRequestLine
+			}
+		}
+	}
+}
+
+// bodyReader reads a streamed body, first from what the Reader buffered past
+// the headers and then from the connection.
+type bodyReader struct {
+	rr        *Reader
+	remaining int
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.remaining == 0 {
+		return 0, io.EOF
+	}
+	p = p[:min(len(p), b.remaining)]
+
+	rr := b.rr
+	if rr.bufIdx > 0 {
+		n := copy(p, rr.buf[:rr.bufIdx])
+		copy(rr.buf, rr.buf[n:rr.bufIdx])
+		rr.bufIdx -= n
+		b.remaining -= n
+		return n, nil
+	}
+
+	n, err := rr.reader.Read(p)
+	b.remaining -= n
+	if err == io.EOF && b.remaining > 0 {
+		err = ErrorReadingBody
+	} else if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func RequestFromReader(reader io.Reader) (*Request, error) {
+	rr := NewReader(reader)
+	request, err := rr.ReadRequest()
+	if err == io.EOF {
+		return nil, ErrorParsingRequestLine
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(rr.Buffered()) > 0 {
+		return nil, ErrorBodyLengthExceeded
 	}
 
 	return request, nil
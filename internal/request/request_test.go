@@ -3,6 +3,7 @@ package request
 import (
 	"io"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -74,10 +75,38 @@ func TestRequestFromReader(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "HEAD",
+			reader: &chunkReader{
+				data:            "HEAD /coffee HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+				numBytesPerRead: 3,
+			},
+			want: &Request{
+				RequestLine: RequestLine{
+					Method:        "HEAD",
+					RequestTarget: "/coffee",
+					HttpVersion:   "1.1",
+				},
+			},
+		},
+		{
+			name: "Extension method",
+			reader: &chunkReader{
+				data:            "PROPFIND /coffee HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+				numBytesPerRead: 3,
+			},
+			want: &Request{
+				RequestLine: RequestLine{
+					Method:        "PROPFIND",
+					RequestTarget: "/coffee",
+					HttpVersion:   "1.1",
+				},
+			},
+		},
 		{
 			name: "Invalid method",
 			reader: &chunkReader{
-				data:            "WRONG /coffee HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n",
+				data:            "GET@ /coffee HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n",
 				numBytesPerRead: 3,
 			},
 			wantErr: true,
@@ -172,3 +201,158 @@ func TestParseBody(t *testing.T) {
 	_, err = RequestFromReader(reader)
 	require.Error(t, err)
 }
+
+func TestReaderPipelined(t *testing.T) {
+	reader := NewReader(&chunkReader{
+		data: "POST /first HTTP/1.1\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"helloGET /second HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"\r\n",
+		numBytesPerRead: 7,
+	})
+
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/first", r.RequestLine.RequestTarget)
+	assert.Equal(t, "hello", string(r.Body))
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+	assert.Equal(t, "localhost:42069", r.Headers.Get("Host"))
+
+	_, err = reader.ReadRequest()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReaderStreamBody(t *testing.T) {
+	reader := NewReader(&chunkReader{
+		data: "POST /first HTTP/1.1\r\n" +
+			"Content-Length: 11\r\n" +
+			"\r\n" +
+			"hello worldGET /second HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"\r\n",
+		numBytesPerRead: 7,
+	})
+
+	r, err := reader.ReadRequestHeader()
+	require.NoError(t, err)
+	require.NoError(t, reader.StreamBody(r))
+	assert.True(t, r.BodyStreamed())
+	assert.Equal(t, 11, r.ContentLength())
+	assert.True(t, reader.BodyPending())
+
+	body, err := io.ReadAll(r.BodyReader())
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(body))
+	assert.Empty(t, r.Body)
+	assert.False(t, reader.BodyPending())
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+	assert.False(t, r.BodyStreamed())
+
+	// The connection ends before the body does
+	reader = NewReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nhello"))
+	r, err = reader.ReadRequestHeader()
+	require.NoError(t, err)
+	require.NoError(t, reader.StreamBody(r))
+	_, err = io.ReadAll(r.BodyReader())
+	assert.Equal(t, ErrorReadingBody, err)
+}
+
+func TestReaderBodyFraming(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers string
+		wantErr error
+	}{
+		{name: "content-length", headers: "Content-Length: 5\r\n"},
+		{name: "transfer-encoding", headers: "Transfer-Encoding: chunked\r\n", wantErr: ErrorTransferEncoding},
+		{name: "content-length and transfer-encoding", headers: "Transfer-Encoding: chunked\r\nContent-Length: 5\r\n", wantErr: ErrorInvalidContentLength},
+		{name: "duplicate content-length", headers: "Content-Length: 5\r\nContent-Length: 5\r\n", wantErr: ErrorInvalidContentLength},
+		{name: "conflicting content-length", headers: "Content-Length: 5\r\nContent-Length: 6\r\n", wantErr: ErrorInvalidContentLength},
+		{name: "list in one field", headers: "Content-Length: 5,5\r\n", wantErr: ErrorInvalidContentLength},
+		{name: "plus sign", headers: "Content-Length: +5\r\n", wantErr: ErrorInvalidContentLength},
+		{name: "negative", headers: "Content-Length: -5\r\n", wantErr: ErrorInvalidContentLength},
+		{name: "not a number", headers: "Content-Length: five\r\n", wantErr: ErrorInvalidContentLength},
+		{name: "empty", headers: "Content-Length:\r\n", wantErr: ErrorInvalidContentLength},
+		{name: "overflow", headers: "Content-Length: 99999999999999999999\r\n", wantErr: ErrorInvalidContentLength},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := "POST / HTTP/1.1\r\nHost: localhost\r\n" + tt.headers + "\r\nhello"
+			r, err := NewReader(strings.NewReader(data)).ReadRequest()
+			if tt.wantErr != nil {
+				assert.Equal(t, tt.wantErr, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "hello", string(r.Body))
+
+			// Streaming checks the same way
+			reader := NewReader(strings.NewReader(data))
+			r, err = reader.ReadRequestHeader()
+			require.NoError(t, err)
+			require.NoError(t, reader.StreamBody(r))
+		})
+	}
+}
+
+func TestReaderLimits(t *testing.T) {
+	reader := NewReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\n\r\n",
+		numBytesPerRead: 8,
+	})
+	reader.MaxHeaderBytes = 32
+	_, err := reader.ReadRequest()
+	assert.Equal(t, ErrorHeaderTooLarge, err)
+
+	reader = NewReader(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: 13\r\n\r\nhello world!\n",
+		numBytesPerRead: 8,
+	})
+	reader.MaxBodyBytes = 10
+	_, err = reader.ReadRequest()
+	assert.Equal(t, ErrorBodyTooLarge, err)
+}
+
+func TestRequestTargetForms(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    TargetForm
+		wantErr error
+	}{
+		{name: "origin form", line: "GET /coffee?size=large HTTP/1.1", want: OriginForm},
+		{name: "absolute form", line: "GET http://example.com/coffee HTTP/1.1", want: AbsoluteForm},
+		{name: "authority form", line: "CONNECT example.com:443 HTTP/1.1", want: AuthorityForm},
+		{name: "ipv6 authority form", line: "CONNECT [2001:db8::1]:443 HTTP/1.1", want: AuthorityForm},
+		{name: "asterisk form", line: "OPTIONS * HTTP/1.1", want: AsteriskForm},
+		{name: "connect without port", line: "CONNECT example.com HTTP/1.1", wantErr: ErrorInvalidRequestTarget},
+		{name: "connect with path", line: "CONNECT example.com:443/x HTTP/1.1", wantErr: ErrorInvalidRequestTarget},
+		{name: "asterisk with get", line: "GET * HTTP/1.1", wantErr: ErrorInvalidRequestTarget},
+		{name: "relative target", line: "GET coffee HTTP/1.1", wantErr: ErrorInvalidRequestTarget},
+		{name: "unsupported scheme", line: "GET ftp://example.com/ HTTP/1.1", wantErr: ErrorInvalidRequestTarget},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := RequestFromReader(&chunkReader{
+				data:            tt.line + "\r\nHost: example.com\r\n\r\n",
+				numBytesPerRead: 5,
+			})
+			if tt.wantErr != nil {
+				assert.Equal(t, tt.wantErr, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, r.RequestLine.Form)
+		})
+	}
+}
@@ -5,15 +5,32 @@ import (
 	"fmt"
 	"http-from-tcp/internal/headers"
 	"io"
+	"maps"
+	"net"
 	"strconv"
 )
 
 type StatusCode uint16
 
 const (
-	StatusOK                  StatusCode = 200
-	StatusBadRequest          StatusCode = 400
-	StatusInternalServerError StatusCode = 500
+	StatusSwitchingProtocols          StatusCode = 101
+	StatusOK                          StatusCode = 200
+	StatusNoContent                   StatusCode = 204
+	StatusNotModified                 StatusCode = 304
+	StatusBadRequest                  StatusCode = 400
+	StatusForbidden                   StatusCode = 403
+	StatusNotFound                    StatusCode = 404
+	StatusMethodNotAllowed            StatusCode = 405
+	StatusProxyAuthRequired           StatusCode = 407
+	StatusContentTooLarge             StatusCode = 413
+	StatusUpgradeRequired             StatusCode = 426
+	StatusTooManyRequests             StatusCode = 429
+	StatusRequestHeaderFieldsTooLarge StatusCode = 431
+	StatusInternalServerError         StatusCode = 500
+	StatusNotImplemented              StatusCode = 501
+	StatusBadGateway                  StatusCode = 502
+	StatusServiceUnavailable          StatusCode = 503
+	StatusGatewayTimeout              StatusCode = 504
 )
 
 type writeState uint16
@@ -29,12 +46,42 @@ const HTTPVersion = "1.1"
 
 func getReason(sc StatusCode) string {
 	switch sc {
+	case StatusSwitchingProtocols:
+		return "Switching Protocols"
 	case StatusOK:
 		return "OK"
+	case StatusNoContent:
+		return "No Content"
+	case StatusNotModified:
+		return "Not Modified"
 	case StatusBadRequest:
 		return "Bad Request"
+	case StatusForbidden:
+		return "Forbidden"
+	case StatusNotFound:
+		return "Not Found"
+	case StatusMethodNotAllowed:
+		return "Method Not Allowed"
+	case StatusProxyAuthRequired:
+		return "Proxy Authentication Required"
+	case StatusContentTooLarge:
+		return "Content Too Large"
+	case StatusUpgradeRequired:
+		return "Upgrade Required"
+	case StatusTooManyRequests:
+		return "Too Many Requests"
+	case StatusRequestHeaderFieldsTooLarge:
+		return "Request Header Fields Too Large"
 	case StatusInternalServerError:
 		return "Internal Server Error"
+	case StatusNotImplemented:
+		return "Not Implemented"
+	case StatusBadGateway:
+		return "Bad Gateway"
+	case StatusServiceUnavailable:
+		return "Service Unavailable"
+	case StatusGatewayTimeout:
+		return "Gateway Timeout"
 	default:
 		return ""
 	}
@@ -50,59 +97,176 @@ func GetDefaultHeaders(contentLen int) headers.Headers {
 	return h
 }
 
+// writeStatus is shared by every copy of a Writer, handlers receive the
+// Writer by value and wrappers still need to see what was written.
+type writeStatus struct {
+	state        writeState
+	statusCode   StatusCode
+	headers      headers.Headers
+	bytesWritten int
+	bodyWritten  int
+	hijack       Hijacker
+	hijacked     bool
+}
+
+var ErrorNotHijackable = fmt.Errorf("connection cannot be hijacked")
+var ErrorNoWriter = fmt.Errorf("response writer has nothing to write to")
+var ErrorHijacked = fmt.Errorf("connection has been hijacked")
+
+// Hijacker takes the connection away from the server, returning the bytes
+// the server read from it past the current request.
+type Hijacker func() (net.Conn, []byte, error)
+
 type Writer struct {
 	io.Writer
-	state writeState
+	status *writeStatus
 }
 
 func NewWrite(w io.Writer) Writer {
+	switch rw := w.(type) {
+	case Writer:
+		return rw
+	case *Writer:
+		return *rw
+	}
 	return Writer{
 		Writer: w,
-		state:  NothingWritten,
+		status: &writeStatus{state: NothingWritten},
+	}
+}
+
+// NewHijackableWrite is used by the server so handlers can take over the
+// connection with Hijack.
+func NewHijackableWrite(w io.Writer, hijack Hijacker) Writer {
+	rw := NewWrite(w)
+	rw.status.hijack = hijack
+	return rw
+}
+
+// Hijack hands the raw connection to the caller, which becomes responsible
+// for closing it. The returned bytes were sent by the client after the
+// request and must be consumed before reading from the connection. Writes
+// through w fail from then on and the request context no longer follows the
+// client, it is still cancelled when the handler returns.
+func (w Writer) Hijack() (net.Conn, []byte, error) {
+	if !w.Hijackable() {
+		return nil, nil, ErrorNotHijackable
+	}
+	conn, buffered, err := w.status.hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.status.hijacked = true
+	return conn, buffered, nil
+}
+
+// Hijackable reports whether Hijack would succeed
+func (w Writer) Hijackable() bool {
+	return w.status != nil && w.status.hijack != nil && !w.status.hijacked
+}
+
+func (w Writer) Hijacked() bool {
+	return w.status != nil && w.status.hijacked
+}
+
+// Write passes p through uncounted on a zero Writer, the byte counts live
+// in the status the constructors allocate.
+func (w Writer) Write(p []byte) (int, error) {
+	if w.Writer == nil {
+		return 0, ErrorNoWriter
+	}
+	if w.status == nil {
+		return w.Writer.Write(p)
+	}
+	if w.status.hijacked {
+		return 0, ErrorHijacked
+	}
+	n, err := w.Writer.Write(p)
+	w.status.bytesWritten += n
+	return n, err
+}
+
+func (w Writer) StatusCode() StatusCode {
+	if w.status == nil {
+		return 0
+	}
+	return w.status.statusCode
+}
+
+func (w Writer) Headers() headers.Headers {
+	if w.status == nil {
+		return nil
+	}
+	return w.status.headers
+}
+
+func (w Writer) BytesWritten() int {
+	if w.status == nil {
+		return 0
+	}
+	return w.status.bytesWritten
+}
+
+func (w Writer) BodyWritten() int {
+	if w.status == nil {
+		return 0
+	}
+	return w.status.bodyWritten
+}
+
+// initStatus lets the write methods work on a zero Writer
+func (w *Writer) initStatus() {
+	if w.status == nil {
+		w.status = &writeStatus{state: NothingWritten}
 	}
 }
 
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
-	if w.state != NothingWritten {
+	w.initStatus()
+	if w.status.state != NothingWritten {
 		return errors.New("incorrect order should be written first")
 	}
 	statusLine := fmt.Sprintf("HTTP/%s %v %s\r\n", HTTPVersion, statusCode, getReason(statusCode))
 	_, err := w.Write([]byte(statusLine))
 
-	w.state = StatusLineWritten
+	w.status.state = StatusLineWritten
+	w.status.statusCode = statusCode
 	return err
 }
 
 func (w *Writer) WriteHeaders(headers headers.Headers) error {
-	if w.state != StatusLineWritten {
+	w.initStatus()
+	if w.status.state != StatusLineWritten {
 		return errors.New("incorrect order should be written after status line")
 	}
-	for key, value := range headers {
-		header := fmt.Sprintf("%s: %s\r\n", key, value)
-		_, err := w.Write([]byte(header))
-		if err != nil {
-			return err
-		}
+	if err := w.writeFields(headers); err != nil {
+		return err
 	}
 	_, err := w.Write([]byte("\r\n"))
 	if err != nil {
 		return err
 	}
 
-	w.state = HeaderWritten
+	w.status.state = HeaderWritten
+	w.status.headers = maps.Clone(headers)
 	return nil
 }
 
+// WriteBody can be called repeatedly to stream a body of known length.
 func (w *Writer) WriteBody(body []byte) (int, error) {
-	if w.state != HeaderWritten {
+	w.initStatus()
+	if w.status.state != HeaderWritten && w.status.state != BodyWritten {
 		return 0, errors.New("incorrect order should be written after header")
 	}
 
-	w.state = BodyWritten
-	return w.Write(body)
+	w.status.state = BodyWritten
+	n, err := w.Write(body)
+	w.status.bodyWritten += n
+	return n, err
 }
 
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	w.initStatus()
 	l := len(p)
 	wl := 0
 
@@ -118,6 +282,7 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 		return 0, err
 	}
 	wl += n
+	w.status.bodyWritten += n
 
 	n, err = w.Write([]byte("\r\n"))
 	if err != nil {
@@ -133,13 +298,23 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 }
 
 func (w *Writer) WriteTrailers(h headers.Headers) error {
-	for key, value := range h {
-		header := fmt.Sprintf("%s: %s\r\n", key, value)
-		_, err := w.Write([]byte(header))
-		if err != nil {
-			return err
-		}
+	w.initStatus()
+	if err := w.writeFields(h); err != nil {
+		return err
 	}
 	_, err := w.Write([]byte("\r\n"))
 	return err
 }
+
+func (w *Writer) writeFields(h headers.Headers) error {
+	for key := range h {
+		for _, value := range h.Values(key) {
+			header := fmt.Sprintf("%s: %s\r\n", key, value)
+			_, err := w.Write([]byte(header))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
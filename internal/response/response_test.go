@@ -0,0 +1,45 @@
+package response
+
+import (
+	"bytes"
+	"http-from-tcp/internal/headers"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestZeroWriter(t *testing.T) {
+	var w Writer
+	assert.Equal(t, 0, w.BytesWritten())
+	assert.Equal(t, 0, w.BodyWritten())
+	assert.Equal(t, StatusCode(0), w.StatusCode())
+	assert.Nil(t, w.Headers())
+	assert.False(t, w.Hijacked())
+
+	_, err := w.Write([]byte("x"))
+	assert.ErrorIs(t, err, ErrorNoWriter)
+	_, _, err = w.Hijack()
+	assert.ErrorIs(t, err, ErrorNotHijackable)
+
+	var buf bytes.Buffer
+	w = Writer{Writer: &buf}
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(2)))
+	_, err = w.WriteBody([]byte("ok"))
+	require.NoError(t, err)
+	assert.Equal(t, StatusOK, w.StatusCode())
+	assert.Equal(t, 2, w.BodyWritten())
+	assert.Equal(t, buf.Len(), w.BytesWritten())
+}
+
+func TestWriteHeadersSetCookie(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWrite(&buf)
+	h := headers.NewHeaders()
+	h.Set("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT")
+	h.Set("Set-Cookie", "b=2")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(h))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nset-cookie: a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT\r\nset-cookie: b=2\r\n\r\n", buf.String())
+}
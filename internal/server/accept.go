@@ -0,0 +1,33 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// acceptErrorType names the errors Accept can recover from. Anything else,
+// like the listener being closed underneath the server, is fatal.
+func acceptErrorType(err error) (string, bool) {
+	if kind, ok := acceptErrnoType(err); ok {
+		return kind, true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout", true
+	}
+	return "fatal", false
+}
+
+func nextAcceptBackoff(current time.Duration) time.Duration {
+	if current == 0 {
+		return minAcceptBackoff
+	}
+	return min(current*2, maxAcceptBackoff)
+}
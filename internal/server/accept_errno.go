@@ -0,0 +1,29 @@
+//go:build !plan9
+
+package server
+
+import (
+	"errors"
+	"syscall"
+)
+
+// acceptErrnoType classifies the errno behind a recoverable Accept error
+func acceptErrnoType(err error) (string, bool) {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return "", false
+	}
+	switch errno {
+	case syscall.EMFILE:
+		return "emfile", true
+	case syscall.ENFILE:
+		return "enfile", true
+	case syscall.ENOBUFS, syscall.ENOMEM:
+		return "no_memory", true
+	case syscall.ECONNABORTED, syscall.ECONNRESET, syscall.EPROTO:
+		return "aborted", true
+	case syscall.EINTR, syscall.EAGAIN:
+		return "interrupted", true
+	}
+	return "", false
+}
@@ -0,0 +1,7 @@
+package server
+
+// acceptErrnoType finds nothing to recover from, plan9 reports errors as
+// strings rather than errnos
+func acceptErrnoType(err error) (string, bool) {
+	return "", false
+}
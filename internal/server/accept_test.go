@@ -0,0 +1,108 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type flakyListener struct {
+	net.Listener
+	errs chan error
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	select {
+	case err := <-l.errs:
+		return nil, err
+	default:
+		return l.Listener.Accept()
+	}
+}
+
+func TestAcceptErrorType(t *testing.T) {
+	tests := []struct {
+		err       error
+		want      string
+		temporary bool
+	}{
+		{err: &net.OpError{Op: "accept", Err: os.NewSyscallError("accept", syscall.EMFILE)}, want: "emfile", temporary: true},
+		{err: &net.OpError{Op: "accept", Err: os.NewSyscallError("accept", syscall.ECONNABORTED)}, want: "aborted", temporary: true},
+		{err: net.ErrClosed, want: "fatal", temporary: false},
+		{err: errors.New("boom"), want: "fatal", temporary: false},
+	}
+
+	for _, tt := range tests {
+		got, temporary := acceptErrorType(tt.err)
+		assert.Equal(t, tt.want, got)
+		assert.Equal(t, tt.temporary, temporary)
+	}
+}
+
+func TestAcceptLoopBacksOff(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	flaky := &flakyListener{Listener: l, errs: make(chan error, 10)}
+	for range 3 {
+		flaky.errs <- &net.OpError{Op: "accept", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	}
+
+	metrics := NewMetrics()
+	s, err := NewServer(flaky, okHandler, WithMetrics(metrics, ""))
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve()
+	}()
+
+	// Still serving after the temporary errors
+	get := func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		io.ReadAll(conn)
+	}
+	get()
+	assert.Equal(t, float64(3), metrics.AcceptErrors.Value("emfile"))
+
+	// A fatal error reaches the caller of Serve
+	flaky.errs <- errors.New("listener broke")
+	get()
+	select {
+	case err := <-served:
+		assert.EqualError(t, err, "listener broke")
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve did not return the fatal error")
+	}
+	assert.EqualError(t, s.Wait(), "listener broke")
+}
+
+func TestWait(t *testing.T) {
+	s, err := New(ServerConfig{Listen: []ListenAddr{portAddr(0)}, Handler: okHandler})
+	require.NoError(t, err)
+	require.NoError(t, s.Listen())
+	go s.Serve()
+
+	waited := make(chan error, 1)
+	go func() {
+		waited <- s.Wait()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	s.Close()
+	select {
+	case err := <-waited:
+		assert.ErrorIs(t, err, ErrServerClosed)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Wait did not return after Close")
+	}
+}
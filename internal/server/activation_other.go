@@ -0,0 +1,21 @@
+//go:build !unix
+
+package server
+
+import (
+	"fmt"
+	"net"
+)
+
+var ErrorActivationNotSupported = fmt.Errorf("socket activation is not supported on this platform")
+
+// ActivationListeners always fails, socket activation needs inherited unix
+// file descriptors.
+func ActivationListeners(name string) ([]net.Listener, []string, error) {
+	return nil, nil, ErrorActivationNotSupported
+}
+
+// inheritedListeners finds nothing, so every address is bound afresh
+func inheritedListeners(name string) ([]net.Listener, error) {
+	return nil, nil
+}
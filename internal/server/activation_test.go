@@ -0,0 +1,95 @@
+//go:build unix
+
+package server
+
+import (
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestActivationHelper is the child process started by TestSocketActivation,
+// it plays the part of the service systemd starts.
+func TestActivationHelper(t *testing.T) {
+	if os.Getenv("ACTIVATION_HELPER") != "1" {
+		t.Skip("only runs as a child process")
+	}
+	// systemd sets LISTEN_PID after forking, the harness cannot know it
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+
+	s, err := New(ServerConfig{
+		Listen: []ListenAddr{{Network: "systemd", Address: "web"}},
+		Handler: func(w response.Writer, req *request.Request) {
+			body := "served by " + strconv.Itoa(os.Getpid())
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+			w.WriteBody([]byte(body))
+		},
+	})
+	require.NoError(t, err)
+	go s.ListenAndServe()
+	time.Sleep(5 * time.Second)
+}
+
+func TestSocketActivation(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	f, err := l.(*net.TCPListener).File()
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestActivationHelper$")
+	cmd.Env = append(os.Environ(), "ACTIVATION_HELPER=1", "LISTEN_FDS=1", "LISTEN_FDNAMES=web")
+	cmd.ExtraFiles = []*os.File{f}
+	require.NoError(t, cmd.Start())
+	f.Close()
+	defer cmd.Process.Kill()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	body, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "served by "+strconv.Itoa(cmd.Process.Pid))
+}
+
+func TestInheritedListenerReleasesSocket(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	f, err := l.(*net.TCPListener).File()
+	require.NoError(t, err)
+	l.Close()
+
+	_, err = inheritedFiles()
+	require.NoError(t, err)
+	inherited.mu.Lock()
+	inherited.files = []inheritedFile{{file: f, name: "web"}}
+	inherited.mu.Unlock()
+
+	listeners, err := inheritedListeners("web")
+	require.NoError(t, err)
+	require.Len(t, listeners, 1)
+	_, err = f.Stat()
+	assert.ErrorIs(t, err, os.ErrClosed)
+	assert.Empty(t, inherited.files)
+
+	// With the listener closed nothing holds the port any more
+	require.NoError(t, listeners[0].Close())
+	l, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+	l.Close()
+}
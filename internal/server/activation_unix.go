@@ -0,0 +1,138 @@
+//go:build unix
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+type inheritedFile struct {
+	file *os.File
+	name string
+}
+
+var inherited struct {
+	once sync.Once
+	err  error
+
+	// files still waiting to be turned into listeners
+	mu    sync.Mutex
+	files []inheritedFile
+}
+
+// forActivation reports whether the LISTEN_* variables are meant for this
+// process. systemd sets LISTEN_PID, a process started by Upgrade cannot know
+// its own pid up front and names its parent instead.
+func forActivation() bool {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err == nil && pid == os.Getpid() {
+		return true
+	}
+	if ppid, err := strconv.Atoi(os.Getenv(upgradeParentEnv)); err == nil && ppid == os.Getppid() {
+		return true
+	}
+	return false
+}
+
+// inheritedFiles reads LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES once and
+// unsets them so they do not leak into child processes.
+func inheritedFiles() ([]inheritedFile, error) {
+	inherited.once.Do(func() {
+		defer os.Unsetenv("LISTEN_PID")
+		defer os.Unsetenv("LISTEN_FDS")
+		defer os.Unsetenv("LISTEN_FDNAMES")
+		defer os.Unsetenv(upgradeParentEnv)
+
+		if !forActivation() {
+			return
+		}
+		count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || count <= 0 {
+			inherited.err = fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+			return
+		}
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+		for i := range count {
+			fd := listenFdsStart + i
+			syscall.CloseOnExec(fd)
+
+			name := "unknown"
+			if i < len(names) && names[i] != "" {
+				name = names[i]
+			}
+			inherited.files = append(inherited.files, inheritedFile{
+				file: os.NewFile(uintptr(fd), name),
+				name: name,
+			})
+		}
+	})
+	return inherited.files, inherited.err
+}
+
+// takeListeners wraps the inherited descriptors accepted by match as
+// listeners. Their files are closed once wrapped, net.FileListener keeps a
+// duplicate, so closing the listener releases the socket.
+func takeListeners(match func(name string) bool) ([]net.Listener, []string, error) {
+	if _, err := inheritedFiles(); err != nil {
+		return nil, nil, err
+	}
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+
+	listeners := []net.Listener{}
+	names := []string{}
+	remaining := []inheritedFile{}
+	var err error
+	for _, f := range inherited.files {
+		if err != nil || !match(f.name) {
+			remaining = append(remaining, f)
+			continue
+		}
+		l, lerr := net.FileListener(f.file)
+		f.file.Close()
+		if lerr != nil {
+			err = fmt.Errorf("inherited fd %s: %w", f.name, lerr)
+			continue
+		}
+		listeners = append(listeners, l)
+		names = append(names, f.name)
+	}
+	inherited.files = remaining
+	if err != nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, nil, err
+	}
+	return listeners, names, nil
+}
+
+// ActivationListeners wraps the descriptors passed through socket activation
+// as listeners and returns them with their names. An empty name returns all
+// of them.
+func ActivationListeners(name string) ([]net.Listener, []string, error) {
+	listeners, names, err := takeListeners(func(n string) bool { return name == "" || n == name })
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(listeners) == 0 {
+		if name == "" {
+			return nil, nil, fmt.Errorf("no listeners passed through socket activation")
+		}
+		return nil, nil, fmt.Errorf("no listener named %q passed through socket activation", name)
+	}
+	return listeners, names, nil
+}
+
+// inheritedListeners returns the inherited sockets named name, there is more
+// than one when the parent listened with SO_REUSEPORT.
+func inheritedListeners(name string) ([]net.Listener, error) {
+	listeners, _, err := takeListeners(func(n string) bool { return n == name })
+	return listeners, err
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"crypto/x509"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"path"
+	"strings"
+)
+
+// ClientCertPolicy lists glob patterns (path.Match syntax) a verified client
+// certificate has to match. A certificate is allowed when its subject common
+// name matches one of Subjects or any of its SANs matches one of SANs.
+// Matching ignores case.
+type ClientCertPolicy struct {
+	Subjects []string
+	SANs     []string
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func certSANs(cert *x509.Certificate) []string {
+	sans := []string{}
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
+
+func lowerAll(values []string) []string {
+	lowered := make([]string, len(values))
+	for i, v := range values {
+		lowered[i] = strings.ToLower(v)
+	}
+	return lowered
+}
+
+func (p ClientCertPolicy) normalize() ClientCertPolicy {
+	return ClientCertPolicy{Subjects: lowerAll(p.Subjects), SANs: lowerAll(p.SANs)}
+}
+
+func (p ClientCertPolicy) Allows(cert *x509.Certificate) bool {
+	return p.normalize().allows(cert)
+}
+
+// allows expects the patterns of p to be lowercase already
+func (p ClientCertPolicy) allows(cert *x509.Certificate) bool {
+	if matchAny(p.Subjects, strings.ToLower(cert.Subject.CommonName)) {
+		return true
+	}
+	for _, san := range certSANs(cert) {
+		if matchAny(p.SANs, strings.ToLower(san)) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireClientCert answers 403 unless the request came with a verified
+// client certificate allowed by policy.
+func RequireClientCert(policy ClientCertPolicy) Middleware {
+	policy = policy.normalize()
+	return func(next Handler) Handler {
+		return func(w response.Writer, req *request.Request) {
+			if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || !policy.allows(req.TLS.PeerCertificates[0]) {
+				he := &HandlerError{
+					StatusCode: response.StatusForbidden,
+					Message:    "client certificate not authorized",
+				}
+				he.Write(w)
+				return
+			}
+			next(w, req)
+		}
+	}
+}
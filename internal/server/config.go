@@ -0,0 +1,207 @@
+package server
+
+import (
+	"fmt"
+	"http-from-tcp/internal/request"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultReadTimeout    = 30 * time.Second
+	defaultIdleTimeout    = 2 * time.Minute
+	defaultMaxHeaderBytes = 1 << 20
+)
+
+type ListenAddr struct {
+	// Network is one of tcp, tcp4, tcp6, unix or systemd. For systemd the
+	// address is the LISTEN_FDNAMES entry to use, empty takes every
+	// inherited socket.
+	Network string
+	Address string
+	// FileMode is applied to unix domain sockets after they are created
+	FileMode os.FileMode
+}
+
+func (a ListenAddr) String() string {
+	return a.Network + "://" + a.Address
+}
+
+// ParseListenAddr accepts ":8080", "127.0.0.1:8080", "[::1]:8080",
+// "tcp4://0.0.0.0:8080", "tcp6://[::]:8080", "unix:///run/app.sock" and
+// "systemd://" or "systemd://name" for socket activation.
+func ParseListenAddr(addr string) (ListenAddr, error) {
+	network, address, ok := strings.Cut(addr, "://")
+	if !ok {
+		network, address = "tcp", addr
+	}
+
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return ListenAddr{}, fmt.Errorf("invalid listen address %q: %w", addr, err)
+		}
+	case "systemd":
+	case "unix":
+		if address == "" {
+			return ListenAddr{}, fmt.Errorf("invalid listen address %q: missing socket path", addr)
+		}
+	default:
+		return ListenAddr{}, fmt.Errorf("invalid listen address %q: unsupported network %s", addr, network)
+	}
+	return ListenAddr{Network: network, Address: address}, nil
+}
+
+type Limits struct {
+	MaxHeaderBytes int
+	// MaxBodyBytes of zero means no limit
+	MaxBodyBytes int
+	// MaxRequestsPerConn closes keep-alive connections after that many
+	// requests, zero means no limit
+	MaxRequestsPerConn int
+
+	// MaxConns caps open connections and MaxConcurrentRequests caps requests
+	// inside the handler, zero means no limit. Up to QueueSize connections or
+	// requests over a cap wait QueueTimeout for a slot, the rest are answered
+	// 503 with a Retry-After of RetryAfter. A request stops counting towards
+	// MaxConcurrentRequests once its connection is hijacked.
+	MaxConns              int
+	MaxConcurrentRequests int
+	QueueSize             int
+	QueueTimeout          time.Duration
+	RetryAfter            time.Duration
+}
+
+type Timeouts struct {
+	// Read bounds reading the first request on a connection
+	Read time.Duration
+	// Write bounds writing a response, zero means no limit
+	Write time.Duration
+	// Idle bounds waiting for the next request on a keep-alive connection
+	Idle time.Duration
+	// Request is the deadline on the request context, zero means no limit
+	Request time.Duration
+}
+
+type ServerConfig struct {
+	Listen  []ListenAddr
+	Handler Handler
+	Logger  *slog.Logger
+
+	Limits   Limits
+	Timeouts Timeouts
+
+	// IPFilter is checked right after Accept, denied connections are closed
+	// or, with IPFilterForbidden, answered 403 without reading the request.
+	IPFilter          *IPFilter
+	IPFilterForbidden bool
+
+	// ReusePort opens that many sockets per TCP address with SO_REUSEPORT,
+	// each with its own accept loop. Prefork workers need at least 1.
+	ReusePort int
+
+	TLS         *TLSConfig
+	Metrics     *Metrics
+	MetricsPath string
+
+	// H2C serves HTTP/2 on plain connections to clients that start with the
+	// HTTP/2 preface or ask for it with Upgrade: h2c.
+	H2C bool
+
+	// StreamBody picks the requests whose body is left on the connection
+	// for the handler to read from BodyReader instead of being buffered.
+	StreamBody func(*request.Request) bool
+}
+
+func (c *ServerConfig) setDefaults() {
+	if c.Logger == nil {
+		c.Logger = slog.Default()
+	}
+	if c.Limits.MaxHeaderBytes == 0 {
+		c.Limits.MaxHeaderBytes = defaultMaxHeaderBytes
+	}
+	if c.Limits.QueueTimeout == 0 {
+		c.Limits.QueueTimeout = defaultQueueTimeout
+	}
+	if c.Limits.RetryAfter == 0 {
+		c.Limits.RetryAfter = defaultRetryAfter
+	}
+	if c.Timeouts.Read == 0 {
+		c.Timeouts.Read = defaultReadTimeout
+	}
+	if c.Timeouts.Idle == 0 {
+		c.Timeouts.Idle = defaultIdleTimeout
+	}
+}
+
+type Option func(*ServerConfig)
+
+func WithListen(addrs ...ListenAddr) Option {
+	return func(c *ServerConfig) {
+		c.Listen = append(c.Listen, addrs...)
+	}
+}
+
+func WithLogger(l *slog.Logger) Option {
+	return func(c *ServerConfig) {
+		c.Logger = l
+	}
+}
+
+func WithLimits(l Limits) Option {
+	return func(c *ServerConfig) {
+		c.Limits = l
+	}
+}
+
+func WithTimeouts(t Timeouts) Option {
+	return func(c *ServerConfig) {
+		c.Timeouts = t
+	}
+}
+
+// WithRequestTimeout cancels the request context once d has passed since the
+// request was read.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(c *ServerConfig) {
+		c.Timeouts.Request = d
+	}
+}
+
+// WithMetrics records server metrics into m and serves them on path.
+func WithMetrics(m *Metrics, path string) Option {
+	return func(c *ServerConfig) {
+		c.Metrics = m
+		c.MetricsPath = path
+	}
+}
+
+// WithTLS terminates TLS on every listener using cfg.
+func WithTLS(cfg TLSConfig) Option {
+	return func(c *ServerConfig) {
+		c.TLS = &cfg
+	}
+}
+
+// WithH2C serves HTTP/2 over cleartext next to HTTP/1.1
+func WithH2C() Option {
+	return func(c *ServerConfig) {
+		c.H2C = true
+	}
+}
+
+// WithStreamBody streams the bodies of the requests for which stream returns
+// true.
+func WithStreamBody(stream func(*request.Request) bool) Option {
+	return func(c *ServerConfig) {
+		c.StreamBody = stream
+	}
+}
+
+func portAddr(port uint16) ListenAddr {
+	return ListenAddr{Network: "tcp", Address: ":" + strconv.Itoa(int(port))}
+}
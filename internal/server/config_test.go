@@ -0,0 +1,95 @@
+package server
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseListenAddr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		want    ListenAddr
+		wantErr bool
+	}{
+		{addr: ":8080", want: ListenAddr{Network: "tcp", Address: ":8080"}},
+		{addr: "[::1]:8080", want: ListenAddr{Network: "tcp", Address: "[::1]:8080"}},
+		{addr: "tcp4://127.0.0.1:8080", want: ListenAddr{Network: "tcp4", Address: "127.0.0.1:8080"}},
+		{addr: "unix:///run/app.sock", want: ListenAddr{Network: "unix", Address: "/run/app.sock"}},
+		{addr: "8080", wantErr: true},
+		{addr: "udp://:8080", wantErr: true},
+		{addr: "unix://", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			got, err := ParseListenAddr(tt.addr)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestListenAndServeMultipleListeners(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "server.sock")
+	s, err := New(ServerConfig{
+		Listen: []ListenAddr{
+			{Network: "tcp4", Address: "127.0.0.1:0"},
+			{Network: "unix", Address: sock, FileMode: 0600},
+		},
+		Handler: okHandler,
+	})
+	require.NoError(t, err)
+
+	served := make(chan error, 1)
+	require.NoError(t, s.Listen())
+	go func() {
+		served <- s.Serve()
+	}()
+
+	info, err := os.Stat(sock)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	for _, addr := range s.Addrs() {
+		conn, err := net.Dial(addr.Network(), addr.String())
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		require.NoError(t, err)
+		body, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "200 OK")
+		conn.Close()
+	}
+
+	s.Close()
+	select {
+	case err := <-served:
+		assert.Equal(t, ErrServerClosed, err)
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after Close")
+	}
+}
+
+func TestListenReturnsBindError(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer taken.Close()
+
+	s, err := New(ServerConfig{
+		Listen:  []ListenAddr{{Network: "tcp", Address: taken.Addr().String()}},
+		Handler: okHandler,
+	})
+	require.NoError(t, err)
+	assert.Error(t, s.ListenAndServe())
+}
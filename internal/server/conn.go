@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+var aLongTimeAgo = time.Unix(1, 0)
+
+// connReader is what the request reader reads the connection through. While
+// a handler runs it keeps a read pending on the connection so a client
+// closing its side cancels the request context.
+type connReader struct {
+	conn   net.Conn
+	peeked []byte
+	bgDone chan struct{}
+}
+
+func (cr *connReader) Read(p []byte) (int, error) {
+	if len(cr.peeked) > 0 {
+		n := copy(p, cr.peeked)
+		cr.peeked = cr.peeked[n:]
+		return n, nil
+	}
+	return cr.conn.Read(p)
+}
+
+// sniff reads until the bytes seen so far tell whether the connection
+// starts with prefix, keeping them for the request reader.
+func (cr *connReader) sniff(prefix string) (bool, error) {
+	buf := make([]byte, len(prefix))
+	for {
+		n := min(len(cr.peeked), len(prefix))
+		if string(cr.peeked[:n]) != prefix[:n] {
+			return false, nil
+		}
+		if n == len(prefix) {
+			return true, nil
+		}
+		m, err := cr.conn.Read(buf)
+		cr.peeked = append(cr.peeked, buf[:m]...)
+		if err == io.EOF && len(cr.peeked) > 0 {
+			// Whatever was sent is left for the request reader to reject
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+func (cr *connReader) startBackgroundRead(cancel context.CancelFunc) {
+	cr.bgDone = make(chan struct{})
+	go func() {
+		defer close(cr.bgDone)
+		buf := make([]byte, 1)
+		n, err := cr.conn.Read(buf)
+		if n > 0 {
+			// Pipelined data, keep it for the next request
+			cr.peeked = append(cr.peeked, buf[:n]...)
+			return
+		}
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			cancel()
+		}
+	}()
+}
+
+func (cr *connReader) abortBackgroundRead() {
+	if cr.bgDone == nil {
+		return
+	}
+	cr.conn.SetReadDeadline(aLongTimeAgo)
+	<-cr.bgDone
+	cr.conn.SetReadDeadline(time.Time{})
+	cr.bgDone = nil
+}
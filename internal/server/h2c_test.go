@@ -0,0 +1,317 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"http-from-tcp/internal/http2"
+	"http-from-tcp/internal/http2/hpack"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func h2cClient() *http.Client {
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: &http.Transport{Protocols: protocols}}
+}
+
+func h2cHandler(w response.Writer, req *request.Request) {
+	switch req.RequestLine.RequestTarget {
+	case "/large":
+		body := strings.Repeat("0123456789", 50000)
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+	case "/chunked":
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Override("Transfer-Encoding", "chunked")
+		h.Override("Trailer", "X-Checksum")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		for _, part := range []string{"hello ", "chunked ", "world"} {
+			w.WriteChunkedBody([]byte(part))
+		}
+		w.WriteChunkedBodyDone()
+		w.WriteTrailers(map[string]string{"x-checksum": "abc"})
+	default:
+		body := fmt.Sprintf("%s %s HTTP/%s host=%s body=%s seq=%d", req.RequestLine.Method, req.RequestLine.RequestTarget,
+			req.RequestLine.HttpVersion, req.Headers.Get("Host"), req.Body, req.ConnSeq)
+		w.WriteStatusLine(response.StatusOK)
+		h := response.GetDefaultHeaders(len(body))
+		h.Set("X-Custom", "yes")
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	}
+}
+
+func TestH2CPriorKnowledge(t *testing.T) {
+	s, err := Serve(0, h2cHandler, WithH2C())
+	require.NoError(t, err)
+	defer s.Close()
+	client := h2cClient()
+	base := "http://" + s.Addr().String()
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		body        string
+		wantBody    string
+		wantHeaders map[string]string
+		wantTrailer map[string]string
+	}{
+		{
+			name:        "get",
+			method:      "GET",
+			path:        "/hello?x=1",
+			wantBody:    "GET /hello?x=1 HTTP/2.0 host=" + s.Addr().String() + " body=",
+			wantHeaders: map[string]string{"X-Custom": "yes", "Content-Type": "text/plain"},
+		},
+		{
+			name:     "post with body",
+			method:   "POST",
+			path:     "/submit",
+			body:     "payload",
+			wantBody: "POST /submit HTTP/2.0 host=" + s.Addr().String() + " body=payload",
+		},
+		{
+			name:     "large body past the flow control window",
+			method:   "GET",
+			path:     "/large",
+			wantBody: strings.Repeat("0123456789", 50000),
+		},
+		{
+			name:        "chunked with trailers",
+			method:      "GET",
+			path:        "/chunked",
+			wantBody:    "hello chunked world",
+			wantTrailer: map[string]string{"X-Checksum": "abc"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, base+tt.path, strings.NewReader(tt.body))
+			require.NoError(t, err)
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, 2, resp.ProtoMajor)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			if strings.HasPrefix(tt.wantBody, tt.method) {
+				body = []byte(strings.Split(string(body), " seq=")[0])
+			}
+			assert.Equal(t, tt.wantBody, string(body))
+			for name, value := range tt.wantHeaders {
+				assert.Equal(t, value, resp.Header.Get(name), name)
+			}
+			assert.Empty(t, resp.Header.Get("Connection"))
+			for name, value := range tt.wantTrailer {
+				assert.Equal(t, value, resp.Trailer.Get(name), name)
+			}
+		})
+	}
+}
+
+func TestH2CMultiplexing(t *testing.T) {
+	release := make(chan struct{})
+	var started sync.WaitGroup
+	started.Add(3)
+	s, err := Serve(0, func(w response.Writer, req *request.Request) {
+		started.Done()
+		<-release
+		h2cHandler(w, req)
+	}, WithH2C())
+	require.NoError(t, err)
+	defer s.Close()
+	client := h2cClient()
+
+	// All three handlers must run at once on the one connection to finish
+	var done sync.WaitGroup
+	conns := make(chan string, 3)
+	for i := range 3 {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			resp, err := client.Get(fmt.Sprintf("http://%s/%d", s.Addr(), i))
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			conns <- string(body)
+		}()
+	}
+	started.Wait()
+	close(release)
+	done.Wait()
+	close(conns)
+
+	seqs := []int{}
+	for body := range conns {
+		_, seq, _ := strings.Cut(body, " seq=")
+		n, err := strconv.Atoi(seq)
+		require.NoError(t, err)
+		seqs = append(seqs, n)
+	}
+	assert.ElementsMatch(t, []int{1, 2, 3}, seqs)
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	s, err := Serve(0, h2cHandler, WithH2C())
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// SETTINGS_INITIAL_WINDOW_SIZE of 1 MiB
+	settings := base64.RawURLEncoding.EncodeToString([]byte{0, 4, 0, 0x10, 0, 0})
+	_, err = fmt.Fprintf(conn, "POST /upgraded HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\n"+
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: %s\r\n\r\nbody", settings)
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "h2c", resp.Header.Get("Upgrade"))
+
+	// From here on the client speaks HTTP/2, the standard library transport
+	// takes over the connection after the preface.
+	_, err = conn.Write([]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n\x00\x00\x00\x04\x00\x00\x00\x00\x00"))
+	require.NoError(t, err)
+
+	frames := readFrames(t, br, func(typ byte, flags byte) bool {
+		// Stop at the frame that ends stream 1
+		return (typ == 0 || typ == 1) && flags&1 != 0
+	})
+	assert.Contains(t, frames, "body=body")
+}
+
+// readFrames returns the payloads of the frames read until stop says so,
+// as one string.
+func readFrames(t *testing.T, br *bufio.Reader, stop func(typ, flags byte) bool) string {
+	var sb strings.Builder
+	for {
+		var h [9]byte
+		_, err := io.ReadFull(br, h[:])
+		require.NoError(t, err)
+		length := int(h[0])<<16 | int(h[1])<<8 | int(h[2])
+		payload := make([]byte, length)
+		_, err = io.ReadFull(br, payload)
+		require.NoError(t, err)
+		sb.Write(payload)
+		if stop(h[3], h[4]) {
+			return sb.String()
+		}
+	}
+}
+
+func TestH2CShutdown(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	s, err := Serve(0, func(w response.Writer, req *request.Request) {
+		close(started)
+		<-release
+		h2cHandler(w, req)
+	}, WithH2C())
+	require.NoError(t, err)
+
+	client := h2cClient()
+	result := make(chan error, 1)
+	go func() {
+		resp, err := client.Get("http://" + s.Addr().String() + "/slow")
+		if err == nil {
+			_, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		result <- err
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	assert.NoError(t, <-result)
+	assert.NoError(t, <-shutdown)
+}
+
+func TestH2CShutdownStalledPeer(t *testing.T) {
+	s, err := Serve(0, h2cHandler, WithH2C())
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.(*net.TCPConn).SetReadBuffer(4096)
+
+	// Large windows and more response data than the socket buffers hold,
+	// none of which is ever read
+	frame := func(typ, flags byte, streamID uint32, payload []byte) []byte {
+		b := []byte{byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)), typ, flags}
+		b = binary.BigEndian.AppendUint32(b, streamID)
+		return append(b, payload...)
+	}
+	window := binary.BigEndian.AppendUint32([]byte{0, 4}, 1<<30)
+	b := append([]byte(http2.ClientPreface), frame(4, 0, 0, window)...)
+	b = append(b, frame(8, 0, 0, binary.BigEndian.AppendUint32(nil, 1<<30))...)
+	encoder := hpack.NewEncoder()
+	for id := uint32(1); id < 80; id += 2 {
+		block := encoder.Encode(nil, []hpack.HeaderField{
+			{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"},
+			{Name: ":authority", Value: "localhost"}, {Name: ":path", Value: "/large"},
+		})
+		b = append(b, frame(1, 0x4|0x1, id, block)...)
+	}
+	_, err = conn.Write(b)
+	require.NoError(t, err)
+	time.Sleep(300 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Shutdown(ctx)
+	}()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(3 * time.Second):
+		t.Fatal("Shutdown did not return after its context was done")
+	}
+}
+
+func TestH2CDisabled(t *testing.T) {
+	s, err := Serve(0, h2cHandler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, err = h2cClient().Get("http://" + s.Addr().String() + "/")
+	assert.Error(t, err)
+}
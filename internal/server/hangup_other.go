@@ -0,0 +1,10 @@
+//go:build js || wasip1 || plan9
+
+package server
+
+import "os"
+
+// notifyHangup returns a nil channel, there is no SIGHUP to reload on
+func notifyHangup() (hup <-chan os.Signal, stop func()) {
+	return nil, func() {}
+}
@@ -0,0 +1,16 @@
+//go:build !js && !wasip1 && !plan9
+
+package server
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyHangup delivers SIGHUP on the returned channel until stop is called
+func notifyHangup() (hup <-chan os.Signal, stop func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	return c, func() { signal.Stop(c) }
+}
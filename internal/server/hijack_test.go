@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"http-from-tcp/internal/headers"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHijack(t *testing.T) {
+	writeErrs := make(chan error, 2)
+	handler := func(w response.Writer, req *request.Request) {
+		h := headers.NewHeaders()
+		h.Set("Upgrade", "echo")
+		h.Set("Connection", "Upgrade")
+		w.WriteStatusLine(response.StatusSwitchingProtocols)
+		w.WriteHeaders(h)
+
+		conn, buffered, err := w.Hijack()
+		if err != nil {
+			writeErrs <- err
+			return
+		}
+		_, err = w.Write([]byte("too late"))
+		writeErrs <- err
+		_, _, err = w.Hijack()
+		writeErrs <- err
+
+		// The connection outlives the handler
+		go func() {
+			defer conn.Close()
+			conn.Write(buffered)
+			io.Copy(conn, conn)
+		}()
+	}
+
+	metrics := NewMetrics()
+	s, err := Serve(0, handler,
+		WithTimeouts(Timeouts{Read: time.Second, Write: 50 * time.Millisecond, Idle: 50 * time.Millisecond}),
+		WithMetrics(metrics, ""),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /echo HTTP/1.1\r\nHost: localhost\r\nUpgrade: echo\r\n\r\nearly"))
+	require.NoError(t, err)
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	assert.Equal(t, response.ErrorHijacked, <-writeErrs)
+	assert.Equal(t, response.ErrorNotHijackable, <-writeErrs)
+
+	echo := func(msg string) {
+		t.Helper()
+		buf := make([]byte, len(msg))
+		_, err := io.ReadFull(reader, buf)
+		require.NoError(t, err)
+		assert.Equal(t, msg, string(buf))
+	}
+	echo("early")
+
+	// Past the server's write and idle timeouts
+	time.Sleep(100 * time.Millisecond)
+	conn.Write([]byte("late"))
+	echo("late")
+
+	// Shutdown does not wait for the hijacked connection nor close it
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx))
+	conn.Write([]byte("after shutdown"))
+	echo("after shutdown")
+
+	assert.Equal(t, 1.0, metrics.HijackedConnections.Value())
+}
+
+func TestHijackNotSupported(t *testing.T) {
+	w := response.NewWrite(io.Discard)
+	_, _, err := w.Hijack()
+	assert.Equal(t, response.ErrorNotHijackable, err)
+}
+
+func TestHijackReleasesRequestSlot(t *testing.T) {
+	release := make(chan struct{})
+	hijacked := make(chan struct{})
+	handler := func(w response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget != "/tunnel" {
+			okHandler(w, req)
+			return
+		}
+		conn, _, err := w.Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		close(hijacked)
+		// The tunnel runs inside the handler
+		<-release
+	}
+
+	s, err := Serve(0, handler, WithLimits(Limits{MaxConcurrentRequests: 1}))
+	require.NoError(t, err)
+	defer s.Close()
+	defer close(release)
+
+	tunnel, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer tunnel.Close()
+	_, err = tunnel.Write([]byte("GET /tunnel HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	<-hijacked
+
+	assert.Contains(t, <-sendRequest(t, s.Addr().String()), "200 OK")
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+)
+
+// IPFilter decides which remote addresses may connect. Deny rules win over
+// allow rules and an empty allow list allows everything not denied. Rules can
+// be replaced while the server runs.
+type IPFilter struct {
+	mu    sync.RWMutex
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+func parsePrefix(rule string) (netip.Prefix, error) {
+	if strings.Contains(rule, "/") {
+		p, err := netip.ParsePrefix(rule)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(rule)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func parsePrefixes(rules []string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, rule := range rules {
+		p, err := parsePrefix(strings.TrimSpace(rule))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip rule %q: %w", rule, err)
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+func NewIPFilter(allow, deny []string) (*IPFilter, error) {
+	f := &IPFilter{}
+	if err := f.Update(allow, deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Update swaps in new rules, keeping the old ones if any rule is invalid.
+func (f *IPFilter) Update(allow, deny []string) error {
+	allowPrefixes, err := parsePrefixes(allow)
+	if err != nil {
+		return err
+	}
+	denyPrefixes, err := parsePrefixes(deny)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.allow = allowPrefixes
+	f.deny = denyPrefixes
+	f.mu.Unlock()
+	return nil
+}
+
+// LoadFile reads rules from a file with one "allow <cidr>" or
+// "deny <cidr>" per line, blank lines and lines starting with # are skipped.
+func (f *IPFilter) LoadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	allow := []string{}
+	deny := []string{}
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected \"allow <cidr>\" or \"deny <cidr>\"", path, lineNo)
+		}
+		action, rule := fields[0], fields[1]
+		switch action {
+		case "allow":
+			allow = append(allow, rule)
+		case "deny":
+			deny = append(deny, rule)
+		default:
+			return fmt.Errorf("%s:%d: unknown action %q", path, lineNo, action)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return f.Update(allow, deny)
+}
+
+func (f *IPFilter) Allowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, p := range f.deny {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, p := range f.allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowedConn checks the remote address of conn, connections without an IP
+// such as unix sockets are always allowed.
+func (f *IPFilter) AllowedConn(conn net.Conn) bool {
+	if f == nil {
+		return true
+	}
+	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	addr, ok := netip.AddrFromSlice(tcpAddr.IP)
+	if !ok {
+		return true
+	}
+	return f.Allowed(addr)
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPFilterAllowed(t *testing.T) {
+	f, err := NewIPFilter([]string{"10.0.0.0/8", "2001:db8::/32", "192.168.1.10"}, []string{"10.1.0.0/16"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{addr: "10.2.3.4", want: true},
+		{addr: "10.1.2.3", want: false},
+		{addr: "192.168.1.10", want: true},
+		{addr: "192.168.1.11", want: false},
+		{addr: "::ffff:10.2.3.4", want: true},
+		{addr: "2001:db8::1", want: true},
+		{addr: "2001:db9::1", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			assert.Equal(t, tt.want, f.Allowed(netip.MustParseAddr(tt.addr)))
+		})
+	}
+
+	_, err = NewIPFilter([]string{"10.0.0.0/33"}, nil)
+	assert.Error(t, err)
+}
+
+func TestIPFilterLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules")
+	require.NoError(t, os.WriteFile(path, []byte("# office\nallow\t10.0.0.0/8\n\ndeny   10.0.0.1\n"), 0644))
+
+	f := &IPFilter{}
+	require.NoError(t, f.LoadFile(path))
+	assert.True(t, f.Allowed(netip.MustParseAddr("10.0.0.2")))
+	assert.False(t, f.Allowed(netip.MustParseAddr("10.0.0.1")))
+	assert.False(t, f.Allowed(netip.MustParseAddr("8.8.8.8")))
+
+	for _, bad := range []string{"block 10.0.0.1\n", "deny\n", "deny 10.0.0.1 10.0.0.2\n"} {
+		require.NoError(t, os.WriteFile(path, []byte(bad), 0644))
+		assert.Error(t, f.LoadFile(path), bad)
+	}
+	// A bad file keeps the previous rules
+	assert.False(t, f.Allowed(netip.MustParseAddr("10.0.0.1")))
+}
+
+func TestIPFilterAtAccept(t *testing.T) {
+	filter, err := NewIPFilter(nil, []string{"127.0.0.0/8"})
+	require.NoError(t, err)
+
+	get := func(forbidden bool) string {
+		s, err := New(ServerConfig{
+			Listen:            []ListenAddr{{Network: "tcp4", Address: "127.0.0.1:0"}},
+			Handler:           okHandler,
+			IPFilter:          filter,
+			IPFilterForbidden: forbidden,
+		})
+		require.NoError(t, err)
+		require.NoError(t, s.Listen())
+		go s.Serve()
+		defer s.Close()
+
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		body, _ := io.ReadAll(conn)
+		return string(body)
+	}
+
+	assert.Equal(t, "", get(false))
+	assert.Contains(t, get(true), "403 Forbidden")
+
+	require.NoError(t, filter.Update([]string{"127.0.0.1"}, nil))
+	assert.Contains(t, get(false), "200 OK")
+}
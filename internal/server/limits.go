@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultQueueTimeout = 5 * time.Second
+	defaultRetryAfter   = time.Second
+	lingerTimeout       = 100 * time.Millisecond
+)
+
+// limiter hands out a fixed number of slots, letting up to maxQueue callers
+// wait for one before turning the rest away.
+type limiter struct {
+	slots    chan struct{}
+	queued   atomic.Int64
+	maxQueue int64
+	wait     time.Duration
+}
+
+// newLimiter returns nil when max is not positive, a nil limiter never
+// refuses.
+func newLimiter(max, maxQueue int, wait time.Duration) *limiter {
+	if max <= 0 {
+		return nil
+	}
+	return &limiter{
+		slots:    make(chan struct{}, max),
+		maxQueue: int64(maxQueue),
+		wait:     wait,
+	}
+}
+
+func (l *limiter) acquire(ctx context.Context) bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if l.queued.Add(1) > l.maxQueue {
+		l.queued.Add(-1)
+		return false
+	}
+	defer l.queued.Add(-1)
+
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (l *limiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
+
+// slot is a place held in a limiter. It can be released more than once so a
+// hijacked connection gives its place back before the handler returns.
+type slot struct {
+	once    sync.Once
+	limiter *limiter
+	held    bool
+}
+
+func (s *slot) take(l *limiter) {
+	s.limiter = l
+	s.held = true
+}
+
+func (s *slot) release() {
+	if s.held {
+		s.once.Do(s.limiter.release)
+	}
+}
+
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(max(1, int(math.Ceil(d.Seconds()))))
+}
+
+func (s *Server) writeOverloaded(w response.Writer) {
+	message := "server is overloaded, try again later"
+	h := response.GetDefaultHeaders(len(message))
+	h.Set("Retry-After", retryAfterSeconds(s.cfg.Limits.RetryAfter))
+
+	w.WriteStatusLine(response.StatusServiceUnavailable)
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(message))
+}
+
+func (s *Server) overloadedHandler(w response.Writer, req *request.Request) {
+	s.writeOverloaded(w)
+}
+
+func writeForbidden(w response.Writer) {
+	he := &HandlerError{
+		StatusCode: response.StatusForbidden,
+		Message:    "forbidden",
+	}
+	he.Write(w)
+}
+
+// rejectConn answers a connection without reading its request, then drains
+// briefly so the client sees the response instead of a reset.
+func (s *Server) rejectConn(conn net.Conn, reason string, write func(w response.Writer)) {
+	defer conn.Close()
+	s.cfg.Metrics.connRejected(reason)
+
+	conn.SetDeadline(time.Now().Add(lingerTimeout))
+	write(response.NewWrite(conn))
+	if tcpConn, ok := conn.(interface{ CloseWrite() error }); ok {
+		tcpConn.CloseWrite()
+	}
+	io.Copy(io.Discard, io.LimitReader(conn, 64*1024))
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func blockingServer(t *testing.T, limits Limits) (*Server, chan struct{}, chan struct{}) {
+	t.Helper()
+	entered := make(chan struct{}, 10)
+	release := make(chan struct{})
+	handler := func(w response.Writer, req *request.Request) {
+		entered <- struct{}{}
+		<-release
+		okHandler(w, req)
+	}
+
+	s, err := New(ServerConfig{
+		Listen:  []ListenAddr{{Network: "tcp4", Address: "127.0.0.1:0"}},
+		Handler: handler,
+		Limits:  limits,
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.Listen())
+	go s.Serve()
+	t.Cleanup(func() { s.Close() })
+	return s, entered, release
+}
+
+func sendRequest(t *testing.T, addr string) chan string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	resp := make(chan string, 1)
+	go func() {
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		body, _ := io.ReadAll(conn)
+		resp <- string(body)
+	}()
+	return resp
+}
+
+func TestMaxConnsSheds(t *testing.T) {
+	s, entered, release := blockingServer(t, Limits{MaxConns: 1, RetryAfter: 2 * time.Second})
+	addr := s.Addr().String()
+
+	first := sendRequest(t, addr)
+	<-entered
+
+	rejected := <-sendRequest(t, addr)
+	assert.Contains(t, rejected, "503 Service Unavailable")
+	assert.Contains(t, rejected, "retry-after: 2")
+
+	close(release)
+	assert.Contains(t, <-first, "200 OK")
+}
+
+func TestMaxConnsQueues(t *testing.T) {
+	s, entered, release := blockingServer(t, Limits{MaxConns: 1, QueueSize: 1, QueueTimeout: 2 * time.Second})
+	addr := s.Addr().String()
+
+	first := sendRequest(t, addr)
+	<-entered
+	queued := sendRequest(t, addr)
+	time.Sleep(50 * time.Millisecond)
+	assert.Contains(t, <-sendRequest(t, addr), "503 Service Unavailable")
+
+	close(release)
+	assert.Contains(t, <-first, "200 OK")
+	assert.Contains(t, <-queued, "200 OK")
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	s, entered, release := blockingServer(t, Limits{MaxConcurrentRequests: 1})
+	addr := s.Addr().String()
+
+	first := sendRequest(t, addr)
+	<-entered
+	assert.Contains(t, <-sendRequest(t, addr), "503 Service Unavailable")
+
+	close(release)
+	assert.Contains(t, <-first, "200 OK")
+}
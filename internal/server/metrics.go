@@ -0,0 +1,382 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The registry below writes the Prometheus text exposition format
+// (version 0.0.4) without depending on the Prometheus client library.
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var DefaultSizeBuckets = []float64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576}
+var DefaultLatencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type metricType string
+
+const (
+	counterType   metricType = "counter"
+	gaugeType     metricType = "gauge"
+	histogramType metricType = "histogram"
+)
+
+type metric struct {
+	name       string
+	help       string
+	typ        metricType
+	labelNames []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+func (m *metric) get(labelValues []string) *series {
+	if len(labelValues) != len(m.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", m.name, len(m.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{
+			labelValues: slices.Clone(labelValues),
+			counts:      make([]uint64, len(m.buckets)),
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metric) add(v float64, labelValues []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value += v
+}
+
+func (m *metric) set(v float64, labelValues []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value = v
+}
+
+func (m *metric) value(labelValues []string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.get(labelValues).value
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	pairs := []string{}
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", name, strconv.Quote(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", extra[i], strconv.Quote(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (m *metric) writeTo(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(&sb, "# TYPE %s %s\n", m.name, m.typ)
+
+	for _, key := range slices.Sorted(maps.Keys(m.series)) {
+		s := m.series[key]
+		if m.typ != histogramType {
+			fmt.Fprintf(&sb, "%s%s %s\n", m.name, formatLabels(m.labelNames, s.labelValues), formatFloat(s.value))
+			continue
+		}
+
+		cumulative := uint64(0)
+		for i, upper := range m.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(&sb, "%s_bucket%s %d\n", m.name, formatLabels(m.labelNames, s.labelValues, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(&sb, "%s_bucket%s %d\n", m.name, formatLabels(m.labelNames, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(&sb, "%s_sum%s %s\n", m.name, formatLabels(m.labelNames, s.labelValues), formatFloat(s.sum))
+		fmt.Fprintf(&sb, "%s_count%s %d\n", m.name, formatLabels(m.labelNames, s.labelValues), s.count)
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+type Counter struct{ m *metric }
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.m.add(1, labelValues)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic("counter cannot decrease")
+	}
+	c.m.add(v, labelValues)
+}
+
+func (c *Counter) Value(labelValues ...string) float64 {
+	return c.m.value(labelValues)
+}
+
+type Gauge struct{ m *metric }
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.m.set(v, labelValues)
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.m.add(v, labelValues)
+}
+
+func (g *Gauge) Inc(labelValues ...string) {
+	g.m.add(1, labelValues)
+}
+
+func (g *Gauge) Dec(labelValues ...string) {
+	g.m.add(-1, labelValues)
+}
+
+func (g *Gauge) Value(labelValues ...string) float64 {
+	return g.m.value(labelValues)
+}
+
+type Histogram struct{ m *metric }
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.m.mu.Lock()
+	defer h.m.mu.Unlock()
+
+	s := h.m.get(labelValues)
+	for i, upper := range h.m.buckets {
+		if v <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*metric
+	names   map[string]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		names: map[string]bool{},
+	}
+}
+
+func (r *Registry) register(m *metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.names[m.name] {
+		panic(fmt.Sprintf("metric %s registered twice", m.name))
+	}
+	r.names[m.name] = true
+	m.series = map[string]*series{}
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *Registry) NewCounter(name, help string, labelNames ...string) *Counter {
+	m := &metric{name: name, help: help, typ: counterType, labelNames: labelNames}
+	r.register(m)
+	return &Counter{m}
+}
+
+func (r *Registry) NewGauge(name, help string, labelNames ...string) *Gauge {
+	m := &metric{name: name, help: help, typ: gaugeType, labelNames: labelNames}
+	r.register(m)
+	return &Gauge{m}
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	m := &metric{name: name, help: help, typ: histogramType, labelNames: labelNames, buckets: slices.Sorted(slices.Values(buckets))}
+	r.register(m)
+	return &Histogram{m}
+}
+
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mu.Unlock()
+
+	for _, m := range metrics {
+		if err := m.writeTo(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Registry) Handler() Handler {
+	return func(w response.Writer, req *request.Request) {
+		var sb strings.Builder
+		r.WriteText(&sb)
+
+		w.WriteStatusLine(response.StatusOK)
+		h := response.GetDefaultHeaders(sb.Len())
+		h.Override("Content-Type", metricsContentType)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(sb.String()))
+	}
+}
+
+type Metrics struct {
+	Registry *Registry
+
+	ActiveConnections   *Gauge
+	AcceptedConnections *Counter
+	RejectedConnections *Counter
+	AcceptErrors        *Counter
+	HijackedConnections *Counter
+	Requests            *Counter
+	ParseErrors         *Counter
+	RequestSize         *Histogram
+	ResponseSize        *Histogram
+	RequestDuration     *Histogram
+}
+
+func NewMetrics() *Metrics {
+	r := NewRegistry()
+	return &Metrics{
+		Registry:            r,
+		ActiveConnections:   r.NewGauge("http_active_connections", "Number of connections currently open."),
+		AcceptedConnections: r.NewCounter("http_connections_accepted_total", "Total number of accepted connections."),
+		RejectedConnections: r.NewCounter("http_connections_rejected_total", "Total number of connections rejected by the server.", "reason"),
+		AcceptErrors:        r.NewCounter("http_accept_errors_total", "Total number of errors returned by Accept.", "type"),
+		HijackedConnections: r.NewCounter("http_connections_hijacked_total", "Total number of connections taken over by handlers."),
+		Requests:            r.NewCounter("http_requests_total", "Total number of handled requests.", "method", "code"),
+		ParseErrors:         r.NewCounter("http_request_parse_errors_total", "Total number of requests that failed to parse.", "type"),
+		RequestSize:         r.NewHistogram("http_request_size_bytes", "Size of request bodies.", DefaultSizeBuckets),
+		ResponseSize:        r.NewHistogram("http_response_size_bytes", "Size of responses written.", DefaultSizeBuckets),
+		RequestDuration:     r.NewHistogram("http_request_duration_seconds", "Time spent in the handler.", DefaultLatencyBuckets),
+	}
+}
+
+func statusClass(sc response.StatusCode) string {
+	if sc < 100 || sc > 599 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%dxx", sc/100)
+}
+
+func parseErrorType(err error) string {
+	switch {
+	case errors.Is(err, request.ErrorMalformedStartLine):
+		return "malformed_start_line"
+	case errors.Is(err, request.ErrorInvalidRequestLine):
+		return "invalid_request_line"
+	case errors.Is(err, request.ErrorInvalidRequestTarget):
+		return "invalid_request_target"
+	case errors.Is(err, request.ErrorInvalidData):
+		return "invalid_data"
+	case errors.Is(err, request.ErrorInvalidContentLength):
+		return "invalid_content_length"
+	case errors.Is(err, request.ErrorTransferEncoding):
+		return "transfer_encoding"
+	case errors.Is(err, request.ErrorHeaderTooLarge):
+		return "header_too_large"
+	case errors.Is(err, request.ErrorBodyTooLarge):
+		return "body_too_large"
+	case errors.Is(err, request.ErrorBodyLengthExceeded):
+		return "body_length_exceeded"
+	case errors.Is(err, request.ErrorReadingBody):
+		return "reading_body"
+	case errors.Is(err, request.ErrorParsingRequestLine):
+		return "incomplete_request"
+	default:
+		return "other"
+	}
+}
+
+// The helpers below are nil safe so the server can call them whether or
+// not metrics were configured.
+
+func (m *Metrics) connOpened() {
+	if m == nil {
+		return
+	}
+	m.AcceptedConnections.Inc()
+	m.ActiveConnections.Inc()
+}
+
+func (m *Metrics) connClosed() {
+	if m == nil {
+		return
+	}
+	m.ActiveConnections.Dec()
+}
+
+func (m *Metrics) connRejected(reason string) {
+	if m == nil {
+		return
+	}
+	m.RejectedConnections.Inc(reason)
+}
+
+func (m *Metrics) connHijacked() {
+	if m == nil {
+		return
+	}
+	m.HijackedConnections.Inc()
+}
+
+func (m *Metrics) acceptError(errType string) {
+	if m == nil {
+		return
+	}
+	m.AcceptErrors.Inc(errType)
+}
+
+func (m *Metrics) parseError(err error) {
+	if m == nil {
+		return
+	}
+	m.ParseErrors.Inc(parseErrorType(err))
+}
+
+func (m *Metrics) observe(req *request.Request, rec Recorder) {
+	if m == nil {
+		return
+	}
+	m.Requests.Inc(req.RequestLine.Method, statusClass(rec.StatusCode))
+	m.RequestSize.Observe(float64(req.ContentLength()))
+	m.ResponseSize.Observe(float64(rec.BytesWritten))
+	m.RequestDuration.Observe(rec.Duration.Seconds())
+}
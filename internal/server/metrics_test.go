@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryWriteText(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Requests.", "method", "code")
+	g := r.NewGauge("active", "Active.")
+	h := r.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1})
+
+	c.Inc("GET", "2xx")
+	c.Inc("GET", "2xx")
+	c.Add(3, "POST", "5xx")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	var sb strings.Builder
+	require.NoError(t, r.WriteText(&sb))
+
+	want := `# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{method="GET",code="2xx"} 2
+requests_total{method="POST",code="5xx"} 3
+# HELP active Active.
+# TYPE active gauge
+active 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 5.55
+latency_seconds_count 3
+`
+	assert.Equal(t, want, sb.String())
+}
+
+func TestStatusClass(t *testing.T) {
+	assert.Equal(t, "2xx", statusClass(200))
+	assert.Equal(t, "5xx", statusClass(503))
+	assert.Equal(t, "unknown", statusClass(0))
+}
+
+func TestParseErrorType(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: request.ErrorMalformedStartLine, want: "malformed_start_line"},
+		{err: request.ErrorHeaderTooLarge, want: "header_too_large"},
+		{err: request.ErrorBodyTooLarge, want: "body_too_large"},
+		{err: fmt.Errorf("reading: %w", request.ErrorBodyTooLarge), want: "body_too_large"},
+		{err: request.ErrorInvalidContentLength, want: "invalid_content_length"},
+		{err: request.ErrorTransferEncoding, want: "transfer_encoding"},
+		{err: io.ErrUnexpectedEOF, want: "other"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			assert.Equal(t, tt.want, parseErrorType(tt.err))
+		})
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	m := NewMetrics()
+	s, err := Serve(0, func(w response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	}, WithMetrics(m, "/metrics"))
+	require.NoError(t, err)
+	defer s.Close()
+	base := "http://" + s.Addr().String()
+
+	resp, err := http.Get(base + "/hello")
+	require.NoError(t, err)
+	resp.Body.Close()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	conn.Write([]byte("garbage\r\n\r\n"))
+	io.ReadAll(conn)
+	conn.Close()
+
+	resp, err = http.Get(base + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), `http_requests_total{method="GET",code="2xx"} 1`)
+	assert.Contains(t, string(body), `http_request_parse_errors_total{type="malformed_start_line"} 1`)
+	assert.NotContains(t, string(body), "http_connections_rejected_total{")
+}
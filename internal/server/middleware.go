@@ -0,0 +1,43 @@
+package server
+
+import (
+	"http-from-tcp/internal/headers"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"time"
+)
+
+type Middleware func(next Handler) Handler
+
+// Chain wraps h so that the first middleware is the outermost one.
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+type Recorder struct {
+	StatusCode   response.StatusCode
+	Headers      headers.Headers
+	BytesWritten int
+	BodyWritten  int
+	Duration     time.Duration
+	// Hijacked is set when the handler took over the connection
+	Hijacked bool
+}
+
+// Record runs next and reports what it wrote to w.
+func Record(next Handler, w response.Writer, req *request.Request) Recorder {
+	start := time.Now()
+	next(w, req)
+
+	return Recorder{
+		StatusCode:   w.StatusCode(),
+		Headers:      w.Headers(),
+		BytesWritten: w.BytesWritten(),
+		BodyWritten:  w.BodyWritten(),
+		Duration:     time.Since(start),
+		Hijacked:     w.Hijacked(),
+	}
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"bytes"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChain(t *testing.T) {
+	order := []string{}
+	mw := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(w response.Writer, req *request.Request) {
+				order = append(order, name)
+				next(w, req)
+			}
+		}
+	}
+	h := Chain(func(w response.Writer, req *request.Request) {
+		order = append(order, "handler")
+	}, mw("first"), mw("second"))
+
+	h(response.NewWrite(&bytes.Buffer{}), request.NewRequest())
+	assert.Equal(t, []string{"first", "second", "handler"}, order)
+}
+
+func TestRecord(t *testing.T) {
+	buf := &bytes.Buffer{}
+	h := func(w response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusBadRequest)
+		w.WriteHeaders(response.GetDefaultHeaders(5))
+		w.WriteBody([]byte("hello"))
+	}
+
+	rec := Record(h, response.NewWrite(buf), request.NewRequest())
+	assert.Equal(t, response.StatusBadRequest, rec.StatusCode)
+	assert.Equal(t, "5", rec.Headers.Get("Content-Length"))
+	assert.Equal(t, 5, rec.BodyWritten)
+	assert.Equal(t, buf.Len(), rec.BytesWritten)
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"container/list"
+	"fmt"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBucketIdleTimeout = 10 * time.Minute
+	defaultMaxBuckets        = 100_000
+)
+
+var ErrorInvalidRate = fmt.Errorf("rate limit needs a positive, finite rate")
+
+type KeyFunc func(req *request.Request) string
+
+func KeyByRemoteIP(req *request.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// KeyByHeader keys on a header such as an API key, falling back to the
+// remote IP when the header is missing. Clients pick the header value, so
+// every new value gets a fresh bucket: only use it for headers a trusted
+// upstream sets or checks, otherwise key by the remote IP.
+func KeyByHeader(name string) KeyFunc {
+	return func(req *request.Request) string {
+		if value := req.Headers.Get(name); value != "" {
+			return name + ":" + value
+		}
+		return KeyByRemoteIP(req)
+	}
+}
+
+type RateLimitConfig struct {
+	// Rate is how many requests per second a key may make on average and
+	// Burst how many it may make at once.
+	Rate  float64
+	Burst int
+	// Key defaults to KeyByRemoteIP
+	Key KeyFunc
+	// Buckets unused for IdleTimeout are dropped, they would be full again
+	// by then anyway.
+	IdleTimeout time.Duration
+	// MaxKeys bounds how many buckets are kept, 100000 by default. Once it
+	// is reached the least recently used bucket makes room only if it has
+	// refilled, otherwise new keys are refused until it has.
+	MaxKeys int
+}
+
+type bucket struct {
+	key      string
+	tokens   float64
+	lastSeen time.Time
+}
+
+type RateLimiter struct {
+	cfg RateLimitConfig
+	now func() time.Time
+
+	mu sync.Mutex
+	// order holds the buckets least recently used last
+	order   *list.List
+	buckets map[string]*list.Element
+}
+
+func NewRateLimiter(cfg RateLimitConfig) (*RateLimiter, error) {
+	if !(cfg.Rate > 0) || math.IsInf(cfg.Rate, 1) {
+		return nil, ErrorInvalidRate
+	}
+	if cfg.Key == nil {
+		cfg.Key = KeyByRemoteIP
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = max(1, int(math.Ceil(cfg.Rate)))
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = max(defaultBucketIdleTimeout, time.Duration(float64(cfg.Burst)/cfg.Rate*float64(time.Second)))
+	}
+	if cfg.MaxKeys <= 0 {
+		cfg.MaxKeys = defaultMaxBuckets
+	}
+	return &RateLimiter{
+		cfg:     cfg,
+		now:     time.Now,
+		order:   list.New(),
+		buckets: map[string]*list.Element{},
+	}, nil
+}
+
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the bucket is full again and RetryAfter how
+	// long until the next request would be allowed.
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// sweep drops the buckets unused for IdleTimeout, they sit at the back
+func (rl *RateLimiter) sweep(now time.Time) {
+	for el := rl.order.Back(); el != nil; el = rl.order.Back() {
+		if now.Sub(el.Value.(*bucket).lastSeen) <= rl.cfg.IdleTimeout {
+			return
+		}
+		rl.remove(el)
+	}
+}
+
+func (rl *RateLimiter) remove(el *list.Element) {
+	b := rl.order.Remove(el).(*bucket)
+	delete(rl.buckets, b.key)
+}
+
+// tokens is what b holds at now, topped up for the time since it was last
+// seen
+func (rl *RateLimiter) tokens(b *bucket, now time.Time) float64 {
+	return math.Min(float64(rl.cfg.Burst), b.tokens+now.Sub(b.lastSeen).Seconds()*rl.cfg.Rate)
+}
+
+func (rl *RateLimiter) Allow(key string) RateLimitResult {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	rl.sweep(now)
+
+	burst := float64(rl.cfg.Burst)
+	result := RateLimitResult{Limit: rl.cfg.Burst}
+	el, ok := rl.buckets[key]
+	if ok {
+		rl.order.MoveToFront(el)
+	} else {
+		if rl.order.Len() >= rl.cfg.MaxKeys {
+			// Dropping a bucket that is not full would hand its key a fresh
+			// burst, so refuse the new key instead.
+			if tokens := rl.tokens(rl.order.Back().Value.(*bucket), now); tokens < burst {
+				result.RetryAfter = rl.secondsFor(burst - tokens)
+				result.Reset = result.RetryAfter
+				return result
+			}
+			rl.remove(rl.order.Back())
+		}
+		el = rl.order.PushFront(&bucket{key: key, tokens: burst, lastSeen: now})
+		rl.buckets[key] = el
+	}
+	b := el.Value.(*bucket)
+	b.tokens = rl.tokens(b, now)
+	b.lastSeen = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = rl.secondsFor(1 - b.tokens)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = rl.secondsFor(burst - b.tokens)
+	return result
+}
+
+func (rl *RateLimiter) secondsFor(tokens float64) time.Duration {
+	return time.Duration(tokens / rl.cfg.Rate * float64(time.Second))
+}
+
+func (rl *RateLimiter) Len() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.order.Len()
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// Middleware answers 429 once a key runs out of tokens, with the
+// RateLimit-Policy, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset and
+// Retry-After headers set.
+func (rl *RateLimiter) Middleware() Middleware {
+	window := ceilSeconds(time.Duration(float64(rl.cfg.Burst) / rl.cfg.Rate * float64(time.Second)))
+	policy := fmt.Sprintf("%d;w=%s", rl.cfg.Burst, window)
+
+	return func(next Handler) Handler {
+		return func(w response.Writer, req *request.Request) {
+			result := rl.Allow(rl.cfg.Key(req))
+			if result.Allowed {
+				next(w, req)
+				return
+			}
+
+			message := "rate limit exceeded"
+			h := response.GetDefaultHeaders(len(message))
+			h.Set("RateLimit-Policy", policy)
+			h.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+			h.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			h.Set("RateLimit-Reset", ceilSeconds(result.Reset))
+			h.Set("Retry-After", retryAfterSeconds(result.RetryAfter))
+
+			w.WriteStatusLine(response.StatusTooManyRequests)
+			w.WriteHeaders(h)
+			w.WriteBody([]byte(message))
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bytes"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestRateLimiterAllow(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	rl, err := NewRateLimiter(RateLimitConfig{Rate: 2, Burst: 3})
+	require.NoError(t, err)
+	rl.now = clock.now
+
+	for i := range 3 {
+		result := rl.Allow("a")
+		assert.True(t, result.Allowed)
+		assert.Equal(t, 2-i, result.Remaining)
+	}
+	result := rl.Allow("a")
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 500*time.Millisecond, result.RetryAfter)
+	assert.Equal(t, 1500*time.Millisecond, result.Reset)
+
+	// Other keys have their own bucket
+	assert.True(t, rl.Allow("b").Allowed)
+
+	clock.advance(500 * time.Millisecond)
+	assert.True(t, rl.Allow("a").Allowed)
+	assert.False(t, rl.Allow("a").Allowed)
+}
+
+func TestNewRateLimiterRejectsInvalidRates(t *testing.T) {
+	for _, rate := range []float64{0, -1, math.NaN(), math.Inf(1)} {
+		_, err := NewRateLimiter(RateLimitConfig{Rate: rate})
+		assert.ErrorIs(t, err, ErrorInvalidRate, "rate %v", rate)
+	}
+}
+
+func TestRateLimiterEvictsIdleBuckets(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	rl, err := NewRateLimiter(RateLimitConfig{Rate: 1, Burst: 1, IdleTimeout: time.Minute})
+	require.NoError(t, err)
+	rl.now = clock.now
+
+	rl.Allow("a")
+	rl.Allow("b")
+	assert.Equal(t, 2, rl.Len())
+
+	clock.advance(2 * time.Minute)
+	rl.Allow("c")
+	assert.Equal(t, 1, rl.Len())
+}
+
+func TestRateLimiterMaxKeys(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	rl, err := NewRateLimiter(RateLimitConfig{Rate: 1, Burst: 1, MaxKeys: 2})
+	require.NoError(t, err)
+	rl.now = clock.now
+
+	assert.True(t, rl.Allow("a").Allowed)
+	clock.advance(100 * time.Millisecond)
+	assert.True(t, rl.Allow("b").Allowed)
+
+	// Neither bucket has refilled, the new key is refused rather than
+	// handing a fresh burst to whoever is evicted
+	result := rl.Allow("c")
+	assert.False(t, result.Allowed)
+	assert.InDelta(t, 900*time.Millisecond, result.RetryAfter, float64(time.Millisecond))
+	assert.False(t, rl.Allow("a").Allowed, "a keeps its drained bucket")
+	assert.Equal(t, 2, rl.Len())
+
+	// b is now the least recently used and makes room once it is full
+	clock.advance(time.Second)
+	assert.True(t, rl.Allow("c").Allowed)
+	assert.Equal(t, 2, rl.Len())
+	assert.Contains(t, rl.buckets, "a")
+	assert.NotContains(t, rl.buckets, "b")
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	rl, err := NewRateLimiter(RateLimitConfig{Rate: 1, Burst: 1, Key: KeyByHeader("X-Api-Key")})
+	require.NoError(t, err)
+	h := Chain(okHandler, rl.Middleware())
+
+	do := func(apiKey string) string {
+		req := request.NewRequest()
+		req.RemoteAddr = "10.0.0.1:5000"
+		if apiKey != "" {
+			req.Headers.Set("X-Api-Key", apiKey)
+		}
+		buf := &bytes.Buffer{}
+		h(response.NewWrite(buf), req)
+		return buf.String()
+	}
+
+	assert.Contains(t, do("first"), "200 OK")
+	limited := do("first")
+	assert.Contains(t, limited, "429 Too Many Requests")
+	assert.Contains(t, limited, "retry-after: 1\r\n")
+	assert.Contains(t, limited, "ratelimit-limit: 1\r\n")
+	assert.Contains(t, limited, "ratelimit-remaining: 0\r\n")
+	assert.Contains(t, limited, "ratelimit-policy: 1;w=1\r\n")
+
+	assert.Contains(t, do("second"), "200 OK")
+	// Without the header the remote IP is the key
+	assert.Contains(t, do(""), "200 OK")
+	assert.Contains(t, do(""), "429 Too Many Requests")
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const preforkWorkerEnv = "PREFORK_WORKER"
+
+// PreforkWorker reports whether this process was started by Prefork and
+// which worker slot it fills.
+func PreforkWorker() (int, bool) {
+	id, err := strconv.Atoi(os.Getenv(preforkWorkerEnv))
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// Prefork supervises worker processes that each run a copy of the current
+// executable with the same arguments. Workers are expected to listen with
+// ServerConfig.ReusePort so they can share the port.
+type Prefork struct {
+	Workers      int
+	RestartDelay time.Duration
+	StopTimeout  time.Duration
+	Logger       *slog.Logger
+}
+
+type workerExit struct {
+	id  int
+	pid int
+	err error
+}
+
+// Run starts the workers, restarts any that exit and stops them all with
+// SIGTERM once ctx is done.
+func (p Prefork) Run(ctx context.Context) error {
+	if p.Workers <= 0 {
+		return fmt.Errorf("prefork needs at least one worker")
+	}
+	if p.RestartDelay == 0 {
+		p.RestartDelay = time.Second
+	}
+	if p.StopTimeout == 0 {
+		p.StopTimeout = 30 * time.Second
+	}
+	if p.Logger == nil {
+		p.Logger = slog.Default()
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	exits := make(chan workerExit)
+	procs := map[int]*os.Process{}
+	start := func(id int) error {
+		cmd := exec.Command(exe, os.Args[1:]...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", preforkWorkerEnv, id))
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		procs[id] = cmd.Process
+		p.Logger.Info("started worker", "worker", id, "pid", cmd.Process.Pid)
+		go func() {
+			err := cmd.Wait()
+			exits <- workerExit{id: id, pid: cmd.Process.Pid, err: err}
+		}()
+		return nil
+	}
+
+	for id := range p.Workers {
+		if err := start(id); err != nil {
+			p.stop(procs, exits)
+			return err
+		}
+	}
+
+	for {
+		select {
+		case exit := <-exits:
+			delete(procs, exit.id)
+			p.Logger.Error("worker exited, restarting", "worker", exit.id, "pid", exit.pid, "error", exit.err)
+
+			select {
+			case <-time.After(p.RestartDelay):
+			case <-ctx.Done():
+				p.stop(procs, exits)
+				return nil
+			}
+			if err := start(exit.id); err != nil {
+				p.Logger.Error("error restarting worker", "worker", exit.id, "error", err)
+				go func() {
+					exits <- workerExit{id: exit.id, err: err}
+				}()
+			}
+		case <-ctx.Done():
+			p.stop(procs, exits)
+			return nil
+		}
+	}
+}
+
+func (p Prefork) stop(procs map[int]*os.Process, exits chan workerExit) {
+	for _, proc := range procs {
+		proc.Signal(syscall.SIGTERM)
+	}
+
+	timeout := time.After(p.StopTimeout)
+	for len(procs) > 0 {
+		select {
+		case exit := <-exits:
+			delete(procs, exit.id)
+		case <-timeout:
+			for _, proc := range procs {
+				proc.Kill()
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !unix || solaris
+
+package server
+
+import (
+	"fmt"
+	"net"
+)
+
+var ErrorReusePortNotSupported = fmt.Errorf("SO_REUSEPORT is not supported on this platform")
+
+func bindReusePort(addr ListenAddr, n int) ([]net.Listener, error) {
+	return nil, ErrorReusePortNotSupported
+}
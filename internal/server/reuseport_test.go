@@ -0,0 +1,177 @@
+//go:build unix && !solaris
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func pidHandler(w response.Writer, req *request.Request) {
+	body := strconv.Itoa(os.Getpid())
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody([]byte(body))
+}
+
+func TestReusePort(t *testing.T) {
+	s, err := New(ServerConfig{
+		Listen:    []ListenAddr{{Network: "tcp4", Address: "127.0.0.1:0"}},
+		Handler:   okHandler,
+		ReusePort: 4,
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.Listen())
+	go s.Serve()
+	defer s.Close()
+
+	addrs := s.Addrs()
+	require.Len(t, addrs, 4)
+	for _, addr := range addrs {
+		assert.Equal(t, addrs[0].String(), addr.String())
+	}
+
+	for range 8 {
+		conn, err := net.Dial("tcp", addrs[0].String())
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		require.NoError(t, err)
+		body, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "200 OK")
+		conn.Close()
+	}
+}
+
+// TestPreforkHelper is both the master and the workers in TestPrefork.
+func TestPreforkHelper(t *testing.T) {
+	addr := os.Getenv("TEST_PREFORK_ADDR")
+	if addr == "" {
+		t.Skip("only runs as a child process")
+	}
+
+	if _, ok := PreforkWorker(); ok {
+		s, err := New(ServerConfig{
+			Listen:    []ListenAddr{{Network: "tcp4", Address: addr}},
+			Handler:   pidHandler,
+			ReusePort: 1,
+		})
+		require.NoError(t, err)
+		go s.ListenAndServe()
+		time.Sleep(10 * time.Second)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		bufio.NewReader(os.Stdin).ReadString('\n')
+		cancel()
+	}()
+	require.NoError(t, Prefork{Workers: 2, RestartDelay: 10 * time.Millisecond, StopTimeout: time.Second}.Run(ctx))
+}
+
+func TestPrefork(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestPreforkHelper$")
+	cmd.Env = append(os.Environ(), "TEST_PREFORK_ADDR="+addr)
+	stdin, err := cmd.StdinPipe()
+	require.NoError(t, err)
+	require.NoError(t, cmd.Start())
+	defer cmd.Process.Kill()
+
+	// Connections are spread by the kernel, keep asking until both workers answered
+	workerPids := func(want int, exclude int) map[int]bool {
+		pids := map[int]bool{}
+		deadline := time.Now().Add(5 * time.Second)
+		for len(pids) < want && time.Now().Before(deadline) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+			resp, _ := io.ReadAll(conn)
+			conn.Close()
+			_, body, _ := strings.Cut(string(resp), "\r\n\r\n")
+			if pid, err := strconv.Atoi(body); err == nil && pid != exclude {
+				pids[pid] = true
+			}
+		}
+		return pids
+	}
+
+	pids := workerPids(2, 0)
+	require.Len(t, pids, 2)
+
+	// A crashed worker is replaced
+	var crashed int
+	for pid := range pids {
+		crashed = pid
+		break
+	}
+	syscall.Kill(crashed, syscall.SIGKILL)
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, workerPids(2, crashed), 2)
+
+	stdin.Write([]byte("stop\n"))
+	require.NoError(t, cmd.Wait())
+}
+
+func benchmarkServer(b *testing.B, reusePort int) {
+	s, err := New(ServerConfig{
+		Listen:    []ListenAddr{{Network: "tcp4", Address: "127.0.0.1:0"}},
+		Handler:   okHandler,
+		ReusePort: reusePort,
+	})
+	require.NoError(b, err)
+	require.NoError(b, s.Listen())
+	go s.Serve()
+	defer s.Close()
+	addr := s.Addr().String()
+
+	b.RunParallel(func(pb *testing.PB) {
+		buf := make([]byte, 256)
+		for pb.Next() {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+			for {
+				if _, err := conn.Read(buf); err != nil {
+					break
+				}
+			}
+			conn.Close()
+		}
+	})
+}
+
+// Compare with: go test -run '^$' -bench Listener ./internal/server
+func BenchmarkSingleListener(b *testing.B) {
+	benchmarkServer(b, 0)
+}
+
+func BenchmarkReusePortListeners(b *testing.B) {
+	benchmarkServer(b, 4)
+}
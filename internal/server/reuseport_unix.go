@@ -0,0 +1,42 @@
+//go:build unix && !solaris
+
+package server
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+var reusePortConfig = net.ListenConfig{
+	Control: func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	},
+}
+
+// bindReusePort opens n sockets on addr with SO_REUSEPORT so the kernel
+// spreads incoming connections across them.
+func bindReusePort(addr ListenAddr, n int) ([]net.Listener, error) {
+	listeners := []net.Listener{}
+	address := addr.Address
+	for range n {
+		l, err := reusePortConfig.Listen(context.Background(), addr.Network, address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		// Every socket has to share the port picked for the first one
+		address = l.Addr().String()
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
@@ -1,15 +1,28 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"http-from-tcp/internal/headers"
+	"http-from-tcp/internal/http2"
 	"http-from-tcp/internal/request"
 	"http-from-tcp/internal/response"
 	"io"
 	"log/slog"
 	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
+var ErrServerClosed = errors.New("server closed")
+var ErrorNoListeners = errors.New("no listen addresses configured")
+
 type Handler func(w response.Writer, req *request.Request)
 
 type HandlerError struct {
@@ -37,72 +50,690 @@ func (h *HandlerError) Write(w io.Writer) {
 }
 
 type Server struct {
-	running  atomic.Bool
-	listener net.Listener
-	handler  Handler
+	cfg        ServerConfig
+	logger     *slog.Logger
+	closed     atomic.Bool
+	nextConnID atomic.Uint64
+
+	mu           sync.Mutex
+	listeners    []*boundListener
+	conns        map[*trackedConn]struct{}
+	connsWG      sync.WaitGroup
+	shuttingDown atomic.Bool
+	// shutdownStarted is closed when Shutdown is called, see ShuttingDown
+	shutdownStarted chan struct{}
+	shutdownOnce    sync.Once
+
+	tlsConfig *tls.Config
+	certs     *certReloader
+
+	connLimiter    *limiter
+	requestLimiter *limiter
+
+	baseCtx       context.Context
+	cancelBaseCtx context.CancelFunc
+
+	// done is closed with serveErr set once Serve returns
+	done     chan struct{}
+	doneOnce sync.Once
+	serveErr error
 }
 
-func NewServer(l net.Listener, h Handler) *Server {
+// New validates cfg, nothing is bound until Listen or ListenAndServe.
+func New(cfg ServerConfig) (*Server, error) {
+	if cfg.Handler == nil {
+		return nil, errors.New("server config has no handler")
+	}
+	cfg.setDefaults()
+
 	s := &Server{
-		handler:  h,
-		listener: l,
+		cfg:    cfg,
+		logger: cfg.Logger,
+		conns:  map[*trackedConn]struct{}{},
+		done:   make(chan struct{}),
+
+		shutdownStarted: make(chan struct{}),
 	}
-	return s
+	s.baseCtx, s.cancelBaseCtx = context.WithCancel(context.Background())
+	s.connLimiter = newLimiter(cfg.Limits.MaxConns, cfg.Limits.QueueSize, cfg.Limits.QueueTimeout)
+	s.requestLimiter = newLimiter(cfg.Limits.MaxConcurrentRequests, cfg.Limits.QueueSize, cfg.Limits.QueueTimeout)
+
+	if cfg.TLS != nil {
+		conf, reloader, err := newTLSConfig(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		s.tlsConfig = conf
+		s.certs = reloader
+	}
+	return s, nil
 }
 
-func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
-	req, err := request.RequestFromReader(conn)
+// NewServer serves on an already bound listener, wrapped with TLS when the
+// options configure it.
+func NewServer(l net.Listener, h Handler, opts ...Option) (*Server, error) {
+	cfg := ServerConfig{Handler: h}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	s, err := New(cfg)
 	if err != nil {
-		statusCode := response.StatusInternalServerError
+		return nil, err
+	}
+	addr := ListenAddr{Network: l.Addr().Network(), Address: l.Addr().String()}
+	bl := &boundListener{Listener: l, raw: l, name: fdName(addr)}
+	if s.tlsConfig != nil {
+		bl.Listener = tls.NewListener(l, s.tlsConfig)
+	}
+	s.listeners = []*boundListener{bl}
+	return s, nil
+}
 
-		if err == request.ErrorMalformedStartLine || err == request.ErrorInvalidData || err == request.ErrorInvalidRequestLine || err == request.ErrorBodyLengthExceeded {
-			statusCode = response.StatusBadRequest
+func (s *Server) bind(addr ListenAddr) ([]net.Listener, error) {
+	if addr.Network != "unix" && s.cfg.ReusePort > 0 {
+		return bindReusePort(addr, s.cfg.ReusePort)
+	}
+	l, err := bind(addr)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{l}, nil
+}
+
+func bind(addr ListenAddr) (net.Listener, error) {
+	if addr.Network != "unix" {
+		return net.Listen(addr.Network, addr.Address)
+	}
+
+	// A socket file left behind by a previous run would fail the bind
+	if info, err := os.Stat(addr.Address); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(addr.Address)
+	}
+	l, err := net.Listen("unix", addr.Address)
+	if err != nil {
+		return nil, err
+	}
+	if addr.FileMode != 0 {
+		if err := os.Chmod(addr.Address, addr.FileMode); err != nil {
+			l.Close()
+			return nil, err
 		}
+	}
+	return l, nil
+}
+
+// boundListener keeps the socket next to the (possibly TLS wrapped)
+// listener connections are accepted from, Upgrade hands the socket over.
+type boundListener struct {
+	net.Listener
+	raw  net.Listener
+	name string
+}
 
-		he := &HandlerError{
-			StatusCode: statusCode,
-			Message:    err.Error(),
+// Listen binds every configured address, closing the ones already bound if
+// any of them fails. Addresses handed over by a parent process through
+// Upgrade are reused instead of bound again.
+func (s *Server) Listen() error {
+	if len(s.cfg.Listen) == 0 {
+		return ErrorNoListeners
+	}
+
+	listeners := []*boundListener{}
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
 		}
-		he.Write(conn)
-		return
 	}
+	for _, addr := range s.cfg.Listen {
+		raw := []net.Listener{}
+		names := []string{}
+		var err error
 
-	respWriter := response.NewWrite(conn)
-	s.handler(respWriter, req)
+		if addr.Network == "systemd" {
+			raw, names, err = ActivationListeners(addr.Address)
+		} else {
+			raw, err = inheritedListeners(fdName(addr))
+			if err == nil && len(raw) == 0 {
+				raw, err = s.bind(addr)
+			}
+			for range raw {
+				names = append(names, fdName(addr))
+			}
+		}
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("listening on %s: %w", addr, err)
+		}
+
+		for i, l := range raw {
+			bl := &boundListener{Listener: l, raw: l, name: names[i]}
+			if s.tlsConfig != nil {
+				bl.Listener = tls.NewListener(l, s.tlsConfig)
+			}
+			listeners = append(listeners, bl)
+		}
+	}
+
+	s.mu.Lock()
+	s.listeners = append(s.listeners, listeners...)
+	s.mu.Unlock()
+	return nil
 }
 
-func (s *Server) listen() {
-	s.running.Swap(true)
-	for {
-		conn, err := s.listener.Accept()
-		if !s.running.Load() {
+// Serve accepts on every bound listener and blocks until the server is
+// closed, returning ErrServerClosed, or one of the listeners fails.
+func (s *Server) Serve() error {
+	err := s.serve()
+	s.doneOnce.Do(func() {
+		s.serveErr = err
+		close(s.done)
+	})
+	return err
+}
+
+func (s *Server) serve() error {
+	s.mu.Lock()
+	listeners := s.listeners
+	s.mu.Unlock()
+	if len(listeners) == 0 {
+		return ErrorNoListeners
+	}
+
+	if s.closed.Load() {
+		return ErrServerClosed
+	}
+
+	if s.certs != nil {
+		s.certs.start()
+	}
+	notifyReady()
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func() {
+			errs <- s.acceptLoop(l)
+		}()
+	}
+
+	// Losing one listener takes the whole server down
+	err := <-errs
+	if !s.closed.Load() {
+		s.Close()
+	}
+	return err
+}
+
+func (s *Server) ListenAndServe() error {
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	return s.Serve()
+}
+
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.listeners) == 0 {
+		return nil
+	}
+	return s.listeners[0].Addr()
+}
+
+func (s *Server) Addrs() []net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addrs := []net.Addr{}
+	for _, l := range s.listeners {
+		addrs = append(addrs, l.Addr())
+	}
+	return addrs
+}
+
+func (s *Server) Metrics() *Metrics {
+	return s.cfg.Metrics
+}
+
+type shutdownKey struct{}
+
+func (s *Server) requestContext() (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(s.baseCtx, shutdownKey{}, s.shutdownStarted)
+	if s.cfg.Timeouts.Request > 0 {
+		return context.WithTimeout(ctx, s.cfg.Timeouts.Request)
+	}
+	return context.WithCancel(ctx)
+}
+
+// ShuttingDown returns a channel that is closed as soon as the server
+// handling the request with ctx starts a graceful shutdown. In-flight
+// requests are given until the drain deadline to finish, handlers that
+// would otherwise run until the client leaves, such as event streams,
+// should return when it is closed. It is nil outside of a request.
+func ShuttingDown(ctx context.Context) <-chan struct{} {
+	ch, _ := ctx.Value(shutdownKey{}).(chan struct{})
+	return ch
+}
+
+func parseErrorStatus(err error) response.StatusCode {
+	switch err {
+	case request.ErrorMalformedStartLine, request.ErrorInvalidData, request.ErrorInvalidRequestLine, request.ErrorInvalidRequestTarget, request.ErrorBodyLengthExceeded, request.ErrorInvalidContentLength:
+		return response.StatusBadRequest
+	case request.ErrorTransferEncoding:
+		return response.StatusNotImplemented
+	case request.ErrorHeaderTooLarge:
+		return response.StatusRequestHeaderFieldsTooLarge
+	case request.ErrorBodyTooLarge:
+		return response.StatusContentTooLarge
+	default:
+		return response.StatusInternalServerError
+	}
+}
+
+// keepAlive reports whether another request can be read from the
+// connection after the handler wrote its response.
+func keepAlive(req *request.Request, rec Recorder) bool {
+	if strings.Contains(strings.ToLower(req.Headers.Get("Connection")), "close") {
+		return false
+	}
+	if rec.Headers == nil || strings.Contains(strings.ToLower(rec.Headers.Get("Connection")), "close") {
+		return false
+	}
+	// Without a length or chunked encoding the body ends when the connection does
+	return rec.Headers.Get("Content-Length") != "" || strings.Contains(rec.Headers.Get("Transfer-Encoding"), "chunked")
+}
+
+func (s *Server) handle(conn net.Conn, acceptedAt time.Time) {
+	hijacked := false
+	defer func() {
+		if !hijacked {
+			conn.Close()
+		}
+	}()
+	tc := s.trackConn(conn)
+	if tc == nil {
+		return
+	}
+	defer s.untrackConn(tc)
+
+	metrics := s.cfg.Metrics
+	metrics.connOpened()
+	defer metrics.connClosed()
+
+	connID := s.nextConnID.Add(1)
+	cr := &connReader{conn: conn}
+	reader := request.NewReader(cr)
+	reader.MaxHeaderBytes = s.cfg.Limits.MaxHeaderBytes
+	reader.MaxBodyBytes = s.cfg.Limits.MaxBodyBytes
+
+	_, isTLS := conn.(*tls.Conn)
+	if s.cfg.H2C && !isTLS {
+		conn.SetReadDeadline(time.Now().Add(s.cfg.Timeouts.Read))
+		prior, err := cr.sniff(http2.ClientPreface)
+		if err != nil {
+			return
+		}
+		if prior {
+			s.serveHTTP2(conn, tc, connID, acceptedAt, cr.peeked, nil)
+			return
+		}
+	}
+
+	for seq := 1; ; seq++ {
+		if seq == 1 {
+			conn.SetReadDeadline(time.Now().Add(s.cfg.Timeouts.Read))
+		} else {
+			conn.SetReadDeadline(time.Now().Add(s.cfg.Timeouts.Idle))
+			tc.idle.Store(true)
+		}
+		req, err := reader.ReadRequestHeader()
+		tc.idle.Store(false)
+		streamed := false
+		if err == nil {
+			h2cUpgrade := s.cfg.H2C && !isTLS && http2.IsUpgrade(req)
+			streamed = s.cfg.StreamBody != nil && !h2cUpgrade && s.cfg.StreamBody(req)
+			if streamed {
+				err = reader.StreamBody(req)
+			} else {
+				err = reader.ReadBody(req)
+			}
+		}
+		if err == io.EOF || (seq > 1 && errors.Is(err, os.ErrDeadlineExceeded)) {
 			return
 		}
 		if err != nil {
-			slog.Error("error accepting connection", "error", err)
+			metrics.parseError(err)
+
+			he := &HandlerError{
+				StatusCode: parseErrorStatus(err),
+				Message:    err.Error(),
+			}
+			he.Write(conn)
 			return
 		}
+		if streamed {
+			// The handler reads the body under the same limit
+			conn.SetReadDeadline(time.Now().Add(s.cfg.Timeouts.Read))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		if s.cfg.Timeouts.Write > 0 {
+			conn.SetWriteDeadline(time.Now().Add(s.cfg.Timeouts.Write))
+		}
+
+		req.RemoteAddr = conn.RemoteAddr().String()
+		req.LocalAddr = conn.LocalAddr().String()
+		req.ConnID = connID
+		req.ConnSeq = seq
+		req.AcceptedAt = acceptedAt
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			state := tlsConn.ConnectionState()
+			req.TLS = &state
+		}
+		if s.cfg.H2C && !isTLS && http2.IsUpgrade(req) {
+			buffered := append(slices.Clone(reader.Buffered()), cr.peeked...)
+			s.serveHTTP2(conn, tc, connID, acceptedAt, buffered, req)
+			return
+		}
+
+		ctx, cancel := s.requestContext()
+		req = req.WithContext(ctx)
+		if len(reader.Buffered()) == 0 && !reader.BodyPending() {
+			cr.startBackgroundRead(cancel)
+		}
+
+		// After a hijack the connection is left alone: no deadlines, no
+		// more requests, Shutdown neither waits for nor closes it. It no
+		// longer counts towards MaxConcurrentRequests either.
+		held := &slot{}
+		respWriter := response.NewHijackableWrite(conn, func() (net.Conn, []byte, error) {
+			cr.abortBackgroundRead()
+			conn.SetDeadline(time.Time{})
+			buffered := append(slices.Clone(reader.Buffered()), cr.peeked...)
+			cr.peeked = nil
+			hijacked = true
+			s.untrackConn(tc)
+			held.release()
+			metrics.connHijacked()
+			return conn, buffered, nil
+		})
+		rec := s.serveRequest(respWriter, req, held)
+
+		cancel()
+		if hijacked {
+			return
+		}
+		cr.abortBackgroundRead()
+		conn.SetWriteDeadline(time.Time{})
+
+		// An unread streamed body is in the way of the next request
+		if !keepAlive(req, rec) || reader.BodyPending() || seq == s.cfg.Limits.MaxRequestsPerConn || s.shuttingDown.Load() {
+			return
+		}
+	}
+}
+
+// serveRequest runs the handler for req within the request limits and
+// records it, holding its request slot in held.
+func (s *Server) serveRequest(w response.Writer, req *request.Request, held *slot) Recorder {
+	metrics := s.cfg.Metrics
+	handler := s.cfg.Handler
+	if metrics != nil && s.cfg.MetricsPath != "" && req.RequestLine.RequestTarget == s.cfg.MetricsPath {
+		handler = metrics.Registry.Handler()
+	}
+
+	if s.requestLimiter.acquire(req.Context()) {
+		held.take(s.requestLimiter)
+	} else {
+		handler = s.overloadedHandler
+	}
+	rec := Record(handler, w, req)
+	metrics.observe(req, rec)
+	held.release()
+	return rec
+}
+
+// serveHTTP2 runs an h2c connection. upgrade is the HTTP/1.1 request that
+// asked to switch, nil when the client started with the HTTP/2 preface.
+func (s *Server) serveHTTP2(conn net.Conn, tc *trackedConn, connID uint64, acceptedAt time.Time, buffered []byte, upgrade *request.Request) {
+	conn.SetDeadline(time.Time{})
+	var seq atomic.Int64
+	h2 := http2.NewConn(conn, buffered, http2.Config{
+		Handler: func(w response.Writer, req *request.Request) {
+			req.RemoteAddr = conn.RemoteAddr().String()
+			req.LocalAddr = conn.LocalAddr().String()
+			req.ConnID = connID
+			req.ConnSeq = int(seq.Add(1))
+			req.AcceptedAt = acceptedAt
+			s.serveRequest(w, req, &slot{})
+		},
+		NewContext:     s.requestContext,
+		MaxHeaderBytes: s.cfg.Limits.MaxHeaderBytes,
+		MaxBodyBytes:   s.cfg.Limits.MaxBodyBytes,
+		IdleTimeout:    s.cfg.Timeouts.Idle,
+		WriteTimeout:   s.cfg.Timeouts.Write,
+		StreamBody:     s.cfg.StreamBody,
+		Logger:         s.logger,
+	})
+	s.mu.Lock()
+	tc.shutdown = h2.Shutdown
+	s.mu.Unlock()
+
+	if upgrade != nil {
+		w := response.NewWrite(conn)
+		w.WriteStatusLine(response.StatusSwitchingProtocols)
+		h := headers.NewHeaders()
+		h.Set("Connection", "Upgrade")
+		h.Set("Upgrade", "h2c")
+		if err := w.WriteHeaders(h); err != nil {
+			return
+		}
+	}
+	if err := h2.Serve(upgrade); err != nil {
+		s.logger.Debug("http2 connection ended", "remote_addr", conn.RemoteAddr(), "error", err)
+	}
+}
+
+// acceptLoop backs off on temporary accept errors, such as running out of
+// file descriptors, and only returns once the listener is closed or fails.
+func (s *Server) acceptLoop(l net.Listener) error {
+	backoff := time.Duration(0)
+	for {
+		conn, err := l.Accept()
+		if s.closed.Load() {
+			if conn != nil {
+				conn.Close()
+			}
+			return ErrServerClosed
+		}
+		if err != nil {
+			errType, temporary := acceptErrorType(err)
+			s.cfg.Metrics.acceptError(errType)
+			if !temporary {
+				s.logger.Error("error accepting connection", "addr", l.Addr(), "error", err)
+				return err
+			}
+
+			backoff = nextAcceptBackoff(backoff)
+			s.logger.Warn("temporary error accepting connection", "addr", l.Addr(), "error", err, "retry_in", backoff)
+			select {
+			case <-time.After(backoff):
+			case <-s.baseCtx.Done():
+			}
+			continue
+		}
+		backoff = 0
+		acceptedAt := time.Now()
+
+		if !s.cfg.IPFilter.AllowedConn(conn) {
+			s.logger.Debug("connection denied by ip filter", "remote_addr", conn.RemoteAddr())
+			if s.cfg.IPFilterForbidden {
+				go s.rejectConn(conn, "ip_denied", writeForbidden)
+			} else {
+				s.cfg.Metrics.connRejected("ip_denied")
+				conn.Close()
+			}
+			continue
+		}
+
 		go func() {
-			slog.Info("connection recieved, handling the connection")
-			s.handle(conn)
+			s.logger.Debug("connection received", "remote_addr", conn.RemoteAddr())
+			if !s.connLimiter.acquire(s.baseCtx) {
+				s.rejectConn(conn, "overloaded", s.writeOverloaded)
+				return
+			}
+			defer s.connLimiter.release()
+			s.handle(conn, acceptedAt)
 		}()
 	}
 }
 
-func Serve(port uint16, handler Handler) (*Server, error) {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+// Serve binds port on all interfaces and accepts connections in the
+// background, use New and ListenAndServe to get accept errors back.
+func Serve(port uint16, handler Handler, opts ...Option) (*Server, error) {
+	cfg := ServerConfig{
+		Listen:  []ListenAddr{portAddr(port)},
+		Handler: handler,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	s, err := New(cfg)
 	if err != nil {
 		return nil, err
 	}
-
-	s := NewServer(listener, handler)
-	go s.listen()
+	if err := s.Listen(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	go func() {
+		err := s.Serve()
+		if err != nil && err != ErrServerClosed {
+			s.logger.Error("server stopped", "error", err)
+		}
+	}()
 
 	return s, nil
 }
 
+// Wait blocks until Serve returns and returns its error, ErrServerClosed
+// after Close or Shutdown.
+func (s *Server) Wait() error {
+	<-s.done
+	return s.serveErr
+}
+
+type trackedConn struct {
+	net.Conn
+	// idle is set while waiting for the next request on a keep-alive connection
+	idle atomic.Bool
+	// shutdown is set for HTTP/2 connections, which are drained with GOAWAY
+	// instead of waiting for them to go idle
+	shutdown func()
+}
+
+// trackConn returns nil once shutdown started.
+func (s *Server) trackConn(conn net.Conn) *trackedConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown.Load() {
+		return nil
+	}
+	tc := &trackedConn{Conn: conn}
+	s.conns[tc] = struct{}{}
+	s.connsWG.Add(1)
+	return tc
+}
+
+// untrackConn may be called twice for hijacked connections
+func (s *Server) untrackConn(tc *trackedConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.conns[tc]; !ok {
+		return
+	}
+	delete(s.conns, tc)
+	s.connsWG.Done()
+}
+
+func (s *Server) closeConns(idleOnly bool) {
+	s.mu.Lock()
+	shutdowns := []func(){}
+	for tc := range s.conns {
+		switch {
+		case idleOnly && tc.shutdown != nil:
+			shutdowns = append(shutdowns, tc.shutdown)
+		case !idleOnly || tc.idle.Load():
+			tc.Close()
+		}
+	}
+	s.mu.Unlock()
+
+	// HTTP/2 connections send GOAWAY in the background, still it happens
+	// outside the lock
+	for _, shutdown := range shutdowns {
+		shutdown()
+	}
+}
+
+func (s *Server) closeListeners() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	errs := []error{}
+	for _, l := range s.listeners {
+		if err := l.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	s.listeners = nil
+	return errors.Join(errs...)
+}
+
+// Shutdown stops accepting, closes idle keep-alive connections, signals
+// long-lived handlers through ShuttingDown and waits for in-flight requests
+// to finish. When ctx is done first the request contexts are cancelled, the
+// remaining connections closed and ctx.Err returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shuttingDown.Store(true)
+	s.mu.Unlock()
+	s.shutdownOnce.Do(func() { close(s.shutdownStarted) })
+	s.closed.Store(true)
+	if s.certs != nil {
+		s.certs.Close()
+	}
+	err := s.closeListeners()
+
+	drained := make(chan struct{})
+	go func() {
+		s.connsWG.Wait()
+		close(drained)
+	}()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		s.closeConns(true)
+		select {
+		case <-drained:
+			s.cancelBaseCtx()
+			return err
+		case <-ctx.Done():
+			s.cancelBaseCtx()
+			s.closeConns(false)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops accepting and cancels in-flight requests without waiting for
+// them, use Shutdown to drain.
 func (s *Server) Close() error {
-	s.running.Swap(false)
-	return s.listener.Close()
+	s.closed.Store(true)
+	s.cancelBaseCtx()
+	if s.certs != nil {
+		s.certs.Close()
+	}
+	return s.closeListeners()
 }
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectionMetadata(t *testing.T) {
+	var mu sync.Mutex
+	seen := []*request.Request{}
+	handler := func(w response.Writer, req *request.Request) {
+		mu.Lock()
+		seen = append(seen, req)
+		mu.Unlock()
+
+		body := fmt.Sprintf("request %d", req.ConnSeq)
+		h := response.GetDefaultHeaders(len(body))
+		h.Override("Connection", "keep-alive")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	}
+
+	s, err := Serve(0, handler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET /one HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"GET /two HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	body, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "request 1")
+	assert.Contains(t, string(body), "request 2")
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, seen, 2)
+	assert.Equal(t, 1, seen[0].ConnSeq)
+	assert.Equal(t, 2, seen[1].ConnSeq)
+	assert.Equal(t, seen[0].ConnID, seen[1].ConnID)
+	assert.Equal(t, conn.LocalAddr().String(), seen[0].RemoteAddr)
+	assert.Equal(t, conn.RemoteAddr().String(), seen[0].LocalAddr)
+	assert.False(t, seen[0].AcceptedAt.IsZero())
+	assert.Equal(t, seen[0].AcceptedAt, seen[1].AcceptedAt)
+}
+
+func TestRequestSmuggling(t *testing.T) {
+	tests := []struct {
+		name       string
+		headers    string
+		wantStatus string
+	}{
+		{name: "content-length and transfer-encoding", headers: "Content-Length: 6\r\nTransfer-Encoding: chunked\r\n", wantStatus: "400"},
+		{name: "transfer-encoding", headers: "Transfer-Encoding: chunked\r\n", wantStatus: "501"},
+		{name: "conflicting content-length", headers: "Content-Length: 6\r\nContent-Length: 0\r\n", wantStatus: "400"},
+		{name: "signed content-length", headers: "Content-Length: +6\r\n", wantStatus: "400"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			seen := []string{}
+			s, err := Serve(0, func(w response.Writer, req *request.Request) {
+				mu.Lock()
+				seen = append(seen, req.RequestLine.RequestTarget)
+				mu.Unlock()
+				h := response.GetDefaultHeaders(0)
+				h.Override("Connection", "keep-alive")
+				w.WriteStatusLine(response.StatusOK)
+				w.WriteHeaders(h)
+			})
+			require.NoError(t, err)
+			defer s.Close()
+
+			conn, err := net.Dial("tcp", s.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+
+			// Whichever way the body is framed, the hidden request must not
+			// be served
+			_, err = conn.Write([]byte("POST /a HTTP/1.1\r\nHost: localhost\r\n" + tt.headers + "\r\n" +
+				"0\r\n\r\n" +
+				"POST /admin HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\n\r\n"))
+			require.NoError(t, err)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			resp, err := io.ReadAll(conn)
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(string(resp), "HTTP/1.1 "+tt.wantStatus+" "), string(resp))
+			assert.Equal(t, 1, strings.Count(string(resp), "HTTP/1.1 "))
+
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Empty(t, seen)
+		})
+	}
+}
+
+func TestStreamBody(t *testing.T) {
+	var mu sync.Mutex
+	served := []string{}
+	handler := func(w response.Writer, req *request.Request) {
+		var body []byte
+		if req.RequestLine.RequestTarget == "/part" {
+			body = make([]byte, 2)
+			io.ReadFull(req.BodyReader(), body)
+		} else {
+			body, _ = io.ReadAll(req.BodyReader())
+		}
+		mu.Lock()
+		served = append(served, req.RequestLine.RequestTarget)
+		mu.Unlock()
+
+		h := response.GetDefaultHeaders(len(body))
+		h.Override("Connection", "keep-alive")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		w.WriteBody(body)
+	}
+
+	s, err := New(ServerConfig{
+		Listen:     []ListenAddr{portAddr(0)},
+		Handler:    handler,
+		StreamBody: func(req *request.Request) bool { return true },
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.Listen())
+	go s.Serve()
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("POST /all HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello" +
+		"POST /part HTTP/1.1\r\nContent-Length: 5\r\n\r\nworld" +
+		"GET /never HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	body, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "\r\n\r\nhello")
+	assert.Contains(t, string(body), "\r\n\r\nwo")
+
+	// The unread part of the body ends the connection
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"/all", "/part"}, served)
+}
+
+func TestRequestContext(t *testing.T) {
+	cancelled := make(chan error, 1)
+	handler := func(w response.Writer, req *request.Request) {
+		<-req.Context().Done()
+		cancelled <- req.Context().Err()
+	}
+
+	s, err := Serve(0, handler, WithRequestTimeout(50*time.Millisecond))
+	require.NoError(t, err)
+	defer s.Close()
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		require.NoError(t, err)
+		return conn
+	}
+
+	// Client goes away before the deadline
+	conn := dial()
+	time.Sleep(10 * time.Millisecond)
+	conn.Close()
+	assert.Equal(t, context.Canceled, waitFor(t, cancelled))
+
+	// Deadline passes while the client waits
+	conn = dial()
+	defer conn.Close()
+	assert.Equal(t, context.DeadlineExceeded, waitFor(t, cancelled))
+}
+
+func TestRequestContextClose(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan error, 1)
+	handler := func(w response.Writer, req *request.Request) {
+		close(started)
+		<-req.Context().Done()
+		cancelled <- req.Context().Err()
+	}
+
+	s, err := Serve(0, handler)
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	<-started
+	s.Close()
+	assert.Equal(t, context.Canceled, waitFor(t, cancelled))
+}
+
+func TestRequestContextShutdown(t *testing.T) {
+	started := make(chan struct{})
+	signalled := make(chan error, 1)
+	handler := func(w response.Writer, req *request.Request) {
+		close(started)
+		select {
+		case <-ShuttingDown(req.Context()):
+			// The request itself may still finish
+			signalled <- req.Context().Err()
+		case <-time.After(5 * time.Second):
+			signalled <- context.DeadlineExceeded
+		}
+	}
+
+	s, err := Serve(0, handler)
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	require.NoError(t, s.Shutdown(ctx))
+	assert.Less(t, time.Since(start), time.Second)
+	assert.NoError(t, waitFor(t, signalled))
+	assert.Nil(t, ShuttingDown(context.Background()))
+}
+
+func waitFor(t *testing.T, ch chan error) error {
+	t.Helper()
+	select {
+	case err := <-ch:
+		return err
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the request context")
+		return nil
+	}
+}
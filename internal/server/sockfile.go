@@ -0,0 +1,12 @@
+//go:build !plan9
+
+package server
+
+import "net"
+
+// keepSocketFile leaves a unix socket file in place when l is closed
+func keepSocketFile(l net.Listener) {
+	if ul, ok := l.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+}
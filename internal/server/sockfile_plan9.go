@@ -0,0 +1,6 @@
+package server
+
+import "net"
+
+// keepSocketFile has nothing to do, plan9 has no unix sockets
+func keepSocketFile(l net.Listener) {}
@@ -0,0 +1,7 @@
+//go:build unix && !solaris && !(linux && (amd64 || 386 || arm))
+
+package server
+
+import "syscall"
+
+const soReusePort = syscall.SO_REUSEPORT
@@ -0,0 +1,6 @@
+//go:build linux && (amd64 || 386 || arm)
+
+package server
+
+// The syscall package is frozen without SO_REUSEPORT on these architectures.
+const soReusePort = 0xf
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrorNoCertificates = fmt.Errorf("tls config has no certificates")
+
+type CertKeyPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+type TLSConfig struct {
+	// Certificates are picked by SNI, the first one is used when the client
+	// sends no server name or none of the certificates match.
+	Certificates []CertKeyPair
+	MinVersion   uint16
+	// ReloadInterval is how often the files are checked for changes, zero
+	// disables polling. Certificates are also reloaded on SIGHUP where the
+	// platform has it.
+	ReloadInterval time.Duration
+	// ClientCAFile enables mutual TLS, client certificates must chain up to
+	// one of the CAs in this PEM bundle.
+	ClientCAFile string
+	// ClientAuth defaults to tls.RequireAndVerifyClientCert when
+	// ClientCAFile is set.
+	ClientAuth tls.ClientAuthType
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+type certReloader struct {
+	pairs []CertKeyPair
+
+	mu       sync.RWMutex
+	certs    []*tls.Certificate
+	byName   map[string]*tls.Certificate
+	modTimes []time.Time
+
+	interval  time.Duration
+	startOnce sync.Once
+	stop      chan struct{}
+	once      sync.Once
+}
+
+func newCertReloader(pairs []CertKeyPair) (*certReloader, error) {
+	if len(pairs) == 0 {
+		return nil, ErrorNoCertificates
+	}
+	r := &certReloader{
+		pairs: pairs,
+		stop:  make(chan struct{}),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) Reload() error {
+	certs := []*tls.Certificate{}
+	byName := map[string]*tls.Certificate{}
+	modTimes := []time.Time{}
+
+	for _, pair := range r.pairs {
+		cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return fmt.Errorf("loading %s: %w", pair.CertFile, err)
+		}
+		certs = append(certs, &cert)
+
+		for _, name := range cert.Leaf.DNSNames {
+			name = strings.ToLower(name)
+			if _, ok := byName[name]; !ok {
+				byName[name] = &cert
+			}
+		}
+		modTimes = append(modTimes, pairModTime(pair))
+	}
+
+	r.mu.Lock()
+	r.certs = certs
+	r.byName = byName
+	r.modTimes = modTimes
+	r.mu.Unlock()
+	return nil
+}
+
+func pairModTime(pair CertKeyPair) time.Time {
+	latest := time.Time{}
+	for _, file := range []string{pair.CertFile, pair.KeyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+func (r *certReloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for i, pair := range r.pairs {
+		if !pairModTime(pair).Equal(r.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *certReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := r.byName[name]; ok {
+		return cert, nil
+	}
+	// Wildcards only cover a single label
+	if _, rest, ok := strings.Cut(name, "."); ok {
+		if cert, ok := r.byName["*."+rest]; ok {
+			return cert, nil
+		}
+	}
+	return r.certs[0], nil
+}
+
+// start watches for changes in the background until Close, it only runs
+// once the server serves so a server that is never closed leaks nothing.
+func (r *certReloader) start() {
+	r.startOnce.Do(func() { go r.watch(r.interval) })
+}
+
+func (r *certReloader) watch(interval time.Duration) {
+	hup, stop := notifyHangup()
+	defer stop()
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-hup:
+		case <-tick:
+			if !r.changed() {
+				continue
+			}
+		}
+
+		// A failed reload keeps serving the previous certificates
+		if err := r.Reload(); err != nil {
+			slog.Error("error reloading tls certificates", "error", err)
+			continue
+		}
+		slog.Info("reloaded tls certificates")
+	}
+}
+
+func (r *certReloader) Close() {
+	r.once.Do(func() { close(r.stop) })
+}
+
+func newTLSConfig(cfg *TLSConfig) (*tls.Config, *certReloader, error) {
+	reloader, err := newCertReloader(cfg.Certificates)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	minVersion := cfg.MinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+	conf := &tls.Config{
+		MinVersion:     minVersion,
+		NextProtos:     []string{"http/1.1"},
+		GetCertificate: reloader.GetCertificate,
+		ClientAuth:     cfg.ClientAuth,
+	}
+	if cfg.ClientCAFile != "" {
+		pool, err := loadCertPool(cfg.ClientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		conf.ClientCAs = pool
+		if conf.ClientAuth == tls.NoClientCert {
+			conf.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	reloader.interval = cfg.ReloadInterval
+	return conf, reloader, nil
+}
+
+// GenerateSelfSignedCert returns a PEM encoded certificate and key valid for
+// hosts, meant for local testing only.
+func GenerateSelfSignedCert(hosts []string, validFor time.Duration) ([]byte, []byte, error) {
+	if len(hosts) == 0 {
+		return nil, nil, errors.New("at least one host is required")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0], Organization: []string{"http-from-tcp development"}},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return certPEM, keyPEM, nil
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeCert(t *testing.T, dir, name string, hosts ...string) CertKeyPair {
+	t.Helper()
+	certPEM, keyPEM, err := GenerateSelfSignedCert(hosts, time.Hour)
+	require.NoError(t, err)
+
+	pair := CertKeyPair{
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+	}
+	require.NoError(t, os.WriteFile(pair.CertFile, certPEM, 0644))
+	require.NoError(t, os.WriteFile(pair.KeyFile, keyPEM, 0600))
+	return pair
+}
+
+func okHandler(w response.Writer, req *request.Request) {
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(response.GetDefaultHeaders(2))
+	w.WriteBody([]byte("ok"))
+}
+
+func tlsGet(t *testing.T, addr, serverName string) *x509.Certificate {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: " + serverName + "\r\n\r\n"))
+	require.NoError(t, err)
+	body, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "HTTP/1.1 200 OK")
+	assert.Equal(t, "http/1.1", conn.ConnectionState().NegotiatedProtocol)
+
+	return conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	first := writeCert(t, dir, "first", "first.test")
+	second := writeCert(t, dir, "second", "*.second.test")
+
+	s, err := Serve(0, okHandler, WithTLS(TLSConfig{Certificates: []CertKeyPair{first, second}}))
+	require.NoError(t, err)
+	defer s.Close()
+	addr := s.Addr().String()
+
+	assert.Equal(t, []string{"first.test"}, tlsGet(t, addr, "first.test").DNSNames)
+	assert.Equal(t, []string{"*.second.test"}, tlsGet(t, addr, "api.second.test").DNSNames)
+	assert.Equal(t, []string{"first.test"}, tlsGet(t, addr, "unknown.test").DNSNames)
+
+}
+
+// replaceCert writes a new certificate for pair, moving its modification
+// time forward so polling notices even on coarse file system clocks.
+func replaceCert(t *testing.T, dir, name string, hosts ...string) {
+	t.Helper()
+	pair := writeCert(t, dir, name, hosts...)
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(pair.CertFile, later, later))
+	require.NoError(t, os.Chtimes(pair.KeyFile, later, later))
+}
+
+func TestReloadTLS(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		trigger  func(t *testing.T)
+	}{
+		{
+			name:     "polling",
+			interval: 10 * time.Millisecond,
+			trigger:  func(t *testing.T) {},
+		},
+		{
+			name: "SIGHUP",
+			trigger: func(t *testing.T) {
+				if runtime.GOOS == "windows" {
+					t.Skip("no SIGHUP on windows")
+				}
+				// Keep the default action from killing the test binary
+				// should the watcher not be listening yet.
+				hup := make(chan os.Signal, 1)
+				signal.Notify(hup, syscall.SIGHUP)
+				t.Cleanup(func() { signal.Stop(hup) })
+				proc, err := os.FindProcess(os.Getpid())
+				require.NoError(t, err)
+				require.NoError(t, proc.Signal(syscall.SIGHUP))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			first := writeCert(t, dir, "first", "first.test")
+			s, err := Serve(0, okHandler, WithTLS(TLSConfig{
+				Certificates:   []CertKeyPair{first},
+				ReloadInterval: tt.interval,
+			}))
+			require.NoError(t, err)
+			defer s.Close()
+			addr := s.Addr().String()
+
+			before := tlsGet(t, addr, "first.test").SerialNumber
+			replaceCert(t, dir, "first", "first.test")
+			tt.trigger(t)
+			assert.Eventually(t, func() bool {
+				return tlsGet(t, addr, "first.test").SerialNumber.Cmp(before) != 0
+			}, 2*time.Second, 20*time.Millisecond)
+		})
+	}
+}
+
+func issueClientCert(t *testing.T, ca CertKeyPair, commonName string, dnsNames ...string) tls.Certificate {
+	t.Helper()
+	caCert, err := tls.LoadX509KeyPair(ca.CertFile, ca.KeyFile)
+	require.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, caCert.Leaf, &key.PublicKey, caCert.PrivateKey)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	serverPair := writeCert(t, dir, "server", "localhost")
+	ca := writeCert(t, dir, "ca", "internal-ca")
+
+	handler := Chain(okHandler, RequireClientCert(ClientCertPolicy{
+		Subjects: []string{"billing-*"},
+		SANs:     []string{"*.svc.internal"},
+	}))
+	s, err := Serve(0, handler, WithTLS(TLSConfig{
+		Certificates: []CertKeyPair{serverPair},
+		ClientCAFile: ca.CertFile,
+	}))
+	require.NoError(t, err)
+	defer s.Close()
+
+	get := func(cert *tls.Certificate) (string, error) {
+		conf := &tls.Config{InsecureSkipVerify: true}
+		if cert != nil {
+			conf.Certificates = []tls.Certificate{*cert}
+		}
+		conn, err := tls.Dial("tcp", s.Addr().String(), conf)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+			return "", err
+		}
+		body, err := io.ReadAll(conn)
+		return string(body), err
+	}
+
+	bySubject := issueClientCert(t, ca, "billing-api")
+	body, err := get(&bySubject)
+	require.NoError(t, err)
+	assert.Contains(t, body, "200 OK")
+
+	bySAN := issueClientCert(t, ca, "worker", "jobs.svc.internal")
+	body, err = get(&bySAN)
+	require.NoError(t, err)
+	assert.Contains(t, body, "200 OK")
+
+	denied := issueClientCert(t, ca, "reporting")
+	body, err = get(&denied)
+	require.NoError(t, err)
+	assert.Contains(t, body, "403 Forbidden")
+
+	_, err = get(nil)
+	assert.Error(t, err)
+}
+
+func TestClientCertPolicy(t *testing.T) {
+	policy := ClientCertPolicy{
+		Subjects: []string{"Billing-*"},
+		SANs:     []string{"API.example.com", "*.Svc.Internal"},
+	}
+
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		want bool
+	}{
+		{name: "subject", cert: &x509.Certificate{Subject: pkix.Name{CommonName: "billing-worker"}}, want: true},
+		{name: "subject in another case", cert: &x509.Certificate{Subject: pkix.Name{CommonName: "BILLING-worker"}}, want: true},
+		{name: "other subject", cert: &x509.Certificate{Subject: pkix.Name{CommonName: "search"}}, want: false},
+		{name: "dns name", cert: &x509.Certificate{DNSNames: []string{"api.example.com"}}, want: true},
+		{name: "dns name in another case", cert: &x509.Certificate{DNSNames: []string{"Api.Example.COM"}}, want: true},
+		{name: "wildcard pattern", cert: &x509.Certificate{DNSNames: []string{"orders.svc.internal"}}, want: true},
+		{name: "other dns name", cert: &x509.Certificate{DNSNames: []string{"api.example.org"}}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, policy.Allows(tt.cert))
+		})
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	_, err = NewServer(l, nil)
+	assert.Error(t, err)
+
+	pair := writeCert(t, t.TempDir(), "server", "localhost")
+	s, err := NewServer(l, okHandler, WithTLS(TLSConfig{Certificates: []CertKeyPair{pair}}))
+	require.NoError(t, err)
+	go s.Serve()
+	defer s.Close()
+
+	assert.Equal(t, []string{"localhost"}, tlsGet(t, l.Addr().String(), "localhost").DNSNames)
+}
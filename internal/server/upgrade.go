@@ -0,0 +1,139 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An upgraded process gets its listeners the same way systemd passes them,
+// except that it is told its parent pid instead of its own.
+const (
+	upgradeParentEnv = "UPGRADE_PARENT_PID"
+	upgradeReadyEnv  = "UPGRADE_READY_FD"
+)
+
+// Descriptors passed by systemd start right after stdin, stdout and stderr.
+const listenFdsStart = 3
+
+// fdName names a bound address in LISTEN_FDNAMES, which is colon separated.
+func fdName(addr ListenAddr) string {
+	return url.QueryEscape(addr.String())
+}
+
+// notifyReady tells the parent that started this process through Upgrade
+// that the inherited listeners are being served.
+func notifyReady() {
+	fd, err := strconv.Atoi(os.Getenv(upgradeReadyEnv))
+	if err != nil {
+		return
+	}
+	os.Unsetenv(upgradeReadyEnv)
+
+	f := os.NewFile(uintptr(fd), "upgrade-ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+func upgradeEnv(names []string, readyFd int) []string {
+	env := slices.DeleteFunc(os.Environ(), func(kv string) bool {
+		return strings.HasPrefix(kv, "LISTEN_") || strings.HasPrefix(kv, "UPGRADE_")
+	})
+	return append(env,
+		fmt.Sprintf("LISTEN_FDS=%d", len(names)),
+		fmt.Sprintf("LISTEN_FDNAMES=%s", strings.Join(names, ":")),
+		fmt.Sprintf("%s=%d", upgradeParentEnv, os.Getpid()),
+		fmt.Sprintf("%s=%d", upgradeReadyEnv, listenFdsStart+len(names)),
+	)
+}
+
+// Upgrade starts a new copy of the running executable with the same
+// arguments, hands it every listener and waits up to timeout for it to start
+// serving. On success the caller should Shutdown to drain its connections;
+// the listening sockets stay open in the new process.
+func (s *Server) Upgrade(timeout time.Duration) (*os.Process, error) {
+	s.mu.Lock()
+	listeners := slices.Clone(s.listeners)
+	s.mu.Unlock()
+	if len(listeners) == 0 {
+		return nil, ErrorNoListeners
+	}
+
+	files := []*os.File{}
+	names := []string{}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		fl, ok := l.raw.(fileListener)
+		if !ok {
+			return nil, fmt.Errorf("listener %s cannot be handed over", l.name)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+		names = append(names, l.name)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyR.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = upgradeEnv(names, len(files))
+	cmd.ExtraFiles = append(slices.Clone(files), readyW)
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		// EOF here means the child exited without becoming ready
+		_, err := readyR.Read(make([]byte, 1))
+		ready <- err
+	}()
+
+	select {
+	case err = <-ready:
+	case <-time.After(timeout):
+		err = errors.New("timed out")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("upgraded process did not become ready: %w", err)
+	}
+	go cmd.Wait()
+
+	// The socket files now belong to the new process
+	for _, l := range listeners {
+		keepSocketFile(l.raw)
+	}
+	s.logger.Info("handed listeners to upgraded process", "pid", cmd.Process.Pid)
+	return cmd.Process, nil
+}
@@ -0,0 +1,124 @@
+//go:build unix
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestUpgradeHelper runs as the server process in TestUpgrade. The first
+// copy upgrades when a line arrives on stdin, the copy it starts just serves.
+func TestUpgradeHelper(t *testing.T) {
+	if os.Getenv("TEST_UPGRADE_HELPER") != "1" {
+		t.Skip("only runs as a child process")
+	}
+	upgraded := os.Getenv(upgradeParentEnv) != ""
+
+	s, err := New(ServerConfig{
+		Listen: []ListenAddr{{Network: "tcp4", Address: "127.0.0.1:0"}},
+		Handler: func(w response.Writer, req *request.Request) {
+			body := strconv.Itoa(os.Getpid())
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+			w.WriteBody([]byte(body))
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.Listen())
+	go s.Serve()
+
+	if upgraded {
+		time.Sleep(10 * time.Second)
+		return
+	}
+
+	fmt.Println("addr", s.Addr())
+	bufio.NewReader(os.Stdin).ReadString('\n')
+	_, err = s.Upgrade(5 * time.Second)
+	require.NoError(t, err)
+	require.NoError(t, s.Shutdown(context.Background()))
+}
+
+func getPid(t *testing.T, addr string) int {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	resp, err := io.ReadAll(conn)
+	require.NoError(t, err)
+
+	_, body, _ := strings.Cut(string(resp), "\r\n\r\n")
+	pid, err := strconv.Atoi(body)
+	require.NoError(t, err)
+	return pid
+}
+
+func TestUpgrade(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestUpgradeHelper$")
+	cmd.Env = append(os.Environ(), "TEST_UPGRADE_HELPER=1")
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	require.NoError(t, err)
+	stdout, err := cmd.StdoutPipe()
+	require.NoError(t, err)
+	require.NoError(t, cmd.Start())
+	defer cmd.Process.Kill()
+
+	br := bufio.NewReader(stdout)
+	line, err := br.ReadString('\n')
+	go io.Copy(os.Stderr, br)
+	require.NoError(t, err)
+	addr := strings.TrimSpace(strings.TrimPrefix(line, "addr "))
+
+	assert.Equal(t, cmd.Process.Pid, getPid(t, addr))
+
+	// Keep hitting the port while the upgrade happens, nothing may be refused
+	stop := make(chan struct{})
+	failures := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				close(failures)
+				return
+			default:
+			}
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				failures <- err
+				close(failures)
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	_, err = stdin.Write([]byte("upgrade\n"))
+	require.NoError(t, err)
+	require.NoError(t, cmd.Wait())
+	close(stop)
+	assert.NoError(t, <-failures)
+
+	pid := getPid(t, addr)
+	assert.NotEqual(t, cmd.Process.Pid, pid)
+	syscall.Kill(pid, syscall.SIGKILL)
+}
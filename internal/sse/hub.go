@@ -0,0 +1,305 @@
+package sse
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+const (
+	DefaultReplaySize = 64
+	DefaultBufferSize = 32
+)
+
+var ErrorSubscriberDropped = fmt.Errorf("subscriber fell behind and was dropped")
+var ErrorSubscriptionClosed = fmt.Errorf("subscription closed")
+var ErrorHubClosed = fmt.Errorf("hub closed")
+
+// OverflowPolicy decides what happens when a subscriber's queue is full,
+// publishers never wait for subscribers.
+type OverflowPolicy int
+
+const (
+	// DropSubscriber ends the subscription, the client reconnects with its
+	// Last-Event-ID and catches up from the replay buffer.
+	DropSubscriber OverflowPolicy = iota
+	// Coalesce replaces queued events of the same name with the new one,
+	// or discards the oldest queued event if there is none.
+	Coalesce
+)
+
+type HubConfig struct {
+	// ReplaySize is how many events each topic keeps for reconnecting
+	// clients, negative keeps none
+	ReplaySize int
+	// BufferSize bounds the events queued for one subscriber, the events
+	// replayed on subscribing do not count against it
+	BufferSize int
+	Overflow   OverflowPolicy
+	Metrics    *Metrics
+}
+
+// Hub broadcasts events published on a topic to its subscribers.
+type Hub struct {
+	cfg HubConfig
+
+	mu     sync.Mutex
+	topics map[string]*topic
+	closed bool
+}
+
+type topic struct {
+	name   string
+	seq    uint64
+	replay []Event
+	subs   map[*Subscription]struct{}
+}
+
+func NewHub(cfg HubConfig) *Hub {
+	if cfg.ReplaySize == 0 {
+		cfg.ReplaySize = DefaultReplaySize
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = DefaultBufferSize
+	}
+	return &Hub{
+		cfg:    cfg,
+		topics: map[string]*topic{},
+	}
+}
+
+func (h *Hub) topic(name string) *topic {
+	t, ok := h.topics[name]
+	if !ok {
+		t = &topic{name: name, subs: map[*Subscription]struct{}{}}
+		h.topics[name] = t
+	}
+	return t
+}
+
+// Publish sends ev to every subscriber of name and returns it with its ID,
+// which is numbered per topic unless ev already has one.
+func (h *Hub) Publish(name string, ev Event) (Event, error) {
+	if _, err := appendEvent(nil, ev); err != nil {
+		return ev, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return ev, ErrorHubClosed
+	}
+	t := h.topic(name)
+	t.seq++
+	if ev.ID == "" {
+		ev.ID = strconv.FormatUint(t.seq, 10)
+	}
+	if h.cfg.ReplaySize > 0 {
+		if len(t.replay) == h.cfg.ReplaySize {
+			t.replay = slices.Delete(t.replay, 0, 1)
+		}
+		t.replay = append(t.replay, ev)
+	}
+	h.cfg.Metrics.published(name)
+
+	for sub := range t.subs {
+		h.deliver(t, sub, ev)
+	}
+	return ev, nil
+}
+
+// deliver is called with h.mu held
+func (h *Hub) deliver(t *topic, sub *Subscription, ev Event) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if len(sub.queue) >= h.cfg.BufferSize {
+		switch h.cfg.Overflow {
+		case DropSubscriber:
+			sub.err = ErrorSubscriberDropped
+			delete(t.subs, sub)
+			h.cfg.Metrics.subscribed(t.name, -1)
+			h.cfg.Metrics.dropped(t.name)
+			sub.wake()
+			return
+		case Coalesce:
+			n := len(sub.queue)
+			sub.queue = slices.DeleteFunc(sub.queue, func(queued Event) bool {
+				return queued.Event == ev.Event
+			})
+			if len(sub.queue) == n {
+				sub.queue = slices.Delete(sub.queue, 0, 1)
+			}
+			h.cfg.Metrics.coalesced(t.name, n-len(sub.queue))
+		}
+	}
+	sub.queue = append(sub.queue, ev)
+	sub.wake()
+}
+
+// Subscribe starts receiving the events of name. With a lastEventID the
+// events published after it are replayed first, all of the replay buffer
+// when that event is no longer in it.
+func (h *Hub) Subscribe(name, lastEventID string) *Subscription {
+	sub := &Subscription{
+		hub:    h,
+		notify: make(chan struct{}, 1),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		sub.err = ErrorHubClosed
+		return sub
+	}
+	t := h.topic(name)
+	sub.topic = t
+	if lastEventID != "" {
+		start := 0
+		for i, ev := range t.replay {
+			if ev.ID == lastEventID {
+				start = i + 1
+			}
+		}
+		sub.replay = slices.Clone(t.replay[start:])
+	}
+	t.subs[sub] = struct{}{}
+	h.cfg.Metrics.subscribed(name, 1)
+	return sub
+}
+
+// Subscribers returns the number of subscribers of a topic
+func (h *Hub) Subscribers(name string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if t, ok := h.topics[name]; ok {
+		return len(t.subs)
+	}
+	return 0
+}
+
+// Topics returns the subscriber count of every topic that had events or
+// subscribers.
+func (h *Hub) Topics() map[string]int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	counts := make(map[string]int, len(h.topics))
+	for name, t := range h.topics {
+		counts[name] = len(t.subs)
+	}
+	return counts
+}
+
+// Close ends every subscription, Next returns ErrorHubClosed.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for _, t := range h.topics {
+		for sub := range t.subs {
+			sub.mu.Lock()
+			sub.err = ErrorHubClosed
+			sub.wake()
+			sub.mu.Unlock()
+			delete(t.subs, sub)
+			h.cfg.Metrics.subscribed(t.name, -1)
+		}
+	}
+}
+
+func (h *Hub) unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.err == nil {
+		sub.err = ErrorSubscriptionClosed
+	}
+	sub.wake()
+	if t := sub.topic; t != nil {
+		if _, ok := t.subs[sub]; ok {
+			delete(t.subs, sub)
+			h.cfg.Metrics.subscribed(t.name, -1)
+		}
+	}
+}
+
+// Stream sends the events of name to stream, starting after its
+// LastEventID, until the client goes away, the subscriber is dropped or the
+// hub is closed. A client leaving is not an error.
+func (h *Hub) Stream(stream *Stream, name string) error {
+	sub := h.Subscribe(name, stream.LastEventID())
+	defer sub.Close()
+	for {
+		ev, err := sub.Next(stream.ctx)
+		if stream.ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(ev); err != nil {
+			return err
+		}
+	}
+}
+
+type Subscription struct {
+	hub    *Hub
+	topic  *topic
+	notify chan struct{}
+
+	mu sync.Mutex
+	// replay holds the missed events and is sent before queue, the
+	// overflow policy only applies to queue
+	replay []Event
+	queue  []Event
+	err    error
+}
+
+// wake is called with s.mu held
+func (s *Subscription) wake() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Next waits for the next event. Once the subscription is dropped, closed
+// or the hub is closed the events still queued are discarded and the
+// reason is returned.
+func (s *Subscription) Next(ctx context.Context) (Event, error) {
+	for {
+		s.mu.Lock()
+		if s.err != nil {
+			err := s.err
+			s.mu.Unlock()
+			return Event{}, err
+		}
+		if len(s.replay) > 0 {
+			ev := s.replay[0]
+			s.replay = s.replay[1:]
+			s.mu.Unlock()
+			return ev, nil
+		}
+		if len(s.queue) > 0 {
+			ev := s.queue[0]
+			s.queue = s.queue[1:]
+			s.mu.Unlock()
+			return ev, nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return Event{}, ctx.Err()
+		case <-s.notify:
+		}
+	}
+}
+
+func (s *Subscription) Close() {
+	s.hub.unsubscribe(s)
+}
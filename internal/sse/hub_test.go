@@ -0,0 +1,243 @@
+package sse
+
+import (
+	"bufio"
+	"context"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"http-from-tcp/internal/server"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// queued drains the events already waiting for sub
+func queued(t *testing.T, sub *Subscription) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	ids := []string{}
+	for {
+		ev, err := sub.Next(ctx)
+		if err != nil {
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+			return ids
+		}
+		ids = append(ids, ev.ID+ev.Event)
+	}
+}
+
+func TestHubReplay(t *testing.T) {
+	hub := NewHub(HubConfig{ReplaySize: 3})
+	defer hub.Close()
+	for range 5 {
+		_, err := hub.Publish("news", Event{Data: "x"})
+		require.NoError(t, err)
+	}
+
+	tests := []struct {
+		name        string
+		lastEventID string
+		want        []string
+	}{
+		{name: "new client", lastEventID: "", want: []string{}},
+		{name: "one behind", lastEventID: "4", want: []string{"5"}},
+		{name: "up to date", lastEventID: "5", want: []string{}},
+		{name: "evicted id", lastEventID: "1", want: []string{"3", "4", "5"}},
+		{name: "unknown id", lastEventID: "nope", want: []string{"3", "4", "5"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub := hub.Subscribe("news", tt.lastEventID)
+			defer sub.Close()
+			assert.Equal(t, tt.want, queued(t, sub))
+
+			ev, err := hub.Publish("other", Event{ID: "custom"})
+			require.NoError(t, err)
+			assert.Equal(t, "custom", ev.ID)
+			assert.Equal(t, []string{}, queued(t, sub))
+		})
+	}
+}
+
+func TestHubOverflow(t *testing.T) {
+	tests := []struct {
+		name          string
+		overflow      OverflowPolicy
+		publish       []string
+		want          []string
+		wantErr       error
+		wantCoalesced float64
+	}{
+		{
+			name:     "within buffer",
+			overflow: DropSubscriber,
+			publish:  []string{"a", "b"},
+			want:     []string{"1a", "2b"},
+		},
+		{
+			name:     "drop subscriber",
+			overflow: DropSubscriber,
+			publish:  []string{"a", "b", "c"},
+			wantErr:  ErrorSubscriberDropped,
+		},
+		{
+			name:          "coalesce same name",
+			overflow:      Coalesce,
+			publish:       []string{"a", "b", "a"},
+			want:          []string{"2b", "3a"},
+			wantCoalesced: 1,
+		},
+		{
+			name:          "coalesce drops oldest",
+			overflow:      Coalesce,
+			publish:       []string{"a", "b", "c", "d"},
+			want:          []string{"3c", "4d"},
+			wantCoalesced: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics := NewMetrics(server.NewRegistry())
+			hub := NewHub(HubConfig{BufferSize: 2, Overflow: tt.overflow, Metrics: metrics})
+			defer hub.Close()
+			sub := hub.Subscribe("news", "")
+			defer sub.Close()
+
+			for _, name := range tt.publish {
+				_, err := hub.Publish("news", Event{Event: name})
+				require.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantCoalesced, metrics.Coalesced.Value("news"))
+
+			if tt.wantErr != nil {
+				_, err := sub.Next(context.Background())
+				assert.ErrorIs(t, err, tt.wantErr)
+				assert.Zero(t, hub.Subscribers("news"))
+				assert.Equal(t, 1.0, metrics.Dropped.Value("news"))
+				assert.Zero(t, metrics.Subscribers.Value("news"))
+				return
+			}
+			assert.Equal(t, tt.want, queued(t, sub))
+		})
+	}
+}
+
+func TestHubReplayLargerThanBuffer(t *testing.T) {
+	tests := []struct {
+		name     string
+		overflow OverflowPolicy
+		live     []string
+		want     []string
+	}{
+		{
+			name:     "drop subscriber",
+			overflow: DropSubscriber,
+			live:     []string{"a", "b"},
+			want:     []string{"1", "2", "3", "4", "5a", "6b"},
+		},
+		{
+			name:     "coalesce",
+			overflow: Coalesce,
+			live:     []string{"a", "b", "a"},
+			want:     []string{"1", "2", "3", "4", "6b", "7a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := NewHub(HubConfig{ReplaySize: 8, BufferSize: 2, Overflow: tt.overflow})
+			defer hub.Close()
+			for range 4 {
+				_, err := hub.Publish("news", Event{Data: "x"})
+				require.NoError(t, err)
+			}
+
+			// Only the live events count against the buffer
+			sub := hub.Subscribe("news", "nope")
+			defer sub.Close()
+			for _, name := range tt.live {
+				_, err := hub.Publish("news", Event{Event: name})
+				require.NoError(t, err)
+			}
+			assert.Equal(t, tt.want, queued(t, sub))
+			assert.Equal(t, 1, hub.Subscribers("news"))
+		})
+	}
+}
+
+func TestHubSubscribers(t *testing.T) {
+	metrics := NewMetrics(server.NewRegistry())
+	hub := NewHub(HubConfig{Metrics: metrics})
+
+	a := hub.Subscribe("a", "")
+	hub.Subscribe("a", "")
+	b := hub.Subscribe("b", "")
+	assert.Equal(t, map[string]int{"a": 2, "b": 1}, hub.Topics())
+
+	a.Close()
+	a.Close()
+	b.Close()
+	assert.Equal(t, map[string]int{"a": 1, "b": 0}, hub.Topics())
+	assert.Equal(t, 1.0, metrics.Subscribers.Value("a"))
+	assert.Equal(t, 0.0, metrics.Subscribers.Value("b"))
+	_, err := b.Next(context.Background())
+	assert.ErrorIs(t, err, ErrorSubscriptionClosed)
+
+	remaining := hub.Subscribe("c", "")
+	hub.Close()
+	_, err = remaining.Next(context.Background())
+	assert.ErrorIs(t, err, ErrorHubClosed)
+	assert.Equal(t, 0.0, metrics.Subscribers.Value("a"))
+	_, err = hub.Publish("a", Event{})
+	assert.ErrorIs(t, err, ErrorHubClosed)
+	_, err = hub.Subscribe("a", "").Next(context.Background())
+	assert.ErrorIs(t, err, ErrorHubClosed)
+}
+
+func TestHubStream(t *testing.T) {
+	hub := NewHub(HubConfig{})
+	defer hub.Close()
+	s, err := server.Serve(0, func(w response.Writer, req *request.Request) {
+		stream, err := NewStream(w, req, Config{})
+		require.NoError(t, err)
+		defer stream.Close()
+		assert.NoError(t, hub.Stream(stream, "news"))
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	hub.Publish("news", Event{Data: "missed"})
+	hub.Publish("news", Event{Data: "replayed"})
+
+	req, err := http.NewRequest("GET", "http://"+s.Addr().String()+"/news", nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	br := bufio.NewReader(resp.Body)
+
+	readEvent := func() string {
+		var event string
+		for {
+			line, err := br.ReadString('\n')
+			require.NoError(t, err)
+			if line == "\n" {
+				return event
+			}
+			event += line
+		}
+	}
+	assert.Equal(t, "id: 2\ndata: replayed\n", readEvent())
+
+	require.Eventually(t, func() bool { return hub.Subscribers("news") == 1 }, time.Second, time.Millisecond)
+	hub.Publish("news", Event{Event: "live", Data: "now"})
+	assert.Equal(t, "id: 3\nevent: live\ndata: now\n", readEvent())
+
+	resp.Body.Close()
+	assert.Eventually(t, func() bool { return hub.Subscribers("news") == 0 }, 5*time.Second, time.Millisecond)
+}
@@ -0,0 +1,47 @@
+package sse
+
+import "http-from-tcp/internal/server"
+
+type Metrics struct {
+	Subscribers *server.Gauge
+	Published   *server.Counter
+	Dropped     *server.Counter
+	Coalesced   *server.Counter
+}
+
+func NewMetrics(r *server.Registry) *Metrics {
+	return &Metrics{
+		Subscribers: r.NewGauge("sse_subscribers", "Number of subscribers per topic.", "topic"),
+		Published:   r.NewCounter("sse_events_published_total", "Total number of events published.", "topic"),
+		Dropped:     r.NewCounter("sse_subscribers_dropped_total", "Total number of subscribers dropped for falling behind.", "topic"),
+		Coalesced:   r.NewCounter("sse_events_coalesced_total", "Total number of queued events replaced or discarded for slow subscribers.", "topic"),
+	}
+}
+
+func (m *Metrics) subscribed(topic string, delta float64) {
+	if m == nil {
+		return
+	}
+	m.Subscribers.Add(delta, topic)
+}
+
+func (m *Metrics) published(topic string) {
+	if m == nil {
+		return
+	}
+	m.Published.Inc(topic)
+}
+
+func (m *Metrics) dropped(topic string) {
+	if m == nil {
+		return
+	}
+	m.Dropped.Inc(topic)
+}
+
+func (m *Metrics) coalesced(topic string, n int) {
+	if m == nil {
+		return
+	}
+	m.Coalesced.Add(float64(n), topic)
+}
@@ -0,0 +1,209 @@
+package sse
+
+import (
+	"context"
+	"fmt"
+	"http-from-tcp/internal/headers"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"http-from-tcp/internal/server"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The stream follows the event stream format of the HTML Living Standard,
+// section 9.2 Server-sent events.
+
+const ContentType = "text/event-stream"
+
+var ErrorInvalidEvent = fmt.Errorf("event id and name cannot contain newlines")
+var ErrorStreamClosed = fmt.Errorf("event stream closed")
+
+type Event struct {
+	ID    string
+	Event string
+	// Data may span several lines, each is sent as its own data field
+	Data string
+	// Retry tells the client how long to wait before reconnecting
+	Retry time.Duration
+}
+
+// appendEvent encodes ev followed by the blank line that dispatches it.
+func appendEvent(buf []byte, ev Event) ([]byte, error) {
+	if strings.ContainsAny(ev.ID, "\r\n\x00") || strings.ContainsAny(ev.Event, "\r\n") {
+		return buf, ErrorInvalidEvent
+	}
+	if ev.ID != "" {
+		buf = append(buf, "id: "+ev.ID+"\n"...)
+	}
+	if ev.Event != "" {
+		buf = append(buf, "event: "+ev.Event+"\n"...)
+	}
+	if ev.Retry > 0 {
+		buf = append(buf, "retry: "+strconv.FormatInt(ev.Retry.Milliseconds(), 10)+"\n"...)
+	}
+	// Any of CRLF, CR and LF ends a line for the client
+	data := strings.ReplaceAll(ev.Data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\r", "\n")
+	for line := range strings.SplitSeq(data, "\n") {
+		buf = append(buf, "data: "+line+"\n"...)
+	}
+	return append(buf, '\n'), nil
+}
+
+func appendComment(buf []byte, text string) []byte {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	for line := range strings.SplitSeq(text, "\n") {
+		buf = append(buf, ": "+line+"\n"...)
+	}
+	return append(buf, '\n')
+}
+
+type Config struct {
+	// Heartbeat sends a comment whenever the stream was quiet that long so
+	// proxies keep the connection open, zero disables it.
+	Heartbeat time.Duration
+	// Retry is sent once when the stream starts
+	Retry time.Duration
+}
+
+// Stream writes events as chunks of a text/event-stream response. Send may
+// be called from several goroutines.
+type Stream struct {
+	w           response.Writer
+	ctx         context.Context
+	cancel      context.CancelFunc
+	lastEventID string
+
+	mu        sync.Mutex
+	closed    bool
+	lastWrite time.Time
+	done      chan struct{}
+}
+
+// NewStream writes the response headers and starts the heartbeat. The
+// stream ends when the client disconnects, the request context is done, the
+// server starts shutting down or Close is called.
+func NewStream(w response.Writer, req *request.Request, cfg Config) (*Stream, error) {
+	h := headers.NewHeaders()
+	h.Set("Content-Type", ContentType)
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Connection", "close")
+	// Stop proxies such as nginx from buffering the stream
+	h.Set("X-Accel-Buffering", "no")
+	if err := w.WriteStatusLine(response.StatusOK); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	s := &Stream{
+		w:           w,
+		ctx:         ctx,
+		cancel:      cancel,
+		lastEventID: req.Headers.Get("Last-Event-ID"),
+		lastWrite:   time.Now(),
+		done:        make(chan struct{}),
+	}
+	if cfg.Retry > 0 {
+		if err := s.write(fmt.Appendf(nil, "retry: %d\n\n", cfg.Retry.Milliseconds())); err != nil {
+			return nil, err
+		}
+	}
+	go s.run(cfg.Heartbeat, server.ShuttingDown(req.Context()))
+	return s, nil
+}
+
+// LastEventID is the id of the last event the client saw before it
+// reconnected, empty on the first connection.
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done is closed once the stream cannot be written anymore
+func (s *Stream) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+func (s *Stream) Send(ev Event) error {
+	buf, err := appendEvent(nil, ev)
+	if err != nil {
+		return err
+	}
+	return s.write(buf)
+}
+
+// Comment sends text that clients ignore
+func (s *Stream) Comment(text string) error {
+	return s.write(appendComment(nil, text))
+}
+
+func (s *Stream) write(buf []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.ctx.Err() != nil {
+		return ErrorStreamClosed
+	}
+	if _, err := s.w.WriteChunkedBody(buf); err != nil {
+		s.cancel()
+		return err
+	}
+	s.lastWrite = time.Now()
+	return nil
+}
+
+// Close ends the response and stops the heartbeat, the handler must call it
+// before returning.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	defer s.cancel()
+
+	if s.ctx.Err() != nil {
+		// The client is gone, there is nobody to end the body for
+		return nil
+	}
+	if _, err := s.w.WriteChunkedBodyDone(); err != nil {
+		return err
+	}
+	return s.w.WriteTrailers(nil)
+}
+
+func (s *Stream) run(heartbeat time.Duration, shutdown <-chan struct{}) {
+	var tick <-chan time.Time
+	if heartbeat > 0 {
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.done:
+			return
+		case <-shutdown:
+			// Clients reconnect to another instance with their Last-Event-ID
+			s.Close()
+			return
+		case <-tick:
+			s.mu.Lock()
+			quiet := time.Since(s.lastWrite) >= heartbeat
+			s.mu.Unlock()
+			if quiet {
+				s.Comment("heartbeat")
+			}
+		}
+	}
+}
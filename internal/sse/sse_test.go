@@ -0,0 +1,181 @@
+package sse
+
+import (
+	"bufio"
+	"context"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"http-from-tcp/internal/server"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppendEvent(t *testing.T) {
+	tests := []struct {
+		name    string
+		event   Event
+		want    string
+		wantErr error
+	}{
+		{
+			name:  "data only",
+			event: Event{Data: "hello"},
+			want:  "data: hello\n\n",
+		},
+		{
+			name:  "empty data",
+			event: Event{},
+			want:  "data: \n\n",
+		},
+		{
+			name:  "all fields",
+			event: Event{ID: "42", Event: "update", Data: "{}", Retry: 3 * time.Second},
+			want:  "id: 42\nevent: update\nretry: 3000\ndata: {}\n\n",
+		},
+		{
+			name:  "multi-line data",
+			event: Event{Data: "one\ntwo\r\nthree\rfour"},
+			want:  "data: one\ndata: two\ndata: three\ndata: four\n\n",
+		},
+		{
+			name:  "trailing newline",
+			event: Event{Data: "line\n"},
+			want:  "data: line\ndata: \n\n",
+		},
+		{
+			name:    "newline in id",
+			event:   Event{ID: "1\n2", Data: "x"},
+			wantErr: ErrorInvalidEvent,
+		},
+		{
+			name:    "newline in event name",
+			event:   Event{Event: "a\rb", Data: "x"},
+			wantErr: ErrorInvalidEvent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := appendEvent(nil, tt.event)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(got))
+		})
+	}
+}
+
+func TestStream(t *testing.T) {
+	s, err := server.Serve(0, func(w response.Writer, req *request.Request) {
+		stream, err := NewStream(w, req, Config{Retry: time.Second})
+		require.NoError(t, err)
+		defer stream.Close()
+		stream.Send(Event{ID: "1", Event: "greeting", Data: "hello\nworld"})
+		stream.Comment("between")
+		stream.Send(Event{ID: "2", Data: "last id " + stream.LastEventID()})
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	req, err := http.NewRequest("GET", "http://"+s.Addr().String()+"/events", nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "41")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, ContentType, resp.Header.Get("Content-Type"))
+	assert.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "retry: 1000\n\n"+
+		"id: 1\nevent: greeting\ndata: hello\ndata: world\n\n"+
+		": between\n\n"+
+		"id: 2\ndata: last id 41\n\n", string(body))
+}
+
+func TestStreamHeartbeatAndDisconnect(t *testing.T) {
+	stopped := make(chan error, 1)
+	s, err := server.Serve(0, func(w response.Writer, req *request.Request) {
+		stream, err := NewStream(w, req, Config{Heartbeat: 10 * time.Millisecond})
+		require.NoError(t, err)
+		defer stream.Close()
+		select {
+		case <-stream.Done():
+			stopped <- stream.Send(Event{Data: "too late"})
+		case <-time.After(5 * time.Second):
+			stopped <- nil
+		}
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	resp, err := http.Get("http://" + s.Addr().String() + "/events")
+	require.NoError(t, err)
+
+	br := bufio.NewReader(resp.Body)
+	for range 2 {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, ": heartbeat\n", line)
+		line, err = br.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "\n", line)
+	}
+	resp.Body.Close()
+
+	select {
+	case err := <-stopped:
+		assert.ErrorIs(t, err, ErrorStreamClosed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream did not notice the client leaving")
+	}
+}
+
+func TestStreamEndsOnShutdown(t *testing.T) {
+	hub := NewHub(HubConfig{})
+	defer hub.Close()
+	s, err := server.Serve(0, func(w response.Writer, req *request.Request) {
+		stream, err := NewStream(w, req, Config{})
+		require.NoError(t, err)
+		defer stream.Close()
+		hub.Stream(stream, "news")
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	resp, err := http.Get("http://" + s.Addr().String() + "/events")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	_, err = hub.Publish("news", Event{Data: "hello"})
+	require.NoError(t, err)
+	br := bufio.NewReader(resp.Body)
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "id: 1\n", line)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	require.NoError(t, s.Shutdown(ctx))
+	assert.Less(t, time.Since(start), time.Second)
+
+	// The stream was ended properly rather than cut off
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "data: hello\n\n", string(rest))
+}
+
+func TestAppendComment(t *testing.T) {
+	assert.Equal(t, ": a\n: b\n\n", string(appendComment(nil, "a\r\nb")))
+}
@@ -0,0 +1,494 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"http-from-tcp/internal/server"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The cases below follow the sections of the Autobahn test suite that apply
+// to a server without extensions.
+
+const testMaxMessageBytes = 1 << 17
+
+var testMask = [4]byte{0x37, 0xfa, 0x21, 0x3d}
+
+type testFrame struct {
+	fin      bool
+	opcode   byte
+	payload  []byte
+	rsv      byte
+	unmasked bool
+	// raw is written as is instead of encoding the fields above
+	raw []byte
+}
+
+func (f testFrame) encode() []byte {
+	if f.raw != nil {
+		return f.raw
+	}
+	mask := &testMask
+	if f.unmasked {
+		mask = nil
+	}
+	b := appendFrame(nil, f.fin, f.opcode, mask, f.payload)
+	b[0] |= f.rsv
+	return b
+}
+
+func text(s string) testFrame {
+	return testFrame{fin: true, opcode: TextMessage, payload: []byte(s)}
+}
+
+func binaryFrame(b []byte) testFrame {
+	return testFrame{fin: true, opcode: BinaryMessage, payload: b}
+}
+
+func control(opcode byte, payload []byte) testFrame {
+	return testFrame{fin: true, opcode: opcode, payload: payload}
+}
+
+func closeFrame(code int, reason string) testFrame {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return control(CloseMessage, append(payload, reason...))
+}
+
+func fragment(opcode byte, payload string, fin bool) testFrame {
+	return testFrame{fin: fin, opcode: opcode, payload: []byte(payload)}
+}
+
+func pattern(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+type wsClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// dialWebSocket performs the opening handshake, pipelined is sent in the
+// same write as the request.
+func dialWebSocket(t *testing.T, addr, path string, pipelined []byte) *wsClient {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	handshake := "GET " + path + " HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: " + testKey + "\r\n\r\n"
+	_, err = conn.Write(append([]byte(handshake), pipelined...))
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	return &wsClient{t: t, conn: conn, br: br}
+}
+
+func (c *wsClient) send(frames ...testFrame) {
+	for _, f := range frames {
+		_, err := c.conn.Write(f.encode())
+		require.NoError(c.t, err)
+	}
+}
+
+func (c *wsClient) read() testFrame {
+	h, err := readFrameHeader(c.br)
+	require.NoError(c.t, err)
+	assert.False(c.t, h.masked, "server frames must not be masked")
+	assert.Zero(c.t, h.rsv)
+	payload := make([]byte, h.length)
+	_, err = io.ReadFull(c.br, payload)
+	require.NoError(c.t, err)
+	return testFrame{fin: h.fin, opcode: h.opcode, payload: payload}
+}
+
+// expect reads the frames in want, close frames are compared by code only
+// since the reason is up to the server.
+func (c *wsClient) expect(want ...testFrame) {
+	for _, w := range want {
+		got := c.read()
+		require.Equal(c.t, w.opcode, got.opcode)
+		assert.Equal(c.t, w.fin, got.fin)
+		if w.opcode == CloseMessage && len(w.payload) >= 2 {
+			require.GreaterOrEqual(c.t, len(got.payload), 2)
+			assert.Equal(c.t, binary.BigEndian.Uint16(w.payload), binary.BigEndian.Uint16(got.payload))
+			continue
+		}
+		assert.Equal(c.t, string(w.payload), string(got.payload))
+	}
+}
+
+func (c *wsClient) expectEOF() {
+	_, err := c.br.ReadByte()
+	assert.ErrorIs(c.t, err, io.EOF)
+}
+
+func startEchoServer(t *testing.T) net.Addr {
+	upgrader := &Upgrader{MaxMessageBytes: testMaxMessageBytes}
+	s, err := server.Serve(0, func(w response.Writer, req *request.Request) {
+		conn, err := upgrader.Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if req.RequestLine.RequestTarget == "/fragmented" {
+			conn.FragmentSize = 4
+		}
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(messageType, data); err != nil {
+				return
+			}
+		}
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s.Addr()
+}
+
+func TestConformance(t *testing.T) {
+	addr := startEchoServer(t)
+	normalClose := closeFrame(CloseNormal, "")
+
+	type testCase struct {
+		name      string
+		send      []testFrame
+		want      []testFrame
+		pipelined bool
+	}
+	// Every case ends with the server closing the connection after want
+	var tests []testCase
+
+	for _, n := range []int{0, 125, 126, 127, 65535, 65536} {
+		payload := pattern(n)
+		tests = append(tests,
+			testCase{
+				name: fmt.Sprintf("1.1 text %d bytes", n),
+				send: []testFrame{text(strings.Repeat("*", n)), normalClose},
+				want: []testFrame{text(strings.Repeat("*", n)), normalClose},
+			},
+			testCase{
+				name: fmt.Sprintf("1.2 binary %d bytes", n),
+				send: []testFrame{binaryFrame(payload), normalClose},
+				want: []testFrame{binaryFrame(payload), normalClose},
+			},
+		)
+	}
+
+	tests = append(tests, []testCase{
+		{
+			name: "2.1 ping without payload",
+			send: []testFrame{control(PingMessage, nil), normalClose},
+			want: []testFrame{control(PongMessage, nil), normalClose},
+		},
+		{
+			name: "2.2 ping with payload",
+			send: []testFrame{control(PingMessage, []byte("Hello, world!")), normalClose},
+			want: []testFrame{control(PongMessage, []byte("Hello, world!")), normalClose},
+		},
+		{
+			name: "2.4 ping with 125 bytes",
+			send: []testFrame{control(PingMessage, pattern(125)), normalClose},
+			want: []testFrame{control(PongMessage, pattern(125)), normalClose},
+		},
+		{
+			name: "2.5 ping with 126 bytes",
+			send: []testFrame{control(PingMessage, pattern(126))},
+			want: []testFrame{closeFrame(CloseProtocolError, "")},
+		},
+		{
+			name: "2.6 unsolicited pong",
+			send: []testFrame{control(PongMessage, []byte("unsolicited")), text("after"), normalClose},
+			want: []testFrame{text("after"), normalClose},
+		},
+		{
+			name: "2.10 several pings",
+			send: []testFrame{control(PingMessage, []byte("1")), control(PingMessage, []byte("2")), normalClose},
+			want: []testFrame{control(PongMessage, []byte("1")), control(PongMessage, []byte("2")), normalClose},
+		},
+		{
+			name: "3.1 rsv1 set",
+			send: []testFrame{{fin: true, opcode: TextMessage, payload: []byte("x"), rsv: 0x40}},
+			want: []testFrame{closeFrame(CloseProtocolError, "")},
+		},
+		{
+			name: "3.3 rsv3 set after a valid message",
+			send: []testFrame{text("ok"), {fin: true, opcode: TextMessage, rsv: 0x10}},
+			want: []testFrame{text("ok"), closeFrame(CloseProtocolError, "")},
+		},
+		{
+			name: "3.7 rsv set on a ping",
+			send: []testFrame{{fin: true, opcode: PingMessage, rsv: 0x70}},
+			want: []testFrame{closeFrame(CloseProtocolError, "")},
+		},
+		{
+			name: "4.1 reserved data opcode",
+			send: []testFrame{{fin: true, opcode: 0x3}},
+			want: []testFrame{closeFrame(CloseProtocolError, "")},
+		},
+		{
+			name: "4.2 reserved control opcode",
+			send: []testFrame{{fin: true, opcode: 0xb, payload: []byte("x")}},
+			want: []testFrame{closeFrame(CloseProtocolError, "")},
+		},
+		{
+			name: "5.1 fragmented ping",
+			send: []testFrame{fragment(PingMessage, "frag", false), fragment(continuationFrame, "ment", true)},
+			want: []testFrame{closeFrame(CloseProtocolError, "")},
+		},
+		{
+			name: "5.3 fragmented text",
+			send: []testFrame{fragment(TextMessage, "frag", false), fragment(continuationFrame, "ment", true), normalClose},
+			want: []testFrame{text("fragment"), normalClose},
+		},
+		{
+			name: "5.5 fragments of one byte",
+			send: []testFrame{fragment(TextMessage, "a", false), fragment(continuationFrame, "b", false), fragment(continuationFrame, "c", true), normalClose},
+			want: []testFrame{text("abc"), normalClose},
+		},
+		{
+			name: "5.6 ping between fragments",
+			send: []testFrame{fragment(TextMessage, "frag", false), control(PingMessage, []byte("p")), fragment(continuationFrame, "ment", true), normalClose},
+			want: []testFrame{control(PongMessage, []byte("p")), text("fragment"), normalClose},
+		},
+		{
+			name: "5.9 continuation without a message",
+			send: []testFrame{fragment(continuationFrame, "x", true)},
+			want: []testFrame{closeFrame(CloseProtocolError, "")},
+		},
+		{
+			name: "5.18 new message before the previous one finished",
+			send: []testFrame{fragment(TextMessage, "a", false), fragment(TextMessage, "b", true)},
+			want: []testFrame{closeFrame(CloseProtocolError, "")},
+		},
+		{
+			name: "5.19 empty fragments",
+			send: []testFrame{fragment(BinaryMessage, "", false), fragment(continuationFrame, "", false), fragment(continuationFrame, "", true), normalClose},
+			want: []testFrame{binaryFrame(nil), normalClose},
+		},
+		{
+			name: "6.2 valid UTF-8",
+			send: []testFrame{text("Hello-µ@ßöäüàá-UTF-8!!"), normalClose},
+			want: []testFrame{text("Hello-µ@ßöäüàá-UTF-8!!"), normalClose},
+		},
+		{
+			name: "6.2 code point split across fragments",
+			send: []testFrame{fragment(TextMessage, "κόσμε"[:3], false), fragment(continuationFrame, "κόσμε"[3:], true), normalClose},
+			want: []testFrame{text("κόσμε"), normalClose},
+		},
+		{
+			name: "6.3 invalid UTF-8",
+			send: []testFrame{text("\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5\xed\xa0\x80\x65\x64\x69\x74\x65\x64")},
+			want: []testFrame{closeFrame(CloseInvalidPayload, "")},
+		},
+		{
+			name: "6.4 invalid UTF-8 in the last fragment",
+			send: []testFrame{fragment(TextMessage, "valid", false), fragment(continuationFrame, "\xf4\x90\x80\x80", true)},
+			want: []testFrame{closeFrame(CloseInvalidPayload, "")},
+		},
+		{
+			name: "6.x invalid UTF-8 in binary is fine",
+			send: []testFrame{binaryFrame([]byte{0xff, 0xfe}), normalClose},
+			want: []testFrame{binaryFrame([]byte{0xff, 0xfe}), normalClose},
+		},
+		{
+			name: "7.1 close without payload",
+			send: []testFrame{control(CloseMessage, nil)},
+			want: []testFrame{control(CloseMessage, nil)},
+		},
+		{
+			name: "7.1 nothing is echoed after close",
+			send: []testFrame{normalClose, text("late")},
+			want: []testFrame{normalClose},
+		},
+		{
+			name: "7.3 close with one byte",
+			send: []testFrame{control(CloseMessage, []byte{0x03})},
+			want: []testFrame{closeFrame(CloseProtocolError, "")},
+		},
+		{
+			name: "7.3 close with reason",
+			send: []testFrame{closeFrame(CloseNormal, "goodbye")},
+			want: []testFrame{normalClose},
+		},
+		{
+			name: "7.3 close with 123 byte reason",
+			send: []testFrame{closeFrame(CloseNormal, strings.Repeat("*", 123))},
+			want: []testFrame{normalClose},
+		},
+		{
+			name: "7.5 close reason is not UTF-8",
+			send: []testFrame{closeFrame(CloseNormal, "\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5\xed\xa0\x80")},
+			want: []testFrame{closeFrame(CloseInvalidPayload, "")},
+		},
+		{
+			name: "9.x message over the limit",
+			// Only the header is sent, the length alone is reason enough
+			send: []testFrame{{raw: append([]byte{finBit | BinaryMessage, maskBit | 127}, append(binary.BigEndian.AppendUint64(nil, testMaxMessageBytes+1), testMask[:]...)...)}},
+			want: []testFrame{closeFrame(CloseMessageTooBig, "")},
+		},
+		{
+			name: "length with the most significant bit set",
+			send: []testFrame{{raw: append([]byte{finBit | BinaryMessage, maskBit | 127}, append(binary.BigEndian.AppendUint64(nil, 1<<63|5), testMask[:]...)...)}},
+			want: []testFrame{closeFrame(CloseProtocolError, "")},
+		},
+		{
+			name: "9.x fragmented message over the limit",
+			send: []testFrame{
+				{opcode: BinaryMessage, payload: pattern(testMaxMessageBytes)},
+				{fin: true, opcode: continuationFrame, payload: []byte{1}},
+			},
+			want: []testFrame{closeFrame(CloseMessageTooBig, "")},
+		},
+		{
+			name: "unmasked frame",
+			send: []testFrame{{fin: true, opcode: TextMessage, payload: []byte("x"), unmasked: true}},
+			want: []testFrame{closeFrame(CloseProtocolError, "")},
+		},
+		{
+			name:      "frames pipelined with the handshake",
+			send:      []testFrame{text("early"), control(PingMessage, []byte("p")), normalClose},
+			want:      []testFrame{text("early"), control(PongMessage, []byte("p")), normalClose},
+			pipelined: true,
+		},
+	}...)
+
+	for _, code := range []int{0, 999, 1004, 1005, 1006, 1015, 1016, 2000, 2999, 5000, 65535} {
+		tests = append(tests, testCase{
+			name: fmt.Sprintf("7.9 invalid close code %d", code),
+			send: []testFrame{closeFrame(code, "")},
+			want: []testFrame{closeFrame(CloseProtocolError, "")},
+		})
+	}
+	for _, code := range []int{1000, 1001, 1002, 1003, 1007, 1011, 1014, 3000, 3999, 4000, 4999} {
+		tests = append(tests, testCase{
+			name: fmt.Sprintf("7.7 valid close code %d", code),
+			send: []testFrame{closeFrame(code, "")},
+			want: []testFrame{closeFrame(code, "")},
+		})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c *wsClient
+			if tt.pipelined {
+				var pipelined []byte
+				for _, f := range tt.send {
+					pipelined = append(pipelined, f.encode()...)
+				}
+				c = dialWebSocket(t, addr.String(), "/", pipelined)
+			} else {
+				c = dialWebSocket(t, addr.String(), "/", nil)
+				c.send(tt.send...)
+			}
+			c.expect(tt.want...)
+			c.expectEOF()
+		})
+	}
+}
+
+func TestServerFragmentation(t *testing.T) {
+	addr := startEchoServer(t)
+	c := dialWebSocket(t, addr.String(), "/fragmented", nil)
+
+	c.send(text("hello world"))
+	c.expect(
+		fragment(TextMessage, "hell", false),
+		fragment(continuationFrame, "o wo", false),
+		fragment(continuationFrame, "rld", true),
+	)
+	c.send(text("tiny"))
+	c.expect(text("tiny"))
+}
+
+func TestServerClose(t *testing.T) {
+	readErr := make(chan error, 1)
+	upgrader := &Upgrader{}
+	s, err := server.Serve(0, func(w response.Writer, req *request.Request) {
+		conn, err := upgrader.Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.PongHandler = func(data []byte) {
+			conn.WriteClose(CloseGoingAway, string(data))
+		}
+		conn.Ping([]byte("bye"))
+		_, _, err = conn.ReadMessage()
+		readErr <- err
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	c := dialWebSocket(t, s.Addr().String(), "/", nil)
+	c.expect(control(PingMessage, []byte("bye")))
+	c.send(control(PongMessage, []byte("bye")))
+	c.expect(closeFrame(CloseGoingAway, ""))
+	c.send(closeFrame(CloseGoingAway, ""))
+	c.expectEOF()
+
+	var closeErr *CloseError
+	require.True(t, errors.As(<-readErr, &closeErr))
+	assert.Equal(t, CloseGoingAway, closeErr.Code)
+}
+
+// A peer that keeps sending after breaking the protocol must not keep the
+// server draining its input until the close timeout.
+func TestFailDrainIsBounded(t *testing.T) {
+	readErr := make(chan error, 1)
+	upgrader := &Upgrader{}
+	s, err := server.Serve(0, func(w response.Writer, req *request.Request) {
+		conn, err := upgrader.Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _, err = conn.ReadMessage()
+		readErr <- err
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	c := dialWebSocket(t, s.Addr().String(), "/", nil)
+	c.send(testFrame{fin: true, opcode: TextMessage, rsv: 0x40, payload: []byte("bad")})
+	go func() {
+		flood := text(strings.Repeat("x", 1024)).encode()
+		for {
+			if _, err := c.conn.Write(flood); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-readErr:
+		var closeErr *CloseError
+		require.True(t, errors.As(err, &closeErr))
+		assert.Equal(t, CloseProtocolError, closeErr.Code)
+	case <-time.After(closeTimeout / 2):
+		t.Fatal("server kept draining the flood")
+	}
+}
@@ -0,0 +1,335 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	CloseNormal             = 1000
+	CloseGoingAway          = 1001
+	CloseProtocolError      = 1002
+	CloseUnsupportedData    = 1003
+	CloseNoStatus           = 1005
+	CloseAbnormal           = 1006
+	CloseInvalidPayload     = 1007
+	ClosePolicyViolation    = 1008
+	CloseMessageTooBig      = 1009
+	CloseMandatoryExtension = 1010
+	CloseInternalError      = 1011
+)
+
+const (
+	DefaultMaxMessageBytes = 1 << 20
+	// closeTimeout is how long the peer gets to answer our close frame
+	closeTimeout = 5 * time.Second
+	// maxCloseDrain is how much input fail discards waiting for the peer to
+	// finish sending
+	maxCloseDrain = 64 << 10
+)
+
+var ErrorCloseSent = fmt.Errorf("close frame already sent")
+
+// CloseError is returned by ReadMessage once the connection is closing,
+// either because the peer sent a close frame or because it broke the
+// protocol.
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	if e.Text == "" {
+		return fmt.Sprintf("websocket closed with code %d", e.Code)
+	}
+	return fmt.Sprintf("websocket closed with code %d: %s", e.Code, e.Text)
+}
+
+// validCloseCode reports whether a peer may send code, RFC 6455 section
+// 7.4 and the IANA registry.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// Conn is the server side of a WebSocket connection. One goroutine may read
+// while others write.
+type Conn struct {
+	conn        net.Conn
+	br          *bufio.Reader
+	subprotocol string
+	// MaxMessageBytes closes the connection with CloseMessageTooBig when a
+	// message grows larger.
+	MaxMessageBytes int64
+	// FragmentSize splits written messages into frames of at most this
+	// many bytes, zero sends every message in one frame.
+	FragmentSize int
+	// PongHandler is called with the payload of every pong received
+	PongHandler func(data []byte)
+
+	readErr error
+
+	writeMu   sync.Mutex
+	closeSent bool
+}
+
+func newConn(conn net.Conn, buffered []byte, subprotocol string) *Conn {
+	var r io.Reader = conn
+	if len(buffered) > 0 {
+		r = io.MultiReader(bytes.NewReader(buffered), conn)
+	}
+	return &Conn{
+		conn:            conn,
+		br:              bufio.NewReader(r),
+		subprotocol:     subprotocol,
+		MaxMessageBytes: DefaultMaxMessageBytes,
+	}
+}
+
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close closes the underlying connection without a close handshake, use
+// WriteClose first to end the connection cleanly.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// ReadMessage returns the next text or binary message, answering pings and
+// close frames on the way. Fragmented messages are returned whole.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+
+	messageType := 0
+	var message []byte
+	for {
+		h, err := readFrameHeader(c.br)
+		if err != nil {
+			return 0, nil, c.abort(err)
+		}
+		switch {
+		case h.rsv != 0:
+			return 0, nil, c.fail(CloseProtocolError, "reserved bits set without a negotiated extension")
+		case !h.masked:
+			return 0, nil, c.fail(CloseProtocolError, "client frames must be masked")
+		case h.length>>63 != 0:
+			// RFC 6455 section 5.2
+			return 0, nil, c.fail(CloseProtocolError, "payload length has the most significant bit set")
+		}
+
+		if h.control() {
+			if !h.fin || h.length > maxControlPayload {
+				return 0, nil, c.fail(CloseProtocolError, "control frames must be final and at most 125 bytes")
+			}
+			payload, err := c.readPayload(h)
+			if err != nil {
+				return 0, nil, c.abort(err)
+			}
+			if err := c.handleControl(h.opcode, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+
+		switch h.opcode {
+		case continuationFrame:
+			if messageType == 0 {
+				return 0, nil, c.fail(CloseProtocolError, "continuation frame without a message to continue")
+			}
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				return 0, nil, c.fail(CloseProtocolError, "new message before the previous one finished")
+			}
+			messageType = int(h.opcode)
+		default:
+			return 0, nil, c.fail(CloseProtocolError, fmt.Sprintf("unknown opcode %d", h.opcode))
+		}
+
+		if c.MaxMessageBytes > 0 && uint64(len(message))+h.length > uint64(c.MaxMessageBytes) {
+			return 0, nil, c.fail(CloseMessageTooBig, "message too big")
+		}
+		payload, err := c.readPayload(h)
+		if err != nil {
+			return 0, nil, c.abort(err)
+		}
+		message = append(message, payload...)
+
+		if h.fin {
+			if messageType == TextMessage && !utf8.Valid(message) {
+				return 0, nil, c.fail(CloseInvalidPayload, "text message is not valid UTF-8")
+			}
+			if message == nil {
+				message = []byte{}
+			}
+			return messageType, message, nil
+		}
+	}
+}
+
+// readPayload grows the buffer as the payload arrives instead of trusting
+// the length the peer announced.
+func (c *Conn) readPayload(h frameHeader) ([]byte, error) {
+	payload, err := io.ReadAll(io.LimitReader(c.br, int64(h.length)))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(payload)) != h.length {
+		return nil, io.ErrUnexpectedEOF
+	}
+	maskBytes(h.mask, 0, payload)
+	return payload, nil
+}
+
+func (c *Conn) handleControl(opcode byte, payload []byte) error {
+	switch opcode {
+	case PingMessage:
+		if err := c.writeFrame(true, PongMessage, payload); err != nil && err != ErrorCloseSent {
+			return c.abort(err)
+		}
+		return nil
+	case PongMessage:
+		if c.PongHandler != nil {
+			c.PongHandler(payload)
+		}
+		return nil
+	case CloseMessage:
+		return c.handleClose(payload)
+	}
+	return c.fail(CloseProtocolError, fmt.Sprintf("unknown opcode %d", opcode))
+}
+
+// handleClose answers the peer's close frame with the same code and closes
+// the connection.
+func (c *Conn) handleClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatus}
+	switch {
+	case len(payload) == 1:
+		return c.fail(CloseProtocolError, "close frame payload of one byte")
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Text = string(payload[2:])
+		if !validCloseCode(closeErr.Code) {
+			return c.fail(CloseProtocolError, fmt.Sprintf("invalid close code %d", closeErr.Code))
+		}
+		if !utf8.ValidString(closeErr.Text) {
+			return c.fail(CloseInvalidPayload, "close reason is not valid UTF-8")
+		}
+	}
+
+	var reply []byte
+	if closeErr.Code != CloseNoStatus {
+		reply = binary.BigEndian.AppendUint16(nil, uint16(closeErr.Code))
+	}
+	c.writeFrame(true, CloseMessage, reply)
+	c.conn.Close()
+	c.readErr = closeErr
+	return closeErr
+}
+
+// fail starts the close handshake for a protocol violation by the peer
+func (c *Conn) fail(code int, reason string) error {
+	c.WriteClose(code, reason)
+	// Closing with unread input resets the connection and the peer may never
+	// see our close frame, so let it finish sending first.
+	if cw, ok := c.conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		// WriteClose skips the deadline when its write fails
+		c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+		io.Copy(io.Discard, io.LimitReader(c.br, maxCloseDrain))
+	}
+	c.conn.Close()
+	c.readErr = &CloseError{Code: code, Text: reason}
+	return c.readErr
+}
+
+// abort is for connections that broke without a close handshake
+func (c *Conn) abort(err error) error {
+	c.conn.Close()
+	c.readErr = &CloseError{Code: CloseAbnormal, Text: err.Error()}
+	return c.readErr
+}
+
+func (c *Conn) writeFrame(fin bool, opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrorCloseSent
+	}
+	if opcode == CloseMessage {
+		c.closeSent = true
+	}
+	_, err := c.conn.Write(appendFrame(nil, fin, opcode, nil, payload))
+	return err
+}
+
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return fmt.Errorf("unsupported message type %d", messageType)
+	}
+	if c.FragmentSize <= 0 || len(data) <= c.FragmentSize {
+		return c.writeFrame(true, byte(messageType), data)
+	}
+
+	// Fragments of one message must not interleave with other messages
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrorCloseSent
+	}
+	opcode := byte(messageType)
+	var buf []byte
+	for len(data) > 0 {
+		n := min(c.FragmentSize, len(data))
+		buf = appendFrame(buf[:0], n == len(data), opcode, nil, data[:n])
+		if _, err := c.conn.Write(buf); err != nil {
+			return err
+		}
+		data = data[n:]
+		opcode = continuationFrame
+	}
+	return nil
+}
+
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return fmt.Errorf("ping payload larger than %d bytes", maxControlPayload)
+	}
+	return c.writeFrame(true, PingMessage, data)
+}
+
+// WriteClose sends a close frame and gives the peer closeTimeout to answer,
+// the reading goroutine sees its answer as a CloseError.
+func (c *Conn) WriteClose(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > maxControlPayload {
+		payload = payload[:maxControlPayload]
+	}
+	if err := c.writeFrame(true, CloseMessage, payload); err != nil {
+		return err
+	}
+	return c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+}
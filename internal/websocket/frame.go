@@ -0,0 +1,115 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	continuationFrame = 0x0
+
+	TextMessage   = 0x1
+	BinaryMessage = 0x2
+	CloseMessage  = 0x8
+	PingMessage   = 0x9
+	PongMessage   = 0xa
+)
+
+const (
+	finBit  = 0x80
+	rsvBits = 0x70
+	maskBit = 0x80
+
+	maxControlPayload = 125
+)
+
+type frameHeader struct {
+	fin    bool
+	rsv    byte
+	opcode byte
+	masked bool
+	mask   [4]byte
+	length uint64
+}
+
+func (h frameHeader) control() bool {
+	return h.opcode&0x8 != 0
+}
+
+func readFrameHeader(r *bufio.Reader) (frameHeader, error) {
+	var h frameHeader
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return h, err
+	}
+	h.fin = b[0]&finBit != 0
+	h.rsv = b[0] & rsvBits
+	h.opcode = b[0] & 0x0f
+	h.masked = b[1]&maskBit != 0
+
+	switch length := b[1] &^ maskBit; length {
+	case 126:
+		if _, err := io.ReadFull(r, b[:2]); err != nil {
+			return h, err
+		}
+		h.length = uint64(binary.BigEndian.Uint16(b[:2]))
+	case 127:
+		if _, err := io.ReadFull(r, b[:8]); err != nil {
+			return h, err
+		}
+		h.length = binary.BigEndian.Uint64(b[:8])
+	default:
+		h.length = uint64(length)
+	}
+
+	if h.masked {
+		if _, err := io.ReadFull(r, h.mask[:]); err != nil {
+			return h, err
+		}
+	}
+	return h, nil
+}
+
+// appendFrame encodes a frame, masking the payload when mask is given as
+// clients must.
+func appendFrame(buf []byte, fin bool, opcode byte, mask *[4]byte, payload []byte) []byte {
+	b0 := opcode
+	if fin {
+		b0 |= finBit
+	}
+	var b1 byte
+	if mask != nil {
+		b1 = maskBit
+	}
+
+	n := len(payload)
+	switch {
+	case n <= 125:
+		buf = append(buf, b0, b1|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, b0, b1|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, b0, b1|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+
+	if mask == nil {
+		return append(buf, payload...)
+	}
+	buf = append(buf, mask[:]...)
+	start := len(buf)
+	buf = append(buf, payload...)
+	maskBytes(*mask, 0, buf[start:])
+	return buf
+}
+
+// maskBytes XORs b with the mask starting at pos within the payload and
+// returns the position after b.
+func maskBytes(mask [4]byte, pos int, b []byte) int {
+	for i := range b {
+		b[i] ^= mask[(pos+i)&3]
+	}
+	return (pos + len(b)) & 3
+}
@@ -0,0 +1,139 @@
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"http-from-tcp/internal/headers"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"http-from-tcp/internal/server"
+	"slices"
+	"strings"
+)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var ErrorBadHandshake = fmt.Errorf("bad websocket handshake")
+
+// Upgrader turns requests into WebSocket connections
+type Upgrader struct {
+	// Subprotocols are in order of preference, the first one the client
+	// also offers is selected.
+	Subprotocols []string
+	// MaxMessageBytes defaults to DefaultMaxMessageBytes
+	MaxMessageBytes int64
+	FragmentSize    int
+	// CheckOrigin rejects cross-origin handshakes with 403 when it returns
+	// false, nil accepts every origin.
+	CheckOrigin func(req *request.Request) bool
+}
+
+// AcceptKey computes Sec-WebSocket-Accept for a Sec-WebSocket-Key
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func headerTokens(value string) []string {
+	var tokens []string
+	for _, token := range strings.Split(value, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+func hasToken(value, token string) bool {
+	return slices.ContainsFunc(headerTokens(value), func(t string) bool {
+		return strings.EqualFold(t, token)
+	})
+}
+
+// IsUpgrade reports whether req asks for a WebSocket connection
+func IsUpgrade(req *request.Request) bool {
+	return hasToken(req.Headers.Get("Connection"), "upgrade") && hasToken(req.Headers.Get("Upgrade"), "websocket")
+}
+
+func (u *Upgrader) selectSubprotocol(req *request.Request) string {
+	offered := headerTokens(req.Headers.Get("Sec-WebSocket-Protocol"))
+	for _, p := range u.Subprotocols {
+		if slices.Contains(offered, p) {
+			return p
+		}
+	}
+	return ""
+}
+
+func rejectHandshake(w response.Writer, status response.StatusCode, reason string) error {
+	he := &server.HandlerError{
+		StatusCode: status,
+		Message:    reason,
+	}
+	he.Write(w)
+	return fmt.Errorf("%w: %s", ErrorBadHandshake, reason)
+}
+
+// Upgrade validates the opening handshake of RFC 6455 section 4.2, answers
+// it and takes over the connection. On failure the error response has
+// already been written.
+func (u *Upgrader) Upgrade(w response.Writer, req *request.Request) (*Conn, error) {
+	switch {
+	case req.RequestLine.Method != "GET":
+		return nil, rejectHandshake(w, response.StatusMethodNotAllowed, "websocket handshake must be a GET")
+	case !IsUpgrade(req):
+		return nil, rejectHandshake(w, response.StatusBadRequest, "missing websocket upgrade headers")
+	case req.Headers.Get("Sec-WebSocket-Version") != "13":
+		message := "unsupported websocket version"
+		h := response.GetDefaultHeaders(len(message))
+		h.Override("Sec-WebSocket-Version", "13")
+		w.WriteStatusLine(response.StatusUpgradeRequired)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(message))
+		return nil, fmt.Errorf("%w: %s", ErrorBadHandshake, message)
+	case u.CheckOrigin != nil && !u.CheckOrigin(req):
+		return nil, rejectHandshake(w, response.StatusForbidden, "origin not allowed")
+	}
+
+	key := req.Headers.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, rejectHandshake(w, response.StatusBadRequest, "invalid Sec-WebSocket-Key")
+	}
+
+	// Once 101 is sent the connection has to be taken over
+	if !w.Hijackable() {
+		he := &server.HandlerError{
+			StatusCode: response.StatusInternalServerError,
+			Message:    "connection cannot be upgraded",
+		}
+		he.Write(w)
+		return nil, response.ErrorNotHijackable
+	}
+
+	subprotocol := u.selectSubprotocol(req)
+	h := headers.NewHeaders()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", AcceptKey(key))
+	if subprotocol != "" {
+		h.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+	if err := w.WriteStatusLine(response.StatusSwitchingProtocols); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+
+	netConn, buffered, err := w.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	c := newConn(netConn, buffered, subprotocol)
+	if u.MaxMessageBytes > 0 {
+		c.MaxMessageBytes = u.MaxMessageBytes
+	}
+	c.FragmentSize = u.FragmentSize
+	return c, nil
+}
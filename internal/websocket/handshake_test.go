@@ -0,0 +1,141 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"http-from-tcp/internal/request"
+	"http-from-tcp/internal/response"
+	"http-from-tcp/internal/server"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testKey = "dGhlIHNhbXBsZSBub25jZQ=="
+
+func TestAcceptKey(t *testing.T) {
+	// The example from RFC 6455 section 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", AcceptKey(testKey))
+}
+
+func TestUpgrade(t *testing.T) {
+	upgrader := &Upgrader{
+		Subprotocols: []string{"v2.chat", "v1.chat"},
+		CheckOrigin: func(req *request.Request) bool {
+			origin := req.Headers.Get("Origin")
+			return origin == "" || origin == "https://example.com"
+		},
+	}
+	s, err := server.Serve(0, func(w response.Writer, req *request.Request) {
+		conn, err := upgrader.Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		conn.WriteClose(CloseNormal, "")
+		conn.Close()
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	valid := "GET /ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: " + testKey + "\r\n"
+
+	tests := []struct {
+		name            string
+		request         string
+		wantStatus      int
+		wantHeaders     map[string]string
+		wantSubprotocol string
+	}{
+		{
+			name:       "valid",
+			request:    valid + "\r\n",
+			wantStatus: http.StatusSwitchingProtocols,
+			wantHeaders: map[string]string{
+				"Upgrade":              "websocket",
+				"Connection":           "Upgrade",
+				"Sec-WebSocket-Accept": "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=",
+			},
+		},
+		{
+			name:       "subprotocol",
+			request:    valid + "Sec-WebSocket-Protocol: v1.chat, v2.chat\r\n\r\n",
+			wantStatus: http.StatusSwitchingProtocols,
+			wantHeaders: map[string]string{
+				"Sec-WebSocket-Protocol": "v2.chat",
+			},
+		},
+		{
+			name:        "unknown subprotocol",
+			request:     valid + "Sec-WebSocket-Protocol: v3.chat\r\n\r\n",
+			wantStatus:  http.StatusSwitchingProtocols,
+			wantHeaders: map[string]string{"Sec-WebSocket-Protocol": ""},
+		},
+		{
+			name:       "allowed origin",
+			request:    valid + "Origin: https://example.com\r\n\r\n",
+			wantStatus: http.StatusSwitchingProtocols,
+		},
+		{
+			name:       "forbidden origin",
+			request:    valid + "Origin: https://evil.test\r\n\r\n",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:        "unsupported version",
+			request:     strings.Replace(valid, "Version: 13", "Version: 8", 1) + "\r\n",
+			wantStatus:  http.StatusUpgradeRequired,
+			wantHeaders: map[string]string{"Sec-WebSocket-Version": "13"},
+		},
+		{
+			name:       "short key",
+			request:    strings.Replace(valid, testKey, "c2hvcnQ=", 1) + "\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "missing upgrade",
+			request:    strings.Replace(valid, "Upgrade: websocket\r\n", "", 1) + "\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "post",
+			request:    strings.Replace(valid, "GET", "POST", 1) + "\r\n",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", s.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			_, err = conn.Write([]byte(tt.request))
+			require.NoError(t, err)
+
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			for name, value := range tt.wantHeaders {
+				assert.Equal(t, value, resp.Header.Get(name), name)
+			}
+		})
+	}
+}
+
+func TestUpgradeNotHijackable(t *testing.T) {
+	req, err := request.RequestFromReader(strings.NewReader("GET /ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\n" +
+		"Connection: Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: " + testKey + "\r\n\r\n"))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	_, err = (&Upgrader{}).Upgrade(response.NewWrite(&buf), req)
+	assert.ErrorIs(t, err, response.ErrorNotHijackable)
+
+	resp, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+}